@@ -0,0 +1,373 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+	"vazmin.github.io/fastcfs-csi/pkg/fcfs"
+	driver "vazmin.github.io/fastcfs-csi/pkg/fcfs-driver"
+)
+
+// Import results
+const (
+	importCreated = "created"
+	importDryRun  = "dry-run"
+	importSkipped = "skipped"
+	importFailed  = "failed"
+)
+
+// importOptions are the flags of the import command.
+type importOptions struct {
+	configBasePath     string
+	secret             string // namespace/name
+	user               string
+	includeProvisioned bool
+	storageClassName   string
+	accessMode         string
+	reclaimPolicy      string
+	defaultCapacity    string
+	pvcNamespace       string
+	dryRun             bool
+
+	secretRef *v1.SecretReference
+	capacity  resource.Quantity
+}
+
+// imported is the result of importing a pool.
+type imported struct {
+	Pool                  string `json:"pool"`
+	PersistentVolume      string `json:"persistentVolume,omitempty"`
+	PersistentVolumeClaim string `json:"persistentVolumeClaim,omitempty"` // namespace/name
+	CapacityBytes         int64  `json:"capacityBytes,omitempty"`
+	Result                string `json:"result"`
+	Reason                string `json:"reason,omitempty"`
+
+	pv  *v1.PersistentVolume
+	pvc *v1.PersistentVolumeClaim
+}
+
+func (o *importOptions) complete() error {
+	if len(o.configBasePath) == 0 || len(o.secret) == 0 {
+		return errors.New("--config-base-path and --secret are required")
+	}
+	parts := strings.Split(o.secret, "/")
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return fmt.Errorf("invalid --secret %q, must be namespace/name", o.secret)
+	}
+	o.secretRef = &v1.SecretReference{Namespace: parts[0], Name: parts[1]}
+
+	switch v1.PersistentVolumeAccessMode(o.accessMode) {
+	case v1.ReadWriteOnce, v1.ReadOnlyMany, v1.ReadWriteMany:
+	default:
+		return fmt.Errorf("invalid --access-mode %q", o.accessMode)
+	}
+	// deleting an imported PV must never delete the pool and its data
+	if v1.PersistentVolumeReclaimPolicy(o.reclaimPolicy) != v1.PersistentVolumeReclaimRetain {
+		return fmt.Errorf("invalid --reclaim-policy %q, imported PVs must be %s", o.reclaimPolicy,
+			v1.PersistentVolumeReclaimRetain)
+	}
+	capacity, err := resource.ParseQuantity(o.defaultCapacity)
+	if err != nil {
+		return fmt.Errorf("invalid --default-capacity %q: %w", o.defaultCapacity, err)
+	}
+	o.capacity = capacity
+	return nil
+}
+
+// pvName returns the name of the PV of poolName, the pool name itself if it is
+// a valid object name.
+func pvName(poolName string) (string, error) {
+	if len(validation.IsDNS1123Subdomain(poolName)) == 0 {
+		return poolName, nil
+	}
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '-'
+		}
+	}, poolName)
+	if len(name) > validation.DNS1123SubdomainMaxLength {
+		name = name[:validation.DNS1123SubdomainMaxLength]
+	}
+	name = strings.Trim(name, "-.")
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return "", fmt.Errorf("no valid PV name for pool %s: %s", poolName, strings.Join(errs, ", "))
+	}
+	return name, nil
+}
+
+// newStaticPV returns the static PV of p and, if a PVC namespace is set, the
+// PVC bound to it.
+func (o *importOptions) newStaticPV(p fcfs.Pool, driverName string) (*v1.PersistentVolume, *v1.PersistentVolumeClaim, error) {
+	name, err := pvName(p.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	capacity := o.capacity
+	if p.QuotaBytes != fcfs.UnlimitedQuota {
+		capacity = *resource.NewQuantity(p.QuotaBytes, resource.BinarySI)
+	}
+	accessModes := []v1.PersistentVolumeAccessMode{v1.PersistentVolumeAccessMode(o.accessMode)}
+	volumeMode := v1.PersistentVolumeFilesystem
+
+	pv := &v1.PersistentVolume{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolume"},
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity:                      v1.ResourceList{v1.ResourceStorage: capacity},
+			VolumeMode:                    &volumeMode,
+			AccessModes:                   accessModes,
+			StorageClassName:              o.storageClassName,
+			PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimPolicy(o.reclaimPolicy),
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver:             driverName,
+					VolumeHandle:       p.Name,
+					NodeStageSecretRef: o.secretRef,
+					VolumeAttributes: map[string]string{
+						common.FastCFSConfigBasePath: o.configBasePath,
+						common.StaticVolumeKey:       "true",
+					},
+				},
+			},
+		},
+	}
+	// the node plugin reads the static volume the same way
+	if _, err := driver.NewVolOptionsFromStatic(p.Name, pv.Spec.CSI.VolumeAttributes); err != nil {
+		return nil, nil, err
+	}
+	if len(o.pvcNamespace) == 0 {
+		return pv, nil, nil
+	}
+
+	pvc := &v1.PersistentVolumeClaim{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolumeClaim"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: o.pvcNamespace},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes:      accessModes,
+			VolumeMode:       &volumeMode,
+			StorageClassName: &o.storageClassName,
+			VolumeName:       name,
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{v1.ResourceStorage: capacity},
+			},
+		},
+	}
+	// reserve the PV for the PVC
+	pv.Spec.ClaimRef = &v1.ObjectReference{APIVersion: "v1", Kind: "PersistentVolumeClaim", Namespace: pvc.Namespace, Name: pvc.Name}
+	return pv, pvc, nil
+}
+
+// plan returns the import of each pool, skipping the pools provisioned by the
+// driver unless included and the pools already used by a PV of the driver.
+// Pools whose PV name clashes with another pool or an existing PV fail.
+func (o *importOptions) plan(pools []fcfs.Pool, existing []*pool, driverName string) []*imported {
+	used := make(map[string]string, len(existing))
+	pvNames := make(map[string]string, len(existing))
+	for _, p := range existing {
+		if p.ConfigBasePath == o.configBasePath {
+			used[p.Pool] = p.PersistentVolume
+		}
+		pvNames[p.PersistentVolume] = p.Pool
+	}
+	planned := make(map[string][]*imported)
+	var plan []*imported
+	for _, p := range pools {
+		imp := &imported{Pool: p.Name, Result: importSkipped}
+		plan = append(plan, imp)
+		if pvName, ok := used[p.Name]; ok {
+			imp.PersistentVolume = pvName
+			imp.Reason = "already used by PV " + pvName
+			continue
+		}
+		if !o.includeProvisioned && strings.HasPrefix(p.Name, common.CsiVolNamingPrefix) {
+			imp.Reason = "provisioned by the driver"
+			continue
+		}
+		pv, pvc, err := o.newStaticPV(p, driverName)
+		if err != nil {
+			imp.Result, imp.Reason = importFailed, err.Error()
+			continue
+		}
+		if other, ok := pvNames[pv.Name]; ok {
+			imp.Result, imp.Reason = importFailed, fmt.Sprintf("PV %s already exists for pool %s", pv.Name, other)
+			continue
+		}
+		planned[pv.Name] = append(planned[pv.Name], imp)
+		imp.pv, imp.pvc = pv, pvc
+		imp.PersistentVolume = pv.Name
+		imp.CapacityBytes = pv.Spec.Capacity.Storage().Value()
+		if pvc != nil {
+			imp.PersistentVolumeClaim = pvc.Namespace + "/" + pvc.Name
+		}
+		imp.Result = importDryRun
+	}
+	// which of the pools would get the name depends on the listing order, import none of them
+	for name, imps := range planned {
+		if len(imps) < 2 {
+			continue
+		}
+		clashing := make([]string, 0, len(imps))
+		for _, imp := range imps {
+			clashing = append(clashing, imp.Pool)
+		}
+		for _, imp := range imps {
+			imp.Result, imp.Reason = importFailed, fmt.Sprintf("pools %s map to the same PV name %s", strings.Join(clashing, ", "), name)
+			imp.pv, imp.pvc = nil, nil
+			imp.PersistentVolume, imp.PersistentVolumeClaim, imp.CapacityBytes = "", "", 0
+		}
+	}
+	return plan
+}
+
+// create creates the PV and PVC of imp, a PV that already exists is skipped.
+func create(ctx context.Context, client kubernetes.Interface, imp *imported) {
+	if _, err := client.CoreV1().PersistentVolumes().Create(ctx, imp.pv, metav1.CreateOptions{}); err != nil {
+		if apierrors.IsAlreadyExists(err) {
+			imp.Result, imp.Reason = importSkipped, "PV already exists"
+			return
+		}
+		imp.Result, imp.Reason = importFailed, err.Error()
+		return
+	}
+	imp.Result = importCreated
+	if imp.pvc == nil {
+		return
+	}
+	if _, err := client.CoreV1().PersistentVolumeClaims(imp.pvc.Namespace).Create(ctx, imp.pvc, metav1.CreateOptions{}); err != nil {
+		imp.Result, imp.Reason = importFailed, fmt.Sprintf("PV created, PVC: %v", err)
+	}
+}
+
+// printYAML writes the objects of the planned imports as a multi-document YAML.
+func printYAML(w io.Writer, plan []*imported) error {
+	for _, imp := range plan {
+		if imp.pv == nil {
+			continue
+		}
+		objects := []interface{}{imp.pv}
+		if imp.pvc != nil {
+			objects = append(objects, imp.pvc)
+		}
+		for _, obj := range objects {
+			data, err := yaml.Marshal(obj)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "---\n%s", data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func runImport(args []string) error {
+	fs, f := newPoolFlagSet("import")
+	o := &importOptions{}
+	fs.StringVar(&o.configBasePath, "config-base-path", "", "fastcfs-config-base-path of the pools")
+	fs.StringVar(&o.secret, "secret", "", "namespace/name of the secret listing and mounting the pools")
+	fs.StringVar(&o.user, "user", "", "FastCFS user owning the pools, defaults to the userName of the secret")
+	fs.BoolVar(&o.includeProvisioned, "include-provisioned", false, "also import the "+common.CsiVolNamingPrefix+" pools")
+	fs.StringVar(&o.storageClassName, "storage-class-name", "", "storage class of the PVs")
+	fs.StringVar(&o.accessMode, "access-mode", string(v1.ReadWriteOnce), "access mode of the PVs")
+	fs.StringVar(&o.reclaimPolicy, "reclaim-policy", string(v1.PersistentVolumeReclaimRetain), "reclaim policy of the PVs, only "+string(v1.PersistentVolumeReclaimRetain)+" is supported")
+	fs.StringVar(&o.defaultCapacity, "default-capacity", "1Gi", "capacity of the PVs of pools without quota")
+	fs.StringVar(&o.pvcNamespace, "pvc-namespace", "", "also create a PVC bound to each PV in this namespace")
+	fs.BoolVar(&o.dryRun, "dry-run", false, "print the PVs and PVCs as YAML instead of creating them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := o.complete(); err != nil {
+		fs.Usage()
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+	client, err := f.kubernetesClient()
+	if err != nil {
+		return err
+	}
+	secret, err := client.CoreV1().Secrets(o.secretRef.Namespace).Get(ctx, o.secretRef.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get secret %s: %w", o.secret, err)
+	}
+	secrets := make(map[string]string, len(secret.Data))
+	for k, v := range secret.Data {
+		secrets[k] = string(v)
+	}
+	if len(o.user) == 0 {
+		o.user = common.VolumeUserName(true, secrets)
+	}
+	if len(o.user) == 0 {
+		return fmt.Errorf("secret %s has no userName, set --user", o.secret)
+	}
+	// an admin may list the pools of any user
+	cr, err := common.NewAdminCredentials(secrets)
+	if err != nil {
+		if cr, err = common.NewUserCredentials(secrets); err != nil {
+			return err
+		}
+	}
+	defer cr.DeleteCredentials()
+
+	cfs, err := fcfs.NewCFS()
+	if err != nil {
+		return err
+	}
+	pools, err := cfs.ListPools(ctx, o.configBasePath, o.user, cr)
+	if err != nil {
+		return err
+	}
+	existing, err := f.listPools(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	plan := o.plan(pools, existing, f.driverName)
+	if o.dryRun {
+		return printYAML(os.Stdout, plan)
+	}
+	for _, imp := range plan {
+		if imp.pv != nil {
+			create(ctx, client, imp)
+		}
+	}
+	return printRows(os.Stdout, *f.output, plan, []string{"POOL", "PV", "PVC", "CAPACITY", "RESULT", "REASON"}, func(i int) []string {
+		imp := plan[i]
+		return []string{imp.Pool, imp.PersistentVolume, imp.PersistentVolumeClaim, formatBytes(&imp.CapacityBytes), imp.Result, imp.Reason}
+	}, len(plan))
+}
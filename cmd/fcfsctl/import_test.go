@@ -0,0 +1,156 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+	"vazmin.github.io/fastcfs-csi/pkg/fcfs"
+)
+
+func TestPVName(t *testing.T) {
+	testCases := []struct {
+		pool    string
+		name    string
+		wantErr bool
+	}{
+		{pool: "legacy-app", name: "legacy-app"},
+		{pool: "Legacy_App", name: "legacy-app"},
+		{pool: "_data.", name: "data"},
+		{pool: strings.Repeat("a", 300), name: strings.Repeat("a", 253)},
+		{pool: "__", wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.pool, func(t *testing.T) {
+			name, err := pvName(tc.pool)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.name, name)
+		})
+	}
+}
+
+func newImportOptions(t *testing.T, pvcNamespace string) *importOptions {
+	o := &importOptions{
+		configBasePath:  "/etc/fastcfs-client-config",
+		secret:          "default/fcfs-secret",
+		accessMode:      string(v1.ReadWriteOnce),
+		reclaimPolicy:   string(v1.PersistentVolumeReclaimRetain),
+		defaultCapacity: "5Gi",
+		pvcNamespace:    pvcNamespace,
+	}
+	require.NoError(t, o.complete())
+	return o
+}
+
+func TestImportPlan(t *testing.T) {
+	o := newImportOptions(t, "")
+	pools := []fcfs.Pool{
+		{Name: "legacy-app", QuotaBytes: 10 * common.GiB},
+		{Name: "legacy-db", QuotaBytes: fcfs.UnlimitedQuota},
+		{Name: "csi-vol-pv1", QuotaBytes: common.GiB},
+		{Name: "imported", QuotaBytes: common.GiB},
+	}
+	existing := []*pool{{Pool: "imported", PersistentVolume: "imported", ConfigBasePath: o.configBasePath, Static: true}}
+
+	plan := o.plan(pools, existing, common.DefaultDriverName)
+	require.Len(t, plan, 4)
+
+	app := plan[0]
+	require.Equal(t, importDryRun, app.Result)
+	require.Equal(t, int64(10*common.GiB), app.CapacityBytes)
+	require.Equal(t, "legacy-app", app.pv.Spec.CSI.VolumeHandle)
+	require.Equal(t, "fcfs-secret", app.pv.Spec.CSI.NodeStageSecretRef.Name)
+	require.Equal(t, "true", app.pv.Spec.CSI.VolumeAttributes[common.StaticVolumeKey])
+	require.Nil(t, app.pvc)
+
+	p, ok := newPool(app.pv, common.DefaultDriverName)
+	require.True(t, ok, "fcfsctl list must see the imported PV")
+	require.True(t, p.Static)
+	require.Equal(t, "legacy-app", p.Pool)
+
+	require.Equal(t, int64(5*common.GiB), plan[1].CapacityBytes)
+	require.Equal(t, importSkipped, plan[2].Result)
+	require.Equal(t, importSkipped, plan[3].Result)
+	require.Equal(t, "imported", plan[3].PersistentVolume)
+
+	o.includeProvisioned = true
+	plan = o.plan(pools, existing, common.DefaultDriverName)
+	require.Equal(t, importDryRun, plan[2].Result)
+}
+
+func TestImportPlanNameClash(t *testing.T) {
+	o := newImportOptions(t, "")
+	pools := []fcfs.Pool{
+		{Name: "Legacy_App", QuotaBytes: common.GiB},
+		{Name: "legacy-app", QuotaBytes: common.GiB},
+		{Name: "Imported", QuotaBytes: common.GiB},
+		{Name: "legacy-db", QuotaBytes: common.GiB},
+	}
+	existing := []*pool{{Pool: "imported", PersistentVolume: "imported", ConfigBasePath: o.configBasePath, Static: true}}
+
+	plan := o.plan(pools, existing, common.DefaultDriverName)
+	require.Len(t, plan, 4)
+	for _, imp := range plan[:3] {
+		require.Equal(t, importFailed, imp.Result, imp.Pool)
+		require.Nil(t, imp.pv, imp.Pool)
+	}
+	require.Contains(t, plan[0].Reason, "Legacy_App, legacy-app")
+	require.Contains(t, plan[2].Reason, "already exists for pool imported")
+	require.Equal(t, importDryRun, plan[3].Result)
+}
+
+func TestImportOptionsReclaimPolicy(t *testing.T) {
+	o := &importOptions{
+		configBasePath:  "/etc/fastcfs-client-config",
+		secret:          "default/fcfs-secret",
+		accessMode:      string(v1.ReadWriteOnce),
+		reclaimPolicy:   string(v1.PersistentVolumeReclaimDelete),
+		defaultCapacity: "5Gi",
+	}
+	require.Error(t, o.complete())
+}
+
+func TestImportYAML(t *testing.T) {
+	o := newImportOptions(t, "apps")
+	plan := o.plan([]fcfs.Pool{{Name: "legacy-app", QuotaBytes: 10 * common.GiB}}, nil, common.DefaultDriverName)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, printYAML(buf, plan))
+	docs := strings.Split(strings.TrimPrefix(buf.String(), "---\n"), "---\n")
+	require.Len(t, docs, 2)
+
+	pv := &v1.PersistentVolume{}
+	require.NoError(t, yaml.Unmarshal([]byte(docs[0]), pv))
+	require.Equal(t, "PersistentVolume", pv.Kind)
+	require.Equal(t, "apps", pv.Spec.ClaimRef.Namespace)
+	require.Equal(t, v1.PersistentVolumeReclaimRetain, pv.Spec.PersistentVolumeReclaimPolicy)
+
+	pvc := &v1.PersistentVolumeClaim{}
+	require.NoError(t, yaml.Unmarshal([]byte(docs[1]), pvc))
+	require.Equal(t, "legacy-app", pvc.Spec.VolumeName)
+	require.Equal(t, "", *pvc.Spec.StorageClassName)
+}
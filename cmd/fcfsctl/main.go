@@ -0,0 +1,85 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// fcfsctl inspects the FastCFS pools of the CSI driver.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"k8s.io/klog/v2"
+)
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{name: "decode", summary: "decode volume IDs into config base path, user and pool", run: runDecode},
+	{name: "encode", summary: "encode a volume ID from config base path, user and pool", run: runEncode},
+	{name: "list", summary: "list the pools of the driver with their PV and PVC", run: runList},
+	{name: "usage", summary: "show quota and usage of the pools of the driver", run: runUsage},
+	{name: "drift", summary: "show provisioned pools whose quota differs from the PV capacity", run: runDrift},
+	{name: "import", summary: "import existing pools of a FastCFS user as static PVs", run: runImport},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: fcfsctl <command> [flags]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun 'fcfsctl <command> -h' for the flags of a command.\n")
+}
+
+// quietKlog drops the info logs of the commands run by the fcfs package, errors
+// are still written to stderr.
+func quietKlog() {
+	klogFlags := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(klogFlags)
+	_ = klogFlags.Set("logtostderr", "false")
+	_ = klogFlags.Set("stderrthreshold", "ERROR")
+	klog.SetOutput(ioutil.Discard)
+}
+
+func main() {
+	quietKlog()
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	for _, c := range commands {
+		if c.name != os.Args[1] {
+			continue
+		}
+		if err := c.run(os.Args[2:]); err != nil {
+			if err != flag.ErrHelp {
+				fmt.Fprintf(os.Stderr, "fcfsctl %s: %v\n", c.name, err)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+	if os.Args[1] != "-h" && os.Args[1] != "--help" && os.Args[1] != "help" {
+		fmt.Fprintf(os.Stderr, "fcfsctl: unknown command %q\n\n", os.Args[1])
+	}
+	usage()
+	os.Exit(2)
+}
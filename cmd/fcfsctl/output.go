@@ -0,0 +1,70 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"vazmin.github.io/fastcfs-csi/pkg/fcfs"
+)
+
+// Output formats
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+func outputFlag(fs *flag.FlagSet) *string {
+	return fs.String("o", outputTable, "output format: table or json")
+}
+
+// printRows prints v as JSON, or the n rows returned by row as a table.
+func printRows(w io.Writer, format string, v interface{}, header []string, row func(i int) []string, n int) error {
+	switch format {
+	case outputJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	case outputTable:
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join(header, "\t"))
+		for i := 0; i < n; i++ {
+			fmt.Fprintln(tw, strings.Join(row(i), "\t"))
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown output format %q, must be %s or %s", format, outputTable, outputJSON)
+	}
+}
+
+// formatBytes formats a size for tables, nil is unknown.
+func formatBytes(size *int64) string {
+	switch {
+	case size == nil:
+		return "-"
+	case *size == fcfs.UnlimitedQuota:
+		return "unlimited"
+	default:
+		return resource.NewQuantity(*size, resource.BinarySI).String()
+	}
+}
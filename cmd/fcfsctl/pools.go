@@ -0,0 +1,263 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+	"vazmin.github.io/fastcfs-csi/pkg/fcfs"
+	driver "vazmin.github.io/fastcfs-csi/pkg/fcfs-driver"
+)
+
+// pool is a FastCFS pool backing a PV of the driver.
+type pool struct {
+	Pool                  string `json:"pool"`
+	VolumeID              string `json:"volumeID"`
+	ConfigBasePath        string `json:"configBasePath"`
+	User                  string `json:"user,omitempty"`
+	Static                bool   `json:"static"`
+	PersistentVolume      string `json:"persistentVolume"`
+	PersistentVolumeClaim string `json:"persistentVolumeClaim,omitempty"` // namespace/name
+	CapacityBytes         int64  `json:"capacityBytes"`
+	QuotaBytes            *int64 `json:"quotaBytes,omitempty"`
+	UsedBytes             *int64 `json:"usedBytes,omitempty"`
+	Error                 string `json:"error,omitempty"`
+
+	secretRef *v1.SecretReference
+}
+
+// poolFlags are the flags of the commands reading the PVs of the driver.
+type poolFlags struct {
+	kubeconfig string
+	driverName string
+	timeout    time.Duration
+	output     *string
+}
+
+func newPoolFlagSet(name string) (*flag.FlagSet, *poolFlags) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	f := &poolFlags{}
+	fs.StringVar(&f.kubeconfig, "kubeconfig", "", "path to the kubeconfig file, defaults to $KUBECONFIG or ~/.kube/config")
+	fs.StringVar(&f.driverName, "driver-name", common.DefaultDriverName, "name of the driver")
+	fs.DurationVar(&f.timeout, "timeout", time.Minute, "timeout of the command")
+	f.output = outputFlag(fs)
+	return fs, f
+}
+
+func (f *poolFlags) kubernetesClient() (kubernetes.Interface, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = f.kubeconfig
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// listPools returns the pools of the PVs of the driver, sorted by PV name.
+func (f *poolFlags) listPools(ctx context.Context, client kubernetes.Interface) ([]*pool, error) {
+	pvs, err := client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list persistent volumes: %w", err)
+	}
+	var pools []*pool
+	for i := range pvs.Items {
+		if p, ok := newPool(&pvs.Items[i], f.driverName); ok {
+			pools = append(pools, p)
+		}
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].PersistentVolume < pools[j].PersistentVolume })
+	return pools, nil
+}
+
+// newPool returns the pool of pv if it is a volume of driverName.
+func newPool(pv *v1.PersistentVolume, driverName string) (*pool, bool) {
+	csiSource := pv.Spec.CSI
+	if csiSource == nil || csiSource.Driver != driverName {
+		return nil, false
+	}
+	p := &pool{
+		VolumeID:         csiSource.VolumeHandle,
+		PersistentVolume: pv.Name,
+		secretRef:        csiSource.ControllerExpandSecretRef,
+	}
+	if capacity, ok := pv.Spec.Capacity[v1.ResourceStorage]; ok {
+		p.CapacityBytes = capacity.Value()
+	}
+	if claim := pv.Spec.ClaimRef; claim != nil {
+		p.PersistentVolumeClaim = claim.Namespace + "/" + claim.Name
+	}
+	if p.secretRef == nil {
+		p.secretRef = csiSource.NodeStageSecretRef
+	}
+
+	cid := &common.CSIIdentifier{}
+	if err := cid.DecomposeCSIID(csiSource.VolumeHandle); err == nil {
+		p.Pool, p.ConfigBasePath, p.User = cid.VolName, cid.BasePath(), cid.UserName
+		return p, true
+	}
+	// static volume handles start with their pool
+	volOptions, err := driver.NewVolOptionsFromStatic(csiSource.VolumeHandle, csiSource.VolumeAttributes)
+	if err != nil {
+		return nil, false
+	}
+	p.Pool = volOptions.VolName
+	p.ConfigBasePath = volOptions.BaseConfigURL
+	p.Static = true
+	return p, true
+}
+
+// fetchUsage fills the quota and usage of p, or the error getting them.
+func fetchUsage(ctx context.Context, client kubernetes.Interface, cfs fcfs.Cfs, p *pool) {
+	usage, err := getUsage(ctx, client, cfs, p)
+	if err != nil {
+		p.Error = err.Error()
+		return
+	}
+	p.QuotaBytes, p.UsedBytes = &usage.QuotaBytes, &usage.UsedBytes
+}
+
+func getUsage(ctx context.Context, client kubernetes.Interface, cfs fcfs.Cfs, p *pool) (*fcfs.VolumeUsage, error) {
+	if p.secretRef == nil {
+		return nil, fmt.Errorf("PV %s has no secret reference", p.PersistentVolume)
+	}
+	secret, err := client.CoreV1().Secrets(p.secretRef.Namespace).Get(ctx, p.secretRef.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret %s/%s: %w", p.secretRef.Namespace, p.secretRef.Name, err)
+	}
+	secrets := make(map[string]string, len(secret.Data))
+	for k, v := range secret.Data {
+		secrets[k] = string(v)
+	}
+	cr, err := common.GetCredentialsForVolume(p.Static, secrets)
+	if err != nil {
+		return nil, err
+	}
+	defer cr.DeleteCredentials()
+
+	volOptions := &fcfs.VolumeOptions{
+		VolID:          p.VolumeID,
+		VolName:        p.Pool,
+		BaseConfigURL:  p.ConfigBasePath,
+		PreProvisioned: p.Static,
+	}
+	return cfs.GetVolumeUsage(ctx, volOptions, cr)
+}
+
+// drifted reports whether the quota of a provisioned pool differs from the
+// capacity of its PV, quotas are set in whole GiB.
+func (p *pool) drifted() bool {
+	if p.Static || p.QuotaBytes == nil {
+		return false
+	}
+	return *p.QuotaBytes != common.RoundUpGiB(p.CapacityBytes)*common.GiB
+}
+
+var (
+	listHeader  = []string{"POOL", "PV", "PVC", "CAPACITY", "STATIC", "CONFIG BASE PATH"}
+	usageHeader = []string{"POOL", "PV", "PVC", "CAPACITY", "QUOTA", "USED", "ERROR"}
+)
+
+func listRow(p *pool) []string {
+	return []string{p.Pool, p.PersistentVolume, p.PersistentVolumeClaim, formatBytes(&p.CapacityBytes),
+		strconv.FormatBool(p.Static), p.ConfigBasePath}
+}
+
+func usageRow(p *pool) []string {
+	return []string{p.Pool, p.PersistentVolume, p.PersistentVolumeClaim, formatBytes(&p.CapacityBytes),
+		formatBytes(p.QuotaBytes), formatBytes(p.UsedBytes), p.Error}
+}
+
+func runList(args []string) error {
+	fs, f := newPoolFlagSet("list")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+	client, err := f.kubernetesClient()
+	if err != nil {
+		return err
+	}
+	pools, err := f.listPools(ctx, client)
+	if err != nil {
+		return err
+	}
+	return printRows(os.Stdout, *f.output, pools, listHeader, func(i int) []string { return listRow(pools[i]) }, len(pools))
+}
+
+func runUsage(args []string) error {
+	fs, f := newPoolFlagSet("usage")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	pools, err := f.poolsWithUsage()
+	if err != nil {
+		return err
+	}
+	return printRows(os.Stdout, *f.output, pools, usageHeader, func(i int) []string { return usageRow(pools[i]) }, len(pools))
+}
+
+func runDrift(args []string) error {
+	fs, f := newPoolFlagSet("drift")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	pools, err := f.poolsWithUsage()
+	if err != nil {
+		return err
+	}
+	drifted := []*pool{}
+	for _, p := range pools {
+		if p.drifted() {
+			drifted = append(drifted, p)
+		}
+	}
+	return printRows(os.Stdout, *f.output, drifted, usageHeader, func(i int) []string { return usageRow(drifted[i]) }, len(drifted))
+}
+
+func (f *poolFlags) poolsWithUsage() ([]*pool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+	client, err := f.kubernetesClient()
+	if err != nil {
+		return nil, err
+	}
+	pools, err := f.listPools(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	cfs, err := fcfs.NewCFS()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pools {
+		fetchUsage(ctx, client, cfs, p)
+	}
+	return pools, nil
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+	"vazmin.github.io/fastcfs-csi/pkg/fcfs"
+)
+
+func newPV(name, driver, handle string, attributes map[string]string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity: v1.ResourceList{v1.ResourceStorage: resource.MustParse("10Gi")},
+			ClaimRef: &v1.ObjectReference{Namespace: "default", Name: "data"},
+			PersistentVolumeSource: v1.PersistentVolumeSource{CSI: &v1.CSIPersistentVolumeSource{
+				Driver:             driver,
+				VolumeHandle:       handle,
+				VolumeAttributes:   attributes,
+				NodeStageSecretRef: &v1.SecretReference{Namespace: "default", Name: "fcfs-secret"},
+			}},
+		},
+	}
+}
+
+func TestNewPool(t *testing.T) {
+	volID, err := (&common.CSIIdentifier{ClusterID: "/etc/fastcfs-client-config", UserName: "admin", VolName: "csi-vol-pv1"}).ComposeCSIID()
+	require.NoError(t, err)
+
+	p, ok := newPool(newPV("pv1", common.DefaultDriverName, volID, nil), common.DefaultDriverName)
+	require.True(t, ok)
+	require.Equal(t, "csi-vol-pv1", p.Pool)
+	require.Equal(t, "/etc/fastcfs-client-config", p.ConfigBasePath)
+	require.Equal(t, "admin", p.User)
+	require.Equal(t, "default/data", p.PersistentVolumeClaim)
+	require.Equal(t, int64(10*common.GiB), p.CapacityBytes)
+	require.False(t, p.Static)
+	require.Equal(t, "fcfs-secret", p.secretRef.Name)
+
+	p, ok = newPool(newPV("pv2", common.DefaultDriverName, "static-pool", map[string]string{
+		"static": "true", common.FastCFSConfigBasePath: "http://192.168.99.170:8080",
+	}), common.DefaultDriverName)
+	require.True(t, ok)
+	require.Equal(t, "static-pool", p.Pool)
+	require.Equal(t, "http://192.168.99.170:8080", p.ConfigBasePath)
+	require.True(t, p.Static)
+
+	p, ok = newPool(newPV("pv5", common.DefaultDriverName, "static-pool#tenants/app-1", map[string]string{
+		"static": "true", common.FastCFSConfigBasePath: "http://192.168.99.170:8080",
+	}), common.DefaultDriverName)
+	require.True(t, ok)
+	require.Equal(t, "static-pool", p.Pool)
+	require.Equal(t, "static-pool#tenants/app-1", p.VolumeID)
+
+	_, ok = newPool(newPV("pv3", "other.csi.driver", volID, nil), common.DefaultDriverName)
+	require.False(t, ok)
+	_, ok = newPool(newPV("pv4", common.DefaultDriverName, "unknown", nil), common.DefaultDriverName)
+	require.False(t, ok)
+}
+
+func TestPoolDrifted(t *testing.T) {
+	quota := func(v int64) *int64 { return &v }
+	testCases := []struct {
+		name    string
+		pool    pool
+		drifted bool
+	}{
+		{name: "matching quota", pool: pool{CapacityBytes: 10 * common.GiB, QuotaBytes: quota(10 * common.GiB)}},
+		{name: "rounded up quota", pool: pool{CapacityBytes: 1500 * common.MiB, QuotaBytes: quota(2 * common.GiB)}},
+		{name: "smaller quota", pool: pool{CapacityBytes: 10 * common.GiB, QuotaBytes: quota(5 * common.GiB)}, drifted: true},
+		{name: "unlimited quota", pool: pool{CapacityBytes: 10 * common.GiB, QuotaBytes: quota(fcfs.UnlimitedQuota)}, drifted: true},
+		{name: "unknown quota", pool: pool{CapacityBytes: 10 * common.GiB}},
+		{name: "static pool", pool: pool{Static: true, CapacityBytes: 10 * common.GiB, QuotaBytes: quota(fcfs.UnlimitedQuota)}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.drifted, tc.pool.drifted())
+		})
+	}
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+)
+
+type decodedVolumeID struct {
+	VolumeID       string `json:"volumeID"`
+	ConfigBasePath string `json:"configBasePath"`
+	User           string `json:"user"`
+	Pool           string `json:"pool"`
+}
+
+func runDecode(args []string) error {
+	fs := flag.NewFlagSet("decode", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: fcfsctl decode [flags] <volume-id>...\n")
+		fs.PrintDefaults()
+	}
+	output := outputFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("missing volume ID")
+	}
+
+	var ids []decodedVolumeID
+	for _, volID := range fs.Args() {
+		cid := &common.CSIIdentifier{}
+		if err := cid.DecomposeCSIID(volID); err != nil {
+			return fmt.Errorf("invalid volume ID %q: %w", volID, err)
+		}
+		ids = append(ids, decodedVolumeID{VolumeID: volID, ConfigBasePath: cid.BasePath(), User: cid.UserName, Pool: cid.VolName})
+	}
+	return printRows(os.Stdout, *output, ids, []string{"VOLUME ID", "CONFIG BASE PATH", "USER", "POOL"}, func(i int) []string {
+		return []string{ids[i].VolumeID, ids[i].ConfigBasePath, ids[i].User, ids[i].Pool}
+	}, len(ids))
+}
+
+func runEncode(args []string) error {
+	fs := flag.NewFlagSet("encode", flag.ContinueOnError)
+	cid := &common.CSIIdentifier{}
+	fs.StringVar(&cid.ClusterID, "config-base-path", "", "fastcfs-config-base-path of the storage class")
+	fs.StringVar(&cid.UserName, "user", "", "FastCFS admin user owning the pool")
+	fs.StringVar(&cid.VolName, "pool", "", "name of the pool, e.g. "+common.CsiVolNamingPrefix+"<pv name>")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(cid.ClusterID) == 0 || len(cid.UserName) == 0 || len(cid.VolName) == 0 {
+		fs.Usage()
+		return errors.New("--config-base-path, --user and --pool are required")
+	}
+	volID, err := cid.ComposeCSIID()
+	if err != nil {
+		return err
+	}
+	fmt.Println(volID)
+	return nil
+}
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"k8s.io/klog/v2"
 	"os"
+	"time"
 	"vazmin.github.io/fastcfs-csi/pkg/common"
 	fcfs "vazmin.github.io/fastcfs-csi/pkg/fcfs-driver"
 )
@@ -36,9 +37,30 @@ func initFlag() {
 	flag.StringVar(&conf.DriverName, "driver-name", common.DefaultDriverName, "name of the driver")
 	flag.StringVar(&conf.NodeID, "nodeid", "", "node id")
 	flag.BoolVar(&conf.Ephemeral, "ephemeral", false, "publish volumes in ephemeral mode even if kubelet did not ask for it (only needed for Kubernetes 1.15)")
+	flag.StringVar(&conf.EphemeralSecret, "ephemeral-secret", "", "namespace/name of the secret with the admin credentials the node server deletes the pools of ephemeral volumes with, which are not published if empty")
 	flag.Int64Var(&conf.MaxVolumesPerNode, "max-volumes-per-node", 0, "limit of volumes per node")
 	flag.BoolVar(&conf.Version, "version", false, "Show version.")
+	flag.StringVar(&conf.LogFormat, "log-format", common.LogFormatText, "log format: text or json, lines logged while handling a request carry its requestID")
 	flag.Var(common.NewStringSlice(&conf.DomainLabels), "domain-labels", "topology")
+	flag.StringVar(&conf.HTTPEndpoint, "http-endpoint", "", "TCP address (e.g. :8080) of the HTTP server serving /metrics, disabled if empty")
+	flag.StringVar(&conf.AuditLog, "audit-log", "", "file the audit records of pool changes and mounts are appended to, - for stdout, disabled if empty")
+	flag.BoolVar(&conf.EnableEvents, "enable-events", true, "emit Kubernetes events on the PV and PVC of volumes failing to be created, expanded, deleted or mounted")
+	flag.StringVar(&conf.Tracing.OTLPEndpoint, "otlp-endpoint", "", "host:port of the OTLP gRPC collector traces are exported to, tracing is disabled if empty")
+	flag.BoolVar(&conf.Tracing.OTLPInsecure, "otlp-insecure", false, "connect to the OTLP collector without TLS")
+	flag.DurationVar(&conf.ProbeCacheTTL, "probe-cache-ttl", 10*time.Second, "how long the result of the Probe health checks is cached")
+	flag.DurationVar(&conf.VolumeStatsTimeout, "volume-stats-timeout", 5*time.Second, "how long NodeGetVolumeStats waits for statfs of a volume path before it reports the mount as stale")
+	flag.DurationVar(&conf.VolumeStatsCacheTTL, "volume-stats-cache-ttl", 30*time.Second, "how long the stats of a volume path are cached")
+	flag.BoolVar(&conf.VolumeStatsQuota, "volume-stats-quota", false, "report the quota and usage of the pool in the volume stats, the node keeps the stage credentials of each volume in plaintext next to its staging path for it")
+	flag.Var(common.NewStringSlice(&conf.ClusterConfigURLs), "cluster-config-url", "fastcfs-config-base-path of a FastCFS cluster whose client.conf and fuse.conf are checked by Probe, may be repeated")
+	flag.StringVar(&conf.ConfigCache.Dir, "config-cache-dir", "/var/lib/fcfs-csi/config-cache", "directory http(s) FastCFS client configs are downloaded to, so that the last good copy is used while the config server is unreachable, empty passes the URLs to the FastCFS commands")
+	flag.DurationVar(&conf.ConfigCache.MaxAge, "config-cache-max-age", time.Minute, "how long a downloaded config is used before it is revalidated with the config server")
+	flag.Var(common.NewStringSlice(&conf.ConfigCache.Checksums), "config-checksum", "comma separated URL=sha256 pins of downloaded config files, which are refused if their checksum differs, may be repeated")
+	flag.StringVar(&conf.ConfigCache.TLS.CAFile, "config-tls-ca-file", "", "CA file used to verify the certificate of https config servers")
+	flag.StringVar(&conf.ConfigCache.TLS.CertFile, "config-tls-cert-file", "", "client certificate file presented to https config servers")
+	flag.StringVar(&conf.ConfigCache.TLS.KeyFile, "config-tls-key-file", "", "client private key file presented to https config servers")
+	flag.DurationVar(&conf.SweepInterval, "sweep-interval", 10*time.Minute, "interval of cleaning up the mounts of volumes kubelet no longer uses and the base paths of pools no fcfs_fused serves by the node server, at startup and then periodically, 0 disables it")
+	flag.StringVar(&conf.KubeletDir, "kubelet-dir", "/var/lib/kubelet", "root dir of kubelet, as mounted in the node server")
+	flag.DurationVar(&conf.VolumeUsageInterval, "volume-usage-interval", time.Minute, "interval of exporting the quota and usage of provisioned pools by the controller server (requires --http-endpoint), 0 disables it")
 
 	flag.BoolVar(&conf.IsNodeServer, "node-server", false, "start fastcfs-csi node server")
 	flag.BoolVar(&conf.IsControllerServer, "controller-server", false, "start fastcfs-csi controller server")
@@ -46,12 +68,21 @@ func initFlag() {
 	flag.StringVar(&conf.FcfsFusedProxyEndpoint, "fcfsfused-proxy-endpoint", "unix://tmp/fcfsfused-proxy.sock", "fcfsfused-proxy endpoint")
 	flag.BoolVar(&conf.EnableFcfsFusedProxy, "enable-fcfsfused-proxy", false, "enable fcfsfused-proxy")
 	flag.IntVar(&conf.FcfsFusedProxyConnTimout, "fcfsfused-proxy-conn-timeout", 5, "fcfsfused proxy connection timeout(seconds)")
+	flag.StringVar(&conf.FcfsFusedProxyFallback, "fcfsfused-proxy-fallback", "never", "fallback policy when fcfsfused-proxy is unreachable: never, on-unavailable (mount directly)")
+	flag.BoolVar(&conf.FcfsFusedProxyTLS.Enable, "fcfsfused-proxy-tls", false, "connect to fcfsfused-proxy over TLS")
+	flag.StringVar(&conf.FcfsFusedProxyTLS.CAFile, "fcfsfused-proxy-tls-ca-file", "", "CA file used to verify the fcfsfused-proxy certificate")
+	flag.StringVar(&conf.FcfsFusedProxyTLS.CertFile, "fcfsfused-proxy-tls-cert-file", "", "client certificate file presented to fcfsfused-proxy (mutual TLS)")
+	flag.StringVar(&conf.FcfsFusedProxyTLS.KeyFile, "fcfsfused-proxy-tls-key-file", "", "client private key file presented to fcfsfused-proxy (mutual TLS)")
+	flag.StringVar(&conf.FcfsFusedProxyTLS.ServerName, "fcfsfused-proxy-tls-server-name", "", "server name used to verify the fcfsfused-proxy certificate")
 
 	klog.InitFlags(nil)
 	if err := flag.Set("logtostderr", "true"); err != nil {
 		klog.Exitf("failed to set logtostderr flag: %v", err)
 	}
 	flag.Parse()
+	if err := common.SetLogFormat(conf.LogFormat); err != nil {
+		klog.Exitf("invalid --log-format: %v", err)
+	}
 }
 
 func main() {
@@ -0,0 +1,98 @@
+#!/bin/bash
+
+# Copyright 2021 vazmin.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+# Runs csi-sanity against the plugin with fake-fastcfs installed as fcfs_pool
+# and fcfs_fused. It mounts the pools, so it must run as root on a box without
+# FastCFS, e.g. a CI runner or a container started with --privileged.
+
+set -euo pipefail
+BASE_DIR=$(dirname "$(realpath "${BASH_SOURCE[0]}")")
+REPO_DIR=$(realpath "${BASE_DIR}/../..")
+
+source "${REPO_DIR}"/hack/e2e/util.sh
+
+CSI_SANITY_VERSION=${CSI_SANITY_VERSION:-v4.4.0}
+GINKGO_SKIP=${GINKGO_SKIP:-}
+TEST_DIR=${TEST_DIR:-$(mktemp -d /tmp/fcfs-csi-sanity.XXXX)}
+BIN_DIR=${TEST_DIR}/bin
+export FAKE_FASTCFS_ROOT=${TEST_DIR}/fastcfs
+
+if [[ $(id -u) != 0 ]]; then
+  echo "csi-sanity mounts the fake pools, run as root"
+  exit 1
+fi
+for cmd in /usr/bin/fcfs_pool /usr/bin/fcfs_fused; do
+  if [[ -e ${cmd} && ! -L ${cmd} ]]; then
+    echo "${cmd} exists, refusing to replace it with fake-fastcfs"
+    exit 1
+  fi
+done
+
+# the key files and the fcfs_fused base paths of the plugin
+mkdir -p "${BIN_DIR}" /tmp/csi/keys /opt/fastcfs
+loudecho "Building fcfsplugin and fake-fastcfs to ${BIN_DIR}"
+(cd "${REPO_DIR}" && go build -o "${BIN_DIR}/fcfsplugin" ./cmd/fcfsplugin)
+(cd "${REPO_DIR}" && go build -o "${BIN_DIR}/fake-fastcfs" ./tests/sanity/fake-fastcfs)
+if ! command -v csi-sanity >/dev/null; then
+  loudecho "Installing csi-sanity ${CSI_SANITY_VERSION} to ${BIN_DIR}"
+  GOBIN=${BIN_DIR} go install "github.com/kubernetes-csi/csi-test/v4/cmd/csi-sanity@${CSI_SANITY_VERSION}"
+fi
+export PATH=${BIN_DIR}:${PATH}
+
+PLUGIN_PID=
+function cleanup() {
+  if [[ -n ${PLUGIN_PID} ]]; then
+    kill "${PLUGIN_PID}" || true
+  fi
+  rm -f /usr/bin/fcfs_pool /usr/bin/fcfs_fused
+  grep -o " ${TEST_DIR}[^ ]*" /proc/self/mounts | sort -r | xargs -r -n1 umount || true
+}
+trap cleanup EXIT
+ln -sf "${BIN_DIR}/fake-fastcfs" /usr/bin/fcfs_pool
+ln -sf "${BIN_DIR}/fake-fastcfs" /usr/bin/fcfs_fused
+
+cat > "${TEST_DIR}/secrets.yaml" <<EOF
+CreateVolumeSecret:
+  adminName: admin
+  adminSecretKey: admin-key
+DeleteVolumeSecret:
+  adminName: admin
+  adminSecretKey: admin-key
+ControllerExpandVolumeSecret:
+  adminName: admin
+  adminSecretKey: admin-key
+NodeStageVolumeSecret:
+  adminName: admin
+  adminSecretKey: admin-key
+EOF
+cat > "${TEST_DIR}/parameters.yaml" <<EOF
+fastcfs-config-base-path: /etc/fastcfs-client-config
+EOF
+
+loudecho "Starting fcfsplugin"
+ENDPOINT=unix://${TEST_DIR}/csi.sock
+fcfsplugin --endpoint="${ENDPOINT}" --nodeid=sanity-node --enable-events=false --sweep-interval=0 --v=5 \
+  >"${TEST_DIR}/fcfsplugin.log" 2>&1 &
+PLUGIN_PID=$!
+
+loudecho "Running csi-sanity, the plugin log is ${TEST_DIR}/fcfsplugin.log"
+csi-sanity --csi.endpoint="${ENDPOINT}" \
+  --csi.secrets="${TEST_DIR}/secrets.yaml" \
+  --csi.testvolumeparameters="${TEST_DIR}/parameters.yaml" \
+  --csi.mountdir="${TEST_DIR}/mount" \
+  --csi.stagingdir="${TEST_DIR}/staging" \
+  --csi.testvolumeexpandsize=2147483648 \
+  --ginkgo.skip="${GINKGO_SKIP}"
@@ -0,0 +1,141 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"k8s.io/klog/v2"
+)
+
+// Audited operations
+const (
+	AuditCreate  = "create"
+	AuditDelete  = "delete"
+	AuditQuota   = "quota"
+	AuditMount   = "mount"
+	AuditUnmount = "unmount"
+)
+
+// Audit outcomes
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// AuditStdout is the audit log path writing to stdout.
+const AuditStdout = "-"
+
+// AuditEvent is a record of the audit log.
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestID,omitempty"`
+	Operation string    `json:"operation"`
+	VolumeID  string    `json:"volumeID"`
+	Pool      string    `json:"pool"`
+	User      string    `json:"user"`
+	Method    string    `json:"method,omitempty"`    // CSI method of the request
+	Requester string    `json:"requester,omitempty"` // sidecar or kubelet sending the request
+	UserAgent string    `json:"userAgent,omitempty"`
+	Request   string    `json:"request,omitempty"` // command arguments or proxy request, secrets redacted
+	Outcome   string    `json:"outcome"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// requesters maps the CSI methods to the component calling them.
+var requesters = map[string]string{
+	"/csi.v1.Controller/CreateVolume":           "csi-provisioner",
+	"/csi.v1.Controller/DeleteVolume":           "csi-provisioner",
+	"/csi.v1.Controller/ControllerExpandVolume": "csi-resizer",
+	"/csi.v1.Node/NodeStageVolume":              "kubelet",
+	"/csi.v1.Node/NodeUnstageVolume":            "kubelet",
+	"/csi.v1.Node/NodePublishVolume":            "kubelet",
+	"/csi.v1.Node/NodeUnpublishVolume":          "kubelet",
+}
+
+var auditLog struct {
+	mux sync.Mutex
+	w   io.Writer
+}
+
+// OpenAuditLog appends the audit records to the file at path, or writes them
+// to stdout if path is AuditStdout. Auditing is disabled if path is empty.
+func OpenAuditLog(path string) error {
+	var w io.Writer
+	switch path {
+	case "":
+	case AuditStdout:
+		w = os.Stdout
+	default:
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+	auditLog.mux.Lock()
+	defer auditLog.mux.Unlock()
+	auditLog.w = w
+	return nil
+}
+
+// Audit completes event with the request of ctx and the outcome err, and
+// appends it to the audit log.
+func Audit(ctx context.Context, event *AuditEvent, err error) {
+	auditLog.mux.Lock()
+	defer auditLog.mux.Unlock()
+	if auditLog.w == nil {
+		return
+	}
+
+	event.Time = time.Now().UTC()
+	event.RequestID = RequestIDFromContext(ctx)
+	if method, ok := grpc.Method(ctx); ok {
+		event.Method = method
+		event.Requester = requesters[method]
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		event.UserAgent = strings.Join(md.Get("user-agent"), " ")
+	}
+	event.Outcome = AuditSuccess
+	if err != nil {
+		event.Outcome = AuditFailure
+		event.Error = err.Error()
+	}
+
+	line, jsonErr := json.Marshal(event)
+	if jsonErr != nil {
+		klog.Errorf("failed to encode audit event of volume %s: %v", event.VolumeID, jsonErr)
+		return
+	}
+	if _, writeErr := auditLog.w.Write(append(line, '\n')); writeErr != nil {
+		klog.Errorf("failed to write audit event of volume %s: %v", event.VolumeID, writeErr)
+	}
+}
+
+// AuditArgs returns the command arguments of an audit event, secrets redacted.
+func AuditArgs(program string, args []string) string {
+	return strings.Join(append([]string{program}, StripSecretInArgs(args)...), " ")
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// fakeTransportStream carries the method of a server request.
+type fakeTransportStream struct {
+	method string
+}
+
+func (s *fakeTransportStream) Method() string                  { return s.method }
+func (s *fakeTransportStream) SetHeader(md metadata.MD) error  { return nil }
+func (s *fakeTransportStream) SendHeader(md metadata.MD) error { return nil }
+func (s *fakeTransportStream) SetTrailer(md metadata.MD) error { return nil }
+
+func TestAudit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	require.NoError(t, OpenAuditLog(path))
+	defer OpenAuditLog("")
+
+	ctx := grpc.NewContextWithServerTransportStream(context.Background(),
+		&fakeTransportStream{method: "/csi.v1.Controller/CreateVolume"})
+	ctx = metadata.NewIncomingContext(WithRequestID(ctx, "0123456789abcdef"), metadata.Pairs("user-agent", "grpc-go/1.29.1"))
+	args := []string{"-u", "admin", "-k", "/tmp/csi/keys/keyfile-1", "-c", "/etc/fastcfs/auth/client.conf", "create", "csi-vol-1", "1g"}
+	event := &AuditEvent{Operation: AuditCreate, VolumeID: "vol-1", Pool: "csi-vol-1", User: "admin", Request: AuditArgs(PoolCMD, args)}
+	Audit(ctx, event, nil)
+
+	// reopening appends to the log
+	require.NoError(t, OpenAuditLog(path))
+	Audit(context.Background(), &AuditEvent{Operation: AuditDelete, VolumeID: "vol-1", Pool: "csi-vol-1", User: "admin"},
+		errors.New("exit status 1"))
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	var events []AuditEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e AuditEvent
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		events = append(events, e)
+	}
+	require.Len(t, events, 2)
+
+	require.Equal(t, "0123456789abcdef", events[0].RequestID)
+	require.Equal(t, "/csi.v1.Controller/CreateVolume", events[0].Method)
+	require.Equal(t, "csi-provisioner", events[0].Requester)
+	require.Equal(t, "grpc-go/1.29.1", events[0].UserAgent)
+	require.Equal(t, "/usr/bin/fcfs_pool -u admin -k *** -c /etc/fastcfs/auth/client.conf create csi-vol-1 1g", events[0].Request)
+	require.Equal(t, AuditSuccess, events[0].Outcome)
+	require.False(t, events[0].Time.IsZero())
+
+	require.Equal(t, AuditDelete, events[1].Operation)
+	require.Equal(t, AuditFailure, events[1].Outcome)
+	require.Equal(t, "exit status 1", events[1].Error)
+}
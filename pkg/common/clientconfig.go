@@ -0,0 +1,262 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Storage class parameters of the servers of a generated FastCFS client config.
+const (
+	FdirServersKey          = "fdir-servers"
+	FstoreServersKey        = "fstore-servers"
+	FstoreDataGroupCountKey = "fstore-data-group-count"
+	AuthServersKey          = "auth-servers"
+
+	// ClientConfigDirName is the directory of the generated client config in the volume base path.
+	ClientConfigDirName = "config"
+
+	defaultDataGroupCount = 64
+)
+
+// files of the config tree below fastcfs-config-base-path
+const (
+	fdirClusterConfigFile   = "/fastcfs/fdir/cluster.conf"
+	fstoreClusterConfigFile = "/fastcfs/fstore/cluster.conf"
+	authConfigFile          = "/fastcfs/auth/auth.conf"
+	authClusterConfigFile   = "/fastcfs/auth/cluster.conf"
+)
+
+var clientConfigKeys = []string{FdirServersKey, FstoreServersKey, FstoreDataGroupCountKey, AuthServersKey}
+
+//go:embed clientconfig
+var clientConfigTemplates embed.FS
+
+var serverAddressRegexp = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.-]*[A-Za-z0-9])?(:[0-9]{1,5})?$`)
+
+type fstoreServerGroup struct {
+	ID           int
+	ServerIDs    string
+	DataGroupIDs string
+}
+
+// clientConfig is the data of the client config templates. The cluster files
+// are relative paths of the generated tree, or those of the shared tree for
+// the servers which are not set.
+type clientConfig struct {
+	FdirServers    []string
+	FstoreServers  []string
+	FstoreGroups   []fstoreServerGroup
+	DataGroupCount int
+	AuthServers    []string
+
+	FdirCluster   string
+	FstoreCluster string
+	AuthConfig    string
+}
+
+// ClientConfigParameters returns the client config parameters in params, or
+// nil if there are none.
+func ClientConfigParameters(params map[string]string) map[string]string {
+	var config map[string]string
+	for _, key := range clientConfigKeys {
+		if val, ok := params[key]; ok {
+			if config == nil {
+				config = make(map[string]string)
+			}
+			config[key] = val
+		}
+	}
+	return config
+}
+
+// ValidateClientConfig checks the server addresses and counts of the client config parameters.
+func ValidateClientConfig(params map[string]string) error {
+	_, err := newClientConfig(params)
+	return err
+}
+
+func newClientConfig(params map[string]string) (*clientConfig, error) {
+	for key := range params {
+		if !isClientConfigKey(key) {
+			return nil, fmt.Errorf("client config parameter %q is not allowed", key)
+		}
+	}
+	c := &clientConfig{DataGroupCount: defaultDataGroupCount}
+	var err error
+	if c.FdirServers, err = parseServers(FdirServersKey, params[FdirServersKey]); err != nil {
+		return nil, err
+	}
+	if c.AuthServers, err = parseServers(AuthServersKey, params[AuthServersKey]); err != nil {
+		return nil, err
+	}
+	if val, ok := params[FstoreDataGroupCountKey]; ok {
+		if c.DataGroupCount, err = strconv.Atoi(val); err != nil || c.DataGroupCount < 1 {
+			return nil, fmt.Errorf("%s %q must be a positive number", FstoreDataGroupCountKey, val)
+		}
+		if _, ok := params[FstoreServersKey]; !ok {
+			return nil, fmt.Errorf("%s is set without %s", FstoreDataGroupCountKey, FstoreServersKey)
+		}
+	}
+
+	// server groups are separated by semicolons, their servers by commas
+	var groups []string
+	if val := strings.TrimSpace(params[FstoreServersKey]); len(val) > 0 {
+		groups = strings.Split(val, ";")
+	}
+	if len(groups) > c.DataGroupCount {
+		return nil, fmt.Errorf("%s has %d server groups, more than the %d data groups", FstoreServersKey, len(groups), c.DataGroupCount)
+	}
+	for i, group := range groups {
+		servers, err := parseServers(FstoreServersKey, group)
+		if err != nil {
+			return nil, err
+		}
+		if len(servers) == 0 {
+			return nil, fmt.Errorf("server group %d of %s is empty", i+1, FstoreServersKey)
+		}
+		first := len(c.FstoreServers) + 1
+		c.FstoreServers = append(c.FstoreServers, servers...)
+		// the data groups are split evenly between the server groups
+		c.FstoreGroups = append(c.FstoreGroups, fstoreServerGroup{
+			ID:           i + 1,
+			ServerIDs:    idRange(first, len(c.FstoreServers)),
+			DataGroupIDs: idRange(i*c.DataGroupCount/len(groups)+1, (i+1)*c.DataGroupCount/len(groups)),
+		})
+	}
+	return c, nil
+}
+
+func isClientConfigKey(key string) bool {
+	for _, k := range clientConfigKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// parseServers parses a comma separated list of host[:port].
+func parseServers(key, val string) ([]string, error) {
+	var servers []string
+	for _, server := range strings.Split(val, ",") {
+		server = strings.TrimSpace(server)
+		if len(server) == 0 {
+			continue
+		}
+		if !serverAddressRegexp.MatchString(server) {
+			return nil, fmt.Errorf("invalid server address %q in %s", server, key)
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+func idRange(first, last int) string {
+	if first == last {
+		return strconv.Itoa(first)
+	}
+	return fmt.Sprintf("[%d, %d]", first, last)
+}
+
+// RenderClientConfig writes the FastCFS client config of the servers in params
+// to dir, laid out as the shared config tree, and returns the path of its
+// fuse.conf. The servers which are not in params are taken from the shared
+// config tree at baseConfigURL.
+func RenderClientConfig(dir, baseConfigURL string, params map[string]string) (string, error) {
+	c, err := newClientConfig(params)
+	if err != nil {
+		return "", err
+	}
+	c.FdirCluster = baseConfigURL + fdirClusterConfigFile
+	c.FstoreCluster = baseConfigURL + fstoreClusterConfigFile
+	c.AuthConfig = baseConfigURL + authConfigFile
+
+	files := map[string]string{"fuse.conf": FuseClientConfigFile}
+	if len(c.AuthServers) > 0 {
+		c.AuthConfig = "../auth/auth.conf"
+		files["auth.conf"] = authConfigFile
+		files["auth-client.conf"] = PoolConfigFile
+		files["auth-cluster.conf"] = authClusterConfigFile
+	}
+	if len(c.FdirServers) > 0 {
+		c.FdirCluster = "../fdir/cluster.conf"
+		files["fdir-cluster.conf"] = fdirClusterConfigFile
+	}
+	if len(c.FstoreServers) > 0 {
+		c.FstoreCluster = "../fstore/cluster.conf"
+		files["fstore-cluster.conf"] = fstoreClusterConfigFile
+	}
+
+	// the config of removed servers must not be left behind
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	tmpl, err := template.New("").
+		Funcs(template.FuncMap{"inc": func(i int) int { return i + 1 }}).
+		ParseFS(clientConfigTemplates, "clientconfig/*.conf")
+	if err != nil {
+		return "", err
+	}
+	for name, file := range files {
+		path := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return "", err
+		}
+		var out bytes.Buffer
+		if err := tmpl.ExecuteTemplate(&out, name, c); err != nil {
+			return "", fmt.Errorf("failed to render %s: %w", file, err)
+		}
+		if err := ioutil.WriteFile(path, out.Bytes(), 0600); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(dir, FuseClientConfigFile), nil
+}
+
+// VolumeFuseConfig returns the fuse.conf fcfs_fused mounts the volume with
+// base path basePath with. It is the shared fuseConfigURL, or the fuse.conf
+// generated from clientConfig if set, with fuseOptions applied in a copy below
+// basePath if set.
+func VolumeFuseConfig(basePath, fuseConfigURL string, clientConfig, fuseOptions map[string]string) (string, error) {
+	configURL := fuseConfigURL
+	if len(clientConfig) > 0 {
+		baseConfigURL := strings.TrimSuffix(fuseConfigURL, FuseClientConfigFile)
+		var err error
+		configURL, err = RenderClientConfig(filepath.Join(basePath, ClientConfigDirName), baseConfigURL, clientConfig)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate client config: %w", err)
+		}
+	}
+	if len(fuseOptions) > 0 {
+		volConfig := filepath.Join(basePath, FuseConfigFileName)
+		if err := RenderFuseConfig(configURL, volConfig, fuseOptions); err != nil {
+			return "", err
+		}
+		configURL = volConfig
+	}
+	return configURL, nil
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientConfigParameters(t *testing.T) {
+	require.Nil(t, ClientConfigParameters(map[string]string{FastCFSConfigBasePath: "/etc/fastcfs"}))
+	require.Equal(t, map[string]string{FdirServersKey: "10.0.0.1"}, ClientConfigParameters(map[string]string{
+		FastCFSConfigBasePath: "/etc/fastcfs",
+		FdirServersKey:        "10.0.0.1",
+	}))
+}
+
+func TestNewClientConfig(t *testing.T) {
+	tests := []struct {
+		params  map[string]string
+		want    *clientConfig
+		wantErr bool
+	}{
+		{
+			params: map[string]string{FdirServersKey: "10.0.0.1, fdir-2.example.com:11012,"},
+			want:   &clientConfig{FdirServers: []string{"10.0.0.1", "fdir-2.example.com:11012"}, DataGroupCount: 64},
+		},
+		{
+			params: map[string]string{FstoreServersKey: "10.0.0.1,10.0.0.2;10.0.0.3", FstoreDataGroupCountKey: "5"},
+			want: &clientConfig{
+				FstoreServers: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+				FstoreGroups: []fstoreServerGroup{
+					{ID: 1, ServerIDs: "[1, 2]", DataGroupIDs: "[1, 2]"},
+					{ID: 2, ServerIDs: "3", DataGroupIDs: "[3, 5]"},
+				},
+				DataGroupCount: 5,
+			},
+		},
+		{params: map[string]string{FdirServersKey: "10.0.0.1\n[server-2]"}, wantErr: true},
+		{params: map[string]string{AuthServersKey: "10.0.0.1 10.0.0.2"}, wantErr: true},
+		{params: map[string]string{FstoreServersKey: "10.0.0.1;;10.0.0.2"}, wantErr: true},
+		{params: map[string]string{FstoreServersKey: "10.0.0.1;10.0.0.2", FstoreDataGroupCountKey: "1"}, wantErr: true},
+		{params: map[string]string{FstoreDataGroupCountKey: "64"}, wantErr: true},
+		{params: map[string]string{FastCFSConfigBasePath: "/etc/fastcfs"}, wantErr: true},
+	}
+	for i, test := range tests {
+		c, err := newClientConfig(test.params)
+		if test.wantErr {
+			require.Error(t, err, i)
+			continue
+		}
+		require.NoError(t, err, i)
+		require.Equal(t, test.want, c, i)
+	}
+}
+
+func TestRenderClientConfig(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), ClientConfigDirName)
+	fuseConf, err := RenderClientConfig(dir, "http://config.example.com", map[string]string{
+		FdirServersKey:   "10.0.0.1,10.0.0.2",
+		FstoreServersKey: "10.0.0.3;10.0.0.4",
+	})
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, FuseClientConfigFile), fuseConf)
+
+	content, err := ioutil.ReadFile(fuseConf)
+	require.NoError(t, err)
+	require.Contains(t, string(content), "cluster_config_filename = ../fdir/cluster.conf\n")
+	require.Contains(t, string(content), "cluster_config_filename = ../fstore/cluster.conf\n")
+
+	// the auth servers are taken from the shared config tree
+	content, err = ioutil.ReadFile(filepath.Join(dir, fdirClusterConfigFile))
+	require.NoError(t, err)
+	require.Contains(t, string(content), "auth_config_filename = http://config.example.com/fastcfs/auth/auth.conf\n")
+	require.Contains(t, string(content), `
+[server-1]
+host = 10.0.0.1
+
+[server-2]
+host = 10.0.0.2
+`)
+	require.NoFileExists(t, filepath.Join(dir, authConfigFile))
+
+	content, err = ioutil.ReadFile(filepath.Join(dir, fstoreClusterConfigFile))
+	require.NoError(t, err)
+	require.Contains(t, string(content), "server_group_count = 2\n")
+	require.Contains(t, string(content), `
+[server-group-2]
+server_ids = 2
+data_group_ids = [33, 64]
+`)
+
+	// rendering again drops the files of servers no longer set
+	_, err = RenderClientConfig(dir, "/etc/fastcfs", map[string]string{AuthServersKey: "10.0.0.5"})
+	require.NoError(t, err)
+	require.NoFileExists(t, filepath.Join(dir, fdirClusterConfigFile))
+	content, err = ioutil.ReadFile(filepath.Join(dir, authClusterConfigFile))
+	require.NoError(t, err)
+	require.Contains(t, string(content), "[server-1]\nhost = 10.0.0.5\n")
+	require.FileExists(t, filepath.Join(dir, PoolConfigFile))
+}
+
+func TestVolumeFuseConfig(t *testing.T) {
+	basePath := t.TempDir()
+	shared := "/etc/fastcfs-client-config"
+
+	configURL, err := VolumeFuseConfig(basePath, shared+FuseClientConfigFile, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, shared+FuseClientConfigFile, configURL)
+
+	configURL, err = VolumeFuseConfig(basePath, shared+FuseClientConfigFile,
+		map[string]string{FdirServersKey: "10.0.0.1"}, map[string]string{"entry_timeout": "1.0"})
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(basePath, FuseConfigFileName), configURL)
+	content, err := ioutil.ReadFile(configURL)
+	require.NoError(t, err)
+	require.Contains(t, string(content), "cluster_config_filename = "+filepath.Join(basePath, ClientConfigDirName, fdirClusterConfigFile)+"\n")
+	require.Contains(t, string(content), "cluster_config_filename = "+shared+fstoreClusterConfigFile+"\n")
+	require.Contains(t, string(content), "entry_timeout = 1.0\n")
+}
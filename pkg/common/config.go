@@ -16,9 +16,14 @@ limitations under the License.
 
 package common
 
+import "time"
+
 const (
 	ClientBasePath = "/opt/fastcfs"
 	PidSuffixPath  = "fused.pid"
+	// SharedPoolDirName keeps the base paths of volumes sharing a pool, pool
+	// names start with a letter or digit
+	SharedPoolDirName = "_shared"
 )
 
 type Config struct {
@@ -26,9 +31,25 @@ type Config struct {
 	DriverName        string // name of the driver
 	NodeID            string // node id
 	Ephemeral         bool   // publish volumes in ephemeral mode even if kubelet did not ask for it (only needed for Kubernetes 1.15)
+	EphemeralSecret   string // namespace/name of the admin secret the node deletes the pools of ephemeral volumes with
 	MaxVolumesPerNode int64  // limit of volumes per node
 	Version           bool   // Show version
+	LogFormat         string // text or json
 	DomainLabels      []string
+	HTTPEndpoint      string // endpoint of the metrics http server, disabled if empty
+
+	VolumeUsageInterval time.Duration // interval of collecting pool usage metrics, disabled if 0
+	Tracing             TracingOptions
+	EnableEvents        bool          // emit events on the PV and PVC of failed volumes
+	AuditLog            string        // file the audit records are appended to, "-" for stdout, disabled if empty
+	ProbeCacheTTL       time.Duration // how long the result of the Probe health checks is reused
+	VolumeStatsTimeout  time.Duration // how long NodeGetVolumeStats waits for the stats of a volume path
+	VolumeStatsCacheTTL time.Duration // how long the stats of a volume path are reused
+	VolumeStatsQuota    bool          // report the quota and usage of the pool in the volume stats
+	ClusterConfigURLs   []string      // base paths of the FastCFS cluster configs checked by Probe
+	SweepInterval       time.Duration // interval of cleaning up orphaned mounts and base paths on the node, disabled if 0
+	KubeletDir          string        // root dir of kubelet, the staging and target paths are below it
+	ConfigCache         ConfigCacheOptions
 
 	IsControllerServer bool
 	IsNodeServer       bool
@@ -36,4 +57,6 @@ type Config struct {
 	FcfsFusedProxyEndpoint   string
 	EnableFcfsFusedProxy     bool
 	FcfsFusedProxyConnTimout int
+	FcfsFusedProxyTLS        TLSOptions
+	FcfsFusedProxyFallback   string
 }
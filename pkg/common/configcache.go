@@ -0,0 +1,356 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// maxConfigSize limits the size of a downloaded config file.
+const maxConfigSize = 1 << 20
+
+// ConfigCacheOptions configures the local cache of http(s) FastCFS client configs.
+type ConfigCacheOptions struct {
+	Dir       string        // cache directory, the configs are passed to the commands as they are if empty
+	MaxAge    time.Duration // how long a cached config is used before it is revalidated
+	Checksums []string      // URL=sha256 pins of config files
+	TLS       TLSOptions    // CA and client certificate of https servers
+}
+
+// configCache downloads configs and the configs they include by relative path
+// into a directory tree mirroring their URLs, so that the includes resolve
+// within the cache.
+type configCache struct {
+	dir    string
+	maxAge time.Duration
+	pins   map[string]string
+	client *http.Client
+
+	// mux guards the maps, the downloads of a URL are serialized by its lock
+	// so that a slow server does not hold up the configs of others
+	mux     sync.Mutex
+	locks   map[string]*sync.Mutex
+	checked map[string]time.Time // last revalidation by URL
+}
+
+// configMeta is stored next to a cached config to revalidate it.
+type configMeta struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	SHA256       string `json:"sha256"`
+}
+
+var defaultConfigCache *configCache
+
+// InitConfigCache sets up the cache LocalConfig downloads http(s) configs to.
+func InitConfigCache(opts *ConfigCacheOptions) error {
+	if len(opts.Dir) == 0 {
+		defaultConfigCache = nil
+		return nil
+	}
+	c, err := newConfigCache(opts)
+	if err != nil {
+		return err
+	}
+	defaultConfigCache = c
+	return nil
+}
+
+func newConfigCache(opts *ConfigCacheOptions) (*configCache, error) {
+	pins := make(map[string]string)
+	for _, pin := range opts.Checksums {
+		i := strings.LastIndex(pin, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("config checksum %q must be URL=sha256", pin)
+		}
+		sum := strings.ToLower(pin[i+1:])
+		if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("config checksum %q must be URL=sha256", pin)
+		}
+		pins[pin[:i]] = sum
+	}
+	tlsConfig, err := opts.TLS.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create config cache dir %s: %w", opts.Dir, err)
+	}
+	return &configCache{
+		dir:     opts.Dir,
+		maxAge:  opts.MaxAge,
+		pins:    pins,
+		client:  &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		locks:   make(map[string]*sync.Mutex),
+		checked: make(map[string]time.Time),
+	}, nil
+}
+
+// IsRemoteConfig reports whether configURL is a http(s) URL.
+func IsRemoteConfig(configURL string) bool {
+	return strings.HasPrefix(configURL, "http://") || strings.HasPrefix(configURL, "https://")
+}
+
+// LocalConfig returns the local path of the config at configURL. http(s)
+// configs are downloaded with their includes to the config cache, if it is
+// set up, and the last good copy is used while the server is unreachable.
+func LocalConfig(ctx context.Context, configURL string) (string, error) {
+	if !IsRemoteConfig(configURL) || defaultConfigCache == nil {
+		return configURL, nil
+	}
+	return defaultConfigCache.get(ctx, configURL)
+}
+
+func (c *configCache) get(ctx context.Context, configURL string) (string, error) {
+	local := ""
+	visited := make(map[string]bool)
+	queue := []string{configURL}
+	for len(queue) > 0 {
+		u := queue[0]
+		queue = queue[1:]
+		if visited[u] {
+			continue
+		}
+		visited[u] = true
+
+		p, content, err := c.fetch(ctx, u)
+		if err != nil {
+			return "", err
+		}
+		if len(local) == 0 {
+			local = p
+		}
+		refs, err := configIncludes(u, content)
+		if err != nil {
+			return "", err
+		}
+		queue = append(queue, refs...)
+	}
+	return local, nil
+}
+
+// lock locks the downloads of u and returns the function unlocking them.
+func (c *configCache) lock(u string) func() {
+	c.mux.Lock()
+	l, ok := c.locks[u]
+	if !ok {
+		l = &sync.Mutex{}
+		c.locks[u] = l
+	}
+	c.mux.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+func (c *configCache) lastChecked(u string) time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.checked[u]
+}
+
+func (c *configCache) setChecked(u string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.checked[u] = time.Now()
+}
+
+// fetch returns the local path and content of the config at u, downloading it
+// if the cached copy is missing or changed on the server.
+func (c *configCache) fetch(ctx context.Context, u string) (string, []byte, error) {
+	local, err := c.localPath(u)
+	if err != nil {
+		return "", nil, err
+	}
+	defer c.lock(u)()
+	pin := c.pins[u]
+	cached, meta := c.readCached(local)
+	if cached != nil && len(pin) > 0 && meta.SHA256 != pin {
+		cached = nil
+	}
+	if cached != nil && time.Since(c.lastChecked(u)) < c.maxAge {
+		return local, cached, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	if cached != nil {
+		if len(meta.ETag) > 0 {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if len(meta.LastModified) > 0 {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return c.offline(u, local, cached, err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		c.setChecked(u)
+		return local, cached, nil
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return c.offline(u, local, cached, fmt.Errorf("unexpected status %s", resp.Status))
+	case resp.StatusCode != http.StatusOK:
+		return "", nil, fmt.Errorf("failed to download config %s: unexpected status %s", u, resp.Status)
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxConfigSize+1))
+	if err != nil {
+		return c.offline(u, local, cached, err)
+	}
+	if len(content) > maxConfigSize {
+		return "", nil, fmt.Errorf("config %s is larger than %d bytes", u, maxConfigSize)
+	}
+	sum := sha256.Sum256(content)
+	meta = configMeta{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		SHA256:       hex.EncodeToString(sum[:]),
+	}
+	if len(pin) > 0 && meta.SHA256 != pin {
+		return "", nil, fmt.Errorf("config %s has sha256 %s, expected %s", u, meta.SHA256, pin)
+	}
+	if err := c.writeCached(local, content, &meta); err != nil {
+		return "", nil, fmt.Errorf("failed to cache config %s: %w", u, err)
+	}
+	c.setChecked(u)
+	klog.V(4).Infof("cached config %s to %s, sha256 %s", u, local, meta.SHA256)
+	return local, content, nil
+}
+
+// offline returns the last good copy of u, if any, when it cannot be downloaded.
+func (c *configCache) offline(u, local string, cached []byte, err error) (string, []byte, error) {
+	if cached == nil {
+		return "", nil, fmt.Errorf("failed to download config %s: %w", u, err)
+	}
+	klog.Warningf("failed to download config %s, using the cached copy: %v", u, err)
+	return local, cached, nil
+}
+
+// localPath maps u to <dir>/<scheme>/<host>/<path>, so that relative paths
+// between configs of a server are kept.
+func (c *configCache) localPath(u string) (string, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	p := path.Clean("/" + parsed.Path)
+	if p == "/" || len(parsed.Host) == 0 || strings.ContainsAny(parsed.Host, `/\`) {
+		return "", fmt.Errorf("invalid config URL %s", u)
+	}
+	host := strings.ReplaceAll(parsed.Host, ":", "_")
+	return filepath.Join(c.dir, parsed.Scheme, host, filepath.FromSlash(p)), nil
+}
+
+func (c *configCache) readCached(local string) ([]byte, configMeta) {
+	var meta configMeta
+	b, err := ioutil.ReadFile(local + ".meta")
+	if err != nil || json.Unmarshal(b, &meta) != nil {
+		return nil, meta
+	}
+	content, err := ioutil.ReadFile(local)
+	if err != nil {
+		return nil, meta
+	}
+	// a copy modified on disk is not a good copy
+	if sum := sha256.Sum256(content); hex.EncodeToString(sum[:]) != meta.SHA256 {
+		return nil, meta
+	}
+	return content, meta
+}
+
+func (c *configCache) writeCached(local string, content []byte, meta *configMeta) error {
+	if err := os.MkdirAll(filepath.Dir(local), 0700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(local, content); err != nil {
+		return err
+	}
+	return writeFileAtomic(local+".meta", b)
+}
+
+func writeFileAtomic(name string, content []byte) error {
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// configIncludes returns the URLs of the configs included by the config at
+// base by relative path, with #include or a *config_filename key.
+func configIncludes(base string, content []byte) ([]string, error) {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	var refs []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		var ref string
+		switch {
+		case strings.HasPrefix(line, "#include "):
+			ref = strings.TrimSpace(strings.TrimPrefix(line, "#include "))
+		case strings.HasPrefix(line, "#"):
+			continue
+		default:
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) == 2 && strings.HasSuffix(strings.TrimSpace(kv[0]), "config_filename") {
+				ref = strings.TrimSpace(kv[1])
+			}
+		}
+		// absolute paths and URLs are left to the commands
+		if len(ref) == 0 || strings.HasPrefix(ref, "/") || strings.Contains(ref, "://") {
+			continue
+		}
+		u, err := baseURL.Parse(ref)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include %q in %s: %w", ref, base, err)
+		}
+		refs = append(refs, u.String())
+	}
+	return refs, scanner.Err()
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// configServer serves files with an ETag of their content and counts the
+// requests answered with a body.
+type configServer struct {
+	mux         sync.Mutex
+	files       map[string]string
+	downloads   int
+	unavailable bool
+}
+
+func (s *configServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.unavailable {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	content, ok := s.files[r.URL.Path]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	sum := sha256.Sum256([]byte(content))
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	s.downloads++
+	w.Header().Set("ETag", etag)
+	_, _ = w.Write([]byte(content))
+}
+
+func (s *configServer) set(name, content string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.files[name] = content
+}
+
+func TestConfigCache(t *testing.T) {
+	ctx := context.Background()
+	srv := &configServer{files: map[string]string{
+		"/fastcfs/fcfs/fuse.conf":       "#include ../auth/auth.conf\n[FastDIR]\ncluster_config_filename = ../fdir/cluster.conf\nowner_type = caller\n",
+		"/fastcfs/auth/auth.conf":       "# #include ../missing.conf\nclient_config_filename = client.conf\nsecret_key_filename = keys/${username}.key\n",
+		"/fastcfs/auth/client.conf":     "cluster_config_filename = /etc/fastcfs/auth/cluster.conf\n",
+		"/fastcfs/fdir/cluster.conf":    "[server-1]\nhost = 10.0.0.1\n",
+		"/fastcfs/fstore/cluster.conf":  "unused",
+		"/fastcfs/fcfs/unreachable.cfg": "",
+	}}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	fuseConfURL := ts.URL + FuseClientConfigFile
+
+	dir := t.TempDir()
+	c, err := newConfigCache(&ConfigCacheOptions{Dir: dir})
+	require.NoError(t, err)
+
+	local, err := c.get(ctx, fuseConfURL)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "http", strings.ReplaceAll(strings.TrimPrefix(ts.URL, "http://"), ":", "_"), FuseClientConfigFile), local)
+	require.Equal(t, 4, srv.downloads)
+	// the includes resolve within the cache
+	content, err := ioutil.ReadFile(filepath.Join(filepath.Dir(local), "../fdir/cluster.conf"))
+	require.NoError(t, err)
+	require.Equal(t, "[server-1]\nhost = 10.0.0.1\n", string(content))
+	require.FileExists(t, filepath.Join(filepath.Dir(local), "../auth/client.conf"))
+
+	// unchanged files are revalidated with their ETag
+	_, err = c.get(ctx, fuseConfURL)
+	require.NoError(t, err)
+	require.Equal(t, 4, srv.downloads)
+
+	srv.set("/fastcfs/fdir/cluster.conf", "[server-1]\nhost = 10.0.0.2\n")
+	_, err = c.get(ctx, fuseConfURL)
+	require.NoError(t, err)
+	require.Equal(t, 5, srv.downloads)
+	content, err = ioutil.ReadFile(filepath.Join(filepath.Dir(local), "../fdir/cluster.conf"))
+	require.NoError(t, err)
+	require.Contains(t, string(content), "10.0.0.2")
+
+	// the last good copy is used while the server is unavailable
+	srv.mux.Lock()
+	srv.unavailable = true
+	srv.mux.Unlock()
+	offline, err := c.get(ctx, fuseConfURL)
+	require.NoError(t, err)
+	require.Equal(t, local, offline)
+	ts.Close()
+	_, err = c.get(ctx, fuseConfURL)
+	require.NoError(t, err)
+
+	// but not a config which was never downloaded
+	_, err = c.get(ctx, ts.URL+"/fastcfs/fcfs/unreachable.cfg")
+	require.Error(t, err)
+}
+
+func TestConfigCacheChecksum(t *testing.T) {
+	ctx := context.Background()
+	srv := &configServer{files: map[string]string{"/fastcfs/auth/client.conf": "good"}}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	configURL := ts.URL + PoolConfigFile
+	sum := sha256.Sum256([]byte("good"))
+
+	_, err := newConfigCache(&ConfigCacheOptions{Dir: t.TempDir(), Checksums: []string{configURL}})
+	require.Error(t, err)
+	_, err = newConfigCache(&ConfigCacheOptions{Dir: t.TempDir(), Checksums: []string{configURL + "=abc"}})
+	require.Error(t, err)
+
+	c, err := newConfigCache(&ConfigCacheOptions{Dir: t.TempDir(), Checksums: []string{configURL + "=" + hex.EncodeToString(sum[:])}})
+	require.NoError(t, err)
+	local, err := c.get(ctx, configURL)
+	require.NoError(t, err)
+
+	// a changed config is refused and the pinned copy is kept
+	srv.set("/fastcfs/auth/client.conf", "bad")
+	_, err = c.get(ctx, configURL)
+	require.Error(t, err)
+	content, err := ioutil.ReadFile(local)
+	require.NoError(t, err)
+	require.Equal(t, "good", string(content))
+}
+
+func TestConfigCacheSlowServer(t *testing.T) {
+	ctx := context.Background()
+	requested, release := make(chan struct{}), make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(requested)
+		<-release
+		_, _ = w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast := httptest.NewServer(&configServer{files: map[string]string{PoolConfigFile: "fast"}})
+	defer fast.Close()
+
+	c, err := newConfigCache(&ConfigCacheOptions{Dir: t.TempDir()})
+	require.NoError(t, err)
+	go func() { _, _ = c.get(ctx, slow.URL+PoolConfigFile) }()
+	<-requested
+
+	// the download from another server is not held up by the slow one
+	done := make(chan error)
+	go func() {
+		_, err := c.get(ctx, fast.URL+PoolConfigFile)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the download waited for another server")
+	}
+}
+
+func TestLocalConfig(t *testing.T) {
+	defer func() { defaultConfigCache = nil }()
+	ctx := context.Background()
+
+	require.NoError(t, InitConfigCache(&ConfigCacheOptions{}))
+	configURL, err := LocalConfig(ctx, "http://config.example.com"+PoolConfigFile)
+	require.NoError(t, err)
+	require.Equal(t, "http://config.example.com"+PoolConfigFile, configURL)
+
+	require.NoError(t, InitConfigCache(&ConfigCacheOptions{Dir: t.TempDir()}))
+	configURL, err = LocalConfig(ctx, "/etc/fastcfs"+PoolConfigFile)
+	require.NoError(t, err)
+	require.Equal(t, "/etc/fastcfs"+PoolConfigFile, configURL)
+	_, err = LocalConfig(ctx, "http://config.example.com/")
+	require.Error(t, err)
+}
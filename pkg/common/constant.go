@@ -33,6 +33,8 @@ const (
 
 const (
 	FastCFSConfigBasePath = "fastcfs-config-base-path"
+	StaticVolumeKey       = "static"
+	FuseOptionsKey        = "fuse-options"
 	PoolCMD               = "/usr/bin/fcfs_pool"
 	PoolConfigFile        = "/fastcfs/auth/client.conf"
 	FuseClientCMD         = "/usr/bin/fcfs_fused"
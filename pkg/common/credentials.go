@@ -113,6 +113,23 @@ func NewUserCredentials(secrets map[string]string) (*Credentials, error) {
 	return newCredentialsFromSecret(userName, userSecretKey, secrets)
 }
 
+// VolumeUserName returns the user GetCredentialsForVolume picks from secrets.
+func VolumeUserName(pre bool, secrets map[string]string) string {
+	if pre {
+		return secrets[userName]
+	}
+	return secrets[adminName]
+}
+
+// VolumeSecrets returns the user and key of secrets GetCredentialsForVolume picks.
+func VolumeSecrets(pre bool, secrets map[string]string) map[string]string {
+	idField, keyField := adminName, adminSecretKey
+	if pre {
+		idField, keyField = userName, userSecretKey
+	}
+	return map[string]string{idField: secrets[idField], keyField: secrets[keyField]}
+}
+
 func GetCredentialsForVolume(pre bool, secrets map[string]string) (*Credentials, error) {
 	var (
 		err error
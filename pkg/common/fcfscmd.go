@@ -18,8 +18,12 @@ package common
 
 import (
 	"context"
-	"k8s.io/klog/v2"
+	"errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"os/exec"
+	"path/filepath"
+	"time"
 )
 
 func ExecCommand(ctx context.Context, program string, args ...string) ([]byte, error) {
@@ -27,8 +31,28 @@ func ExecCommand(ctx context.Context, program string, args ...string) ([]byte, e
 		cmd           = exec.Command(program, args...)
 		sanitizedArgs = StripSecretInArgs(args)
 	)
-	klog.Infof("command : %s %v", program, sanitizedArgs)
-	return cmd.CombinedOutput()
+	Log(ctx).Infof("command : %s %v", program, sanitizedArgs)
+	_, span := StartSpan(ctx, "exec "+filepath.Base(program),
+		trace.WithAttributes(attribute.StringSlice("exec.args", sanitizedArgs)))
+	start := time.Now()
+	out, err := cmd.CombinedOutput()
+	code := exitCode(err)
+	observeExec(program, code, time.Since(start))
+	span.SetAttributes(attribute.Int("exec.exit_code", code))
+	EndSpan(span, err)
+	return out, err
+}
+
+// exitCode returns the exit code of a finished command, -1 if it did not run.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
 }
 
 func ExecPoolCommand(ctx context.Context, args ...string) ([]byte, error) {
@@ -0,0 +1,281 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// FuseConfigFileName is the name of the per-volume fuse.conf written to the volume base path.
+	FuseConfigFileName = "fuse.conf"
+)
+
+type fuseOptionKind int
+
+const (
+	boolFuseOption fuseOptionKind = iota
+	intFuseOption
+	floatFuseOption
+	enumFuseOption
+	sizeFuseOption
+)
+
+// fuseOption maps an allowed option name to its key in fuse.conf.
+type fuseOption struct {
+	section string
+	key     string
+	kind    fuseOptionKind
+	values  []string // allowed values of enumFuseOption
+}
+
+// allowedFuseOptions is the allow-list of fcfs_fused options which may be set per volume.
+var allowedFuseOptions = map[string]fuseOption{
+	"singlethread":      {section: "FUSE", key: "singlethread", kind: boolFuseOption},
+	"clone_fd":          {section: "FUSE", key: "clone_fd", kind: boolFuseOption},
+	"max_idle_threads":  {section: "FUSE", key: "max_idle_threads", kind: intFuseOption},
+	"allow_others":      {section: "FUSE", key: "allow_others", kind: enumFuseOption, values: []string{"all", "root", ""}},
+	"auto_unmount":      {section: "FUSE", key: "auto_unmount", kind: boolFuseOption},
+	"attribute_timeout": {section: "FUSE", key: "attribute_timeout", kind: floatFuseOption},
+	"entry_timeout":     {section: "FUSE", key: "entry_timeout", kind: floatFuseOption},
+	"xattr_enabled":     {section: "FUSE", key: "xattr_enabled", kind: boolFuseOption},
+	"writeback_cache":   {section: "FUSE", key: "writeback_cache", kind: boolFuseOption},
+	"kernel_cache":      {section: "FUSE", key: "kernel_cache", kind: boolFuseOption},
+
+	"read_ahead":                 {section: "read-ahead", key: "enabled", kind: boolFuseOption},
+	"read_ahead_min_buffer_size": {section: "read-ahead", key: "min_buffer_size", kind: sizeFuseOption},
+	"read_ahead_max_buffer_size": {section: "read-ahead", key: "max_buffer_size", kind: sizeFuseOption},
+	"write_combine":              {section: "write-combine", key: "enabled", kind: boolFuseOption},
+
+	"idempotency":              {section: "idempotency", key: "enabled", kind: boolFuseOption},
+	"use_sys_lock_for_append":  {section: "FastDIR", key: "use_sys_lock_for_append", kind: boolFuseOption},
+	"async_report_enabled":     {section: "FastDIR", key: "async_report_enabled", kind: boolFuseOption},
+	"async_report_interval_ms": {section: "FastDIR", key: "async_report_interval_ms", kind: intFuseOption},
+}
+
+// fuseMountOptionAliases are the libfuse mount options which map to fuse options.
+var fuseMountOptionAliases = map[string]map[string]string{
+	"allow_other": {"allow_others": "all"},
+	"allow_root":  {"allow_others": "root"},
+	// bypass the page cache of the kernel
+	"direct_io": {"kernel_cache": "false", "writeback_cache": "false"},
+}
+
+var fuseSizeRegexp = regexp.MustCompile(`^(?i)[0-9]+([KMGT]B?)?$`)
+
+// SplitFuseMountOptions splits mount options into the fuse options of
+// fcfs_fused and the other options, which are left to the bind mount. A fuse
+// option is given as name=value, or as name for a boolean option set to true.
+func SplitFuseMountOptions(mountOptions []string) (map[string]string, []string, error) {
+	fuseOptions := make(map[string]string)
+	var others []string
+	for _, mountOption := range mountOptions {
+		kv := strings.SplitN(mountOption, "=", 2)
+		name := strings.TrimSpace(kv[0])
+		if alias, ok := fuseMountOptionAliases[name]; ok {
+			if len(kv) == 2 {
+				return nil, nil, fmt.Errorf("fuse mount option %q does not take a value", name)
+			}
+			for k, v := range alias {
+				fuseOptions[k] = v
+			}
+			continue
+		}
+		opt, ok := allowedFuseOptions[name]
+		if !ok {
+			others = append(others, mountOption)
+			continue
+		}
+		value := "true"
+		if len(kv) == 2 {
+			value = strings.TrimSpace(kv[1])
+		} else if opt.kind != boolFuseOption {
+			return nil, nil, fmt.Errorf("fuse option %q requires a value", name)
+		}
+		fuseOptions[name] = value
+	}
+	if err := ValidateFuseOptions(fuseOptions); err != nil {
+		return nil, nil, err
+	}
+	return fuseOptions, others, nil
+}
+
+// ParseFuseOptions parses the comma separated fuse options of the
+// FuseOptionsKey parameter, in the syntax of SplitFuseMountOptions.
+func ParseFuseOptions(value string) (map[string]string, error) {
+	var mountOptions []string
+	for _, opt := range strings.Split(value, ",") {
+		if opt = strings.TrimSpace(opt); len(opt) > 0 {
+			mountOptions = append(mountOptions, opt)
+		}
+	}
+	fuseOptions, others, err := SplitFuseMountOptions(mountOptions)
+	if err != nil {
+		return nil, err
+	}
+	if len(others) > 0 {
+		return nil, fmt.Errorf("fuse options %q are not allowed", others)
+	}
+	return fuseOptions, nil
+}
+
+// ValidateFuseOptions checks every option against the allow-list and the type of its value.
+func ValidateFuseOptions(options map[string]string) error {
+	for name, value := range options {
+		opt, ok := allowedFuseOptions[name]
+		if !ok {
+			return fmt.Errorf("fuse option %q is not allowed", name)
+		}
+		if err := opt.validate(value); err != nil {
+			return fmt.Errorf("invalid value %q of fuse option %q: %w", value, name, err)
+		}
+	}
+	return nil
+}
+
+func (o fuseOption) validate(value string) error {
+	var err error
+	switch o.kind {
+	case boolFuseOption:
+		_, err = strconv.ParseBool(value)
+	case intFuseOption:
+		var v int64
+		if v, err = strconv.ParseInt(value, 10, 32); err == nil && v < 0 {
+			err = fmt.Errorf("must not be negative")
+		}
+	case floatFuseOption:
+		var v float64
+		if v, err = strconv.ParseFloat(value, 64); err == nil && v < 0 {
+			err = fmt.Errorf("must not be negative")
+		}
+	case enumFuseOption:
+		for _, allowed := range o.values {
+			if value == allowed {
+				return nil
+			}
+		}
+		err = fmt.Errorf("must be one of %q", o.values)
+	case sizeFuseOption:
+		if !fuseSizeRegexp.MatchString(value) {
+			err = fmt.Errorf("must be a size such as 64KB or 1MB")
+		}
+	}
+	return err
+}
+
+// RenderFuseConfig writes a copy of the fuse.conf at src to dst with the given
+// options applied. Relative paths in src are rewritten to absolute ones, so that
+// dst may live outside of the shared config tree.
+func RenderFuseConfig(src, dst string, options map[string]string) error {
+	if err := ValidateFuseOptions(options); err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("failed to read fuse config %s: %w", src, err)
+	}
+
+	// section -> key -> value, removed once written
+	pending := make(map[string]map[string]string)
+	for name, value := range options {
+		opt := allowedFuseOptions[name]
+		if pending[opt.section] == nil {
+			pending[opt.section] = make(map[string]string)
+		}
+		pending[opt.section][opt.key] = value
+	}
+
+	var (
+		out     bytes.Buffer
+		section string
+		srcDir  = filepath.Dir(src)
+	)
+	flush := func() {
+		writeFuseConfigKeys(&out, pending[section])
+		delete(pending, section)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]"):
+			flush()
+			section = strings.TrimSpace(trimmed[1 : len(trimmed)-1])
+		case strings.HasPrefix(trimmed, "#include "):
+			line = "#include " + absConfigPath(srcDir, strings.TrimSpace(strings.TrimPrefix(trimmed, "#include ")))
+		case len(trimmed) > 0 && !strings.HasPrefix(trimmed, "#") && strings.Contains(trimmed, "="):
+			kv := strings.SplitN(trimmed, "=", 2)
+			key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+			if v, ok := pending[section][key]; ok {
+				value = v
+				delete(pending[section], key)
+			} else {
+				value = absConfigPath(srcDir, value)
+			}
+			line = fmt.Sprintf("%s = %s", key, value)
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to parse fuse config %s: %w", src, err)
+	}
+	flush()
+
+	sections := make([]string, 0, len(pending))
+	for s := range pending {
+		sections = append(sections, s)
+	}
+	sort.Strings(sections)
+	for _, s := range sections {
+		if len(pending[s]) == 0 {
+			continue
+		}
+		fmt.Fprintf(&out, "\n[%s]\n", s)
+		writeFuseConfigKeys(&out, pending[s])
+	}
+
+	return ioutil.WriteFile(dst, out.Bytes(), 0600)
+}
+
+func writeFuseConfigKeys(out *bytes.Buffer, keys map[string]string) {
+	names := make([]string, 0, len(keys))
+	for k := range keys {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		fmt.Fprintf(out, "%s = %s\n", k, keys[k])
+	}
+}
+
+// absConfigPath resolves config values such as "../auth/client.conf" against dir.
+func absConfigPath(dir, value string) string {
+	if strings.HasPrefix(value, "./") || strings.HasPrefix(value, "../") {
+		return filepath.Join(dir, value)
+	}
+	return value
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateFuseOptions(t *testing.T) {
+	tests := []struct {
+		options map[string]string
+		wantErr bool
+	}{
+		{options: nil},
+		{options: map[string]string{"attribute_timeout": "1.5", "singlethread": "true", "allow_others": "root"}},
+		{options: map[string]string{"max_idle_threads": "-1"}, wantErr: true},
+		{options: map[string]string{"allow_others": "everyone"}, wantErr: true},
+		{options: map[string]string{"clone_fd": "yes please"}, wantErr: true},
+		{options: map[string]string{"unknown": "1"}, wantErr: true},
+	}
+	for i, test := range tests {
+		err := ValidateFuseOptions(test.options)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%d: ValidateFuseOptions(%v) error = %v, wantErr %v", i, test.options, err, test.wantErr)
+		}
+	}
+}
+
+func TestSplitFuseMountOptions(t *testing.T) {
+	tests := []struct {
+		mountOptions []string
+		fuseOptions  map[string]string
+		others       []string
+		wantErr      bool
+	}{
+		{
+			mountOptions: []string{"noexec", "ro"},
+			fuseOptions:  map[string]string{},
+			others:       []string{"noexec", "ro"},
+		},
+		{
+			mountOptions: []string{"allow_other", "attribute_timeout=0.5", "read_ahead_max_buffer_size=2MB", "singlethread", "nosuid"},
+			fuseOptions: map[string]string{
+				"allow_others": "all", "attribute_timeout": "0.5", "read_ahead_max_buffer_size": "2MB", "singlethread": "true",
+			},
+			others: []string{"nosuid"},
+		},
+		{
+			mountOptions: []string{"direct_io", "kernel_cache=true"},
+			fuseOptions:  map[string]string{"kernel_cache": "true", "writeback_cache": "false"},
+		},
+		{mountOptions: []string{"entry_timeout"}, wantErr: true},
+		{mountOptions: []string{"allow_other=1"}, wantErr: true},
+		{mountOptions: []string{"read_ahead_min_buffer_size=lots"}, wantErr: true},
+	}
+	for i, test := range tests {
+		fuseOptions, others, err := SplitFuseMountOptions(test.mountOptions)
+		if test.wantErr {
+			require.Error(t, err, i)
+			continue
+		}
+		require.NoError(t, err, i)
+		require.Equal(t, test.fuseOptions, fuseOptions, i)
+		require.Equal(t, test.others, others, i)
+	}
+}
+
+func TestParseFuseOptions(t *testing.T) {
+	options, err := ParseFuseOptions("")
+	require.NoError(t, err)
+	require.Empty(t, options)
+
+	options, err = ParseFuseOptions("allow_root, max_idle_threads=20,")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"allow_others": "root", "max_idle_threads": "20"}, options)
+
+	_, err = ParseFuseOptions("entry_timeout=1,noexec")
+	require.Error(t, err)
+}
+
+func TestRenderFuseConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fuseconf")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "fcfs", "fuse.conf")
+	require.NoError(t, os.MkdirAll(filepath.Dir(src), 0755))
+	require.NoError(t, ioutil.WriteFile(src, []byte(`# fuse config
+#include ../common.conf
+
+[FastDIR]
+cluster_config_filename = ../fdir/cluster.conf
+
+[FUSE]
+entry_timeout = 5.0
+singlethread=false
+`), 0644))
+
+	dst := filepath.Join(dir, "fuse.conf")
+	require.NoError(t, RenderFuseConfig(src, dst, map[string]string{
+		"entry_timeout":    "1.0",
+		"max_idle_threads": "20",
+	}))
+
+	content, err := ioutil.ReadFile(dst)
+	require.NoError(t, err)
+	require.Equal(t, `# fuse config
+#include `+filepath.Join(dir, "common.conf")+`
+
+[FastDIR]
+cluster_config_filename = `+filepath.Join(dir, "fdir", "cluster.conf")+`
+
+[FUSE]
+entry_timeout = 1.0
+singlethread = false
+max_idle_threads = 20
+`, string(content))
+
+	require.Error(t, RenderFuseConfig(src, dst, map[string]string{"mountpoint": "/"}))
+}
@@ -52,6 +52,7 @@ func (vl *VolumeLocks) TryAcquire(volumeID string) bool {
 		return false
 	}
 	vl.locks.Insert(volumeID)
+	volumeLocksHeld.Inc()
 	return true
 }
 
@@ -59,7 +60,10 @@ func (vl *VolumeLocks) TryAcquire(volumeID string) bool {
 func (vl *VolumeLocks) Release(volumeID string) {
 	vl.mux.Lock()
 	defer vl.mux.Unlock()
-	vl.locks.Delete(volumeID)
+	if vl.locks.Has(volumeID) {
+		vl.locks.Delete(volumeID)
+		volumeLocksHeld.Dec()
+	}
 }
 
 type operation string
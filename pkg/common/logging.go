@@ -0,0 +1,187 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"k8s.io/klog/v2"
+)
+
+// Log formats
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+const (
+	// RequestIDMetadataKey is the gRPC metadata key the request ID is propagated in.
+	RequestIDMetadataKey = "x-request-id"
+
+	requestIDLogKey = "requestID"
+	severityLogKey  = "severity"
+)
+
+// jsonLogging is set if klog writes JSON, whose lines carry no severity.
+var jsonLogging bool
+
+type requestIDKey struct{}
+
+// SetLogFormat switches klog to format, the default is text.
+func SetLogFormat(format string) error {
+	switch format {
+	case LogFormatText:
+	case LogFormatJSON:
+		klog.SetLogger(newJSONLogger(os.Stderr))
+		jsonLogging = true
+	default:
+		return fmt.Errorf("unknown log format %q, must be %s or %s", format, LogFormatText, LogFormatJSON)
+	}
+	return nil
+}
+
+// newJSONLogger returns a logger writing a JSON object per line to w.
+func newJSONLogger(w io.Writer) logr.Logger {
+	logger := funcr.NewJSON(func(obj string) {
+		fmt.Fprintln(w, obj)
+	}, funcr.Options{LogTimestamp: true})
+	return logr.New(jsonSink{logger.GetSink()})
+}
+
+// jsonSink drops the newline klog appends to printf style messages.
+type jsonSink struct {
+	logr.LogSink
+}
+
+func (s jsonSink) Info(level int, msg string, keysAndValues ...interface{}) {
+	s.LogSink.Info(level, strings.TrimSuffix(msg, "\n"), keysAndValues...)
+}
+
+func (s jsonSink) Error(err error, msg string, keysAndValues ...interface{}) {
+	s.LogSink.Error(err, strings.TrimSuffix(msg, "\n"), keysAndValues...)
+}
+
+func (s jsonSink) WithValues(keysAndValues ...interface{}) logr.LogSink {
+	return jsonSink{s.LogSink.WithValues(keysAndValues...)}
+}
+
+func (s jsonSink) WithName(name string) logr.LogSink {
+	return jsonSink{s.LogSink.WithName(name)}
+}
+
+// NewRequestID returns a random request ID.
+func NewRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// WithRequestID returns a copy of ctx carrying the request ID.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestIDFromContext returns the request ID of ctx, empty if none.
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// RequestIDServerInterceptor puts the request ID propagated in the request
+// metadata, or a new one, into the context of the handler.
+func RequestIDServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var requestID string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(RequestIDMetadataKey); len(values) > 0 {
+			requestID = values[0]
+		}
+	}
+	if len(requestID) == 0 {
+		requestID = NewRequestID()
+	}
+	return handler(WithRequestID(ctx, requestID), req)
+}
+
+// RequestIDClientInterceptor propagates the request ID of ctx in the request metadata.
+func RequestIDClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if requestID := RequestIDFromContext(ctx); len(requestID) > 0 {
+		ctx = metadata.AppendToOutgoingContext(ctx, RequestIDMetadataKey, requestID)
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// Logger logs printf style messages tagged with the request ID of a context.
+// Lines with a request ID are structured. Structured klog has no warning
+// severity, so warnings carry the request ID in the message in text format,
+// and a severity key in JSON format.
+type Logger struct {
+	verbose   klog.Verbose
+	requestID string
+}
+
+// Log returns the Logger of ctx.
+func Log(ctx context.Context) Logger {
+	return Logger{verbose: klog.V(0), requestID: RequestIDFromContext(ctx)}
+}
+
+// V returns a Logger logging only if the verbosity is at least level.
+func (l Logger) V(level klog.Level) Logger {
+	l.verbose = klog.V(level)
+	return l
+}
+
+func (l Logger) Infof(format string, args ...interface{}) {
+	if !l.verbose.Enabled() {
+		return
+	}
+	if len(l.requestID) == 0 {
+		klog.InfoDepth(1, fmt.Sprintf(format, args...))
+		return
+	}
+	klog.InfoSDepth(1, fmt.Sprintf(format, args...), requestIDLogKey, l.requestID)
+}
+
+func (l Logger) Warningf(format string, args ...interface{}) {
+	switch {
+	case len(l.requestID) == 0:
+		klog.WarningDepth(1, fmt.Sprintf(format, args...))
+	case jsonLogging:
+		klog.InfoSDepth(1, fmt.Sprintf(format, args...), requestIDLogKey, l.requestID, severityLogKey, "warning")
+	default:
+		klog.WarningDepth(1, fmt.Sprintf("%s %s=%q", fmt.Sprintf(format, args...), requestIDLogKey, l.requestID))
+	}
+}
+
+func (l Logger) Errorf(format string, args ...interface{}) {
+	if len(l.requestID) == 0 {
+		klog.ErrorDepth(1, fmt.Sprintf(format, args...))
+		return
+	}
+	klog.ErrorSDepth(1, nil, fmt.Sprintf(format, args...), requestIDLogKey, l.requestID)
+}
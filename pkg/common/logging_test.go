@@ -0,0 +1,105 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"k8s.io/klog/v2"
+)
+
+func TestRequestIDPropagation(t *testing.T) {
+	var proxyRequestID string
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		proxyRequestID = RequestIDFromContext(ctx)
+		return nil, nil
+	}
+	// hands the outgoing metadata of the client over to the server as gRPC would
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		_, err := RequestIDServerInterceptor(metadata.NewIncomingContext(context.Background(), md), req,
+			&grpc.UnaryServerInfo{FullMethod: method}, handler)
+		return err
+	}
+
+	var csiRequestID string
+	_, err := RequestIDServerInterceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeStageVolume"},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			csiRequestID = RequestIDFromContext(ctx)
+			return nil, RequestIDClientInterceptor(ctx, "/MountService/MountFcfsFused", nil, nil, nil, invoker)
+		})
+	require.NoError(t, err)
+	require.Len(t, csiRequestID, 16)
+	require.Equal(t, csiRequestID, proxyRequestID)
+}
+
+func TestJSONLogFormat(t *testing.T) {
+	var buf bytes.Buffer
+	klog.SetLogger(newJSONLogger(&buf))
+	jsonLogging = true
+	defer func() {
+		klog.ClearLogger()
+		jsonLogging = false
+	}()
+
+	Log(WithRequestID(context.Background(), "0123456789abcdef")).Infof("mounting volume %s", "csi-vol-1")
+	klog.Infof("serving on %s", "/csi/csi.sock")
+	Log(WithRequestID(context.Background(), "0123456789abcdef")).Warningf("falling back to direct mount")
+	klog.Flush()
+
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		line := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line), scanner.Text())
+		lines = append(lines, line)
+	}
+	require.Len(t, lines, 3)
+	require.Equal(t, "mounting volume csi-vol-1", lines[0]["msg"])
+	require.Equal(t, "0123456789abcdef", lines[0]["requestID"])
+	require.Equal(t, "serving on /csi/csi.sock", lines[1]["msg"])
+	require.NotContains(t, lines[1], "requestID")
+	require.Equal(t, "warning", lines[2]["severity"])
+	require.Equal(t, "0123456789abcdef", lines[2]["requestID"])
+}
+
+func TestTextLogWarning(t *testing.T) {
+	var buf bytes.Buffer
+	klog.LogToStderr(false)
+	klog.SetOutput(&buf)
+	t.Cleanup(func() {
+		klog.SetOutput(os.Stderr)
+		klog.LogToStderr(true)
+	})
+
+	Log(WithRequestID(context.Background(), "0123456789abcdef")).Warningf("falling back to direct mount")
+	klog.Flush()
+	require.Regexp(t, `^W.* falling back to direct mount requestID="0123456789abcdef"\n`, buf.String())
+}
+
+func TestSetLogFormat(t *testing.T) {
+	require.NoError(t, SetLogFormat(LogFormatText))
+	require.Error(t, SetLogFormat("xml"))
+}
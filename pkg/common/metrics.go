@@ -0,0 +1,108 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// MetricsNamespace prefixes the name of every metric.
+	MetricsNamespace = "fcfs_csi"
+	// MetricsPath is the path metrics are served on by the http endpoint.
+	MetricsPath = "/metrics"
+)
+
+var (
+	// MetricsRegistry holds every metric of the plugin.
+	MetricsRegistry = prometheus.NewRegistry()
+
+	grpcRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "grpc_request_duration_seconds",
+		Help:      "Duration of CSI gRPC requests.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"method"})
+
+	grpcRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "grpc_requests_total",
+		Help:      "Number of CSI gRPC requests by status code.",
+	}, []string{"method", "code"})
+
+	execDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "exec_duration_seconds",
+		Help:      "Duration of fcfs_pool and fcfs_fused commands.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"program"})
+
+	execTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "exec_total",
+		Help:      "Number of fcfs_pool and fcfs_fused commands by exit code, -1 if the command could not be run.",
+	}, []string{"program", "exit_code"})
+
+	volumeLocksHeld = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "volume_locks_held",
+		Help:      "Number of volume locks currently held.",
+	})
+)
+
+func init() {
+	MetricsRegistry.MustRegister(
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		prometheus.NewGoCollector(),
+		grpcRequestDuration,
+		grpcRequestsTotal,
+		execDuration,
+		execTotal,
+		volumeLocksHeld,
+	)
+}
+
+// ObserveGRPCRequest records a finished gRPC request.
+func ObserveGRPCRequest(method, code string, duration time.Duration) {
+	grpcRequestDuration.WithLabelValues(method).Observe(duration.Seconds())
+	grpcRequestsTotal.WithLabelValues(method, code).Inc()
+}
+
+func observeExec(program string, exitCode int, duration time.Duration) {
+	program = filepath.Base(program)
+	execDuration.WithLabelValues(program).Observe(duration.Seconds())
+	execTotal.WithLabelValues(program, strconv.Itoa(exitCode)).Inc()
+}
+
+// ServeMetrics serves MetricsRegistry on endpoint (host:port) in the background.
+func ServeMetrics(endpoint string) {
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, promhttp.HandlerFor(MetricsRegistry, promhttp.HandlerOpts{}))
+	go func() {
+		klog.Infof("Serving metrics on %s%s", endpoint, MetricsPath)
+		if err := http.ListenAndServe(endpoint, mux); err != nil {
+			klog.Fatalf("Failed to serve metrics on %s: %v", endpoint, err)
+		}
+	}()
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVolumeLocksMetric(t *testing.T) {
+	held := testutil.ToFloat64(volumeLocksHeld)
+	locks := NewVolumeLocks()
+
+	require.True(t, locks.TryAcquire("vol-1"))
+	require.False(t, locks.TryAcquire("vol-1"))
+	require.True(t, locks.TryAcquire("vol-2"))
+	require.Equal(t, held+2, testutil.ToFloat64(volumeLocksHeld))
+
+	locks.Release("vol-1")
+	locks.Release("vol-1")
+	require.Equal(t, held+1, testutil.ToFloat64(volumeLocksHeld))
+	locks.Release("vol-2")
+	require.Equal(t, held, testutil.ToFloat64(volumeLocksHeld))
+}
+
+func TestExecCommandMetrics(t *testing.T) {
+	testCases := []struct {
+		name     string
+		program  string
+		args     []string
+		exitCode string
+	}{
+		{name: "success", program: "/bin/sh", args: []string{"-c", "exit 0"}, exitCode: "0"},
+		{name: "failure", program: "/bin/sh", args: []string{"-c", "exit 3"}, exitCode: "3"},
+		{name: "not found", program: "/nonexistent/fcfs_pool", exitCode: "-1"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			counter := execTotal.WithLabelValues(filepath.Base(tc.program), tc.exitCode)
+			before := testutil.ToFloat64(counter)
+			_, _ = ExecCommand(context.TODO(), tc.program, tc.args...)
+			require.Equal(t, before+1, testutil.ToFloat64(counter))
+		})
+	}
+}
+
+func TestObserveGRPCRequest(t *testing.T) {
+	counter := grpcRequestsTotal.WithLabelValues("/csi.v1.Node/NodeStageVolume", "Aborted")
+	before := testutil.ToFloat64(counter)
+	ObserveGRPCRequest("/csi.v1.Node/NodeStageVolume", "Aborted", time.Second)
+	require.Equal(t, before+1, testutil.ToFloat64(counter))
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSOptions describes the certificates used to secure a gRPC connection
+// between the node plugin and the fcfsfused-proxy.
+type TLSOptions struct {
+	Enable     bool
+	CertFile   string // certificate presented to the peer
+	KeyFile    string // private key of CertFile
+	CAFile     string // CA bundle used to verify the peer
+	ServerName string // expected server name, client side only
+}
+
+// ServerConfig returns the tls.Config of the serving side. Client certificates
+// are required and verified against CAFile when it is set (mutual TLS).
+func (o *TLSOptions) ServerConfig() (*tls.Config, error) {
+	if len(o.CertFile) == 0 || len(o.KeyFile) == 0 {
+		return nil, errors.New("TLS certificate and key files must be set")
+	}
+	cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS key pair: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if len(o.CAFile) > 0 {
+		pool, err := loadCertPool(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ClientConfig returns the tls.Config of the dialing side. The client
+// certificate is only presented when both CertFile and KeyFile are set.
+func (o *TLSOptions) ClientConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: o.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(o.CAFile) > 0 {
+		pool, err := loadCertPool(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if len(o.CertFile) > 0 || len(o.KeyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS key pair: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file %s: %w", caFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no valid certificate found in CA file %s", caFile)
+	}
+	return pool, nil
+}
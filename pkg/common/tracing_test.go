@@ -0,0 +1,72 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestTracingPropagation(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		_, err := ExecCommand(ctx, "/bin/sh", "-c", "exit 0")
+		return nil, err
+	}
+	// hands the outgoing metadata of the client over to the server as gRPC would
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		_, err := TracingServerInterceptor(metadata.NewIncomingContext(context.Background(), md), req,
+			&grpc.UnaryServerInfo{FullMethod: method}, handler)
+		return err
+	}
+
+	ctx, root := StartSpan(context.Background(), "NodeStageVolume")
+	err := TracingClientInterceptor(ctx, "/MountService/MountFcfsFused", nil, nil, nil, invoker)
+	require.NoError(t, err)
+	root.End()
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 4)
+	// ended innermost first: exec, server, client, root
+	require.Equal(t, "exec sh", spans[0].Name())
+	require.Equal(t, "/MountService/MountFcfsFused", spans[1].Name())
+	require.Equal(t, "/MountService/MountFcfsFused", spans[2].Name())
+	require.Equal(t, "NodeStageVolume", spans[3].Name())
+	for i := 0; i < 3; i++ {
+		require.Equal(t, spans[i+1].SpanContext().SpanID(), spans[i].Parent().SpanID(), spans[i].Name())
+		require.Equal(t, root.SpanContext().TraceID(), spans[i].SpanContext().TraceID())
+	}
+	require.True(t, spans[1].Parent().IsRemote())
+}
+
+func TestInitTracingDisabled(t *testing.T) {
+	shutdown, err := InitTracing(context.Background(), "test", &TracingOptions{})
+	require.NoError(t, err)
+	require.NoError(t, shutdown(context.Background()))
+}
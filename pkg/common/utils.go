@@ -1,6 +1,8 @@
 package common
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"io/ioutil"
@@ -8,13 +10,42 @@ import (
 	utilpath "k8s.io/utils/path"
 	"math"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 )
 
 func BuildBasePath(suffix string) string {
 	return fmt.Sprintf("%s/%s", ClientBasePath, suffix)
 }
 
+// SharedPoolBasePath returns the base path of the fcfs_fused mounting the
+// volume volID of the pool volName, which other volumes on the node may mount
+// as well. fcfs_fused restarts the instance of its base path, so each volume
+// gets its own, keyed by a hash of volID. They are kept apart from the base
+// paths of pools, which no pool name can collide with.
+func SharedPoolBasePath(volName, volID string) string {
+	sum := sha256.Sum256([]byte(volID))
+	return filepath.Join(ClientBasePath, SharedPoolDirName, volName+"-"+hex.EncodeToString(sum[:8]))
+}
+
+// IsBasePathOf reports whether basePath is the base path of the pool volName,
+// or of a volume sharing it.
+func IsBasePathOf(basePath, volName string) bool {
+	if basePath == BuildBasePath(volName) {
+		return true
+	}
+	if filepath.Dir(basePath) != filepath.Join(ClientBasePath, SharedPoolDirName) {
+		return false
+	}
+	suffix := strings.TrimPrefix(filepath.Base(basePath), volName+"-")
+	if len(suffix) != 16 || len(suffix) == len(filepath.Base(basePath)) {
+		return false
+	}
+	_, err := hex.DecodeString(suffix)
+	return err == nil
+}
+
 func getPidFromBasePath(filepath string) (int, error) {
 	pidFileBytes, err := ioutil.ReadFile(filepath)
 	if err != nil {
@@ -23,3 +23,23 @@ func TestRoundOffBytes(t *testing.T) {
 		t.Fatalf("Wrong result for RoundOffBytes. Got: %d", actual)
 	}
 }
+
+func TestIsBasePathOf(t *testing.T) {
+	shared := SharedPoolBasePath("legacy-app", "legacy-app#app-1")
+	if shared == SharedPoolBasePath("legacy-app", "legacy-app#app-2") {
+		t.Fatalf("volumes sharing a pool got the same base path %s", shared)
+	}
+	for basePath, want := range map[string]bool{
+		"/opt/fastcfs/legacy-app": true,
+		shared:                    true,
+		"/opt/fastcfs/legacy":     false,
+		SharedPoolBasePath("legacy", "legacy#app-1"):         false,
+		"/opt/fastcfs/_shared/legacy-app-0123":               false,
+		"/opt/fastcfs/_shared/legacy-app-0123456789abcdeg":   false,
+		"/opt/fastcfs/_shared/x/legacy-app-0123456789abcdef": false,
+	} {
+		if got := IsBasePathOf(basePath, "legacy-app"); got != want {
+			t.Errorf("IsBasePathOf(%s) = %v, want %v", basePath, got, want)
+		}
+	}
+}
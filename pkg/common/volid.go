@@ -35,7 +35,7 @@ type CSIIdentifier struct {
 
 type CSIIdentifierDecompose struct {
 	composedCSIID string
-	cursor        uint16
+	cursor        int
 }
 
 func (cid *CSIIdentifier) BasePath() string {
@@ -76,7 +76,7 @@ func (cid *CSIIdentifier) DecomposeCSIID(composedCSIID string) (err error) {
 
 	cidd := &CSIIdentifierDecompose{
 		composedCSIID: composedCSIID,
-		cursor:        uint16(0),
+		cursor:        0,
 	}
 
 	cid.ClusterID, err = cidd.next()
@@ -95,13 +95,20 @@ func (cid *CSIIdentifier) DecomposeCSIID(composedCSIID string) (err error) {
 }
 
 func (cidd *CSIIdentifierDecompose) next() (string, error) {
+	if cidd.cursor+4 > len(cidd.composedCSIID) {
+		return "", fmt.Errorf("CSI ID %q is too short", cidd.composedCSIID)
+	}
 	buf16, err := hex.DecodeString(cidd.composedCSIID[cidd.cursor : cidd.cursor+4])
 	if err != nil {
 		return "", err
 	}
-	clusterIDLength := binary.BigEndian.Uint16(buf16)
+	// the arithmetic is done in int, the uint16 length would wrap around
+	length := int(binary.BigEndian.Uint16(buf16))
 	cidd.cursor += 5
-	end := cidd.cursor + clusterIDLength
+	end := cidd.cursor + length
+	if end < cidd.cursor || end > len(cidd.composedCSIID) {
+		return "", fmt.Errorf("CSI ID %q is too short", cidd.composedCSIID)
+	}
 	s := cidd.composedCSIID[cidd.cursor:end]
 	cidd.cursor = end + 1
 	return s, nil
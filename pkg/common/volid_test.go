@@ -41,3 +41,10 @@ func TestComposeCSIID(t *testing.T) {
 	assert.Equal(t, cid.UserName, decid.UserName)
 	assert.Equal(t, cid.VolName, decid.VolName)
 }
+
+func TestDecomposeInvalidCSIID(t *testing.T) {
+	for _, volID := range []string{"", "pvc", "0010-short", "0001-1-0005-admin-00ff-csi-vol-1", "zzzz-1", "fffe-abc", "ffff-abc"} {
+		err := (&CSIIdentifier{}).DecomposeCSIID(volID)
+		assert.Error(t, err, volID)
+	}
+}
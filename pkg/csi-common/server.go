@@ -25,6 +25,7 @@ import (
 
 	"google.golang.org/grpc"
 	"k8s.io/klog/v2"
+	"vazmin.github.io/fastcfs-csi/pkg/common"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 )
@@ -90,7 +91,7 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 	}
 
 	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(logGRPC),
+		grpc.ChainUnaryInterceptor(common.RequestIDServerInterceptor, common.TracingServerInterceptor, logGRPC),
 	}
 	server := grpc.NewServer(opts...)
 	s.server = server
@@ -19,13 +19,16 @@ package csicommon
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"context"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
+	"vazmin.github.io/fastcfs-csi/pkg/common"
 )
 
 func ParseEndpoint(ep string) (string, string, error) {
@@ -116,14 +119,17 @@ func getLogLevel(method string) int32 {
 
 func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 	level := klog.Level(getLogLevel(info.FullMethod))
-	klog.V(level).Infof("GRPC call: %s", info.FullMethod)
-	klog.V(level).Infof("GRPC request: %s", protosanitizer.StripSecrets(req))
+	logger := common.Log(ctx)
+	logger.V(level).Infof("GRPC call: %s", info.FullMethod)
+	logger.V(level).Infof("GRPC request: %s", protosanitizer.StripSecrets(req))
 
+	start := time.Now()
 	resp, err := handler(ctx, req)
+	common.ObserveGRPCRequest(info.FullMethod, status.Code(err).String(), time.Since(start))
 	if err != nil {
-		klog.Errorf("GRPC error: %v", err)
+		logger.Errorf("GRPC error: %v", err)
 	} else {
-		klog.V(level).Infof("GRPC response: %s", protosanitizer.StripSecrets(resp))
+		logger.V(level).Infof("GRPC response: %s", protosanitizer.StripSecrets(resp))
 	}
 	return resp, err
 }
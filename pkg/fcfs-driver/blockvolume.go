@@ -0,0 +1,189 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+)
+
+// A block volume is a pool holding a sparse image file, which the node stages
+// on a loop device and publishes by bind-mounting the device file.
+const (
+	// blockImageName is the image file in the root of the pool of a block volume.
+	blockImageName = "block.img"
+	// imageSizeKey is the volume context key of the size of the image created on
+	// the first stage, CreateVolume sets it for block volumes.
+	imageSizeKey = "image-size"
+)
+
+// errBlockImageMissing is returned by ensureBlockImage if the image does not
+// exist and its size is not known.
+var errBlockImageMissing = errors.New("block image does not exist")
+
+func isBlock(volCap *csi.VolumeCapability) bool {
+	return volCap.GetBlock() != nil
+}
+
+// validateBlockCapability refuses block access from writers on several nodes,
+// as the loop devices of different nodes do not share their page cache.
+func validateBlockCapability(volCap *csi.VolumeCapability) error {
+	if !isBlock(volCap) {
+		return nil
+	}
+	switch volCap.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+		return fmt.Errorf("block volumes cannot be written on several nodes, access mode %s is not supported",
+			volCap.GetAccessMode().GetMode())
+	}
+	return nil
+}
+
+func blockImagePath(stagingPath string) string {
+	return filepath.Join(stagingPath, blockImageName)
+}
+
+// parseImageSize returns the image size of the volume context, or 0 if it is not set.
+func parseImageSize(volumeContext map[string]string) (int64, error) {
+	val, ok := volumeContext[imageSizeKey]
+	if !ok {
+		return 0, nil
+	}
+	size, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("%s %q must be a positive number of bytes", imageSizeKey, val)
+	}
+	return size, nil
+}
+
+// ensureBlockImage creates the sparse image of size in the pool staged at
+// stagingPath if it does not exist, and returns its path.
+func ensureBlockImage(stagingPath string, size int64) (string, error) {
+	image := blockImagePath(stagingPath)
+	if _, err := os.Stat(image); err == nil || !os.IsNotExist(err) {
+		return image, err
+	}
+	if size == 0 {
+		return "", fmt.Errorf("%w: %s is not set", errBlockImageMissing, imageSizeKey)
+	}
+	// the image is renamed into place once it has its size, so that a failed
+	// stage does not leave a short image behind
+	tmp := image + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return "", err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return image, os.Rename(tmp, image)
+}
+
+// growBlockImage extends image to size, it is never shrunk. It returns the size
+// of the image.
+func growBlockImage(image string, size int64) (int64, error) {
+	info, err := os.Stat(image)
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() >= size {
+		return info.Size(), nil
+	}
+	if err := os.Truncate(image, size); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// createTargetFile creates the file a block volume is published on.
+func createTargetFile(target string) error {
+	if err := common.MakeDir(filepath.Dir(target)); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE, 0660)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// FindLoopDevice runs losetup to find the loop device image is attached to, or
+// "" if it is not attached.
+func (n *NodeMounter) FindLoopDevice(ctx context.Context, image string) (string, error) {
+	output, err := common.ExecCommand(ctx, "losetup", "--associated", image)
+	if err != nil {
+		return "", fmt.Errorf("failed to find the loop device of %s: %w, output: %s", image, err, string(output))
+	}
+	// /dev/loop0: [0047]:1234 (/path/block.img)
+	for _, line := range strings.Split(string(output), "\n") {
+		if i := strings.Index(line, ":"); i > 0 {
+			return line[:i], nil
+		}
+	}
+	return "", nil
+}
+
+// AttachLoopDevice attaches image to a free loop device, unless it is attached
+// already, and returns the device.
+func (n *NodeMounter) AttachLoopDevice(ctx context.Context, image string) (string, error) {
+	device, err := n.FindLoopDevice(ctx, image)
+	if err != nil || len(device) > 0 {
+		return device, err
+	}
+	output, err := common.ExecCommand(ctx, "losetup", "--find", "--show", image)
+	if err != nil {
+		return "", fmt.Errorf("failed to attach %s to a loop device: %w, output: %s", image, err, string(output))
+	}
+	device = strings.TrimSpace(string(output))
+	// bypass the page cache of the FUSE mount, which would otherwise cache every
+	// block a second time. FUSE mounts without direct I/O support keep working
+	// buffered, so a failure here is not fatal.
+	if output, err := common.ExecCommand(ctx, "losetup", "--direct-io=on", device); err != nil {
+		common.Log(ctx).Warningf("failed to enable direct I/O on loop device %s: %v, output: %s", device, err, string(output))
+	}
+	return device, nil
+}
+
+func (n *NodeMounter) DetachLoopDevice(ctx context.Context, device string) error {
+	output, err := common.ExecCommand(ctx, "losetup", "--detach", device)
+	if err != nil {
+		return fmt.Errorf("failed to detach loop device %s: %w, output: %s", device, err, string(output))
+	}
+	return nil
+}
+
+// ResizeLoopDevice makes device pick up the new size of its image.
+func (n *NodeMounter) ResizeLoopDevice(ctx context.Context, device string) error {
+	output, err := common.ExecCommand(ctx, "losetup", "--set-capacity", device)
+	if err != nil {
+		return fmt.Errorf("failed to refresh the capacity of loop device %s: %w, output: %s", device, err, string(output))
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+)
+
+func blockCapability(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}
+}
+
+func TestValidateBlockCapability(t *testing.T) {
+	require.NoError(t, validateBlockCapability(mountGroupCapability("")))
+	require.NoError(t, validateBlockCapability(blockCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)))
+	require.NoError(t, validateBlockCapability(blockCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY)))
+	require.Error(t, validateBlockCapability(blockCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)))
+}
+
+func TestParseImageSize(t *testing.T) {
+	size, err := parseImageSize(nil)
+	require.NoError(t, err)
+	require.Zero(t, size)
+	size, err = parseImageSize(map[string]string{imageSizeKey: "1073741824"})
+	require.NoError(t, err)
+	require.Equal(t, int64(common.GiB), size)
+	for _, val := range []string{"1Gi", "0", "-1"} {
+		_, err = parseImageSize(map[string]string{imageSizeKey: val})
+		require.Error(t, err, val)
+	}
+}
+
+func TestBlockImage(t *testing.T) {
+	dir := t.TempDir()
+	_, err := ensureBlockImage(dir, 0)
+	require.True(t, errors.Is(err, errBlockImageMissing), err)
+
+	image, err := ensureBlockImage(dir, common.GiB)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, blockImageName), image)
+	info, err := os.Stat(image)
+	require.NoError(t, err)
+	require.Equal(t, int64(common.GiB), info.Size())
+	require.Zero(t, info.Sys().(*syscall.Stat_t).Blocks, "the image is sparse")
+
+	// an existing image is neither recreated nor shrunk
+	image, err = ensureBlockImage(dir, 2*common.GiB)
+	require.NoError(t, err)
+	size, err := growBlockImage(image, common.GiB/2)
+	require.NoError(t, err)
+	require.Equal(t, int64(common.GiB), size)
+
+	size, err = growBlockImage(image, 3*common.GiB)
+	require.NoError(t, err)
+	require.Equal(t, int64(3*common.GiB), size)
+	info, err = os.Stat(image)
+	require.NoError(t, err)
+	require.Equal(t, int64(3*common.GiB), info.Size())
+}
+
+func TestCreateBlockVolume(t *testing.T) {
+	cs, _ := newFakeControllerServer(t)
+	ctx := context.Background()
+	req := newCreateVolumeRequest("pvc-1", 3*common.GiB/2)
+	req.VolumeCapabilities = []*csi.VolumeCapability{blockCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)}
+
+	resp, err := cs.CreateVolume(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, strconv.FormatInt(2*common.GiB, 10), resp.GetVolume().GetVolumeContext()[imageSizeKey])
+	require.NotContains(t, req.GetParameters(), imageSizeKey)
+
+	expanded, err := cs.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:         resp.GetVolume().GetVolumeId(),
+		CapacityRange:    &csi.CapacityRange{RequiredBytes: 5 * common.GiB},
+		Secrets:          testAdminSecrets,
+		VolumeCapability: req.VolumeCapabilities[0],
+	})
+	require.NoError(t, err)
+	require.True(t, expanded.GetNodeExpansionRequired())
+
+	req = newCreateVolumeRequest("pvc-2", common.GiB)
+	req.VolumeCapabilities = []*csi.VolumeCapability{blockCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)}
+	_, err = cs.CreateVolume(ctx, req)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	req = newCreateVolumeRequest("pvc-3", common.GiB)
+	req.VolumeCapabilities = []*csi.VolumeCapability{blockCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)}
+	req.Parameters[subPathKey] = "app-1"
+	_, err = cs.CreateVolume(ctx, req)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestNodeBlockVolume(t *testing.T) {
+	ns, mounter := newFakeNodeServer(t)
+	ctx := context.Background()
+	stagingPath := t.TempDir()
+	targetPath := filepath.Join(t.TempDir(), "block", "dev")
+	volCap := blockCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+	image := filepath.Join(stagingPath, blockImageName)
+	publishReq := &csi.NodePublishVolumeRequest{
+		VolumeId:          "legacy-app",
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  volCap,
+	}
+
+	_, err := ns.NodePublishVolume(ctx, publishReq)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err), "the volume is not staged")
+
+	stageReq := newNodeStageVolumeRequest("legacy-app", stagingPath)
+	stageReq.VolumeCapability = volCap
+	_, err = ns.NodeStageVolume(ctx, stageReq)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err), "a static volume without image needs its size")
+
+	stageReq.VolumeContext[imageSizeKey] = strconv.FormatInt(common.GiB, 10)
+	_, err = ns.NodeStageVolume(ctx, stageReq)
+	require.NoError(t, err)
+	require.FileExists(t, image)
+	device := mounter.LoopDevices()[image]
+	require.NotEmpty(t, device)
+
+	_, err = ns.NodePublishVolume(ctx, publishReq)
+	require.NoError(t, err)
+	require.FileExists(t, targetPath)
+	mp := mounter.MountPoints[len(mounter.MountPoints)-1]
+	require.Equal(t, device, mp.Device)
+	require.Equal(t, targetPath, mp.Path)
+	// publishing again is idempotent
+	_, err = ns.NodePublishVolume(ctx, publishReq)
+	require.NoError(t, err)
+	require.Len(t, mounter.MountPoints, 2)
+
+	// the stats of a block volume are the size of its image
+	stats, err := ns.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{
+		VolumeId:          "legacy-app",
+		VolumePath:        targetPath,
+		StagingTargetPath: stagingPath,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Total: common.GiB}}, stats.GetUsage())
+
+	expanded, err := ns.NodeExpandVolume(ctx, &csi.NodeExpandVolumeRequest{
+		VolumeId:          "legacy-app",
+		VolumePath:        targetPath,
+		StagingTargetPath: stagingPath,
+		CapacityRange:     &csi.CapacityRange{RequiredBytes: 2 * common.GiB},
+		VolumeCapability:  volCap,
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(2*common.GiB), expanded.GetCapacityBytes())
+	info, err := os.Stat(image)
+	require.NoError(t, err)
+	require.Equal(t, int64(2*common.GiB), info.Size())
+
+	mounter.SetError("ResizeLoopDevice", errors.New("exit status 1"))
+	_, err = ns.NodeExpandVolume(ctx, &csi.NodeExpandVolumeRequest{
+		VolumeId:          "legacy-app",
+		VolumePath:        targetPath,
+		StagingTargetPath: stagingPath,
+		CapacityRange:     &csi.CapacityRange{RequiredBytes: 3 * common.GiB},
+		VolumeCapability:  volCap,
+	})
+	require.Equal(t, codes.Internal, status.Code(err))
+
+	require.NoError(t, mounter.Unmount(targetPath))
+	_, err = ns.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: "legacy-app", StagingTargetPath: stagingPath})
+	require.NoError(t, err)
+	require.Empty(t, mounter.LoopDevices())
+	require.Empty(t, mounter.MountPoints)
+}
+
+func TestNodeExpandFilesystemVolume(t *testing.T) {
+	ns, _ := newFakeNodeServer(t)
+	resp, err := ns.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+		VolumeId:         "legacy-app",
+		VolumePath:       t.TempDir(),
+		CapacityRange:    &csi.CapacityRange{RequiredBytes: 2 * common.GiB},
+		VolumeCapability: mountGroupCapability(""),
+	})
+	require.NoError(t, err)
+	require.Zero(t, resp.GetCapacityBytes())
+
+	_, err = ns.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+		VolumeId:   "legacy-app",
+		VolumePath: filepath.Join(t.TempDir(), "missing"),
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
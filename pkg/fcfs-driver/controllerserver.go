@@ -21,7 +21,7 @@ import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	"k8s.io/klog/v2"
+	"strconv"
 	"vazmin.github.io/fastcfs-csi/pkg/common"
 	csicommon "vazmin.github.io/fastcfs-csi/pkg/csi-common"
 	"vazmin.github.io/fastcfs-csi/pkg/fcfs"
@@ -37,6 +37,7 @@ type controllerServer struct {
 	*csicommon.DefaultControllerServer
 	cfs         fcfs.Cfs
 	volumeLocks *common.VolumeLocks
+	events      *eventRecorder
 }
 
 func NewControllerServer(d *csicommon.CSIDriver) (*controllerServer, error) {
@@ -52,7 +53,7 @@ func NewControllerServer(d *csicommon.CSIDriver) (*controllerServer, error) {
 // CreateVolume create volume
 func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (resp *csi.CreateVolumeResponse, finalErr error) {
 	if err := cs.validateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
-		klog.V(3).Infof("invalid create FcfsVolume req: %v", req)
+		common.Log(ctx).V(3).Infof("invalid create FcfsVolume req: %v", req)
 		return nil, err
 	}
 
@@ -60,7 +61,7 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 
 	cr, err := common.NewAdminCredentials(req.GetSecrets())
 	if err != nil {
-		klog.Errorf("failed to retrieve admin credentials: %v", err)
+		common.Log(ctx).Errorf("failed to retrieve admin credentials: %v", err)
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 	defer cr.DeleteCredentials()
@@ -73,28 +74,33 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	if caps == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities missing in request")
 	}
-	// can only mount
+	block := false
 	for _, cap := range caps {
-		if cap.GetBlock() != nil {
-			return nil, status.Error(codes.InvalidArgument, "cannot have block access type")
+		if err := validateBlockCapability(cap); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
 		}
+		block = block || isBlock(cap)
+	}
+	if _, ok := req.GetParameters()[subPathKey]; ok && block {
+		return nil, status.Error(codes.InvalidArgument, "block volumes cannot have a subpath")
 	}
 
 	// Existence and conflict checks
 	if acquired := cs.volumeLocks.TryAcquire(requestName); !acquired {
-		klog.Errorf(common.VolumeOperationAlreadyExistsFmt, requestName)
+		common.Log(ctx).Errorf(common.VolumeOperationAlreadyExistsFmt, requestName)
 		return nil, status.Errorf(codes.Aborted, common.VolumeOperationAlreadyExistsFmt, requestName)
 	}
 	defer cs.volumeLocks.Release(requestName)
 
 	volOptions, err := newVolumeOptions(ctx, req, requestName, cr)
 	if err != nil {
-		klog.Errorf("validation and extraction of FcfsVolume options failed: %v", err)
+		common.Log(ctx).Errorf("validation and extraction of FcfsVolume options failed: %v", err)
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
 	exists, err := cs.cfs.VolumeExists(ctx, volOptions.BaseConfigURL, volOptions.VolName, cr)
 	if err != nil {
+		cs.events.volumeFailed(volOptions.VolID, "CreateVolume", claimFromParameters(req.GetParameters()), err)
 		return nil, status.Errorf(codes.Internal, "failed to create FcfsVolume %v: %q", volOptions.VolID, err)
 	}
 	// TODO if exists to check capacity
@@ -104,9 +110,10 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	if !exists {
 		_, createErr := cs.cfs.CreateVolume(ctx, volOptions, cr)
 		if createErr != nil {
+			cs.events.volumeFailed(volOptions.VolID, "CreateVolume", claimFromParameters(req.GetParameters()), createErr)
 			return nil, status.Errorf(codes.Internal, "failed to create FcfsVolume %v: %q", volOptions.VolID, createErr)
 		}
-		klog.V(4).Infof("created FcfsVolume %s at path %s", volOptions.VolID, volOptions.VolPath)
+		common.Log(ctx).V(4).Infof("created FcfsVolume %s at path %s", volOptions.VolID, volOptions.VolPath)
 	}
 
 	// VolumeContentSource. Not yet supported VolumeSnapshot and PersistentVolumeClaim Cloning
@@ -117,6 +124,14 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		VolumeContext: req.GetParameters(),
 		ContentSource: req.GetVolumeContentSource(),
 	}
+	if block {
+		// the node creates the image of the pool when it stages the volume first
+		csiVol.VolumeContext = make(map[string]string, len(req.GetParameters())+1)
+		for key, val := range req.GetParameters() {
+			csiVol.VolumeContext[key] = val
+		}
+		csiVol.VolumeContext[imageSizeKey] = strconv.FormatInt(csiVol.CapacityBytes, 10)
+	}
 	topologies := common.GetTopologyFromParams(req.GetParameters(), req.GetAccessibilityRequirements())
 	if topologies != nil {
 		csiVol.AccessibleTopology = []*csi.Topology{
@@ -138,14 +153,14 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 	}
 
 	if err := cs.validateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
-		klog.V(3).Infof("invalid delete FcfsVolume req: %v", req)
+		common.Log(ctx).V(3).Infof("invalid delete FcfsVolume req: %v", req)
 		return nil, err
 	}
 
 	volID := req.GetVolumeId()
 
 	if acquired := cs.volumeLocks.TryAcquire(volID); !acquired {
-		klog.Errorf(common.VolumeOperationAlreadyExistsFmt, volID)
+		common.Log(ctx).Errorf(common.VolumeOperationAlreadyExistsFmt, volID)
 		return nil, status.Errorf(codes.Aborted, common.VolumeOperationAlreadyExistsFmt, volID)
 	}
 	defer cs.volumeLocks.Release(volID)
@@ -158,15 +173,16 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 
 	cr, err := common.NewAdminCredentials(req.GetSecrets())
 	if err != nil {
-		klog.Errorf("failed to retrieve admin credentials: %v", err)
+		common.Log(ctx).Errorf("failed to retrieve admin credentials: %v", err)
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 	defer cr.DeleteCredentials()
   
 	if err := cs.cfs.DeleteVolume(ctx, vol, cr); err != nil {
+		cs.events.volumeFailed(volID, "DeleteVolume", nil, err)
 		return nil, status.Errorf(codes.Internal, "failed to delete FcfsVolume %v: %v", volID, err)
 	}
-	klog.V(4).Infof("FcfsVolume %v successfully deleted", volID)
+	common.Log(ctx).V(4).Infof("FcfsVolume %v successfully deleted", volID)
 
 	return &csi.DeleteVolumeResponse{}, nil
 }
@@ -183,8 +199,8 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 	}
 
 	for _, capability := range req.GetVolumeCapabilities() {
-		if capability.GetBlock() != nil {
-			return nil, status.Error(codes.InvalidArgument, "FastCFS doesn't support Block volume")
+		if err := validateBlockCapability(capability); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
 		}
 	}
 
@@ -217,14 +233,14 @@ func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi
 	}
 
 	if acquired := cs.volumeLocks.TryAcquire(volumeId); !acquired {
-		klog.Errorf(common.VolumeOperationAlreadyExistsFmt, volumeId)
+		common.Log(ctx).Errorf(common.VolumeOperationAlreadyExistsFmt, volumeId)
 		return nil, status.Errorf(codes.Aborted, common.VolumeOperationAlreadyExistsFmt, volumeId)
 	}
 	defer cs.volumeLocks.Release(volumeId)
 
 	cr, err := common.NewAdminCredentials(secrets)
 	if err != nil {
-		klog.Errorf("failed to retrieve admin credentials: %v", err)
+		common.Log(ctx).Errorf("failed to retrieve admin credentials: %v", err)
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 	defer cr.DeleteCredentials()
@@ -232,18 +248,20 @@ func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi
 	vol, err := NewVolOptionsFromVolID(volumeId, req.GetCapacityRange())
 
 	if err != nil {
-		klog.Errorf("failed to new volume %s: %v", volumeId, err)
+		common.Log(ctx).Errorf("failed to new volume %s: %v", volumeId, err)
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 	newSize, err := cs.cfs.ResizeVolume(ctx, vol, cr)
 	if err != nil {
-		klog.Errorf("failed to expand volume %s: %v", volumeId, err)
+		common.Log(ctx).Errorf("failed to expand volume %s: %v", volumeId, err)
+		cs.events.volumeFailed(volumeId, "ExpandVolume", nil, err)
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
 	return &csi.ControllerExpandVolumeResponse{
 		CapacityBytes:         newSize,
-		NodeExpansionRequired: false,
+		// the image of a block volume is grown on the node
+		NodeExpansionRequired: isBlock(req.GetVolumeCapability()),
 	}, nil
 }
 
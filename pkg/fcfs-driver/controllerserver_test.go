@@ -0,0 +1,215 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+	csicommon "vazmin.github.io/fastcfs-csi/pkg/csi-common"
+	"vazmin.github.io/fastcfs-csi/pkg/fcfs"
+	"vazmin.github.io/fastcfs-csi/pkg/fcfs/fake"
+)
+
+const testConfigBasePath = "/etc/fastcfs-client-config"
+
+var testAdminSecrets = map[string]string{"adminName": "admin", "adminSecretKey": "admin-key"}
+
+// newFakeControllerServer returns a controller server on a fake.Cfs.
+func newFakeControllerServer(t *testing.T) (*controllerServer, *fake.Cfs) {
+	// the credentials are written to the key files of the driver
+	require.NoError(t, os.MkdirAll("/tmp/csi/keys", 0700))
+
+	d := csicommon.NewCSIDriver(common.DefaultDriverName, common.DriverVersion, "node-1")
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+	})
+	cfs := fake.NewCfs()
+	newCFSFunc := NewCFSFunc
+	NewCFSFunc = func() (fcfs.Cfs, error) { return cfs, nil }
+	defer func() { NewCFSFunc = newCFSFunc }()
+
+	cs, err := NewControllerServer(d)
+	require.NoError(t, err)
+	return cs, cfs
+}
+
+func newCreateVolumeRequest(name string, capacity int64) *csi.CreateVolumeRequest {
+	return &csi.CreateVolumeRequest{
+		Name:          name,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: capacity},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		}},
+		Parameters: map[string]string{common.FastCFSConfigBasePath: testConfigBasePath},
+		Secrets:    testAdminSecrets,
+	}
+}
+
+func TestCreateVolume(t *testing.T) {
+	cs, cfs := newFakeControllerServer(t)
+	ctx := context.Background()
+
+	resp, err := cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", 3*common.GiB/2))
+	require.NoError(t, err)
+	pool, ok := cfs.GetPool(testConfigBasePath, common.CsiVolNamingPrefix+"pvc-1")
+	require.True(t, ok)
+	require.Equal(t, int64(2*common.GiB), pool.QuotaBytes)
+
+	cid := &common.CSIIdentifier{}
+	require.NoError(t, cid.DecomposeCSIID(resp.GetVolume().GetVolumeId()))
+	require.Equal(t, "admin", cid.UserName)
+	require.Equal(t, pool.Name, cid.VolName)
+
+	// retries of the provisioner are idempotent
+	again, err := cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", 3*common.GiB/2))
+	require.NoError(t, err)
+	require.Equal(t, resp.GetVolume().GetVolumeId(), again.GetVolume().GetVolumeId())
+	require.Equal(t, 1, cfs.Calls("CreateVolume"))
+}
+
+func TestCreateVolumeErrors(t *testing.T) {
+	testCases := []struct {
+		name   string
+		modify func(req *csi.CreateVolumeRequest, cfs *fake.Cfs)
+		code   codes.Code
+	}{
+		{
+			name:   "missing secrets",
+			modify: func(req *csi.CreateVolumeRequest, cfs *fake.Cfs) { req.Secrets = nil },
+			code:   codes.InvalidArgument,
+		},
+		{
+			name:   "missing config base path",
+			modify: func(req *csi.CreateVolumeRequest, cfs *fake.Cfs) { req.Parameters = nil },
+			code:   codes.InvalidArgument,
+		},
+		{
+			name: "subpath outside of the volume",
+			modify: func(req *csi.CreateVolumeRequest, cfs *fake.Cfs) {
+				req.Parameters[subPathKey] = "../shared"
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "block access on several nodes",
+			modify: func(req *csi.CreateVolumeRequest, cfs *fake.Cfs) {
+				req.VolumeCapabilities[0].AccessType = &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "plist fails",
+			modify: func(req *csi.CreateVolumeRequest, cfs *fake.Cfs) {
+				cfs.SetError("VolumeExists", errors.New("connection refused"))
+			},
+			code: codes.Internal,
+		},
+		{
+			name: "create fails",
+			modify: func(req *csi.CreateVolumeRequest, cfs *fake.Cfs) {
+				cfs.SetError("CreateVolume", errors.New("permission denied"))
+			},
+			code: codes.Internal,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cs, cfs := newFakeControllerServer(t)
+			req := newCreateVolumeRequest("pvc-1", common.GiB)
+			tc.modify(req, cfs)
+			_, err := cs.CreateVolume(context.Background(), req)
+			require.Equal(t, tc.code, status.Code(err), err)
+			_, ok := cfs.GetPool(testConfigBasePath, common.CsiVolNamingPrefix+"pvc-1")
+			require.False(t, ok)
+		})
+	}
+}
+
+func TestCreateVolumeTimeout(t *testing.T) {
+	cs, cfs := newFakeControllerServer(t)
+	cfs.Latency = time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", common.GiB))
+	require.Equal(t, codes.Internal, status.Code(err))
+	require.Contains(t, err.Error(), context.DeadlineExceeded.Error())
+}
+
+func TestDeleteVolume(t *testing.T) {
+	cs, cfs := newFakeControllerServer(t)
+	ctx := context.Background()
+	resp, err := cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", common.GiB))
+	require.NoError(t, err)
+	volID := resp.GetVolume().GetVolumeId()
+
+	cfs.SetError("DeleteVolume", errors.New("connection refused"))
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volID, Secrets: testAdminSecrets})
+	require.Equal(t, codes.Internal, status.Code(err))
+	cfs.SetError("DeleteVolume", nil)
+
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volID, Secrets: testAdminSecrets})
+	require.NoError(t, err)
+	_, ok := cfs.GetPool(testConfigBasePath, common.CsiVolNamingPrefix+"pvc-1")
+	require.False(t, ok)
+
+	// deleting a deleted volume succeeds
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volID, Secrets: testAdminSecrets})
+	require.NoError(t, err)
+
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{Secrets: testAdminSecrets})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestControllerExpandVolume(t *testing.T) {
+	cs, cfs := newFakeControllerServer(t)
+	ctx := context.Background()
+	resp, err := cs.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", common.GiB))
+	require.NoError(t, err)
+
+	expanded, err := cs.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:      resp.GetVolume().GetVolumeId(),
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 5 * common.GiB},
+		Secrets:       testAdminSecrets,
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(5*common.GiB), expanded.GetCapacityBytes())
+	require.False(t, expanded.GetNodeExpansionRequired())
+	pool, _ := cfs.GetPool(testConfigBasePath, common.CsiVolNamingPrefix+"pvc-1")
+	require.Equal(t, int64(5*common.GiB), pool.QuotaBytes)
+
+	cid := &common.CSIIdentifier{ClusterID: testConfigBasePath, UserName: "admin", VolName: common.CsiVolNamingPrefix + "missing"}
+	missing, err := cid.ComposeCSIID()
+	require.NoError(t, err)
+	_, err = cs.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:      missing,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 5 * common.GiB},
+		Secrets:       testAdminSecrets,
+	})
+	require.Equal(t, codes.Internal, status.Code(err))
+}
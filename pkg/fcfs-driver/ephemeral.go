@@ -0,0 +1,312 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+	"vazmin.github.io/fastcfs-csi/pkg/fcfs"
+)
+
+// An ephemeral inline volume is a scratch pool, which the node creates with the
+// admin credentials of the node publish secret and mounts at the target path.
+// Unpublish requests carry no secrets, the node deletes the pool with the
+// admin credentials of the secret it is configured with.
+const (
+	// ephemeralContextKey is set by kubelet if podInfoOnMount is enabled.
+	ephemeralContextKey = "csi.storage.k8s.io/ephemeral"
+	// ephemeralSizeKey is the volume attribute of the pool quota, e.g. "10Gi".
+	ephemeralSizeKey = "size"
+	// ephemeralPoolPrefix names the scratch pools, kubelet volume IDs are too
+	// long for pool names and are hashed.
+	ephemeralPoolPrefix = "csi-eph-"
+	// ephemeralFileName is stored next to the target path, as kubelet keeps vol_data.json
+	ephemeralFileName = "fcfs-ephemeral.json"
+
+	defaultEphemeralSize = common.GiB
+)
+
+// ephemeralVolume records a scratch pool for NodeUnpublishVolume, which does
+// not have the volume attributes. It holds no credentials.
+type ephemeralVolume struct {
+	BaseConfigURL string `json:"baseConfigURL"`
+	VolName       string `json:"volName"`
+}
+
+// isEphemeral reports whether kubelet publishes an inline volume, or, if it
+// does not tell as Kubernetes 1.15, whether the driver runs in ephemeral mode.
+func isEphemeral(volumeContext map[string]string, ephemeralMode bool) bool {
+	val, ok := volumeContext[ephemeralContextKey]
+	if !ok {
+		return ephemeralMode
+	}
+	return val == "true"
+}
+
+func ephemeralPoolName(volumeID string) string {
+	sum := sha256.Sum256([]byte(volumeID))
+	return ephemeralPoolPrefix + hex.EncodeToString(sum[:12])
+}
+
+// newEphemeralVolOptions returns the scratch pool of the inline volume volumeID.
+func newEphemeralVolOptions(volumeID string, volumeContext map[string]string) (*fcfs.VolumeOptions, error) {
+	basePath := volumeContext[common.FastCFSConfigBasePath]
+	if len(basePath) == 0 {
+		return nil, fmt.Errorf("the volume attribute '%s' must be set", common.FastCFSConfigBasePath)
+	}
+	size := int64(defaultEphemeralSize)
+	if val, ok := volumeContext[ephemeralSizeKey]; ok {
+		quantity, err := resource.ParseQuantity(val)
+		if err != nil || quantity.Sign() <= 0 {
+			return nil, fmt.Errorf("%s %q must be a positive quantity", ephemeralSizeKey, val)
+		}
+		size = quantity.Value()
+	}
+	return &fcfs.VolumeOptions{
+		VolID:         volumeID,
+		VolName:       ephemeralPoolName(volumeID),
+		CapacityBytes: common.RoundOffBytes(size),
+		BaseConfigURL: basePath,
+	}, nil
+}
+
+// parseSecretRef parses a namespace/name secret reference.
+func parseSecretRef(ref string) (*v1.SecretReference, error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return nil, fmt.Errorf("invalid secret %q, must be namespace/name", ref)
+	}
+	return &v1.SecretReference{Namespace: parts[0], Name: parts[1]}, nil
+}
+
+func ephemeralFile(targetPath string) string {
+	return filepath.Join(filepath.Dir(targetPath), ephemeralFileName)
+}
+
+func saveEphemeralVolume(targetPath string, vol *ephemeralVolume) error {
+	content, err := json.Marshal(vol)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ephemeralFile(targetPath), content, 0600)
+}
+
+// loadEphemeralVolume returns the scratch pool published at targetPath, or nil
+// if the volume is not ephemeral.
+func loadEphemeralVolume(targetPath string) (*ephemeralVolume, error) {
+	content, err := ioutil.ReadFile(ephemeralFile(targetPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	vol := &ephemeralVolume{}
+	if err := json.Unmarshal(content, vol); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", ephemeralFile(targetPath), err)
+	}
+	return vol, nil
+}
+
+func removeEphemeralVolume(targetPath string) error {
+	if err := os.Remove(ephemeralFile(targetPath)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// publishEphemeralVolume creates the scratch pool of an inline volume unless it
+// exists, and mounts it at the target path. The caller holds the volume lock.
+func (ns *nodeServer) publishEphemeralVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	volumeId := req.GetVolumeId()
+	targetPath := req.GetTargetPath()
+	if ns.cfs == nil {
+		return nil, status.Error(codes.FailedPrecondition, "FastCFS is not available on the node, ephemeral volumes cannot be published")
+	}
+	// a pool which could not be deleted would be left behind with the pod
+	if ns.ephemeralSecrets == nil {
+		return nil, status.Error(codes.FailedPrecondition, "the node server has no --ephemeral-secret, ephemeral volumes cannot be published")
+	}
+	volOptions, err := newEphemeralVolOptions(volumeId, req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	owner, err := newVolumeOwner(req.GetVolumeCapability(), req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if volOptions.FuseOptions, err = newFuseOptions(req.GetVolumeCapability(), req.GetVolumeContext()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	volOptions.ClientConfig = common.ClientConfigParameters(req.GetVolumeContext())
+	if err := common.ValidateClientConfig(volOptions.ClientConfig); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	cr, err := common.NewAdminCredentials(req.GetSecrets())
+	if err != nil {
+		common.Log(ctx).Errorf("failed to retrieve admin credentials: %v", err)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	defer cr.DeleteCredentials()
+
+	if err := ns.remountStale(ctx, targetPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unmount stale target %q: %v", targetPath, err)
+	}
+	mnt, err := ns.ensureMountPoint(targetPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not mount target %q: %v", targetPath, err)
+	}
+	if mnt {
+		common.Log(ctx).V(2).Infof("NodePublishVolume: volume %s is already mounted on %s", volumeId, targetPath)
+		// a publish retried after a failure to set the owner completes it
+		if owner != nil {
+			if err := owner.apply(ctx, targetPath); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to set the owner of volume %s: %v", volumeId, err)
+			}
+		}
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	exists, err := ns.cfs.VolumeExists(ctx, volOptions.BaseConfigURL, volOptions.VolName, cr)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create the pool of ephemeral volume %s: %v", volumeId, err)
+	}
+	// a pool which exists was created by an earlier publish of the volume, that
+	// is kubelet retrying, and is only deleted by unpublish
+	created := !exists
+	if created {
+		if _, err := ns.cfs.CreateVolume(ctx, volOptions, cr); err != nil {
+			ns.events.volumeFailed(volumeId, "NodePublishVolume", nil, err)
+			return nil, status.Errorf(codes.Internal, "failed to create the pool of ephemeral volume %s: %v", volumeId, err)
+		}
+		common.Log(ctx).V(4).Infof("created pool %s of ephemeral volume %s", volOptions.VolName, volumeId)
+	}
+	// the pool is recorded before it is mounted, so that a failed publish can be cleaned up
+	vol := &ephemeralVolume{
+		BaseConfigURL: volOptions.BaseConfigURL,
+		VolName:       volOptions.VolName,
+	}
+	if err := saveEphemeralVolume(targetPath, vol); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to record ephemeral volume %s: %v", volumeId, err)
+	}
+
+	volOptions.VolPath = targetPath
+	err = ns.mounter.FcfsMount(ctx, volOptions, &fcfs.MountOptionsSecrets{
+		MountOptions: ns.mountOptions,
+		Secrets:      req.GetSecrets(),
+	})
+	common.Audit(ctx, &common.AuditEvent{
+		Operation: common.AuditMount,
+		VolumeID:  volumeId,
+		Pool:      volOptions.VolName,
+		User:      cr.UserName,
+		Request:   protosanitizer.StripSecrets(req).String(),
+	}, err)
+	if err != nil {
+		ns.events.volumeFailed(volumeId, "NodePublishVolume", nil, err)
+		if created {
+			if cleanupErr := ns.deletePool(ctx, volumeId, targetPath, vol, cr); cleanupErr != nil {
+				common.Log(ctx).Errorf("failed to delete the pool of ephemeral volume %s: %v", volumeId, cleanupErr)
+			}
+		}
+		return nil, status.Errorf(codes.Internal, "[FcfsCFS] fuse mount err %v", err)
+	}
+	if owner != nil {
+		if err := owner.apply(ctx, targetPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to set the owner of volume %s: %v", volumeId, err)
+		}
+	}
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// unpublishEphemeralVolume unmounts the scratch pool of vol and deletes it. The
+// caller holds the volume lock.
+func (ns *nodeServer) unpublishEphemeralVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest, vol *ephemeralVolume) error {
+	volOptions := &fcfs.VolumeOptions{
+		VolID:         req.GetVolumeId(),
+		VolName:       vol.VolName,
+		BaseConfigURL: vol.BaseConfigURL,
+		VolPath:       req.GetTargetPath(),
+	}
+	err := ns.mounter.FcfsUnmount(ctx, volOptions, ns.mountOptions)
+	common.Audit(ctx, &common.AuditEvent{
+		Operation: common.AuditUnmount,
+		VolumeID:  req.GetVolumeId(),
+		Pool:      vol.VolName,
+		Request:   protosanitizer.StripSecrets(req).String(),
+	}, err)
+	if err != nil {
+		return fmt.Errorf("failed to unmount target %q: %w", req.GetTargetPath(), err)
+	}
+	return ns.deleteEphemeralVolume(ctx, req.GetVolumeId(), req.GetTargetPath())
+}
+
+// deleteEphemeralVolume deletes the scratch pool recorded for targetPath with
+// the ephemeral secret, and its record.
+func (ns *nodeServer) deleteEphemeralVolume(ctx context.Context, volumeId, targetPath string) error {
+	vol, err := loadEphemeralVolume(targetPath)
+	if err != nil || vol == nil {
+		return err
+	}
+	if ns.cfs == nil {
+		return errors.New("FastCFS is not available on the node")
+	}
+	if ns.ephemeralSecrets == nil {
+		return errors.New("the node server has no --ephemeral-secret")
+	}
+	secrets, err := ns.ephemeralSecrets(ctx)
+	if err != nil {
+		return err
+	}
+	cr, err := common.NewAdminCredentials(secrets)
+	if err != nil {
+		return err
+	}
+	defer cr.DeleteCredentials()
+	return ns.deletePool(ctx, volumeId, targetPath, vol, cr)
+}
+
+// deletePool deletes the scratch pool vol published at targetPath and its record.
+func (ns *nodeServer) deletePool(ctx context.Context, volumeId, targetPath string, vol *ephemeralVolume, cr *common.Credentials) error {
+	volOptions := &fcfs.VolumeOptions{
+		VolID:         volumeId,
+		VolName:       vol.VolName,
+		BaseConfigURL: vol.BaseConfigURL,
+	}
+	if err := ns.cfs.DeleteVolume(ctx, volOptions, cr); err != nil {
+		ns.events.volumeFailed(volumeId, "NodeUnpublishVolume", nil, err)
+		return err
+	}
+	common.Log(ctx).V(4).Infof("deleted pool %s of ephemeral volume %s", vol.VolName, volumeId)
+	return removeEphemeralVolume(targetPath)
+}
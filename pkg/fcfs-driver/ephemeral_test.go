@@ -0,0 +1,213 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+	csicommon "vazmin.github.io/fastcfs-csi/pkg/csi-common"
+	"vazmin.github.io/fastcfs-csi/pkg/fcfs"
+	"vazmin.github.io/fastcfs-csi/pkg/fcfs/fake"
+)
+
+func newEphemeralPublishRequest(volumeID, targetPath string) *csi.NodePublishVolumeRequest {
+	return &csi.NodePublishVolumeRequest{
+		VolumeId:         volumeID,
+		TargetPath:       targetPath,
+		VolumeCapability: mountGroupCapability(""),
+		VolumeContext: map[string]string{
+			ephemeralContextKey:          "true",
+			common.FastCFSConfigBasePath: testConfigBasePath,
+			ephemeralSizeKey:             "2Gi",
+		},
+		Secrets: testAdminSecrets,
+	}
+}
+
+func TestIsEphemeral(t *testing.T) {
+	require.True(t, isEphemeral(map[string]string{ephemeralContextKey: "true"}, false))
+	require.False(t, isEphemeral(map[string]string{ephemeralContextKey: "false"}, true))
+	require.True(t, isEphemeral(nil, true), "Kubernetes 1.15 does not set the key")
+	require.False(t, isEphemeral(nil, false))
+}
+
+func TestNewEphemeralVolOptions(t *testing.T) {
+	vol, err := newEphemeralVolOptions("csi-0123", map[string]string{common.FastCFSConfigBasePath: testConfigBasePath})
+	require.NoError(t, err)
+	require.Equal(t, int64(defaultEphemeralSize), vol.CapacityBytes)
+	require.Equal(t, ephemeralPoolName("csi-0123"), vol.VolName)
+	require.Len(t, vol.VolName, len(ephemeralPoolPrefix)+24)
+
+	_, err = newEphemeralVolOptions("csi-0123", nil)
+	require.Error(t, err)
+	for _, size := range []string{"ten", "0", "-1Gi"} {
+		_, err = newEphemeralVolOptions("csi-0123", map[string]string{
+			common.FastCFSConfigBasePath: testConfigBasePath,
+			ephemeralSizeKey:             size,
+		})
+		require.Error(t, err, size)
+	}
+}
+
+func TestNodeEphemeralVolume(t *testing.T) {
+	ns, mounter := newFakeNodeServer(t)
+	cfs := ns.cfs.(*fake.Cfs)
+	ctx := context.Background()
+	targetPath := filepath.Join(t.TempDir(), "mount")
+	req := newEphemeralPublishRequest("csi-0123", targetPath)
+	poolName := ephemeralPoolName("csi-0123")
+
+	_, err := ns.NodePublishVolume(ctx, req)
+	require.NoError(t, err)
+	pool, ok := cfs.GetPool(testConfigBasePath, poolName)
+	require.True(t, ok)
+	require.Equal(t, int64(2*common.GiB), pool.QuotaBytes)
+	require.Len(t, mounter.MountPoints, 1)
+	require.Equal(t, poolName, mounter.MountPoints[0].Device)
+	require.Equal(t, targetPath, mounter.MountPoints[0].Path)
+	info, err := os.Stat(ephemeralFile(targetPath))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	record, err := ioutil.ReadFile(ephemeralFile(targetPath))
+	require.NoError(t, err)
+	require.NotContains(t, string(record), testAdminSecrets["adminSecretKey"], "the record holds no credentials")
+
+	// publishing again is idempotent
+	_, err = ns.NodePublishVolume(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, 1, cfs.Calls("CreateVolume"))
+
+	// a retry of a publish which failed to set the owner finds the volume mounted
+	req.VolumeContext[volumeModeKey] = "0770"
+	_, err = ns.NodePublishVolume(ctx, req)
+	require.NoError(t, err)
+	info, err = os.Stat(targetPath)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0770), info.Mode().Perm())
+
+	// unpublish requests carry no secrets, the pool is deleted with the ephemeral secret
+	unpublishReq := &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-0123", TargetPath: targetPath}
+	ephemeralSecrets := ns.ephemeralSecrets
+	ns.ephemeralSecrets = func(ctx context.Context) (map[string]string, error) {
+		return nil, errors.New(`secrets "csi-fcfs-secret" not found`)
+	}
+	_, err = ns.NodeUnpublishVolume(ctx, unpublishReq)
+	require.Equal(t, codes.Internal, status.Code(err))
+	require.FileExists(t, ephemeralFile(targetPath))
+	ns.ephemeralSecrets = ephemeralSecrets
+
+	cfs.SetError("DeleteVolume", errors.New("connection refused"))
+	_, err = ns.NodeUnpublishVolume(ctx, unpublishReq)
+	require.Equal(t, codes.Internal, status.Code(err))
+	require.FileExists(t, ephemeralFile(targetPath))
+
+	cfs.SetError("DeleteVolume", nil)
+	_, err = ns.NodeUnpublishVolume(ctx, unpublishReq)
+	require.NoError(t, err)
+	_, ok = cfs.GetPool(testConfigBasePath, poolName)
+	require.False(t, ok)
+	require.Empty(t, mounter.MountPoints)
+	require.NoFileExists(t, ephemeralFile(targetPath))
+	require.NoDirExists(t, targetPath)
+}
+
+func TestNodeEphemeralVolumeMountFailure(t *testing.T) {
+	ns, mounter := newFakeNodeServer(t)
+	cfs := ns.cfs.(*fake.Cfs)
+	targetPath := filepath.Join(t.TempDir(), "mount")
+	mounter.SetError("FcfsMount", errors.New("exit status 1"))
+
+	_, err := ns.NodePublishVolume(context.Background(), newEphemeralPublishRequest("csi-0123", targetPath))
+	require.Equal(t, codes.Internal, status.Code(err))
+	_, ok := cfs.GetPool(testConfigBasePath, ephemeralPoolName("csi-0123"))
+	require.False(t, ok, "the pool of a failed publish is deleted")
+	require.NoFileExists(t, ephemeralFile(targetPath))
+}
+
+func TestNodeEphemeralVolumeMountFailureExistingPool(t *testing.T) {
+	ns, mounter := newFakeNodeServer(t)
+	cfs := ns.cfs.(*fake.Cfs)
+	ctx := context.Background()
+	targetPath := filepath.Join(t.TempDir(), "mount")
+	poolName := ephemeralPoolName("csi-0123")
+	// e.g. left by a publish which failed before mounting
+	cfs.AddPool(testConfigBasePath, "admin", fcfs.Pool{Name: poolName, QuotaBytes: 2 * common.GiB})
+	mounter.SetError("FcfsMount", errors.New("exit status 1"))
+
+	_, err := ns.NodePublishVolume(ctx, newEphemeralPublishRequest("csi-0123", targetPath))
+	require.Equal(t, codes.Internal, status.Code(err))
+	_, ok := cfs.GetPool(testConfigBasePath, poolName)
+	require.True(t, ok, "a pool the publish did not create is kept")
+	require.FileExists(t, ephemeralFile(targetPath), "unpublish deletes the pool")
+	require.Zero(t, cfs.Calls("DeleteVolume"))
+}
+
+func TestNodeEphemeralVolumeInvalid(t *testing.T) {
+	ns, _ := newFakeNodeServer(t)
+	ctx := context.Background()
+
+	req := newEphemeralPublishRequest("csi-0123", filepath.Join(t.TempDir(), "mount"))
+	req.Secrets = map[string]string{"userName": "user", "userSecretKey": "user-key"}
+	_, err := ns.NodePublishVolume(ctx, req)
+	require.Equal(t, codes.InvalidArgument, status.Code(err), "the admin credentials are required")
+
+	req = newEphemeralPublishRequest("csi-0123", filepath.Join(t.TempDir(), "mount"))
+	req.VolumeCapability = blockCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+	_, err = ns.NodePublishVolume(ctx, req)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	req = newEphemeralPublishRequest("csi-0123", filepath.Join(t.TempDir(), "mount"))
+	req.VolumeContext[subPathKey] = "app-1"
+	_, err = ns.NodePublishVolume(ctx, req)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// persistent volumes still need to be staged
+	req = newEphemeralPublishRequest("csi-0123", filepath.Join(t.TempDir(), "mount"))
+	req.VolumeContext[ephemeralContextKey] = "false"
+	_, err = ns.NodePublishVolume(ctx, req)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// the pool could not be deleted without the ephemeral secret
+	ns.ephemeralSecrets = nil
+	_, err = ns.NodePublishVolume(ctx, newEphemeralPublishRequest("csi-0123", filepath.Join(t.TempDir(), "mount")))
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestNodeEphemeralVolumeWithoutFastCFS(t *testing.T) {
+	newCFSFunc := NewCFSFunc
+	NewCFSFunc = func() (fcfs.Cfs, error) { return nil, errors.New("fcfs_pool not found") }
+	defer func() { NewCFSFunc = newCFSFunc }()
+	mounter := NewFakeMounter(fake.NewCfs())
+	newMounterFunc := NewMounterFunc
+	NewMounterFunc = func() (Mounter, error) { return mounter, nil }
+	defer func() { NewMounterFunc = newMounterFunc }()
+	ns := NewNodeServer(csicommon.NewCSIDriver(common.DefaultDriverName, common.DriverVersion, "node-1"), &fcfs.MountOptions{}, nil)
+
+	_, err := ns.NodePublishVolume(context.Background(), newEphemeralPublishRequest("csi-0123", filepath.Join(t.TempDir(), "mount")))
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.Empty(t, mounter.MountPoints)
+}
@@ -0,0 +1,234 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+)
+
+const (
+	// volumeEventInterval is the minimum interval between two events of a volume.
+	volumeEventInterval = 5 * time.Minute
+	// resolveTimeout bounds looking up the PV and PVC of a volume.
+	resolveTimeout = 10 * time.Second
+
+	// parameters passed by external-provisioner with --extra-create-metadata
+	pvcNameKey      = "csi.storage.k8s.io/pvc/name"
+	pvcNamespaceKey = "csi.storage.k8s.io/pvc/namespace"
+)
+
+// failureClass classifies a failed FastCFS operation by the output of the command.
+type failureClass struct {
+	reason   string
+	patterns []string
+	hint     string
+}
+
+var (
+	failureClasses = []failureClass{
+		{
+			reason:   "FastCFSAuthFailed",
+			patterns: []string{"permission denied", "access denied", "passwd", "secret key", "invalid user", "user not exist", "operation not permitted"},
+			hint:     "check the user name and secret key of the secret referenced by the storage class",
+		}, {
+			reason:   "FastCFSQuotaExceeded",
+			patterns: []string{"quota", "no space left", "exceed"},
+			hint:     "increase the quota of the pool or expand the PVC",
+		}, {
+			reason:   "FastCFSDaemonCrashed",
+			patterns: []string{"signal", "core dumped", "segmentation fault", "transport endpoint is not connected", "killed"},
+			hint:     "check the fcfs_fused log under " + common.ClientBasePath + "/<pool> on the node, then restart the pod",
+		}, {
+			reason:   "FastCFSConfigUnreachable",
+			patterns: []string{"curl", "could not resolve", "connection refused", "timed out", "no route to host", "no such file or directory"},
+			hint:     "check that the " + common.FastCFSConfigBasePath + " of the storage class is reachable from the node",
+		},
+	}
+
+	unknownFailure = failureClass{
+		reason: "FastCFSOperationFailed",
+		hint:   "check the logs of the FastCFS CSI plugin",
+	}
+)
+
+// classifyFailure returns the first failure class matching err.
+func classifyFailure(err error) failureClass {
+	msg := strings.ToLower(err.Error())
+	for _, class := range failureClasses {
+		for _, pattern := range class.patterns {
+			if strings.Contains(msg, pattern) {
+				return class
+			}
+		}
+	}
+	return unknownFailure
+}
+
+// eventRecorder emits warning events on the PV and PVC of a failed volume,
+// at most one per volume within volumeEventInterval.
+type eventRecorder struct {
+	driverName string
+	client     kubernetes.Interface
+	recorder   record.EventRecorder
+
+	mux  sync.Mutex
+	last map[string]time.Time
+}
+
+func newEventRecorder(client kubernetes.Interface, driverName, nodeID string) *eventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartStructuredLogging(4)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return &eventRecorder{
+		driverName: driverName,
+		client:     client,
+		recorder:   broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: driverName, Host: nodeID}),
+		last:       make(map[string]time.Time),
+	}
+}
+
+// volumeFailed reports the failed operation on volID in the background. claim
+// names the PVC of a volume which has no PV yet, otherwise it is nil and the
+// PV and its claim are looked up.
+func (r *eventRecorder) volumeFailed(volID, operation string, claim *v1.ObjectReference, err error) {
+	if r == nil || err == nil || !r.allow(volID) {
+		return
+	}
+	class, message := failureEvent(volID, operation, err)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		defer cancel()
+		if claim == nil {
+			pv, err := r.findPV(ctx, volID)
+			if err != nil {
+				klog.Warningf("failed to find the PV of volume %s: %v", volID, err)
+			}
+			if pv == nil {
+				return
+			}
+			r.recorder.Event(pv, v1.EventTypeWarning, class.reason, message)
+			claim = pv.Spec.ClaimRef
+		}
+		if ref := r.claimReference(ctx, claim); ref != nil {
+			r.recorder.Event(ref, v1.EventTypeWarning, class.reason, message)
+		}
+	}()
+}
+
+// podVolumeFailed reports the failed operation on volID on the pod using it,
+// which is the only object of an inline volume. pod may be nil if it is unknown.
+func (r *eventRecorder) podVolumeFailed(pod *v1.ObjectReference, volID, operation string, err error) {
+	if r == nil || err == nil || pod == nil || !r.allow(string(pod.UID)+"/"+volID) {
+		return
+	}
+	class, message := failureEvent(volID, operation, err)
+	r.recorder.Event(pod, v1.EventTypeWarning, class.reason, message)
+}
+
+// failureEvent returns the class and the message of the event of a failed operation.
+func failureEvent(volID, operation string, err error) (failureClass, string) {
+	class := classifyFailure(err)
+	return class, fmt.Sprintf("%s of volume %s failed: %v. Hint: %s", operation, volID, err, class.hint)
+}
+
+// allow applies the per volume rate limit.
+func (r *eventRecorder) allow(volID string) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	now := time.Now()
+	if last, ok := r.last[volID]; ok && now.Sub(last) < volumeEventInterval {
+		return false
+	}
+	for id, last := range r.last {
+		if now.Sub(last) >= volumeEventInterval {
+			delete(r.last, id)
+		}
+	}
+	r.last[volID] = now
+	return true
+}
+
+// findPV returns the PV of volID, provisioned PVs are named after the request
+// name, static ones are looked up by their volume handle.
+func (r *eventRecorder) findPV(ctx context.Context, volID string) (*v1.PersistentVolume, error) {
+	if volOptions, err := NewVolOptionsFromVolID(volID, nil); err == nil &&
+		strings.HasPrefix(volOptions.VolName, common.CsiVolNamingPrefix) {
+		pv, err := r.client.CoreV1().PersistentVolumes().Get(ctx, strings.TrimPrefix(volOptions.VolName, common.CsiVolNamingPrefix), metav1.GetOptions{})
+		if err == nil && pv.Spec.CSI != nil && pv.Spec.CSI.VolumeHandle == volID {
+			return pv, nil
+		}
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+	}
+	pvs, err := r.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range pvs.Items {
+		if csi := pvs.Items[i].Spec.CSI; csi != nil && csi.Driver == r.driverName && csi.VolumeHandle == volID {
+			return &pvs.Items[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// claimFromParameters returns the PVC passed in the parameters of CreateVolume.
+func claimFromParameters(parameters map[string]string) *v1.ObjectReference {
+	name, namespace := parameters[pvcNameKey], parameters[pvcNamespaceKey]
+	if len(name) == 0 || len(namespace) == 0 {
+		return nil
+	}
+	return &v1.ObjectReference{Name: name, Namespace: namespace}
+}
+
+// claimReference completes claim with the UID events are matched by.
+func (r *eventRecorder) claimReference(ctx context.Context, claim *v1.ObjectReference) *v1.ObjectReference {
+	if claim == nil || len(claim.Name) == 0 {
+		return nil
+	}
+	ref := &v1.ObjectReference{
+		Kind:       "PersistentVolumeClaim",
+		APIVersion: "v1",
+		Name:       claim.Name,
+		Namespace:  claim.Namespace,
+		UID:        claim.UID,
+	}
+	if len(ref.UID) == 0 {
+		pvc, err := r.client.CoreV1().PersistentVolumeClaims(claim.Namespace).Get(ctx, claim.Name, metav1.GetOptions{})
+		if err != nil {
+			klog.Warningf("failed to get PVC %s/%s: %v", claim.Namespace, claim.Name, err)
+			return nil
+		}
+		ref.UID = pvc.UID
+	}
+	return ref
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestClassifyFailure(t *testing.T) {
+	testCases := []struct {
+		err    string
+		reason string
+	}{
+		{err: "exit status 1, output: connect to server fail, Permission denied", reason: "FastCFSAuthFailed"},
+		{err: "exit status 1, output: pool csi-vol-1 exceeds quota", reason: "FastCFSQuotaExceeded"},
+		{err: "exit status 1, output: No space left on device", reason: "FastCFSQuotaExceeded"},
+		{err: "rpc error: code = Internal desc = fcfs_fused failed: signal: segmentation fault (core dumped), output: ", reason: "FastCFSDaemonCrashed"},
+		{err: "exit status 2, output: curl: (6) Could not resolve host: fastcfs-config", reason: "FastCFSConfigUnreachable"},
+		{err: "exit status 2, output: open file /etc/fastcfs/fcfs/fuse.conf fail, errno: 2, error info: No such file or directory", reason: "FastCFSConfigUnreachable"},
+		{err: "exit status 3", reason: "FastCFSOperationFailed"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.reason, func(t *testing.T) {
+			require.Equal(t, tc.reason, classifyFailure(errors.New(tc.err)).reason)
+		})
+	}
+}
+
+func TestEventRecorderAllow(t *testing.T) {
+	r := &eventRecorder{last: make(map[string]time.Time)}
+	require.True(t, r.allow("vol-1"))
+	require.False(t, r.allow("vol-1"))
+	require.True(t, r.allow("vol-2"))
+
+	r.last["vol-1"] = time.Now().Add(-volumeEventInterval)
+	require.True(t, r.allow("vol-1"))
+	require.False(t, r.allow("vol-1"))
+
+	var disabled *eventRecorder
+	disabled.volumeFailed("vol-1", "NodeStageVolume", nil, errors.New("exit status 1"))
+}
+
+func TestClaimFromParameters(t *testing.T) {
+	require.Nil(t, claimFromParameters(map[string]string{}))
+	require.Nil(t, claimFromParameters(map[string]string{pvcNameKey: "data"}))
+	require.Equal(t, &v1.ObjectReference{Name: "data", Namespace: "default"},
+		claimFromParameters(map[string]string{pvcNameKey: "data", pvcNamespaceKey: "default"}))
+}
@@ -0,0 +1,245 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	mountutils "k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+	"vazmin.github.io/fastcfs-csi/pkg/fcfs"
+	"vazmin.github.io/fastcfs-csi/pkg/fcfs/fake"
+)
+
+// FakeMounter is a Mounter keeping the mounts in memory, for tests without
+// FastCFS and mount privileges. The mount points are real directories, so that
+// the node server can create and remove them.
+type FakeMounter struct {
+	*mountutils.FakeMounter
+	// commands are not faked, they must not be run
+	utilexec.Interface
+
+	// Latency delays FcfsMount and FcfsUnmount, they fail if their context is done first.
+	Latency time.Duration
+
+	cfs    *fake.Cfs
+	mux    sync.Mutex
+	errors map[string]error  // by method name
+	loops  map[string]string // loop devices by image
+	// basePaths are the base paths of the fcfs_fused of the FastCFS mounts by mount point
+	basePaths map[string]string
+	// nextLoop numbers the devices of AttachLoopDevice
+	nextLoop int
+}
+
+var _ Mounter = &FakeMounter{}
+
+// NewFakeMounter returns a FakeMounter without mounts. FastCFS volumes are
+// mounted through cfs if set, so that mounting fails if their pool is missing.
+func NewFakeMounter(cfs *fake.Cfs) *FakeMounter {
+	return &FakeMounter{
+		FakeMounter: mountutils.NewFakeMounter(nil),
+		cfs:         cfs,
+		errors:      make(map[string]error),
+		loops:       make(map[string]string),
+		basePaths:   make(map[string]string),
+	}
+}
+
+// BasePath returns the base path of the fcfs_fused mounted at mountPoint.
+func (m *FakeMounter) BasePath(mountPoint string) string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.basePaths[mountPoint]
+}
+
+// SetError makes method, "FcfsMount", "FcfsUnmount", "LazyUnmount", "Mount" or one of the loop
+// device methods, fail with err,
+// a nil err resets it. The errors of IsLikelyNotMountPoint are set by path in
+// MountCheckErrors, those of Unmount with UnmountFunc.
+func (m *FakeMounter) SetError(method string, err error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if err == nil {
+		delete(m.errors, method)
+		return
+	}
+	m.errors[method] = err
+}
+
+// call waits for the latency and returns the error to fail method with.
+func (m *FakeMounter) call(ctx context.Context, method string) error {
+	if m.Latency > 0 {
+		timer := time.NewTimer(m.Latency)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return m.injected(method)
+}
+
+func (m *FakeMounter) injected(method string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.errors[method]
+}
+
+func (m *FakeMounter) Mount(source string, target string, fstype string, options []string) error {
+	if err := m.injected("Mount"); err != nil {
+		return err
+	}
+	// mount resolves the file descriptor paths of subpaths to their directory
+	if strings.HasPrefix(source, "/proc/") {
+		resolved, err := os.Readlink(source)
+		if err != nil {
+			return err
+		}
+		source = resolved
+	}
+	return m.FakeMounter.Mount(source, target, fstype, options)
+}
+
+func (m *FakeMounter) MakeDir(path string) error {
+	return common.MakeDir(path)
+}
+
+func (m *FakeMounter) PathExists(path string) (bool, error) {
+	return mountutils.PathExists(path)
+}
+
+func (m *FakeMounter) FcfsMount(ctx context.Context, volOptions *fcfs.VolumeOptions, mountOptions *fcfs.MountOptionsSecrets) error {
+	if err := m.call(ctx, "FcfsMount"); err != nil {
+		return err
+	}
+	if m.cfs != nil {
+		if err := m.cfs.MountVolume(ctx, volOptions, mountOptions, nil); err != nil {
+			return err
+		}
+	}
+	if err := common.CreateDirIfNotExists(volOptions.VolPath); err != nil {
+		return err
+	}
+	m.mux.Lock()
+	// fcfs_fused restarts the instance of its base path
+	for mountPoint, basePath := range m.basePaths {
+		if basePath == volOptions.BasePath() && mountPoint != volOptions.VolPath {
+			m.mux.Unlock()
+			return fmt.Errorf("base path %s is used by the mount on %s", basePath, mountPoint)
+		}
+	}
+	m.basePaths[volOptions.VolPath] = volOptions.BasePath()
+	m.mux.Unlock()
+	return m.FakeMounter.Mount(volOptions.VolName, volOptions.VolPath, fcfsFuseFsType, nil)
+}
+
+func (m *FakeMounter) FcfsUnmount(ctx context.Context, volOptions *fcfs.VolumeOptions, mountOptions *fcfs.MountOptions) error {
+	if err := m.call(ctx, "FcfsUnmount"); err != nil {
+		return err
+	}
+	// the files written to a fake mount are kept in its mount point, a real
+	// unmount would hide them
+	if notMnt, err := m.IsLikelyNotMountPoint(volOptions.VolPath); err == nil && !notMnt {
+		entries, err := ioutil.ReadDir(volOptions.VolPath)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := os.RemoveAll(filepath.Join(volOptions.VolPath, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	m.mux.Lock()
+	delete(m.basePaths, volOptions.VolPath)
+	m.mux.Unlock()
+	return mountutils.CleanupMountPoint(volOptions.VolPath, m, false)
+}
+
+func (m *FakeMounter) LazyUnmount(ctx context.Context, target string) error {
+	if err := m.call(ctx, "LazyUnmount"); err != nil {
+		return err
+	}
+	return m.FakeMounter.Unmount(target)
+}
+
+func (m *FakeMounter) AttachLoopDevice(ctx context.Context, image string) (string, error) {
+	if err := m.injected("AttachLoopDevice"); err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(image); err != nil {
+		return "", err
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if device, ok := m.loops[image]; ok {
+		return device, nil
+	}
+	device := fmt.Sprintf("/dev/loop%d", m.nextLoop)
+	m.nextLoop++
+	m.loops[image] = device
+	return device, nil
+}
+
+func (m *FakeMounter) FindLoopDevice(ctx context.Context, image string) (string, error) {
+	if err := m.injected("FindLoopDevice"); err != nil {
+		return "", err
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.loops[image], nil
+}
+
+func (m *FakeMounter) DetachLoopDevice(ctx context.Context, device string) error {
+	if err := m.injected("DetachLoopDevice"); err != nil {
+		return err
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for image, d := range m.loops {
+		if d == device {
+			delete(m.loops, image)
+			return nil
+		}
+	}
+	return fmt.Errorf("loop device %s is not attached", device)
+}
+
+func (m *FakeMounter) ResizeLoopDevice(ctx context.Context, device string) error {
+	return m.injected("ResizeLoopDevice")
+}
+
+// LoopDevices returns the attached loop devices by image.
+func (m *FakeMounter) LoopDevices() map[string]string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	loops := make(map[string]string, len(m.loops))
+	for image, device := range m.loops {
+		loops[image] = device
+	}
+	return loops
+}
@@ -17,7 +17,11 @@ limitations under the License.
 package driver
 
 import (
+	"context"
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
 	"vazmin.github.io/fastcfs-csi/pkg/common"
 	csicommon "vazmin.github.io/fastcfs-csi/pkg/csi-common"
@@ -43,6 +47,10 @@ const (
 // be overwritten in unit tests.
 var NewMetadataFunc = fcfs.NewMetadata
 
+// NewMounterFunc is a variable for the newNodeMounter function that can
+// be overwritten in unit tests.
+var NewMounterFunc = newNodeMounter
+
 func NewFcfsDriver() *fcfsDriver {
 	return &fcfsDriver{}
 }
@@ -53,25 +61,43 @@ func NewIdentityServer(d *csicommon.CSIDriver) *identityServer {
 	}
 }
 
-func NewNodeServer(d *csicommon.CSIDriver, enableFcfsFusedProxy bool, fcfsFusedEndpoint string, fcfsFusedProxyConnTimout int, topology map[string]string) *nodeServer {
-	mountOptions := &fcfs.MountOptions{
-		EnableFcfsFusedProxy:     enableFcfsFusedProxy,
-		FcfsFusedEndpoint:        fcfsFusedEndpoint,
-		FcfsFusedProxyConnTimout: fcfsFusedProxyConnTimout,
-	}
-	nodeMounter, err := newNodeMounter()
+func NewNodeServer(d *csicommon.CSIDriver, mountOptions *fcfs.MountOptions, topology map[string]string) *nodeServer {
+	nodeMounter, err := NewMounterFunc()
 	if err != nil {
 		panic(err)
 	}
-	return &nodeServer{
+	// only ephemeral volumes and the pool stats need the FastCFS tools on the node
+	cfsSrv, err := NewCFSFunc()
+	if err != nil {
+		klog.Errorf("failed to initialize FastCFS, ephemeral volumes cannot be published: %v", err)
+		cfsSrv = nil
+	}
+	ns := &nodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d, topology),
 		mounter:           nodeMounter,
 		volumeLocks:       common.NewVolumeLocks(),
 		mountOptions:      mountOptions,
+		cfs:               cfsSrv,
 	}
+	ns.stats = newVolumeStats(defaultVolumeStatsTimeout, defaultVolumeStatsCacheTTL, ns.statVolume)
+	return ns
 }
 
 func (fc *fcfsDriver) Run(conf *common.Config) {
+	shutdownTracing, err := common.InitTracing(context.Background(), conf.DriverName, &conf.Tracing)
+	if err != nil {
+		klog.Fatalf("Failed to init tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	if err := common.OpenAuditLog(conf.AuditLog); err != nil {
+		klog.Fatalf("Failed to open audit log: %v", err)
+	}
+
+	if err := common.InitConfigCache(&conf.ConfigCache); err != nil {
+		klog.Fatalf("Failed to init config cache: %v", err)
+	}
+
 	fc.driver = csicommon.NewCSIDriver(conf.DriverName, common.DriverVersion, conf.NodeID)
 	if fc.driver == nil {
 		klog.Fatalln("Failed to initialize CSI Driver")
@@ -90,31 +116,93 @@ func (fc *fcfsDriver) Run(conf *common.Config) {
 			csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
 		})
 	}
-	metadataSrv, err := NewMetadataFunc(conf.NodeID)
-	if err != nil {
-		klog.Fatalln("Failed New Metadata, %v, %q", err, conf.NodeID)
-	}
-	topology, err := common.GetTopologyFromDomainLabels(metadataSrv.GetLabels(), conf.DomainLabels, conf.DriverName)
-	if err != nil {
-		klog.Fatalln("Failed GetTopologyFromDomainLabels, %v, %q", err, conf.NodeID)
+	// the node labels are only read for the topology, so that the driver runs
+	// without Kubernetes if no domain labels are set, e.g. under csi-sanity
+	var topology map[string]string
+	if len(conf.DomainLabels) > 0 {
+		metadataSrv, err := NewMetadataFunc(conf.NodeID)
+		if err != nil {
+			klog.Fatalln("Failed New Metadata, %v, %q", err, conf.NodeID)
+		}
+		topology, err = common.GetTopologyFromDomainLabels(metadataSrv.GetLabels(), conf.DomainLabels, conf.DriverName)
+		if err != nil {
+			klog.Fatalln("Failed GetTopologyFromDomainLabels, %v, %q", err, conf.NodeID)
+		}
+		klog.V(4).Infof("topology form domain labels: %q", topology)
 	}
-	klog.V(4).Infof("topology form domain labels: %q", topology)
 
 	both := !conf.IsControllerServer && !conf.IsNodeServer
+	collectUsage := len(conf.HTTPEndpoint) > 0 && conf.VolumeUsageInterval > 0
+	sweep := (conf.IsNodeServer || both) && conf.SweepInterval > 0
+	var ephemeralSecret *v1.SecretReference
+	if (conf.IsNodeServer || both) && len(conf.EphemeralSecret) > 0 {
+		if ephemeralSecret, err = parseSecretRef(conf.EphemeralSecret); err != nil {
+			klog.Fatalf("invalid --ephemeral-secret: %v", err)
+		}
+	}
+	var (
+		kubeClient kubernetes.Interface
+		events     *eventRecorder
+	)
+	if conf.EnableEvents || collectUsage || sweep || ephemeralSecret != nil {
+		if kubeClient, err = fcfs.NewKubernetesClient(); err != nil {
+			klog.Fatalf("Failed to create kubernetes client: %v", err)
+		}
+	}
+	if conf.EnableEvents {
+		events = newEventRecorder(kubeClient, conf.DriverName, conf.NodeID)
+	}
+
+	var mountOptions *fcfs.MountOptions
 	fc.ids = NewIdentityServer(fc.driver)
 	if conf.IsControllerServer || both {
 		fc.cs, err = NewControllerServer(fc.driver)
 		if err != nil {
 			klog.Fatalln("Failed New Controller Server, %v, %q", err, conf.NodeID)
 		}
+		fc.cs.events = events
+		if collectUsage {
+			go newUsageCollector(conf.DriverName, fc.cs.cfs, kubeClient, conf.VolumeUsageInterval).run(wait.NeverStop)
+		}
 	}
 
 	if conf.IsNodeServer || both {
 		fc.driver.AddNodeServiceCapabilities([]csi.NodeServiceCapability_RPC_Type{
 			csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
 			csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+			csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
+			csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
 		})
-		fc.ns = NewNodeServer(fc.driver, conf.EnableFcfsFusedProxy, conf.FcfsFusedProxyEndpoint, conf.FcfsFusedProxyConnTimout, topology)
+		switch conf.FcfsFusedProxyFallback {
+		case fcfs.ProxyFallbackNever, fcfs.ProxyFallbackOnUnavailable:
+		default:
+			klog.Fatalf("invalid fcfsfused-proxy fallback policy %q", conf.FcfsFusedProxyFallback)
+		}
+		mountOptions = &fcfs.MountOptions{
+			EnableFcfsFusedProxy:     conf.EnableFcfsFusedProxy,
+			FcfsFusedEndpoint:        conf.FcfsFusedProxyEndpoint,
+			FcfsFusedProxyConnTimout: conf.FcfsFusedProxyConnTimout,
+			FcfsFusedProxyTLS:        &conf.FcfsFusedProxyTLS,
+			FcfsFusedProxyFallback:   conf.FcfsFusedProxyFallback,
+		}
+		fc.ns = NewNodeServer(fc.driver, mountOptions, topology)
+		fc.ns.events = events
+		fc.ns.ephemeral = conf.Ephemeral
+		if ephemeralSecret != nil {
+			fc.ns.ephemeralSecrets = func(ctx context.Context) (map[string]string, error) {
+				return getSecrets(ctx, kubeClient, ephemeralSecret)
+			}
+		}
+		fc.ns.stats = newVolumeStats(conf.VolumeStatsTimeout, conf.VolumeStatsCacheTTL, fc.ns.statVolume)
+		fc.ns.statsQuota = conf.VolumeStatsQuota
+		if sweep {
+			go newMountSweeper(fc.ns, kubeClient, conf.DriverName, conf.NodeID, conf.KubeletDir, conf.SweepInterval).run(wait.NeverStop)
+		}
+	}
+	fc.ids.health = newHealthChecker(conf.ProbeCacheTTL, healthChecks(conf, mountOptions))
+
+	if len(conf.HTTPEndpoint) > 0 {
+		common.ServeMetrics(conf.HTTPEndpoint)
 	}
 
 	s := csicommon.NewNonBlockingGRPCServer()
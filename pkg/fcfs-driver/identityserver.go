@@ -23,7 +23,10 @@ package driver
 
 import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 	glog "k8s.io/klog/v2"
 	csicommon "vazmin.github.io/fastcfs-csi/pkg/csi-common"
 )
@@ -32,6 +35,20 @@ import (
 // identity server spec.
 type identityServer struct {
 	*csicommon.DefaultIdentityServer
+	health *healthChecker
+}
+
+// probeFailureKey is the trailer carrying the reason of a not ready Probe.
+const probeFailureKey = "fcfs-probe-failure"
+
+// Probe reports not ready when a health check of the plugin fails.
+func (is *identityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	if err := is.health.check(ctx); err != nil {
+		glog.Warningf("probe failed: %v", err)
+		_ = grpc.SetTrailer(ctx, metadata.Pairs(probeFailureKey, err.Error()))
+		return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: false}}, nil
+	}
+	return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: true}}, nil
 }
 
 func (is *identityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
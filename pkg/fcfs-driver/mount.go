@@ -3,9 +3,14 @@ package driver
 import (
 	"context"
 	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
 	"k8s.io/klog/v2"
 	mountutils "k8s.io/mount-utils"
 	utilexec "k8s.io/utils/exec"
+	"os"
+	"path/filepath"
 	"strings"
 	"vazmin.github.io/fastcfs-csi/pkg/common"
 	"vazmin.github.io/fastcfs-csi/pkg/fcfs"
@@ -21,6 +26,15 @@ type Mounter interface {
 	PathExists(path string) (bool, error)
 
 	FcfsMount(ctx context.Context, volOptions *fcfs.VolumeOptions, mountOptions *fcfs.MountOptionsSecrets) error
+	FcfsUnmount(ctx context.Context, volOptions *fcfs.VolumeOptions, mountOptions *fcfs.MountOptions) error
+	// LazyUnmount detaches the mount at target, even if its file system does not respond
+	LazyUnmount(ctx context.Context, target string) error
+
+	// loop devices of the images of block volumes
+	AttachLoopDevice(ctx context.Context, image string) (string, error)
+	FindLoopDevice(ctx context.Context, image string) (string, error)
+	DetachLoopDevice(ctx context.Context, device string) error
+	ResizeLoopDevice(ctx context.Context, device string) error
 }
 
 type NodeMounter struct {
@@ -44,19 +58,106 @@ func (n *NodeMounter) PathExists(path string) (bool, error) {
 	return mountutils.PathExists(path)
 }
 
-func (n *NodeMounter) FcfsMount(ctx context.Context, volOptions *fcfs.VolumeOptions, mountOptions *fcfs.MountOptionsSecrets) error {
+// mountPath is the way a volume got mounted, unmount goes through the same path.
+type mountPath string
+
+const (
+	directMountPath mountPath = "direct"
+	proxyMountPath  mountPath = "proxy"
 
+	// mountPathFileName is stored next to the staging path, as kubelet keeps vol_data.json
+	mountPathFileName = "fcfs-mount-path"
+)
+
+func (n *NodeMounter) FcfsMount(ctx context.Context, volOptions *fcfs.VolumeOptions, mountOptions *fcfs.MountOptionsSecrets) error {
 	if mountOptions.EnableFcfsFusedProxy {
 		_, err := fcfs.MountFcfsFusedWithProxy(ctx, volOptions, mountOptions)
+		if err == nil {
+			return saveMountPath(volOptions.VolPath, proxyMountPath)
+		}
+		if mountOptions.FcfsFusedProxyFallback != fcfs.ProxyFallbackOnUnavailable || !fcfs.IsProxyUnavailable(err) {
+			return err
+		}
+		common.Log(ctx).Warningf("falling back to direct mount of volume %s: %v", volOptions.VolID, err)
+	}
+	credentials, err := common.GetCredentialsForVolume(volOptions.PreProvisioned, mountOptions.Secrets)
+	if err != nil {
 		return err
-	} else {
-		credentials, err := common.GetCredentialsForVolume(volOptions.PreProvisioned, mountOptions.Secrets)
-		if err != nil {
+	}
+	defer credentials.DeleteCredentials()
+	if err := fcfs.FuseMount(ctx, volOptions, credentials); err != nil {
+		return err
+	}
+	return saveMountPath(volOptions.VolPath, directMountPath)
+}
+
+func (n *NodeMounter) FcfsUnmount(ctx context.Context, volOptions *fcfs.VolumeOptions, mountOptions *fcfs.MountOptions) error {
+	path := loadMountPath(volOptions.VolPath, mountOptions)
+	if path == proxyMountPath {
+		err := fcfs.UnmountFcfsFusedWithProxy(ctx, volOptions, mountOptions)
+		switch {
+		case err == nil:
+			return removeMountPath(volOptions.VolPath)
+		case status.Code(err) == codes.Unimplemented:
+			common.Log(ctx).Warningf("fcfsfused-proxy does not support unmount, unmounting %s directly", volOptions.VolPath)
+		case mountOptions.FcfsFusedProxyFallback == fcfs.ProxyFallbackOnUnavailable && fcfs.IsProxyUnavailable(err):
+			common.Log(ctx).Warningf("falling back to direct unmount of volume %s: %v", volOptions.VolID, err)
+		default:
 			return err
 		}
-		defer credentials.DeleteCredentials()
-		return fcfs.FuseMount(ctx, volOptions, credentials)
 	}
+	if err := mountutils.CleanupMountPoint(volOptions.VolPath, n, false); err != nil {
+		return err
+	}
+	return removeMountPath(volOptions.VolPath)
+}
+
+func (n *NodeMounter) LazyUnmount(ctx context.Context, target string) error {
+	output, err := common.ExecCommand(ctx, "umount", "--lazy", target)
+	if err != nil {
+		if strings.Contains(string(output), "not mounted") || strings.Contains(string(output), "No such file or directory") {
+			return nil
+		}
+		return fmt.Errorf("failed to unmount %s lazily: %w, output: %s", target, err, string(output))
+	}
+	return nil
+}
+
+func mountPathFile(stagingPath string) string {
+	return filepath.Join(filepath.Dir(stagingPath), mountPathFileName)
+}
+
+func saveMountPath(stagingPath string, path mountPath) error {
+	if err := ioutil.WriteFile(mountPathFile(stagingPath), []byte(path), 0600); err != nil {
+		return fmt.Errorf("failed to record mount path of %s: %w", stagingPath, err)
+	}
+	return nil
+}
+
+// loadMountPath returns the recorded mount path, volumes staged before it was
+// recorded follow the current proxy setting.
+func loadMountPath(stagingPath string, mountOptions *fcfs.MountOptions) mountPath {
+	content, err := ioutil.ReadFile(mountPathFile(stagingPath))
+	if err == nil {
+		switch path := mountPath(strings.TrimSpace(string(content))); path {
+		case directMountPath, proxyMountPath:
+			return path
+		}
+	}
+	if err != nil && !os.IsNotExist(err) {
+		klog.Warningf("failed to read mount path of %s: %v", stagingPath, err)
+	}
+	if mountOptions.EnableFcfsFusedProxy {
+		return proxyMountPath
+	}
+	return directMountPath
+}
+
+func removeMountPath(stagingPath string) error {
+	if err := os.Remove(mountPathFile(stagingPath)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
 }
 
 func bindMount(ctx context.Context, from, to string, mntOptions []string) error {
@@ -64,17 +165,17 @@ func bindMount(ctx context.Context, from, to string, mntOptions []string) error
 
 	output, err := common.ExecCommand(ctx, "mount", "-o", mntOptionSli, from, to)
 	if err == nil {
-		klog.V(5).Infof("successfully to mount bind.")
+		common.Log(ctx).V(5).Infof("successfully to mount bind.")
 		return err
 	}
-	klog.Warningf("failed to mount bind, from %s, to %s output <= %s", from, to, string(output))
+	common.Log(ctx).Warningf("failed to mount bind, from %s, to %s output <= %s", from, to, string(output))
 	return fmt.Errorf("failed to bind-mount %s to %s: %w", from, to, err)
 }
 
 func unmountVolume(ctx context.Context, mountPoint string) error {
 	output, err := common.ExecCommand(ctx, "umount", mountPoint)
 	if err != nil {
-		klog.Warningf("unmount volume err, %s, %v", string(output), err)
+		common.Log(ctx).Warningf("unmount volume err, %s, %v", string(output), err)
 		if strings.Contains(err.Error(), fmt.Sprintf("exit status 32: umount: %s: not mounted", mountPoint)) ||
 			strings.Contains(err.Error(), "No such file or directory") {
 			return nil
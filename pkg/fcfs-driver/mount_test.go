@@ -0,0 +1,65 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"vazmin.github.io/fastcfs-csi/pkg/fcfs"
+)
+
+func TestMountPath(t *testing.T) {
+	testCases := []struct {
+		name         string
+		saved        mountPath
+		content      string
+		enableProxy  bool
+		expectedPath mountPath
+	}{
+		{name: "saved direct with proxy enabled", saved: directMountPath, enableProxy: true, expectedPath: directMountPath},
+		{name: "saved proxy with proxy disabled", saved: proxyMountPath, enableProxy: false, expectedPath: proxyMountPath},
+		{name: "missing with proxy enabled", enableProxy: true, expectedPath: proxyMountPath},
+		{name: "missing with proxy disabled", enableProxy: false, expectedPath: directMountPath},
+		{name: "garbage", content: "unknown", enableProxy: true, expectedPath: proxyMountPath},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "fcfs-mount-path")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			stagingPath := filepath.Join(dir, "globalmount")
+
+			if len(tc.saved) > 0 {
+				require.NoError(t, saveMountPath(stagingPath, tc.saved))
+			}
+			if len(tc.content) > 0 {
+				require.NoError(t, ioutil.WriteFile(mountPathFile(stagingPath), []byte(tc.content), 0600))
+			}
+			mountOptions := &fcfs.MountOptions{EnableFcfsFusedProxy: tc.enableProxy}
+			require.Equal(t, tc.expectedPath, loadMountPath(stagingPath, mountOptions))
+
+			require.NoError(t, removeMountPath(stagingPath))
+			require.NoError(t, removeMountPath(stagingPath))
+			_, err = os.Stat(mountPathFile(stagingPath))
+			require.True(t, os.IsNotExist(err))
+		})
+	}
+}
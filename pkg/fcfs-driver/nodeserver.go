@@ -19,12 +19,13 @@ package driver
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"io/ioutil"
 	"k8s.io/klog/v2"
-	"k8s.io/kubernetes/pkg/volume"
 	"k8s.io/mount-utils"
 	"os"
 	"vazmin.github.io/fastcfs-csi/pkg/common"
@@ -37,6 +38,17 @@ type nodeServer struct {
 	mountOptions *fcfs.MountOptions
 	mounter      Mounter
 	volumeLocks  *common.VolumeLocks
+	events       *eventRecorder
+	// cfs creates and deletes the pools of ephemeral volumes
+	cfs fcfs.Cfs
+	// ephemeral publishes volumes without csi.storage.k8s.io/ephemeral as inline volumes
+	ephemeral bool
+	stats     *volumeStats
+	// statsQuota reports the quota and usage of the pool in the volume stats
+	statsQuota bool
+	// ephemeralSecrets returns the admin secrets the pools of ephemeral volumes
+	// are deleted with, nil if none are configured
+	ephemeralSecrets func(ctx context.Context) (map[string]string, error)
 }
 
 func (ns *nodeServer) NodeStageVolume(ctx context.Context, request *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
@@ -46,22 +58,36 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, request *csi.NodeStag
 
 	stagingTargetPath := request.GetStagingTargetPath()
 	volumeId := request.GetVolumeId()
+	owner, err := newVolumeOwner(request.GetVolumeCapability(), request.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	fuseOptions, err := newFuseOptions(request.GetVolumeCapability(), request.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	clientConfig := common.ClientConfigParameters(request.GetVolumeContext())
+	if err := common.ValidateClientConfig(clientConfig); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	block := isBlock(request.GetVolumeCapability())
+	if err := validateBlockCapability(request.GetVolumeCapability()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	imageSize, err := parseImageSize(request.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
 	if acquired := ns.volumeLocks.TryAcquire(volumeId); !acquired {
-		klog.Error(common.VolumeOperationAlreadyExistsFmt, volumeId)
+		common.Log(ctx).Errorf(common.VolumeOperationAlreadyExistsFmt, volumeId)
 		return nil, status.Errorf(codes.Aborted, common.VolumeOperationAlreadyExistsFmt, volumeId)
 	}
 	defer ns.volumeLocks.Release(volumeId)
 
-	mnt, err := ns.ensureMountPoint(stagingTargetPath)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Could not mount target %q: %v", stagingTargetPath, err)
+	if err := ns.remountStale(ctx, stagingTargetPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unmount stale staging target %q: %v", stagingTargetPath, err)
 	}
-	if mnt {
-		klog.V(2).Infof("NodeStageVolume: volume %s is already mounted on %s", volumeId, stagingTargetPath)
-		return &csi.NodeStageVolumeResponse{}, nil
-	}
-
 
 	volOptions, err := NewVolOptionsFromVolID(volumeId, nil)
 
@@ -74,19 +100,65 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, request *csi.NodeStag
 		return nil, status.Errorf(codes.Internal, "new FcfsVolume err %v", err)
 	}
 	volOptions.VolPath = stagingTargetPath
+	volOptions.FuseOptions = fuseOptions
+	volOptions.ClientConfig = clientConfig
 
+	mnt, err := ns.ensureMountPoint(stagingTargetPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not mount target %q: %v", stagingTargetPath, err)
+	}
+	if mnt {
+		common.Log(ctx).V(2).Infof("NodeStageVolume: volume %s is already mounted on %s", volumeId, stagingTargetPath)
+	} else if err := ns.mountStagedVolume(ctx, request, volOptions); err != nil {
+		return nil, err
+	}
+
+	// the mounted volume is set up on every stage, so that a stage retried
+	// after a failure, or of a volume staged by an older node plugin, completes it
+	if block {
+		if err := ns.attachBlockImage(ctx, volumeId, stagingTargetPath, imageSize); err != nil {
+			return nil, err
+		}
+	} else if owner != nil {
+		if err := owner.apply(ctx, stagingTargetPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to set the owner of volume %s: %v", volumeId, err)
+		}
+	}
+	if ns.statsQuota && !block {
+		if err := saveStagedPool(stagingTargetPath, &stagedPool{
+			BaseConfigURL:  volOptions.BaseConfigURL,
+			VolName:        volOptions.VolName,
+			PreProvisioned: volOptions.PreProvisioned,
+			Secrets:        common.VolumeSecrets(volOptions.PreProvisioned, request.GetSecrets()),
+		}); err != nil {
+			common.Log(ctx).Warningf("failed to record the pool of volume %s, its stats report the file system: %v", volumeId, err)
+		}
+	}
+
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// mountStagedVolume mounts the pool of volOptions at its staging path.
+func (ns *nodeServer) mountStagedVolume(ctx context.Context, request *csi.NodeStageVolumeRequest, volOptions *fcfs.VolumeOptions) error {
 	mountOptions := &fcfs.MountOptionsSecrets{
 		MountOptions: ns.mountOptions,
 		Secrets:      request.Secrets,
 	}
 
-	err = ns.mounter.FcfsMount(ctx, volOptions, mountOptions)
+	err := ns.mounter.FcfsMount(ctx, volOptions, mountOptions)
+	common.Audit(ctx, &common.AuditEvent{
+		Operation: common.AuditMount,
+		VolumeID:  request.GetVolumeId(),
+		Pool:      volOptions.VolName,
+		User:      common.VolumeUserName(volOptions.PreProvisioned, request.GetSecrets()),
+		Request:   protosanitizer.StripSecrets(request).String(),
+	}, err)
 
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "[FcfsCFS] fuse mount err %v", err)
+		ns.events.volumeFailed(request.GetVolumeId(), "NodeStageVolume", nil, err)
+		return status.Errorf(codes.Internal, "[FcfsCFS] fuse mount err %v", err)
 	}
-
-	return &csi.NodeStageVolumeResponse{}, nil
+	return nil
 }
 
 func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
@@ -114,16 +186,35 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 		// return nil, status.Errorf(codes.NotFound, "Volume not mounted %s", targetPath)
 	}
 
-	//vol, err := NewVolOptionsFromVolID(volumeID, nil)
-	//if err != nil {
-	//	return nil, status.Error(codes.Internal, err.Error())
-	//}
-	klog.V(2).Infof("NodeUnstageVolume: CleanupMountPoint %s on volumeID(%s)", targetPath, volumeID)
-	//err = fuseUnmount(ctx, vol)
-	err = mount.CleanupMountPoint(targetPath, ns.mounter, false)
+	volOptions, err := NewVolOptionsFromVolID(volumeID, nil)
+	if errors.Is(err, common.ErrInvalidVolID) {
+		// static volume handles start with their pool
+		pool, _ := splitStaticVolumeID(volumeID)
+		volOptions, err = &fcfs.VolumeOptions{VolID: volumeID, VolName: pool}, nil
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	volOptions.VolPath = targetPath
+	// the image of a block volume is in use until its loop device is detached
+	if err := ns.detachBlockImage(ctx, targetPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to detach the block image of volume %s: %v", volumeID, err)
+	}
+	common.Log(ctx).V(2).Infof("NodeUnstageVolume: CleanupMountPoint %s on volumeID(%s)", targetPath, volumeID)
+	defer ns.stats.forget(targetPath)
+	err = ns.mounter.FcfsUnmount(ctx, volOptions, ns.mountOptions)
+	common.Audit(ctx, &common.AuditEvent{
+		Operation: common.AuditUnmount,
+		VolumeID:  volumeID,
+		Pool:      volOptions.VolName,
+		Request:   protosanitizer.StripSecrets(req).String(),
+	}, err)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to unmount staging target %q: %v", targetPath, err)
 	}
+	if err := removeStagedPool(targetPath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
@@ -145,45 +236,90 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	if len(targetPath) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Target path not provided")
 	}
+	// inline volumes are not staged, their pool is mounted at the target path
+	ephemeral := isEphemeral(req.GetVolumeContext(), ns.ephemeral)
 	stagingTargetPath := req.GetStagingTargetPath()
-	if len(stagingTargetPath) == 0 {
+	if len(stagingTargetPath) == 0 && !ephemeral {
 		return nil, status.Error(codes.InvalidArgument, "StagingTargetPath path not provided")
 	}
-	//ephemeralVolume := request.GetVolumeContext()["csi.storage.k8s.io/ephemeral"] == "true" ||
-	//	request.GetVolumeContext()["csi.storage.k8s.io/ephemeral"] == "" && fc.conf.Ephemeral // Kubernetes 1.15 doesn't have csi.storage.k8s.io/ephemeral.
 
-	if req.GetVolumeCapability().GetBlock() != nil {
-		return nil, status.Error(codes.InvalidArgument, "FastCFS doesn't support block access type")
+	block := isBlock(req.GetVolumeCapability())
+	if err := validateBlockCapability(req.GetVolumeCapability()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	volumeContext, err := staticSubPathContext(volumeId, req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	subPath, err := newSubPath(req.GetVolumeCapability(), volumeContext)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if block && subPath != nil {
+		return nil, status.Error(codes.InvalidArgument, "block volumes cannot have a subpath")
+	}
+	if ephemeral && (block || subPath != nil) {
+		return nil, status.Error(codes.InvalidArgument, "ephemeral volumes cannot be block volumes or have a subpath")
 	}
 
 	if acquired := ns.volumeLocks.TryAcquire(volumeId); !acquired {
-		klog.Errorf(common.VolumeOperationAlreadyExistsFmt, volumeId)
+		common.Log(ctx).Errorf(common.VolumeOperationAlreadyExistsFmt, volumeId)
 		return nil, status.Errorf(codes.Aborted, common.VolumeOperationAlreadyExistsFmt, volumeId)
 	}
 	defer ns.volumeLocks.Release(volumeId)
 
+	if ephemeral {
+		return ns.publishEphemeralVolume(ctx, req)
+	}
+	if block {
+		return ns.publishBlockVolume(ctx, req)
+	}
+
+	if err := ns.remountStale(ctx, targetPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unmount stale target %q: %v", targetPath, err)
+	}
 	mnt, err := ns.ensureMountPoint(targetPath)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Could not mount target %q: %v", targetPath, err)
 	}
 	if mnt {
-		klog.V(2).Infof("NodePublishVolume: volume %s is already mounted on %s", volumeId, targetPath)
+		common.Log(ctx).V(2).Infof("NodePublishVolume: volume %s is already mounted on %s", volumeId, targetPath)
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
+	source := stagingTargetPath
+	if subPath != nil {
+		// the subpath must be created in the pool, not below an unmounted staging path
+		notMnt, err := ns.mounter.IsLikelyNotMountPoint(stagingTargetPath)
+		if err != nil || notMnt {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s is not staged at %q", volumeId, stagingTargetPath)
+		}
+		dir, err := subPath.open(stagingTargetPath)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Could not create subpath of volume %s: %v", volumeId, err)
+		}
+		defer dir.Close()
+		// the directory opened is mounted, not the path, which may have changed since
+		source = fdPath(dir)
+	}
+
 	mountOptions := []string{"bind", "_netdev"}
 	mountOptions = common.ConstructMountOptions(mountOptions, req.GetVolumeCapability())
+	// the fuse options are applied by fcfs_fused in NodeStageVolume
+	if _, mountOptions, err = common.SplitFuseMountOptions(mountOptions); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 	if req.GetReadonly() {
 		mountOptions = append(mountOptions, "ro")
 	}
 	//err = bindMount(ctx, req.GetStagingTargetPath(), targetPath, mountOptions)
-	if err := ns.mounter.Mount(stagingTargetPath, targetPath, "", mountOptions); err != nil {
+	if err := ns.mounter.Mount(source, targetPath, "", mountOptions); err != nil {
 		if removeErr := os.Remove(targetPath); removeErr != nil {
 			return nil, status.Errorf(codes.Internal, "Could not remove mount target %q: %v", targetPath, removeErr)
 		}
-		return nil, status.Errorf(codes.Internal, "Could not mount %q at %q: %v", stagingTargetPath, targetPath, err)
+		return nil, status.Errorf(codes.Internal, "Could not mount %q at %q: %v", source, targetPath, err)
 	}
-	klog.V(4).Infof("successfully mount %s to %s, %v", stagingTargetPath, targetPath, mountOptions)
+	common.Log(ctx).V(4).Infof("successfully mount %s to %s, %v", source, targetPath, mountOptions)
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
@@ -202,7 +338,19 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	}
 	defer ns.volumeLocks.Release(volumeID)
 
-	klog.V(2).Infof("NodeUnpublishVolume: CleanupMountPoint %s on volumeID(%s)", targetPath, volumeID)
+	common.Log(ctx).V(2).Infof("NodeUnpublishVolume: CleanupMountPoint %s on volumeID(%s)", targetPath, volumeID)
+	defer ns.stats.forget(targetPath)
+
+	ephemeralVol, err := loadEphemeralVolume(targetPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if ephemeralVol != nil {
+		if err := ns.unpublishEphemeralVolume(ctx, req, ephemeralVol); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to unpublish ephemeral volume %s: %v", volumeID, err)
+		}
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
 
 	if err := unmountVolume(ctx, targetPath); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
@@ -212,7 +360,7 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	klog.Infof("[FastCFS] successfully unbind volume %s from %s", req.GetVolumeId(), targetPath)
+	common.Log(ctx).Infof("[FastCFS] successfully unbind volume %s from %s", req.GetVolumeId(), targetPath)
 
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
@@ -226,75 +374,94 @@ func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats volume path was empty")
 	}
 
-	notMount, err := ns.mounter.IsLikelyNotMountPoint(req.VolumePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, status.Errorf(codes.NotFound, "NodeGetVolumeStats: path %s does not exist", req.VolumePath)
-		}
-		return nil, status.Errorf(codes.Internal, "failed to stat file %s: %v", req.VolumePath, err)
-	}
-	if notMount {
-		return nil, status.Errorf(codes.InvalidArgument, "volume path %s is not mounted", req.VolumePath)
-	}
-
 	volumeId := req.GetVolumeId()
 	if acquired := ns.volumeLocks.TryAcquire(volumeId); !acquired {
-		klog.Errorf(common.VolumeOperationAlreadyExistsFmt, volumeId)
+		common.Log(ctx).Errorf(common.VolumeOperationAlreadyExistsFmt, volumeId)
 		return nil, status.Errorf(codes.Aborted, common.VolumeOperationAlreadyExistsFmt, volumeId)
 	}
 	defer ns.volumeLocks.Release(volumeId)
 
-	volumeMetrics, err := volume.NewMetricsStatFS(req.VolumePath).GetMetrics()
-	if err != nil {
+	// the stats are read in a worker bounded in time, so that a wedged
+	// fcfs_fused holds the volume lock no longer than that
+	usage, err := ns.stats.get(ctx, req.VolumePath, req.GetStagingTargetPath())
+	switch {
+	case err == nil:
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage:           usage,
+			VolumeCondition: &csi.VolumeCondition{Message: "volume is healthy"},
+		}, nil
+	case os.IsNotExist(err):
+		return nil, status.Errorf(codes.NotFound, "NodeGetVolumeStats: path %s does not exist", req.VolumePath)
+	case errors.Is(err, errNotMounted):
+		return nil, status.Errorf(codes.InvalidArgument, "volume path %s is not mounted", req.VolumePath)
+	case isStaleMount(err):
+		common.Log(ctx).Warningf("volume %s at %s is stale, it is mounted again on the next stage or publish: %v", volumeId, req.VolumePath, err)
+		ns.stats.markStale(req.VolumePath, req.GetStagingTargetPath())
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage: ns.stats.lastUsage(req.VolumePath),
+			VolumeCondition: &csi.VolumeCondition{
+				Abnormal: true,
+				Message:  fmt.Sprintf("fcfs_fused of volume path %s is not responding: %v", req.VolumePath, err),
+			},
+		}, nil
+	default:
 		return nil, status.Errorf(codes.Internal, "failed to get metrics: %v", err)
 	}
+}
 
-	available, ok := volumeMetrics.Available.AsInt64()
-	if !ok {
-		return nil, status.Errorf(codes.Internal, "failed to transform volume available size(%v)", volumeMetrics.Available)
+func (ns *nodeServer) NodeExpandVolume(ctx context.Context, request *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	volumeId := request.GetVolumeId()
+	if len(volumeId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
-	capacity, ok := volumeMetrics.Capacity.AsInt64()
-	if !ok {
-		return nil, status.Errorf(codes.Internal, "failed to transform volume capacity size(%v)", volumeMetrics.Capacity)
+	if len(request.GetVolumePath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume path missing in request")
 	}
-	used, ok := volumeMetrics.Used.AsInt64()
-	if !ok {
-		return nil, status.Errorf(codes.Internal, "failed to transform volume used size(%v)", volumeMetrics.Used)
+	if _, err := os.Stat(request.GetVolumePath()); err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume path %s does not exist", request.GetVolumePath())
+		}
+		return nil, status.Errorf(codes.Internal, "failed to stat file %s: %v", request.GetVolumePath(), err)
 	}
-
-	inodesFree, ok := volumeMetrics.InodesFree.AsInt64()
-	if !ok {
-		return nil, status.Errorf(codes.Internal, "failed to transform disk inodes free(%v)", volumeMetrics.InodesFree)
+	ns.stats.invalidate(request.GetVolumePath())
+	// the quota of the pool of a filesystem volume is raised by the controller
+	if !isBlock(request.GetVolumeCapability()) {
+		return &csi.NodeExpandVolumeResponse{}, nil
 	}
-	inodes, ok := volumeMetrics.Inodes.AsInt64()
-	if !ok {
-		return nil, status.Errorf(codes.Internal, "failed to transform disk inodes(%v)", volumeMetrics.Inodes)
+	stagingTargetPath := request.GetStagingTargetPath()
+	if len(stagingTargetPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "StagingTargetPath path not provided")
 	}
-	inodesUsed, ok := volumeMetrics.InodesUsed.AsInt64()
-	if !ok {
-		return nil, status.Errorf(codes.Internal, "failed to transform disk inodes used(%v)", volumeMetrics.InodesUsed)
+	requiredBytes := request.GetCapacityRange().GetRequiredBytes()
+	if requiredBytes <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "Capacity range missing in request")
 	}
 
-	return &csi.NodeGetVolumeStatsResponse{
-		Usage: []*csi.VolumeUsage{
-			{
-				Unit:      csi.VolumeUsage_BYTES,
-				Available: available,
-				Total:     capacity,
-				Used:      used,
-			},
-			{
-				Unit:      csi.VolumeUsage_INODES,
-				Available: inodesFree,
-				Total:     inodes,
-				Used:      inodesUsed,
-			},
-		},
-	}, nil
-}
+	if acquired := ns.volumeLocks.TryAcquire(volumeId); !acquired {
+		common.Log(ctx).Errorf(common.VolumeOperationAlreadyExistsFmt, volumeId)
+		return nil, status.Errorf(codes.Aborted, common.VolumeOperationAlreadyExistsFmt, volumeId)
+	}
+	defer ns.volumeLocks.Release(volumeId)
 
-func (ns *nodeServer) NodeExpandVolume(ctx context.Context, request *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "NodeExpandVolume")
+	image := blockImagePath(stagingTargetPath)
+	size, err := growBlockImage(image, common.RoundOffBytes(requiredBytes))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "block image of volume %s not found: %v", volumeId, err)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to grow the block image of volume %s: %v", volumeId, err)
+	}
+	device, err := ns.mounter.FindLoopDevice(ctx, image)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if len(device) > 0 {
+		if err := ns.mounter.ResizeLoopDevice(ctx, device); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	common.Log(ctx).V(4).Infof("expanded the block image of volume %s to %d bytes", volumeId, size)
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: size}, nil
 }
 
 func (ns *nodeServer) NodeGetInfo(ctx context.Context, request *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
@@ -307,6 +474,77 @@ func (ns *nodeServer) NodeGetInfo(ctx context.Context, request *csi.NodeGetInfoR
 	}, nil
 }
 
+// attachBlockImage creates the image of a block volume staged at stagingPath,
+// if it does not exist, and attaches it to a loop device.
+func (ns *nodeServer) attachBlockImage(ctx context.Context, volumeID, stagingPath string, size int64) error {
+	image, err := ensureBlockImage(stagingPath, size)
+	if err != nil {
+		if errors.Is(err, errBlockImageMissing) {
+			return status.Errorf(codes.FailedPrecondition, "volume %s has no block image: %v", volumeID, err)
+		}
+		return status.Errorf(codes.Internal, "failed to create the block image of volume %s: %v", volumeID, err)
+	}
+	device, err := ns.mounter.AttachLoopDevice(ctx, image)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	common.Log(ctx).V(4).Infof("attached the block image of volume %s to %s", volumeID, device)
+	return nil
+}
+
+// detachBlockImage detaches the loop device of the block image in the pool
+// staged at stagingPath, if any.
+func (ns *nodeServer) detachBlockImage(ctx context.Context, stagingPath string) error {
+	image := blockImagePath(stagingPath)
+	if _, err := os.Stat(image); os.IsNotExist(err) {
+		return nil
+	}
+	device, err := ns.mounter.FindLoopDevice(ctx, image)
+	if err != nil || len(device) == 0 {
+		return err
+	}
+	return ns.mounter.DetachLoopDevice(ctx, device)
+}
+
+// publishBlockVolume bind-mounts the loop device of a staged block volume on
+// the target file.
+func (ns *nodeServer) publishBlockVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	volumeId := req.GetVolumeId()
+	targetPath := req.GetTargetPath()
+	device, err := ns.mounter.FindLoopDevice(ctx, blockImagePath(req.GetStagingTargetPath()))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if len(device) == 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is not staged at %q", volumeId, req.GetStagingTargetPath())
+	}
+
+	if err := createTargetFile(targetPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not create target file %q: %v", targetPath, err)
+	}
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not check target %q: %v", targetPath, err)
+	}
+	if !notMnt {
+		common.Log(ctx).V(2).Infof("NodePublishVolume: volume %s is already published on %s", volumeId, targetPath)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	mountOptions := []string{"bind"}
+	if req.GetReadonly() {
+		mountOptions = append(mountOptions, "ro")
+	}
+	if err := ns.mounter.Mount(device, targetPath, "", mountOptions); err != nil {
+		if removeErr := os.Remove(targetPath); removeErr != nil {
+			return nil, status.Errorf(codes.Internal, "Could not remove mount target %q: %v", targetPath, removeErr)
+		}
+		return nil, status.Errorf(codes.Internal, "Could not mount %q at %q: %v", device, targetPath, err)
+	}
+	common.Log(ctx).V(4).Infof("successfully mount %s to %s, %v", device, targetPath, mountOptions)
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
 // ensureMountPoint: create mount point if not exists
 // return <true, nil> if it's already a mounted point otherwise return <false, nil>
 func (ns *nodeServer) ensureMountPoint(target string) (bool, error) {
@@ -0,0 +1,314 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mountutils "k8s.io/mount-utils"
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+	csicommon "vazmin.github.io/fastcfs-csi/pkg/csi-common"
+	"vazmin.github.io/fastcfs-csi/pkg/fcfs"
+	"vazmin.github.io/fastcfs-csi/pkg/fcfs/fake"
+)
+
+// newFakeNodeServer returns a node server on a FakeMounter of a fake.Cfs
+// holding the static pool "legacy-app".
+func newFakeNodeServer(t *testing.T) (*nodeServer, *FakeMounter) {
+	cfs := fake.NewCfs()
+	cfs.AddPool(testConfigBasePath, "user", fcfs.Pool{Name: "legacy-app", QuotaBytes: common.GiB})
+	mounter := NewFakeMounter(cfs)
+	newMounterFunc := NewMounterFunc
+	NewMounterFunc = func() (Mounter, error) { return mounter, nil }
+	defer func() { NewMounterFunc = newMounterFunc }()
+	newCFSFunc := NewCFSFunc
+	NewCFSFunc = func() (fcfs.Cfs, error) { return cfs, nil }
+	defer func() { NewCFSFunc = newCFSFunc }()
+
+	d := csicommon.NewCSIDriver(common.DefaultDriverName, common.DriverVersion, "node-1")
+	ns := NewNodeServer(d, &fcfs.MountOptions{}, nil)
+	ns.ephemeralSecrets = func(ctx context.Context) (map[string]string, error) {
+		return testAdminSecrets, nil
+	}
+	return ns, mounter
+}
+
+func newNodeStageVolumeRequest(volumeID, stagingPath string) *csi.NodeStageVolumeRequest {
+	return &csi.NodeStageVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: stagingPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+		VolumeContext: map[string]string{
+			common.StaticVolumeKey:       "true",
+			common.FastCFSConfigBasePath: testConfigBasePath,
+		},
+		Secrets: map[string]string{"userName": "user", "userSecretKey": "user-key"},
+	}
+}
+
+func TestNodeStageVolume(t *testing.T) {
+	ns, mounter := newFakeNodeServer(t)
+	ctx := context.Background()
+	stagingPath := t.TempDir()
+	targetPath := filepath.Join(t.TempDir(), "mount")
+
+	_, err := ns.NodeStageVolume(ctx, newNodeStageVolumeRequest("legacy-app", stagingPath))
+	require.NoError(t, err)
+	require.Len(t, mounter.MountPoints, 1)
+	require.Equal(t, "legacy-app", mounter.MountPoints[0].Device)
+	require.Equal(t, fcfsFuseFsType, mounter.MountPoints[0].Type)
+
+	// staging a mounted volume again succeeds without mounting
+	_, err = ns.NodeStageVolume(ctx, newNodeStageVolumeRequest("legacy-app", stagingPath))
+	require.NoError(t, err)
+	require.Len(t, mounter.MountPoints, 1)
+
+	volCap := newNodeStageVolumeRequest("legacy-app", stagingPath).GetVolumeCapability()
+	volCap.GetMount().MountFlags = []string{"allow_other", "noexec"}
+	_, err = ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:          "legacy-app",
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  volCap,
+		Readonly:          true,
+	})
+	require.NoError(t, err)
+	require.Len(t, mounter.MountPoints, 2)
+	require.Equal(t, "legacy-app", mounter.MountPoints[1].Device, "bind mounts show the device of the source")
+	require.Contains(t, mounter.MountPoints[1].Opts, "ro")
+	require.Contains(t, mounter.MountPoints[1].Opts, "noexec")
+	require.NotContains(t, mounter.MountPoints[1].Opts, "allow_other", "fuse options are not bind mount options")
+
+	_, err = ns.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: "legacy-app", StagingTargetPath: stagingPath})
+	require.NoError(t, err)
+	require.Len(t, mounter.MountPoints, 1)
+	require.NoDirExists(t, stagingPath)
+
+	// the staging path is removed with the mount
+	_, err = ns.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: "legacy-app", StagingTargetPath: stagingPath})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestNodeStageVolumeMountGroup(t *testing.T) {
+	ns, _ := newFakeNodeServer(t)
+	stagingPath := t.TempDir()
+	require.NoError(t, os.Chmod(stagingPath, 0755))
+	req := newNodeStageVolumeRequest("legacy-app", stagingPath)
+	req.VolumeCapability.GetMount().VolumeMountGroup = strconv.Itoa(os.Getgid())
+
+	_, err := ns.NodeStageVolume(context.Background(), req)
+	require.NoError(t, err)
+	info, err := os.Stat(stagingPath)
+	require.NoError(t, err)
+	require.Equal(t, os.ModeDir|os.ModeSetgid|0775, info.Mode())
+
+	// a retry of a stage which failed to set the owner finds the volume mounted
+	require.NoError(t, os.Chmod(stagingPath, 0755))
+	_, err = ns.NodeStageVolume(context.Background(), req)
+	require.NoError(t, err)
+	info, err = os.Stat(stagingPath)
+	require.NoError(t, err)
+	require.Equal(t, os.ModeDir|os.ModeSetgid|0775, info.Mode())
+
+	// the group of the first stage wins, publishing to a pod with another
+	// fsGroup does not take the root directory from the pods using it
+	_, err = ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          "legacy-app",
+		StagingTargetPath: stagingPath,
+		TargetPath:        filepath.Join(t.TempDir(), "mount"),
+		VolumeCapability:  mountGroupCapability(strconv.Itoa(os.Getgid() + 1)),
+	})
+	require.NoError(t, err)
+	info, err = os.Stat(stagingPath)
+	require.NoError(t, err)
+	require.Equal(t, uint32(os.Getgid()), info.Sys().(*syscall.Stat_t).Gid)
+
+	req.VolumeCapability.GetMount().VolumeMountGroup = "users"
+	_, err = ns.NodeStageVolume(context.Background(), req)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestNodePublishVolumeSubPath(t *testing.T) {
+	ns, mounter := newFakeNodeServer(t)
+	ctx := context.Background()
+	stagingPath := t.TempDir()
+	publishRequest := func(volumeContext map[string]string) *csi.NodePublishVolumeRequest {
+		return &csi.NodePublishVolumeRequest{
+			VolumeId:          "legacy-app",
+			StagingTargetPath: stagingPath,
+			TargetPath:        filepath.Join(t.TempDir(), "mount"),
+			VolumeCapability:  newNodeStageVolumeRequest("legacy-app", stagingPath).GetVolumeCapability(),
+			VolumeContext:     volumeContext,
+		}
+	}
+
+	// the subpath is not created below an unmounted staging path
+	_, err := ns.NodePublishVolume(ctx, publishRequest(map[string]string{subPathKey: "app-1"}))
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.NoDirExists(t, filepath.Join(stagingPath, "app-1"))
+
+	_, err = ns.NodeStageVolume(ctx, newNodeStageVolumeRequest("legacy-app", stagingPath))
+	require.NoError(t, err)
+
+	for _, name := range []string{"app-1", "app-2"} {
+		req := publishRequest(map[string]string{subPathKey: name, subPathModeKey: "0700"})
+		_, err = ns.NodePublishVolume(ctx, req)
+		require.NoError(t, err)
+		require.DirExists(t, filepath.Join(stagingPath, name))
+		log := mounter.GetLog()
+		require.Equal(t, mountutils.FakeAction{
+			Action: mountutils.FakeActionMount,
+			Target: req.GetTargetPath(),
+			Source: filepath.Join(stagingPath, name),
+			FSType: "",
+		}, log[len(log)-1])
+	}
+
+	_, err = ns.NodePublishVolume(ctx, publishRequest(map[string]string{subPathKey: "../app-1"}))
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestNodeVolumeStaticSubPathHandle(t *testing.T) {
+	ns, mounter := newFakeNodeServer(t)
+	ctx := context.Background()
+	stagingPath := t.TempDir()
+	targetPath := filepath.Join(t.TempDir(), "mount")
+	volumeID := "legacy-app#tenants/app-1"
+
+	stageRequest := newNodeStageVolumeRequest(volumeID, stagingPath)
+	_, err := ns.NodeStageVolume(ctx, stageRequest)
+	require.NoError(t, err)
+	require.Len(t, mounter.MountPoints, 1)
+	require.Equal(t, "legacy-app", mounter.MountPoints[0].Device, "the pool is the handle up to the separator")
+
+	_, err = ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  stageRequest.GetVolumeCapability(),
+		VolumeContext:     stageRequest.GetVolumeContext(),
+	})
+	require.NoError(t, err)
+	require.DirExists(t, filepath.Join(stagingPath, "tenants", "app-1"))
+	log := mounter.GetLog()
+	require.Equal(t, filepath.Join(stagingPath, "tenants", "app-1"), log[len(log)-1].Source)
+
+	_, err = ns.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: volumeID, StagingTargetPath: stagingPath})
+	require.NoError(t, err)
+	require.NoDirExists(t, stagingPath)
+}
+
+func TestNodeVolumeSharedPool(t *testing.T) {
+	ns, mounter := newFakeNodeServer(t)
+	ctx := context.Background()
+	handles := []string{"legacy-app#app-1", "legacy-app#app-2"}
+	stagingPaths := []string{t.TempDir(), t.TempDir()}
+
+	for i, handle := range handles {
+		_, err := ns.NodeStageVolume(ctx, newNodeStageVolumeRequest(handle, stagingPaths[i]))
+		require.NoError(t, err, handle)
+	}
+	require.Len(t, mounter.MountPoints, 2)
+	require.NotEqual(t, mounter.BasePath(stagingPaths[0]), mounter.BasePath(stagingPaths[1]),
+		"each volume of the pool gets its own fcfs_fused")
+
+	_, err := ns.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: handles[0], StagingTargetPath: stagingPaths[0]})
+	require.NoError(t, err)
+	require.Len(t, mounter.MountPoints, 1)
+	require.Equal(t, stagingPaths[1], mounter.MountPoints[0].Path)
+	require.Equal(t, common.SharedPoolBasePath("legacy-app", handles[1]), mounter.BasePath(stagingPaths[1]))
+}
+
+func TestNodeStageVolumeErrors(t *testing.T) {
+	testCases := []struct {
+		name     string
+		volumeID string
+		modify   func(req *csi.NodeStageVolumeRequest, mounter *FakeMounter)
+		code     codes.Code
+	}{
+		{
+			name:     "missing pool",
+			volumeID: "missing",
+			code:     codes.Internal,
+		},
+		{
+			name:     "not static",
+			volumeID: "legacy-app",
+			modify: func(req *csi.NodeStageVolumeRequest, mounter *FakeMounter) {
+				req.VolumeContext[common.StaticVolumeKey] = "false"
+			},
+			code: codes.Internal,
+		},
+		{
+			name:     "missing secrets",
+			volumeID: "legacy-app",
+			modify: func(req *csi.NodeStageVolumeRequest, mounter *FakeMounter) {
+				req.Secrets = nil
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name:     "invalid fuse option",
+			volumeID: "legacy-app",
+			modify: func(req *csi.NodeStageVolumeRequest, mounter *FakeMounter) {
+				req.VolumeCapability.GetMount().MountFlags = []string{"max_idle_threads=many"}
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name:     "invalid server address",
+			volumeID: "legacy-app",
+			modify: func(req *csi.NodeStageVolumeRequest, mounter *FakeMounter) {
+				req.VolumeContext[common.FdirServersKey] = "10.0.0.1 10.0.0.2"
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name:     "fcfs_fused fails",
+			volumeID: "legacy-app",
+			modify: func(req *csi.NodeStageVolumeRequest, mounter *FakeMounter) {
+				mounter.SetError("FcfsMount", errors.New("exit status 1"))
+			},
+			code: codes.Internal,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ns, mounter := newFakeNodeServer(t)
+			req := newNodeStageVolumeRequest(tc.volumeID, t.TempDir())
+			if tc.modify != nil {
+				tc.modify(req, mounter)
+			}
+			_, err := ns.NodeStageVolume(context.Background(), req)
+			require.Equal(t, tc.code, status.Code(err), err)
+			require.Empty(t, mounter.MountPoints)
+		})
+	}
+}
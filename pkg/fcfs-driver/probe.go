@@ -0,0 +1,145 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+	"vazmin.github.io/fastcfs-csi/pkg/fcfs"
+)
+
+// healthCheck is a named check run by Probe.
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+	// optional checks are logged when they fail, they do not fail Probe
+	optional bool
+}
+
+// healthChecker runs the health checks of the plugin, the result is cached for
+// ttl so that frequent probes do not run commands or dial the proxy each time.
+type healthChecker struct {
+	checks []healthCheck
+	ttl    time.Duration
+
+	mux       sync.Mutex
+	checkedAt time.Time
+	err       error
+}
+
+func newHealthChecker(ttl time.Duration, checks []healthCheck) *healthChecker {
+	return &healthChecker{checks: checks, ttl: ttl}
+}
+
+// healthChecks returns the checks of the binaries and configs the plugin
+// depends on, and of the fcfsfused-proxy if the node server mounts with it.
+func healthChecks(conf *common.Config, mountOptions *fcfs.MountOptions) []healthCheck {
+	checks := []healthCheck{
+		{name: "fcfs_pool", check: func(context.Context) error { return checkExecutable(common.PoolCMD) }},
+		{name: "fcfs_fused", check: func(context.Context) error { return checkExecutable(common.FuseClientCMD) }},
+	}
+	for _, baseURL := range conf.ClusterConfigURLs {
+		for _, configURL := range []string{baseURL + common.PoolConfigFile, baseURL + common.FuseClientConfigFile} {
+			configURL := configURL
+			checks = append(checks, healthCheck{
+				name:  "config " + configURL,
+				check: func(ctx context.Context) error { return checkConfigReadable(ctx, configURL) },
+			})
+		}
+	}
+	if mountOptions != nil && mountOptions.EnableFcfsFusedProxy {
+		checks = append(checks, healthCheck{
+			name:  "fcfsfused-proxy",
+			check: func(ctx context.Context) error { return fcfs.CheckFcfsFusedProxy(ctx, mountOptions) },
+			// volumes are mounted directly while the proxy is down, restarting
+			// the node plugin would not help
+			optional: mountOptions.FcfsFusedProxyFallback == fcfs.ProxyFallbackOnUnavailable,
+		})
+	}
+	return checks
+}
+
+// check returns the error of the first failing check, cached for ttl.
+func (h *healthChecker) check(ctx context.Context) error {
+	if h == nil {
+		return nil
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if !h.checkedAt.IsZero() && time.Since(h.checkedAt) < h.ttl {
+		return h.err
+	}
+	h.err = nil
+	for _, c := range h.checks {
+		err := c.check(ctx)
+		if err == nil {
+			continue
+		}
+		if c.optional {
+			klog.Warningf("health check %s failed: %v", c.name, err)
+			continue
+		}
+		h.err = fmt.Errorf("%s: %w", c.name, err)
+		break
+	}
+	h.checkedAt = time.Now()
+	return h.err
+}
+
+// checkExecutable checks that path is an executable file.
+func checkExecutable(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() || fi.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("%s is not executable", path)
+	}
+	return nil
+}
+
+// checkConfigReadable checks that the config file or http(s) URL can be read.
+func checkConfigReadable(ctx context.Context, configURL string) error {
+	if !strings.HasPrefix(configURL, "http://") && !strings.HasPrefix(configURL, "https://") {
+		f, err := os.Open(configURL)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, configURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", configURL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+	"vazmin.github.io/fastcfs-csi/pkg/fcfs"
+)
+
+func TestHealthCheckerCache(t *testing.T) {
+	var calls int
+	failure := errors.New("not executable")
+	h := newHealthChecker(time.Hour, []healthCheck{{
+		name: "fcfs_pool",
+		check: func(context.Context) error {
+			calls++
+			return failure
+		},
+	}})
+
+	err := h.check(context.Background())
+	require.ErrorIs(t, err, failure)
+	require.EqualError(t, err, "fcfs_pool: not executable")
+	require.ErrorIs(t, h.check(context.Background()), failure)
+	require.Equal(t, 1, calls)
+
+	h.checkedAt = time.Now().Add(-time.Hour)
+	require.Error(t, h.check(context.Background()))
+	require.Equal(t, 2, calls)
+}
+
+func TestProbe(t *testing.T) {
+	ready := &identityServer{health: newHealthChecker(time.Minute, nil)}
+	resp, err := ready.Probe(context.Background(), &csi.ProbeRequest{})
+	require.NoError(t, err)
+	require.True(t, resp.GetReady().GetValue())
+
+	notReady := &identityServer{health: newHealthChecker(time.Minute, []healthCheck{{
+		name:  "fcfsfused-proxy",
+		check: func(context.Context) error { return errors.New("unavailable") },
+	}})}
+	resp, err = notReady.Probe(context.Background(), &csi.ProbeRequest{})
+	require.NoError(t, err)
+	require.False(t, resp.GetReady().GetValue())
+}
+
+func TestHealthChecksProxyFallback(t *testing.T) {
+	proxyCheck := func(fallback string) healthCheck {
+		checks := healthChecks(&common.Config{}, &fcfs.MountOptions{
+			EnableFcfsFusedProxy:   true,
+			FcfsFusedProxyFallback: fallback,
+		})
+		return checks[len(checks)-1]
+	}
+	require.False(t, proxyCheck(fcfs.ProxyFallbackNever).optional)
+	require.True(t, proxyCheck(fcfs.ProxyFallbackOnUnavailable).optional, "volumes are mounted directly while the proxy is down")
+
+	h := newHealthChecker(time.Minute, []healthCheck{{
+		name:     "fcfsfused-proxy",
+		check:    func(context.Context) error { return errors.New("unavailable") },
+		optional: true,
+	}})
+	require.NoError(t, h.check(context.Background()))
+}
+
+func TestCheckExecutable(t *testing.T) {
+	dir := t.TempDir()
+	executable := filepath.Join(dir, "fcfs_pool")
+	require.NoError(t, os.WriteFile(executable, []byte("#!/bin/sh\n"), 0755))
+	regular := filepath.Join(dir, "fuse.conf")
+	require.NoError(t, os.WriteFile(regular, nil, 0644))
+
+	require.NoError(t, checkExecutable(executable))
+	require.Error(t, checkExecutable(regular))
+	require.Error(t, checkExecutable(dir))
+	require.Error(t, checkExecutable(filepath.Join(dir, "fcfs_fused")))
+}
+
+func TestCheckConfigReadable(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "client.conf")
+	require.NoError(t, os.WriteFile(config, nil, 0644))
+	require.NoError(t, checkConfigReadable(context.Background(), config))
+	require.Error(t, checkConfigReadable(context.Background(), filepath.Join(dir, "fuse.conf")))
+
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+	require.NoError(t, checkConfigReadable(context.Background(), server.URL+"/client.conf"))
+	require.Error(t, checkConfigReadable(context.Background(), server.URL+"/fuse.conf"))
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+)
+
+// Volume context and storage class keys of subpath publishing.
+const (
+	subPathKey         = "subpath"
+	subPathModeKey     = "subpath-mode"
+	subPathUIDKey      = "subpath-uid"
+	subPathGIDKey      = "subpath-gid"
+	defaultSubPathMode = 0755
+)
+
+// staticSubPathSeparator separates the pool of a static volume handle from the
+// subpath it publishes, e.g. "legacy-app#tenants/app-1". Kubelet tracks staged
+// volumes by their handle, so PVs sharing a pool must not share it.
+const staticSubPathSeparator = "#"
+
+// splitStaticVolumeID returns the pool and the subpath of a static volume
+// handle. The subpath is empty if the handle names the pool only.
+func splitStaticVolumeID(volID string) (pool, path string) {
+	if i := strings.Index(volID, staticSubPathSeparator); i >= 0 {
+		return volID[:i], volID[i+len(staticSubPathSeparator):]
+	}
+	return volID, ""
+}
+
+// staticSubPathContext returns the volume context of a static volume with the
+// subpath of its handle set. A subpath attribute must match the handle.
+func staticSubPathContext(volID string, volumeContext map[string]string) (map[string]string, error) {
+	if static, _ := strconv.ParseBool(volumeContext[common.StaticVolumeKey]); !static {
+		return volumeContext, nil
+	}
+	_, path := splitStaticVolumeID(volID)
+	if len(path) == 0 {
+		return volumeContext, nil
+	}
+	if set, ok := volumeContext[subPathKey]; ok && set != path {
+		return nil, fmt.Errorf("%s %q does not match the subpath %q of volume handle %s", subPathKey, set, path, volID)
+	}
+	withSubPath := make(map[string]string, len(volumeContext)+1)
+	for k, v := range volumeContext {
+		withSubPath[k] = v
+	}
+	withSubPath[subPathKey] = path
+	return withSubPath, nil
+}
+
+// subPath is a directory of the pool published instead of the whole staging path.
+type subPath struct {
+	path string
+	mode os.FileMode
+	uid  int
+	gid  int
+}
+
+// newSubPath returns the subpath set in the volume context, or nil if there is
+// none. Its group defaults to the VolumeMountGroup of the capability, which is
+// then given write access unless subpath-mode is set.
+func newSubPath(volCap *csi.VolumeCapability, volumeContext map[string]string) (*subPath, error) {
+	path, ok := volumeContext[subPathKey]
+	if !ok {
+		for _, key := range []string{subPathModeKey, subPathUIDKey, subPathGIDKey} {
+			if _, set := volumeContext[key]; set {
+				return nil, fmt.Errorf("%s is set without %s", key, subPathKey)
+			}
+		}
+		return nil, nil
+	}
+
+	sp := &subPath{path: filepath.Clean(path), mode: defaultSubPathMode, uid: -1, gid: -1}
+	if len(path) == 0 || filepath.IsAbs(path) || sp.path == "." ||
+		sp.path == ".." || strings.HasPrefix(sp.path, "../") {
+		return nil, fmt.Errorf("%s %q must be a relative path inside of the volume", subPathKey, path)
+	}
+	var err error
+	if sp.mode, err = parseFileMode(volumeContext, subPathModeKey, defaultSubPathMode); err != nil {
+		return nil, err
+	}
+	if sp.uid, err = parseOwnerID(volumeContext, subPathUIDKey); err != nil {
+		return nil, err
+	}
+	if sp.gid, err = parseOwnerID(volumeContext, subPathGIDKey); err != nil {
+		return nil, err
+	}
+	if sp.gid < 0 {
+		owner, err := newVolumeOwner(volCap, nil)
+		if err != nil {
+			return nil, err
+		}
+		if owner != nil {
+			sp.gid = owner.gid
+			if _, ok := volumeContext[subPathModeKey]; !ok {
+				sp.mode |= groupMode
+			}
+		}
+	}
+	return sp, nil
+}
+
+// open creates the subpath below the staged volume at stagingPath if it does
+// not exist and returns it opened. Directories it creates get the mode and
+// ownership of the subpath, existing ones are left as they are. Each component
+// is opened relative to its parent without following symlinks, so that a
+// symlink swapped in by a pod using the volume cannot lead the bind mount out
+// of it; the caller mounts the path of the returned file descriptor and closes it.
+func (sp *subPath) open(stagingPath string) (*os.File, error) {
+	fd, err := unix.Open(stagingPath, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: stagingPath, Err: err}
+	}
+	dir := os.NewFile(uintptr(fd), stagingPath)
+	for _, name := range strings.Split(sp.path, string(filepath.Separator)) {
+		child, err := sp.openChild(dir, name)
+		dir.Close()
+		if err != nil {
+			return nil, err
+		}
+		dir = child
+	}
+	return dir, nil
+}
+
+// openChild opens the directory name in parent, creating it if it does not exist.
+func (sp *subPath) openChild(parent *os.File, name string) (*os.File, error) {
+	path := filepath.Join(parent.Name(), name)
+	created := false
+	if err := unix.Mkdirat(int(parent.Fd()), name, uint32(sp.mode.Perm())); err == nil {
+		created = true
+	} else if err != unix.EEXIST {
+		return nil, &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	fd, err := unix.Openat(int(parent.Fd()), name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	switch err {
+	case nil:
+	case unix.ELOOP:
+		return nil, fmt.Errorf("%s %q must not contain symlinks, %s is one", subPathKey, sp.path, path)
+	case unix.ENOTDIR:
+		return nil, fmt.Errorf("%s %q must be a directory, %s is not", subPathKey, sp.path, path)
+	default:
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	dir := os.NewFile(uintptr(fd), path)
+	if !created {
+		return dir, nil
+	}
+	// the mode of Mkdirat is masked by the umask and lacks the setgid bit
+	if err := dir.Chmod(sp.mode); err != nil {
+		dir.Close()
+		return nil, err
+	}
+	if err := dir.Chown(sp.uid, sp.gid); err != nil {
+		dir.Close()
+		return nil, err
+	}
+	return dir, nil
+}
+
+// fdPath returns the path of the open file f for other processes, such as
+// mount, which resolve it to the directory f was opened at.
+func fdPath(f *os.File) string {
+	return fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), f.Fd())
+}
@@ -0,0 +1,228 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSubPath(t *testing.T) {
+	testCases := []struct {
+		name          string
+		volCap        *csi.VolumeCapability
+		volumeContext map[string]string
+		expected      *subPath
+		expectErr     bool
+	}{
+		{
+			name:          "no subpath",
+			volumeContext: map[string]string{"static": "true"},
+		},
+		{
+			name:          "defaults",
+			volumeContext: map[string]string{subPathKey: "tenants/a/"},
+			expected:      &subPath{path: "tenants/a", mode: 0755, uid: -1, gid: -1},
+		},
+		{
+			name: "mode and owner",
+			volumeContext: map[string]string{
+				subPathKey: "a", subPathModeKey: "2770", subPathUIDKey: "1000", subPathGIDKey: "2000",
+			},
+			expected: &subPath{path: "a", mode: 0770 | os.ModeSetgid, uid: 1000, gid: 2000},
+		},
+		{
+			name:          "mount group",
+			volCap:        mountGroupCapability("3000"),
+			volumeContext: map[string]string{subPathKey: "a"},
+			expected:      &subPath{path: "a", mode: 0775 | os.ModeSetgid, uid: -1, gid: 3000},
+		},
+		{
+			name:          "mount group with mode and gid",
+			volCap:        mountGroupCapability("3000"),
+			volumeContext: map[string]string{subPathKey: "a", subPathModeKey: "0700", subPathGIDKey: "2000"},
+			expected:      &subPath{path: "a", mode: 0700, uid: -1, gid: 2000},
+		},
+		{
+			name:          "mount group with mode",
+			volCap:        mountGroupCapability("3000"),
+			volumeContext: map[string]string{subPathKey: "a", subPathModeKey: "0700"},
+			expected:      &subPath{path: "a", mode: 0700, uid: -1, gid: 3000},
+		},
+		{
+			name:          "absolute",
+			volumeContext: map[string]string{subPathKey: "/a"},
+			expectErr:     true,
+		},
+		{
+			name:          "outside of the volume",
+			volumeContext: map[string]string{subPathKey: "a/../../b"},
+			expectErr:     true,
+		},
+		{
+			name:          "whole volume",
+			volumeContext: map[string]string{subPathKey: "a/.."},
+			expectErr:     true,
+		},
+		{
+			name:          "decimal mode",
+			volumeContext: map[string]string{subPathKey: "a", subPathModeKey: "0789"},
+			expectErr:     true,
+		},
+		{
+			name:          "user name",
+			volumeContext: map[string]string{subPathKey: "a", subPathUIDKey: "nobody"},
+			expectErr:     true,
+		},
+		{
+			name:          "mode without subpath",
+			volumeContext: map[string]string{subPathModeKey: "0700"},
+			expectErr:     true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sp, err := newSubPath(tc.volCap, tc.volumeContext)
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, sp)
+		})
+	}
+}
+
+func TestStaticSubPathContext(t *testing.T) {
+	static := map[string]string{"static": "true"}
+	testCases := []struct {
+		name          string
+		volID         string
+		volumeContext map[string]string
+		expected      map[string]string
+		expectErr     bool
+	}{
+		{
+			name:          "pool",
+			volID:         "legacy-app",
+			volumeContext: static,
+			expected:      static,
+		},
+		{
+			name:          "pool and subpath",
+			volID:         "legacy-app#tenants/app-1",
+			volumeContext: static,
+			expected:      map[string]string{"static": "true", subPathKey: "tenants/app-1"},
+		},
+		{
+			name:          "matching subpath attribute",
+			volID:         "legacy-app#app-1",
+			volumeContext: map[string]string{"static": "true", subPathKey: "app-1"},
+			expected:      map[string]string{"static": "true", subPathKey: "app-1"},
+		},
+		{
+			name:          "conflicting subpath attribute",
+			volID:         "legacy-app#app-1",
+			volumeContext: map[string]string{"static": "true", subPathKey: "app-2"},
+			expectErr:     true,
+		},
+		{
+			name:          "dynamic volume",
+			volID:         "legacy-app#app-1",
+			volumeContext: map[string]string{},
+			expected:      map[string]string{},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			volumeContext, err := staticSubPathContext(tc.volID, tc.volumeContext)
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, volumeContext)
+		})
+	}
+	require.Equal(t, map[string]string{"static": "true"}, static, "the volume context is not modified")
+}
+
+func TestSubPathOpen(t *testing.T) {
+	stagingPath := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(stagingPath, "tenants"), 0700))
+	sp := &subPath{path: "tenants/a/data", mode: 0750 | os.ModeSetgid, uid: os.Getuid(), gid: os.Getgid()}
+	open := func(sp *subPath) (string, error) {
+		dir, err := sp.open(stagingPath)
+		if err != nil {
+			return "", err
+		}
+		defer dir.Close()
+		return os.Readlink(fdPath(dir))
+	}
+
+	dir, err := open(sp)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(stagingPath, "tenants/a/data"), dir)
+	for path, mode := range map[string]os.FileMode{
+		"tenants":        0700, // existing directories are left as they are
+		"tenants/a":      0750 | os.ModeDir | os.ModeSetgid,
+		"tenants/a/data": 0750 | os.ModeDir | os.ModeSetgid,
+	} {
+		info, err := os.Stat(filepath.Join(stagingPath, path))
+		require.NoError(t, err)
+		if path == "tenants" {
+			require.Equal(t, mode, info.Mode().Perm(), path)
+			continue
+		}
+		require.Equal(t, mode, info.Mode(), path)
+		require.Equal(t, uint32(os.Getuid()), info.Sys().(*syscall.Stat_t).Uid, path)
+	}
+
+	// opening it again does not change it
+	require.NoError(t, os.Chmod(dir, 0700))
+	again, err := open(sp)
+	require.NoError(t, err)
+	require.Equal(t, dir, again)
+	info, err := os.Stat(dir)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	outside := t.TempDir()
+	require.NoError(t, os.Symlink(outside, filepath.Join(stagingPath, "escape")))
+	_, err = open(&subPath{path: "escape/a", mode: 0755, uid: -1, gid: -1})
+	require.Error(t, err)
+	require.NoDirExists(t, filepath.Join(outside, "a"))
+
+	require.NoError(t, os.WriteFile(filepath.Join(stagingPath, "file"), nil, 0600))
+	_, err = open(&subPath{path: "file", mode: 0755, uid: -1, gid: -1})
+	require.Error(t, err)
+
+	// a symlink swapped in after the subpath was opened is not mounted
+	opened, err := (&subPath{path: "swapped", mode: 0755, uid: -1, gid: -1}).open(stagingPath)
+	require.NoError(t, err)
+	defer opened.Close()
+	require.NoError(t, os.Rename(filepath.Join(stagingPath, "swapped"), filepath.Join(stagingPath, "moved")))
+	require.NoError(t, os.Symlink(outside, filepath.Join(stagingPath, "swapped")))
+	resolved, err := os.Readlink(fdPath(opened))
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(stagingPath, "moved"), resolved)
+}
@@ -0,0 +1,543 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/klog/v2"
+	mountutils "k8s.io/mount-utils"
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+	"vazmin.github.io/fastcfs-csi/pkg/fcfs"
+)
+
+const (
+	// fcfsFuseFsType is the file system type of the fcfs_fused mounts and of
+	// the bind mounts of their targets.
+	fcfsFuseFsType = "fuse.fcfs_fused"
+	fcfsFuseName   = "fcfs_fused"
+	// volDataFileName is kept by kubelet next to the staging and target paths.
+	volDataFileName = "vol_data.json"
+	csiPluginDir    = "kubernetes.io~csi"
+
+	// orphanBasePathAge keeps the base paths of pools being mounted, which
+	// are created before fcfs_fused writes its pid file.
+	orphanBasePathAge = 10 * time.Minute
+)
+
+// volData is the part of vol_data.json of kubelet the sweeper needs.
+type volData struct {
+	SpecVolID    string `json:"specVolID"`
+	VolumeHandle string `json:"volumeHandle"`
+	DriverName   string `json:"driverName"`
+}
+
+func loadVolData(path string) (*volData, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data := &volData{}
+	if err := json.Unmarshal(content, data); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return data, nil
+}
+
+// nodeVolumes is the state of the node in Kubernetes the mounts are checked
+// against.
+type nodeVolumes struct {
+	pods     map[string]*v1.ObjectReference // the pods scheduled to the node by UID
+	attached map[string]struct{}            // names of the PVs attached to the node by the driver
+}
+
+// nodeVolumeLister lists the pods of the node and the volume attachments from
+// shared informers, so that the sweeps of every node do not list them from
+// the API server each interval. The caches lag behind by the watch latency, far
+// below the time kubelet takes to mount a volume of a new pod or attachment.
+type nodeVolumeLister struct {
+	driverName  string
+	nodeID      string
+	factories   []informers.SharedInformerFactory
+	pods        corelisters.PodLister
+	attachments storagelisters.VolumeAttachmentLister
+}
+
+func newNodeVolumeLister(client kubernetes.Interface, driverName, nodeID string) *nodeVolumeLister {
+	// volume attachments cannot be selected by node, unlike pods
+	podFactory := informers.NewSharedInformerFactoryWithOptions(client, 0, informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+		options.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", nodeID).String()
+	}))
+	factory := informers.NewSharedInformerFactory(client, 0)
+	// the informers are registered with their factory by getting them
+	pods := podFactory.Core().V1().Pods()
+	pods.Informer()
+	attachments := factory.Storage().V1().VolumeAttachments()
+	attachments.Informer()
+	return &nodeVolumeLister{
+		driverName:  driverName,
+		nodeID:      nodeID,
+		factories:   []informers.SharedInformerFactory{podFactory, factory},
+		pods:        pods.Lister(),
+		attachments: attachments.Lister(),
+	}
+}
+
+// start starts the informers and waits until their caches are synced.
+func (l *nodeVolumeLister) start(stopCh <-chan struct{}) {
+	for _, factory := range l.factories {
+		factory.Start(stopCh)
+	}
+	for _, factory := range l.factories {
+		for informer, synced := range factory.WaitForCacheSync(stopCh) {
+			if !synced {
+				klog.Warningf("sweeper: the cache of %v is not synced", informer)
+			}
+		}
+	}
+}
+
+// list returns the pods of the node and the PVs attached to it by the driver.
+func (l *nodeVolumeLister) list(ctx context.Context) (*nodeVolumes, error) {
+	pods, err := l.pods.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the pods of node %s: %w", l.nodeID, err)
+	}
+	attachments, err := l.attachments.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volume attachments: %w", err)
+	}
+	vols := &nodeVolumes{
+		pods:     make(map[string]*v1.ObjectReference, len(pods)),
+		attached: make(map[string]struct{}),
+	}
+	for _, pod := range pods {
+		vols.pods[string(pod.UID)] = &v1.ObjectReference{
+			Kind:       "Pod",
+			APIVersion: "v1",
+			Name:       pod.Name,
+			Namespace:  pod.Namespace,
+			UID:        pod.UID,
+		}
+	}
+	for _, va := range attachments {
+		pvName := va.Spec.Source.PersistentVolumeName
+		if va.Spec.Attacher != l.driverName || va.Spec.NodeName != l.nodeID || pvName == nil {
+			continue
+		}
+		vols.attached[*pvName] = struct{}{}
+	}
+	return vols, nil
+}
+
+// mountSweeper cleans up after crashes of the node, kubelet or fcfs_fused: the
+// mounts of volumes kubelet no longer uses, e.g. the dead bind mounts of pods
+// deleted meanwhile, and the base paths of pools no fcfs_fused serves.
+// Corrupted mounts still in use are marked stale, so that they are mounted
+// again on the next stage or publish, and reported in an event on their pod or
+// PV, as kubelet does not stage or publish a mounted volume again by itself.
+type mountSweeper struct {
+	ns          *nodeServer
+	driverName  string
+	kubeletDir  string
+	basePathDir string
+	procDir     string
+	interval    time.Duration
+
+	listMounts func() ([]mountutils.MountInfo, error)
+	// start starts watching the state of the node listVolumes returns, if set
+	start       func(stopCh <-chan struct{})
+	listVolumes func(ctx context.Context) (*nodeVolumes, error)
+	// probe returns the error of accessing a mount point, it must not block
+	// on a wedged fcfs_fused
+	probe func(path string) error
+}
+
+func newMountSweeper(ns *nodeServer, client kubernetes.Interface, driverName, nodeID, kubeletDir string, interval time.Duration) *mountSweeper {
+	lister := newNodeVolumeLister(client, driverName, nodeID)
+	return &mountSweeper{
+		ns:          ns,
+		driverName:  driverName,
+		kubeletDir:  kubeletDir,
+		basePathDir: common.ClientBasePath,
+		procDir:     "/proc",
+		interval:    interval,
+		listMounts: func() ([]mountutils.MountInfo, error) {
+			return mountutils.ParseMountInfo("/proc/self/mountinfo")
+		},
+		start:       lister.start,
+		listVolumes: lister.list,
+		probe: func(path string) error {
+			return probeMount(path, ns.stats.timeout)
+		},
+	}
+}
+
+// run sweeps at once and then every interval.
+func (s *mountSweeper) run(stopCh <-chan struct{}) {
+	klog.Infof("sweeping orphaned mounts under %s and base paths under %s every %s", s.kubeletDir, s.basePathDir, s.interval)
+	if s.start != nil {
+		s.start(stopCh)
+	}
+	wait.Until(s.sweep, s.interval, stopCh)
+}
+
+func (s *mountSweeper) sweep() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.interval)
+	defer cancel()
+
+	mounts, err := s.listMounts()
+	if err != nil {
+		klog.Warningf("sweeper: failed to list mounts: %v", err)
+		return
+	}
+	var fuseMounts []mountutils.MountInfo
+	for _, m := range mounts {
+		if m.FsType == fcfsFuseFsType {
+			fuseMounts = append(fuseMounts, m)
+		}
+	}
+
+	// without the state of the node no mount is known to be orphaned, the
+	// base paths are told by their fcfs_fused alone
+	if vols, err := s.listVolumes(ctx); err != nil {
+		klog.Warningf("sweeper: skipping the mounts: %v", err)
+	} else {
+		mounted := make(map[string]struct{}, len(fuseMounts))
+		for _, m := range fuseMounts {
+			mounted[m.MountPoint] = struct{}{}
+			s.sweepMount(ctx, m.MountPoint, vols)
+		}
+		s.sweepTargetDirs(ctx, vols, mounted)
+	}
+	s.sweepBasePaths(fuseMounts)
+}
+
+// sweepMount unmounts path if kubelet no longer uses it, or marks it stale and
+// reports it if it is corrupted.
+func (s *mountSweeper) sweepMount(ctx context.Context, path string, vols *nodeVolumes) {
+	rel, err := filepath.Rel(s.kubeletDir, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	var (
+		data     *volData
+		target   bool
+		orphaned bool
+	)
+	switch {
+	case isTargetPath(parts):
+		target = true
+		data, err = loadVolData(filepath.Join(filepath.Dir(path), volDataFileName))
+		_, used := vols.pods[parts[1]]
+		orphaned = !used
+	case isStagingPath(parts):
+		data, err = loadVolData(s.stagingVolDataFile(path, parts))
+		if err == nil {
+			_, used := vols.attached[data.SpecVolID]
+			orphaned = !used
+		}
+	default:
+		// e.g. the subpaths of pods, which kubelet cleans up
+		return
+	}
+	if err != nil {
+		klog.Warningf("sweeper: skipping mount %s of unknown volume: %v", path, err)
+		return
+	}
+	if data.DriverName != s.driverName {
+		return
+	}
+
+	if !orphaned {
+		if s.ns.stats.isStale(path) {
+			return
+		}
+		if err := s.probe(path); err != nil && (isStaleMount(err) || mountutils.IsCorruptedMnt(err)) {
+			klog.Warningf("sweeper: volume %s at %s in use is corrupted, it is mounted again on the next stage or publish: %v", data.VolumeHandle, path, err)
+			s.ns.stats.markStale(path)
+			// the pods using the volume on the node have to be deleted for that
+			if target {
+				s.ns.events.podVolumeFailed(vols.pods[parts[1]], data.VolumeHandle, "MountCheck", err)
+			} else {
+				s.ns.events.volumeFailed(data.VolumeHandle, "MountCheck", nil, err)
+			}
+		}
+		return
+	}
+
+	volumeID := data.VolumeHandle
+	if acquired := s.ns.volumeLocks.TryAcquire(volumeID); !acquired {
+		klog.V(4).Infof("sweeper: skipping orphaned mount %s, volume %s is busy", path, volumeID)
+		return
+	}
+	defer s.ns.volumeLocks.Release(volumeID)
+	if target {
+		err = s.unpublishOrphan(ctx, volumeID, path)
+	} else {
+		err = s.unstageOrphan(ctx, volumeID, path)
+	}
+	if err != nil {
+		klog.Errorf("sweeper: failed to clean up orphaned mount %s of volume %s: %v", path, volumeID, err)
+		return
+	}
+	s.ns.stats.forget(path)
+	klog.Infof("sweeper: cleaned up orphaned mount %s of volume %s", path, volumeID)
+}
+
+// isTargetPath reports whether parts relative to the kubelet dir are those of
+// pods/<uid>/volumes/kubernetes.io~csi/<name>/mount.
+func isTargetPath(parts []string) bool {
+	return len(parts) == 6 && parts[0] == "pods" && parts[2] == "volumes" && parts[3] == csiPluginDir && parts[5] == "mount"
+}
+
+// isStagingPath reports whether parts relative to the kubelet dir are those of
+// plugins/kubernetes.io/csi/.../globalmount of a filesystem volume, or of
+// plugins/kubernetes.io/csi/volumeDevices/staging/<pv> of a block volume.
+func isStagingPath(parts []string) bool {
+	if len(parts) < 4 || parts[0] != "plugins" || parts[1] != "kubernetes.io" || parts[2] != "csi" {
+		return false
+	}
+	return parts[len(parts)-1] == "globalmount" ||
+		len(parts) == 6 && parts[3] == "volumeDevices" && parts[4] == "staging"
+}
+
+func (s *mountSweeper) stagingVolDataFile(path string, parts []string) string {
+	if parts[len(parts)-1] == "globalmount" {
+		return filepath.Join(filepath.Dir(path), volDataFileName)
+	}
+	// kubelet keeps the data of block volumes apart from their staging path
+	return filepath.Join(s.kubeletDir, "plugins", "kubernetes.io", "csi", "volumeDevices", parts[5], "data", volDataFileName)
+}
+
+// unpublishOrphan unmounts the target of a deleted pod, and deletes the pool
+// of an ephemeral volume. The caller holds the volume lock.
+func (s *mountSweeper) unpublishOrphan(ctx context.Context, volumeID, targetPath string) error {
+	vol, err := loadEphemeralVolume(targetPath)
+	if err != nil {
+		return err
+	}
+	if vol != nil {
+		klog.Infof("sweeper: unpublishing ephemeral volume %s of pool %s at %s", volumeID, vol.VolName, targetPath)
+		return s.ns.unpublishEphemeralVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: volumeID, TargetPath: targetPath}, vol)
+	}
+	// the bind mount of a target does not answer once its staging path is gone
+	klog.Infof("sweeper: unmounting target %s of volume %s", targetPath, volumeID)
+	if err := s.ns.mounter.LazyUnmount(ctx, targetPath); err != nil {
+		return err
+	}
+	if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// unstageOrphan unmounts the staging path of a volume detached from the node.
+// The caller holds the volume lock.
+func (s *mountSweeper) unstageOrphan(ctx context.Context, volumeID, stagingPath string) error {
+	volOptions, err := NewVolOptionsFromVolID(volumeID, nil)
+	if errors.Is(err, common.ErrInvalidVolID) {
+		// static volume handles start with their pool
+		pool, _ := splitStaticVolumeID(volumeID)
+		volOptions, err = &fcfs.VolumeOptions{VolID: volumeID, VolName: pool}, nil
+	}
+	if err != nil {
+		return err
+	}
+	volOptions.VolPath = stagingPath
+	klog.Infof("sweeper: unstaging volume %s of pool %s at %s", volumeID, volOptions.VolName, stagingPath)
+	if err := s.ns.detachBlockImage(ctx, stagingPath); err != nil {
+		klog.Warningf("sweeper: failed to detach the block image of volume %s: %v", volumeID, err)
+	}
+	err = s.ns.mounter.FcfsUnmount(ctx, volOptions, s.ns.mountOptions)
+	common.Audit(ctx, &common.AuditEvent{
+		Operation: common.AuditUnmount,
+		VolumeID:  volumeID,
+		Pool:      volOptions.VolName,
+		Request:   "sweep " + stagingPath,
+	}, err)
+	if err != nil {
+		// a wedged fcfs_fused does not answer the unmount
+		klog.Warningf("sweeper: failed to unmount %s, unmounting it lazily: %v", stagingPath, err)
+		if err := s.ns.mounter.LazyUnmount(ctx, stagingPath); err != nil {
+			return err
+		}
+		if err := removeMountPath(stagingPath); err != nil {
+			return err
+		}
+	}
+	return removeStagedPool(stagingPath)
+}
+
+// sweepTargetDirs deletes the pools of the ephemeral volumes of deleted pods,
+// which are no longer mounted, and removes their empty target paths.
+func (s *mountSweeper) sweepTargetDirs(ctx context.Context, vols *nodeVolumes, mounted map[string]struct{}) {
+	dirs, err := filepath.Glob(filepath.Join(s.kubeletDir, "pods", "*", "volumes", csiPluginDir, "*"))
+	if err != nil {
+		klog.Warningf("sweeper: failed to list target paths: %v", err)
+		return
+	}
+	for _, dir := range dirs {
+		uid := filepath.Base(filepath.Dir(filepath.Dir(filepath.Dir(dir))))
+		targetPath := filepath.Join(dir, "mount")
+		if _, ok := vols.pods[uid]; ok {
+			continue
+		}
+		if _, ok := mounted[targetPath]; ok {
+			continue
+		}
+		data, err := loadVolData(filepath.Join(dir, volDataFileName))
+		if err != nil || data.DriverName != s.driverName {
+			continue
+		}
+		s.sweepTargetDir(ctx, data.VolumeHandle, targetPath)
+	}
+}
+
+func (s *mountSweeper) sweepTargetDir(ctx context.Context, volumeID, targetPath string) {
+	if acquired := s.ns.volumeLocks.TryAcquire(volumeID); !acquired {
+		return
+	}
+	defer s.ns.volumeLocks.Release(volumeID)
+
+	vol, err := loadEphemeralVolume(targetPath)
+	if err != nil {
+		klog.Warningf("sweeper: skipping target %s: %v", targetPath, err)
+		return
+	}
+	if vol != nil {
+		klog.Infof("sweeper: deleting pool %s of ephemeral volume %s of a deleted pod", vol.VolName, volumeID)
+		if err := s.ns.deleteEphemeralVolume(ctx, volumeID, targetPath); err != nil {
+			klog.Errorf("sweeper: failed to delete pool %s of ephemeral volume %s: %v", vol.VolName, volumeID, err)
+			return
+		}
+	}
+	if err := os.Remove(targetPath); err == nil {
+		klog.Infof("sweeper: removed stale target %s of volume %s", targetPath, volumeID)
+	} else if !os.IsNotExist(err) {
+		klog.Warningf("sweeper: failed to remove stale target %s of volume %s: %v", targetPath, volumeID, err)
+	}
+}
+
+// sweepBasePaths removes the base paths of the pools of the driver, which no
+// running fcfs_fused serves.
+func (s *mountSweeper) sweepBasePaths(fuseMounts []mountutils.MountInfo) {
+	entries, err := ioutil.ReadDir(s.basePathDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Warningf("sweeper: failed to list base paths: %v", err)
+		}
+		return
+	}
+	mountedPools := make(map[string]struct{}, len(fuseMounts))
+	for _, m := range fuseMounts {
+		mountedPools[m.Source] = struct{}{}
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || !(strings.HasPrefix(name, common.CsiVolNamingPrefix) || strings.HasPrefix(name, ephemeralPoolPrefix)) {
+			continue
+		}
+		if _, ok := mountedPools[name]; ok {
+			continue
+		}
+		basePath := filepath.Join(s.basePathDir, name)
+		if s.fusedRunning(basePath) {
+			continue
+		}
+		if modTime, err := lastModified(basePath); err != nil || time.Since(modTime) < orphanBasePathAge {
+			continue
+		}
+		if err := os.RemoveAll(basePath); err != nil {
+			klog.Warningf("sweeper: failed to remove orphaned base path %s: %v", basePath, err)
+			continue
+		}
+		klog.Infof("sweeper: removed orphaned base path %s", basePath)
+	}
+}
+
+// fusedRunning reports whether the fcfs_fused of the pid file in basePath runs.
+func (s *mountSweeper) fusedRunning(basePath string) bool {
+	content, err := ioutil.ReadFile(filepath.Join(basePath, common.PidSuffixPath))
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || pid <= 0 {
+		return false
+	}
+	// the pid may have been reused since fcfs_fused died
+	comm, err := ioutil.ReadFile(filepath.Join(s.procDir, strconv.Itoa(pid), "comm"))
+	return err == nil && strings.TrimSpace(string(comm)) == fcfsFuseName
+}
+
+// lastModified returns the latest modification time of dir and its entries.
+func lastModified(dir string) (time.Time, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return time.Time{}, err
+	}
+	latest := info.ModTime()
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, entry := range entries {
+		if entry.ModTime().After(latest) {
+			latest = entry.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// probeMount stats path, a wedged fcfs_fused makes it return errStatsTimeout
+// after timeout, while the stat is left to finish in the background.
+func probeMount(path string, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := os.Stat(path)
+		done <- err
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return errStatsTimeout
+	}
+}
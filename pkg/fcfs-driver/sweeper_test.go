@@ -0,0 +1,274 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	mountutils "k8s.io/mount-utils"
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+	"vazmin.github.io/fastcfs-csi/pkg/fcfs/fake"
+)
+
+func TestSweeperPaths(t *testing.T) {
+	testCases := []struct {
+		path    string
+		target  bool
+		staging bool
+	}{
+		{path: "pods/uid-1/volumes/kubernetes.io~csi/pvc-1/mount", target: true},
+		{path: "pods/uid-1/volumes/kubernetes.io~nfs/pvc-1/mount"},
+		{path: "pods/uid-1/volume-subpaths/pvc-1/app/0"},
+		{path: "plugins/kubernetes.io/csi/pv/pvc-1/globalmount", staging: true},
+		{path: "plugins/kubernetes.io/csi/fcfs.csi.vazmin.github.io/0123abcd/globalmount", staging: true},
+		{path: "plugins/kubernetes.io/csi/volumeDevices/staging/pvc-1", staging: true},
+		{path: "plugins/kubernetes.io/csi/volumeDevices/publish/pvc-1/uid-1"},
+		{path: "plugins/fcfs.csi.vazmin.github.io"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			parts := strings.Split(tc.path, "/")
+			require.Equal(t, tc.target, isTargetPath(parts))
+			require.Equal(t, tc.staging, isStagingPath(parts))
+		})
+	}
+}
+
+func writeVolData(t *testing.T, dir string, data *volData) {
+	require.NoError(t, os.MkdirAll(dir, 0750))
+	content, err := json.Marshal(data)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, volDataFileName), content, 0600))
+}
+
+func TestMountSweeper(t *testing.T) {
+	ns, mounter := newFakeNodeServer(t)
+	cfs := ns.cfs.(*fake.Cfs)
+	ctx := context.Background()
+	kubeletDir := t.TempDir()
+	driverName := common.DefaultDriverName
+	csiDir := func(uid, name string) string {
+		return filepath.Join(kubeletDir, "pods", uid, "volumes", csiPluginDir, name)
+	}
+	mount := func(source, path string) {
+		require.NoError(t, os.MkdirAll(path, 0750))
+		require.NoError(t, mounter.FakeMounter.Mount(source, path, fcfsFuseFsType, nil))
+	}
+
+	// the target of a deleted pod
+	orphanTarget := filepath.Join(csiDir("deleted", "pvc-1"), "mount")
+	writeVolData(t, filepath.Dir(orphanTarget), &volData{SpecVolID: "pvc-1", VolumeHandle: "vol-1", DriverName: driverName})
+	mount("legacy-app", orphanTarget)
+	// the corrupted target of a running pod
+	corruptedTarget := filepath.Join(csiDir("running", "pvc-1"), "mount")
+	writeVolData(t, filepath.Dir(corruptedTarget), &volData{SpecVolID: "pvc-1", VolumeHandle: "vol-1", DriverName: driverName})
+	mount("legacy-app", corruptedTarget)
+	// the target of another driver
+	otherTarget := filepath.Join(csiDir("deleted", "pvc-2"), "mount")
+	writeVolData(t, filepath.Dir(otherTarget), &volData{SpecVolID: "pvc-2", VolumeHandle: "vol-2", DriverName: "other.csi.k8s.io"})
+	mount("other", otherTarget)
+	// a volume detached from the node
+	orphanStaging := filepath.Join(kubeletDir, "plugins", "kubernetes.io", "csi", "pv", "pvc-3", "globalmount")
+	writeVolData(t, filepath.Dir(orphanStaging), &volData{SpecVolID: "pvc-3", VolumeHandle: "legacy-app", DriverName: driverName})
+	mount("legacy-app", orphanStaging)
+	require.NoError(t, saveStagedPool(orphanStaging, &stagedPool{BaseConfigURL: testConfigBasePath, VolName: "legacy-app"}))
+	// a volume attached to the node
+	attachedStaging := filepath.Join(kubeletDir, "plugins", "kubernetes.io", "csi", "pv", "pvc-4", "globalmount")
+	writeVolData(t, filepath.Dir(attachedStaging), &volData{SpecVolID: "pvc-4", VolumeHandle: "legacy-app-4", DriverName: driverName})
+	mount("legacy-app", attachedStaging)
+	// an ephemeral volume of a deleted pod, whose mount is gone with the node
+	ephemeralTarget := filepath.Join(csiDir("deleted", "inline"), "mount")
+	writeVolData(t, filepath.Dir(ephemeralTarget), &volData{VolumeHandle: "csi-0123", DriverName: driverName})
+	_, err := ns.NodePublishVolume(ctx, newEphemeralPublishRequest("csi-0123", ephemeralTarget))
+	require.NoError(t, err)
+	require.NoError(t, mounter.FakeMounter.Unmount(ephemeralTarget))
+	_, ok := cfs.GetPool(testConfigBasePath, ephemeralPoolName("csi-0123"))
+	require.True(t, ok)
+
+	basePathDir := t.TempDir()
+	procDir := t.TempDir()
+	old := time.Now().Add(-2 * orphanBasePathAge)
+	basePath := func(name, pid string, modTime time.Time) string {
+		path := filepath.Join(basePathDir, name)
+		require.NoError(t, os.MkdirAll(path, 0750))
+		if len(pid) > 0 {
+			pidFile := filepath.Join(path, common.PidSuffixPath)
+			require.NoError(t, ioutil.WriteFile(pidFile, []byte(pid), 0600))
+			require.NoError(t, os.Chtimes(pidFile, modTime, modTime))
+		}
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+		return path
+	}
+	deadBasePath := basePath(common.CsiVolNamingPrefix+"dead", "4321", old)
+	runningBasePath := basePath(common.CsiVolNamingPrefix+"running", "1234", old)
+	require.NoError(t, os.MkdirAll(filepath.Join(procDir, "1234"), 0750))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(procDir, "1234", "comm"), []byte(fcfsFuseName+"\n"), 0600))
+	youngBasePath := basePath(ephemeralPoolPrefix+"young", "", time.Now())
+	staticBasePath := basePath("legacy-app", "", old)
+
+	runningPod := &v1.ObjectReference{Kind: "Pod", Name: "app", Namespace: "default", UID: "running"}
+	recorder := record.NewFakeRecorder(10)
+	ns.events = &eventRecorder{recorder: recorder, last: make(map[string]time.Time)}
+	s := &mountSweeper{
+		ns:          ns,
+		driverName:  driverName,
+		kubeletDir:  kubeletDir,
+		basePathDir: basePathDir,
+		procDir:     procDir,
+		interval:    time.Minute,
+		listMounts: func() ([]mountutils.MountInfo, error) {
+			mps, err := mounter.List()
+			infos := make([]mountutils.MountInfo, 0, len(mps))
+			for _, mp := range mps {
+				infos = append(infos, mountutils.MountInfo{Source: mp.Device, MountPoint: mp.Path, FsType: mp.Type})
+			}
+			return infos, err
+		},
+		listVolumes: func(ctx context.Context) (*nodeVolumes, error) {
+			return &nodeVolumes{
+				pods:     map[string]*v1.ObjectReference{"running": runningPod},
+				attached: map[string]struct{}{"pvc-4": {}},
+			}, nil
+		},
+		probe: func(path string) error {
+			if path == corruptedTarget {
+				return &os.PathError{Op: "stat", Path: path, Err: syscall.ENOTCONN}
+			}
+			return nil
+		},
+	}
+	s.sweep()
+
+	var mounted []string
+	for _, mp := range mounter.MountPoints {
+		mounted = append(mounted, mp.Path)
+	}
+	require.ElementsMatch(t, []string{corruptedTarget, otherTarget, attachedStaging}, mounted)
+	require.NoDirExists(t, orphanTarget)
+	require.NoFileExists(t, stagedPoolFile(orphanStaging))
+	require.True(t, ns.stats.isStale(corruptedTarget))
+	require.Len(t, recorder.Events, 1, "the pod of a corrupted target is told")
+	require.Contains(t, <-recorder.Events, "Warning FastCFSDaemonCrashed MountCheck of volume vol-1 failed")
+
+	_, ok = cfs.GetPool(testConfigBasePath, ephemeralPoolName("csi-0123"))
+	require.False(t, ok, "the pool of an ephemeral volume of a deleted pod is deleted")
+	require.NoDirExists(t, ephemeralTarget)
+	require.NoFileExists(t, ephemeralFile(ephemeralTarget))
+
+	require.NoDirExists(t, deadBasePath)
+	require.DirExists(t, runningBasePath)
+	require.DirExists(t, youngBasePath)
+	require.DirExists(t, staticBasePath)
+}
+
+func TestNodeVolumeLister(t *testing.T) {
+	pvName := func(name string) *string { return &name }
+	pods := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	require.NoError(t, pods.Add(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", UID: "uid-1"}}))
+	attachments := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, va := range []*storagev1.VolumeAttachment{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "csi-1"},
+			Spec: storagev1.VolumeAttachmentSpec{
+				Attacher: common.DefaultDriverName, NodeName: "node-1",
+				Source: storagev1.VolumeAttachmentSource{PersistentVolumeName: pvName("pvc-1")},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "csi-2"},
+			Spec: storagev1.VolumeAttachmentSpec{
+				Attacher: common.DefaultDriverName, NodeName: "node-2",
+				Source: storagev1.VolumeAttachmentSource{PersistentVolumeName: pvName("pvc-2")},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "csi-3"},
+			Spec: storagev1.VolumeAttachmentSpec{
+				Attacher: "other.csi.k8s.io", NodeName: "node-1",
+				Source: storagev1.VolumeAttachmentSource{PersistentVolumeName: pvName("pvc-3")},
+			},
+		},
+	} {
+		require.NoError(t, attachments.Add(va))
+	}
+
+	l := &nodeVolumeLister{
+		driverName:  common.DefaultDriverName,
+		nodeID:      "node-1",
+		pods:        corelisters.NewPodLister(pods),
+		attachments: storagelisters.NewVolumeAttachmentLister(attachments),
+	}
+	vols, err := l.list(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, map[string]*v1.ObjectReference{
+		"uid-1": {Kind: "Pod", APIVersion: "v1", Name: "app", Namespace: "default", UID: "uid-1"},
+	}, vols.pods)
+	require.Equal(t, map[string]struct{}{"pvc-1": {}}, vols.attached)
+}
+
+func TestMountSweeperBusyVolume(t *testing.T) {
+	ns, mounter := newFakeNodeServer(t)
+	kubeletDir := t.TempDir()
+	target := filepath.Join(kubeletDir, "pods", "deleted", "volumes", csiPluginDir, "pvc-1", "mount")
+	writeVolData(t, filepath.Dir(target), &volData{SpecVolID: "pvc-1", VolumeHandle: "vol-1", DriverName: common.DefaultDriverName})
+	require.NoError(t, os.MkdirAll(target, 0750))
+	require.NoError(t, mounter.FakeMounter.Mount("legacy-app", target, fcfsFuseFsType, nil))
+
+	s := &mountSweeper{
+		ns:          ns,
+		driverName:  common.DefaultDriverName,
+		kubeletDir:  kubeletDir,
+		basePathDir: t.TempDir(),
+		interval:    time.Minute,
+		listMounts: func() ([]mountutils.MountInfo, error) {
+			return []mountutils.MountInfo{{Source: "legacy-app", MountPoint: target, FsType: fcfsFuseFsType}}, nil
+		},
+		listVolumes: func(ctx context.Context) (*nodeVolumes, error) {
+			return &nodeVolumes{}, nil
+		},
+		probe: func(path string) error { return nil },
+	}
+	// kubelet is unpublishing the volume
+	require.True(t, ns.volumeLocks.TryAcquire("vol-1"))
+	s.sweep()
+	require.Len(t, mounter.MountPoints, 1)
+
+	ns.volumeLocks.Release("vol-1")
+	s.sweep()
+	require.Empty(t, mounter.MountPoints)
+}
+
+func TestProbeMount(t *testing.T) {
+	require.NoError(t, probeMount(t.TempDir(), time.Second))
+	require.True(t, os.IsNotExist(probeMount(filepath.Join(t.TempDir(), "missing"), time.Second)))
+}
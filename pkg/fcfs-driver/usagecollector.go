@@ -0,0 +1,177 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+	"vazmin.github.io/fastcfs-csi/pkg/fcfs"
+)
+
+var (
+	volumeUsageLabels = []string{"volume_id", "pool", "persistentvolume", "persistentvolumeclaim", "namespace"}
+
+	volumeQuotaBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: common.MetricsNamespace,
+		Name:      "volume_quota_bytes",
+		Help:      "Quota of the FastCFS pool of a volume, -1 if unlimited.",
+	}, volumeUsageLabels)
+
+	volumeUsedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: common.MetricsNamespace,
+		Name:      "volume_used_bytes",
+		Help:      "Used bytes of the FastCFS pool of a volume.",
+	}, volumeUsageLabels)
+)
+
+func init() {
+	common.MetricsRegistry.MustRegister(volumeQuotaBytes, volumeUsedBytes)
+}
+
+// usageCollector periodically exports the quota and usage of every
+// provisioned pool, labelled with its PV and PVC.
+type usageCollector struct {
+	driverName string
+	cfs        fcfs.Cfs
+	client     kubernetes.Interface
+	interval   time.Duration
+}
+
+// usageTarget is a PV of the driver whose pool usage is collected.
+type usageTarget struct {
+	volOptions *fcfs.VolumeOptions
+	secretRef  *v1.SecretReference
+	labels     []string
+}
+
+type volumeUsage struct {
+	labels []string
+	usage  *fcfs.VolumeUsage
+}
+
+func newUsageCollector(driverName string, cfs fcfs.Cfs, client kubernetes.Interface, interval time.Duration) *usageCollector {
+	return &usageCollector{
+		driverName: driverName,
+		cfs:        cfs,
+		client:     client,
+		interval:   interval,
+	}
+}
+
+func (c *usageCollector) run(stopCh <-chan struct{}) {
+	klog.Infof("collecting volume usage every %s", c.interval)
+	wait.Until(c.collect, c.interval, stopCh)
+}
+
+func (c *usageCollector) collect() {
+	ctx, cancel := context.WithTimeout(context.Background(), c.interval)
+	defer cancel()
+
+	pvs, err := c.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.Warningf("failed to list persistent volumes: %v", err)
+		return
+	}
+	var usages []volumeUsage
+	for i := range pvs.Items {
+		target, ok := newUsageTarget(&pvs.Items[i], c.driverName)
+		if !ok {
+			continue
+		}
+		usage, err := c.getUsage(ctx, target)
+		if err != nil {
+			klog.Warningf("failed to get usage of volume %s: %v", target.volOptions.VolID, err)
+			continue
+		}
+		usages = append(usages, volumeUsage{labels: target.labels, usage: usage})
+	}
+
+	volumeQuotaBytes.Reset()
+	volumeUsedBytes.Reset()
+	for _, u := range usages {
+		volumeQuotaBytes.WithLabelValues(u.labels...).Set(float64(u.usage.QuotaBytes))
+		volumeUsedBytes.WithLabelValues(u.labels...).Set(float64(u.usage.UsedBytes))
+	}
+}
+
+func (c *usageCollector) getUsage(ctx context.Context, target *usageTarget) (*fcfs.VolumeUsage, error) {
+	secrets, err := getSecrets(ctx, c.client, target.secretRef)
+	if err != nil {
+		return nil, err
+	}
+	cr, err := common.NewAdminCredentials(secrets)
+	if err != nil {
+		return nil, err
+	}
+	defer cr.DeleteCredentials()
+
+	return c.cfs.GetVolumeUsage(ctx, target.volOptions, cr)
+}
+
+// getSecrets returns the data of the secret ref.
+func getSecrets(ctx context.Context, client kubernetes.Interface, ref *v1.SecretReference) (map[string]string, error) {
+	secret, err := client.CoreV1().Secrets(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret %s/%s: %w", ref.Namespace, ref.Name, err)
+	}
+	secrets := make(map[string]string, len(secret.Data))
+	for k, v := range secret.Data {
+		secrets[k] = string(v)
+	}
+	return secrets, nil
+}
+
+// newUsageTarget returns the pool of a dynamically provisioned PV of driverName,
+// and the secret holding the admin credentials of the pool.
+func newUsageTarget(pv *v1.PersistentVolume, driverName string) (*usageTarget, bool) {
+	csiSource := pv.Spec.CSI
+	if csiSource == nil || csiSource.Driver != driverName {
+		return nil, false
+	}
+	volOptions, err := NewVolOptionsFromVolID(csiSource.VolumeHandle, nil)
+	if err != nil || !strings.HasPrefix(volOptions.VolName, common.CsiVolNamingPrefix) {
+		return nil, false
+	}
+	secretRef := csiSource.ControllerExpandSecretRef
+	if secretRef == nil {
+		secretRef = csiSource.NodeStageSecretRef
+	}
+	if secretRef == nil {
+		klog.V(4).Infof("skip usage of volume %s: no secret reference", pv.Name)
+		return nil, false
+	}
+
+	var claimName, claimNamespace string
+	if claim := pv.Spec.ClaimRef; claim != nil {
+		claimName, claimNamespace = claim.Name, claim.Namespace
+	}
+	return &usageTarget{
+		volOptions: volOptions,
+		secretRef:  secretRef,
+		labels:     []string{volOptions.VolID, volOptions.VolName, pv.Name, claimName, claimNamespace},
+	}, true
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+)
+
+func TestNewUsageTarget(t *testing.T) {
+	cid := &common.CSIIdentifier{
+		ClusterID: "http://fastcfs-config/base",
+		UserName:  "admin",
+		VolName:   common.CsiVolNamingPrefix + "pvc-1",
+	}
+	volID, err := cid.ComposeCSIID()
+	require.NoError(t, err)
+
+	expandSecret := &v1.SecretReference{Name: "expand", Namespace: "fastcfs"}
+	stageSecret := &v1.SecretReference{Name: "stage", Namespace: "fastcfs"}
+	newPV := func(driver, handle string, expandRef, stageRef *v1.SecretReference) *v1.PersistentVolume {
+		return &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc-1"},
+			Spec: v1.PersistentVolumeSpec{
+				ClaimRef: &v1.ObjectReference{Name: "data", Namespace: "default"},
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{
+						Driver:                    driver,
+						VolumeHandle:              handle,
+						ControllerExpandSecretRef: expandRef,
+						NodeStageSecretRef:        stageRef,
+					},
+				},
+			},
+		}
+	}
+
+	testCases := []struct {
+		name      string
+		pv        *v1.PersistentVolume
+		ok        bool
+		secretRef *v1.SecretReference
+	}{
+		{name: "expand secret", pv: newPV(common.DefaultDriverName, volID, expandSecret, stageSecret), ok: true, secretRef: expandSecret},
+		{name: "stage secret", pv: newPV(common.DefaultDriverName, volID, nil, stageSecret), ok: true, secretRef: stageSecret},
+		{name: "no secret", pv: newPV(common.DefaultDriverName, volID, nil, nil)},
+		{name: "other driver", pv: newPV("other.csi.k8s.io", volID, expandSecret, nil)},
+		{name: "static volume", pv: newPV(common.DefaultDriverName, "static-pool", expandSecret, nil)},
+		{name: "not csi", pv: &v1.PersistentVolume{}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			target, ok := newUsageTarget(tc.pv, common.DefaultDriverName)
+			require.Equal(t, tc.ok, ok)
+			if !tc.ok {
+				return
+			}
+			require.Equal(t, tc.secretRef, target.secretRef)
+			require.Equal(t, cid.VolName, target.volOptions.VolName)
+			require.Equal(t, []string{volID, cid.VolName, "pvc-1", "data", "default"}, target.labels)
+		})
+	}
+}
@@ -44,6 +44,19 @@ func newVolumeOptions(ctx context.Context, req *csi.CreateVolumeRequest, request
 	if len(basePath) == 0 {
 		return nil, fmt.Errorf("the storage class parameter '%s' must be set", common.FastCFSConfigBasePath)
 	}
+	// the node applies these, check them before the pool is created
+	if _, err := newSubPath(nil, parameters); err != nil {
+		return nil, err
+	}
+	if _, err := newVolumeOwner(nil, parameters); err != nil {
+		return nil, err
+	}
+	if _, err := newFuseOptions(nil, parameters); err != nil {
+		return nil, err
+	}
+	if err := common.ValidateClientConfig(common.ClientConfigParameters(parameters)); err != nil {
+		return nil, err
+	}
 
 	cid := &common.CSIIdentifier{
 		ClusterID: basePath,
@@ -89,7 +102,7 @@ func NewVolOptionsFromStatic(volID string, options map[string]string) (*fcfs.Vol
 		staticVol bool
 		err       error
 	)
-	val, ok := options["static"]
+	val, ok := options[common.StaticVolumeKey]
 	if !ok {
 		return nil, common.ErrNonStaticVolume
 	}
@@ -107,8 +120,9 @@ func NewVolOptionsFromStatic(volID string, options map[string]string) (*fcfs.Vol
 		return nil, fmt.Errorf("the storage class parameter '%s' must be set", common.FastCFSConfigBasePath)
 	}
 
+	pool, _ := splitStaticVolumeID(volID)
 	vol := &fcfs.VolumeOptions{
-		VolName:        volID,
+		VolName:        pool,
 		VolID:          volID,
 		BaseConfigURL:  basePath,
 		PreProvisioned: staticVol,
@@ -116,3 +130,24 @@ func NewVolOptionsFromStatic(volID string, options map[string]string) (*fcfs.Vol
 
 	return vol, nil
 }
+
+// newFuseOptions returns the fuse options of fcfs_fused from the mount flags of
+// the capability, which take precedence over the FuseOptionsKey parameter of
+// the storage class. It returns nil if none is set.
+func newFuseOptions(volCap *csi.VolumeCapability, volumeContext map[string]string) (map[string]string, error) {
+	options, err := common.ParseFuseOptions(volumeContext[common.FuseOptionsKey])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", common.FuseOptionsKey, err)
+	}
+	flags, _, err := common.SplitFuseMountOptions(volCap.GetMount().GetMountFlags())
+	if err != nil {
+		return nil, fmt.Errorf("invalid mount options: %w", err)
+	}
+	for name, value := range flags {
+		options[name] = value
+	}
+	if len(options) == 0 {
+		return nil, nil
+	}
+	return options, nil
+}
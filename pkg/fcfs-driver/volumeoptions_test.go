@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"math"
 	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
 	"vazmin.github.io/fastcfs-csi/pkg/common"
 )
 
@@ -14,3 +17,22 @@ func TestCapacity(t *testing.T) {
 	fmt.Printf("%f\n", float64(gib1piont1)/float64(common.GiB))
 	fmt.Printf("%f\n", math.Ceil(float64(gib1piont1)/float64(common.GiB)))
 }
+
+func TestNewFuseOptions(t *testing.T) {
+	volCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{
+			MountFlags: []string{"entry_timeout=1.0", "noatime"},
+		}},
+	}
+
+	options, err := newFuseOptions(volCap, map[string]string{common.FuseOptionsKey: "entry_timeout=5.0,read_ahead=false"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"entry_timeout": "1.0", "read_ahead": "false"}, options, "mount flags take precedence")
+
+	options, err = newFuseOptions(nil, map[string]string{common.StaticVolumeKey: "true"})
+	require.NoError(t, err)
+	require.Nil(t, options)
+
+	_, err = newFuseOptions(nil, map[string]string{common.FuseOptionsKey: "mountpoint=/"})
+	require.Error(t, err)
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+)
+
+// Volume context and storage class keys of the owner of the volume root directory.
+const (
+	volumeUIDKey  = "volume-uid"
+	volumeGIDKey  = "volume-gid"
+	volumeModeKey = "volume-mode"
+	// groupMode is added to the mode of the root directory given to a group
+	// without volume-mode, so that the group can write and new files inherit it.
+	groupMode = os.ModeSetgid | 0070
+)
+
+// volumeOwner is the owner and mode the root directory of a volume is
+// changed to once it is staged. FastCFS pools are owned by the user fcfs_fused
+// runs as, so pods running as another user could not write to them, and the
+// recursive chown of kubelet for fsGroup takes long over FUSE. Publishing does
+// not change it, which would take the volume from the pods already using it, so
+// the VolumeMountGroup of the first stage on a node wins.
+type volumeOwner struct {
+	uid  int // -1 leaves it unchanged
+	gid  int // -1 leaves it unchanged
+	mode os.FileMode
+	// setMode is false if the mode is only extended by groupMode
+	setMode bool
+}
+
+// newVolumeOwner returns the owner of the volume from the storage class
+// defaults in the volume context and the VolumeMountGroup of the capability,
+// which takes precedence over volume-gid. It returns nil if none is set.
+func newVolumeOwner(volCap *csi.VolumeCapability, volumeContext map[string]string) (*volumeOwner, error) {
+	o := &volumeOwner{}
+	var err error
+	if o.uid, err = parseOwnerID(volumeContext, volumeUIDKey); err != nil {
+		return nil, err
+	}
+	if o.gid, err = parseOwnerID(volumeContext, volumeGIDKey); err != nil {
+		return nil, err
+	}
+	if group := volCap.GetMount().GetVolumeMountGroup(); len(group) > 0 {
+		gid, err := strconv.ParseUint(group, 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("volume mount group %q must be a numeric group id", group)
+		}
+		o.gid = int(gid)
+	}
+	if _, o.setMode = volumeContext[volumeModeKey]; o.setMode {
+		if o.mode, err = parseFileMode(volumeContext, volumeModeKey, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	if o.uid < 0 && o.gid < 0 && !o.setMode {
+		return nil, nil
+	}
+	return o, nil
+}
+
+// apply changes the owner and mode of dir if they differ, it does not descend
+// into it.
+func (o *volumeOwner) apply(ctx context.Context, dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("failed to get the owner of %s", dir)
+	}
+
+	uid, gid := o.uid, o.gid
+	if uid == int(stat.Uid) {
+		uid = -1
+	}
+	if gid == int(stat.Gid) {
+		gid = -1
+	}
+	if uid >= 0 || gid >= 0 {
+		common.Log(ctx).V(4).Infof("changing the owner of %s from %d:%d to %d:%d", dir, stat.Uid, stat.Gid, uid, gid)
+		if err := os.Lchown(dir, uid, gid); err != nil {
+			return err
+		}
+	}
+
+	mode := info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	newMode := o.mode
+	if !o.setMode {
+		if o.gid < 0 {
+			return nil
+		}
+		newMode = mode | groupMode
+	}
+	if newMode != mode {
+		common.Log(ctx).V(4).Infof("changing the mode of %s from %o to %o", dir, mode, newMode)
+		return os.Chmod(dir, newMode)
+	}
+	return nil
+}
+
+// parseFileMode returns the octal file mode of key in the volume context, or
+// defaultMode if it is not set.
+func parseFileMode(volumeContext map[string]string, key string, defaultMode os.FileMode) (os.FileMode, error) {
+	val, ok := volumeContext[key]
+	if !ok {
+		return defaultMode, nil
+	}
+	mode, err := strconv.ParseUint(val, 8, 32)
+	if err != nil || mode > 07777 {
+		return 0, fmt.Errorf("%s %q must be an octal file mode", key, val)
+	}
+	// os.FileMode keeps the setuid, setgid and sticky bits elsewhere
+	fm := os.FileMode(mode & 0777)
+	if mode&04000 != 0 {
+		fm |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		fm |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		fm |= os.ModeSticky
+	}
+	return fm, nil
+}
+
+// parseOwnerID returns the numeric user or group id of key in the volume
+// context, or -1 if it is not set.
+func parseOwnerID(volumeContext map[string]string, key string) (int, error) {
+	val, ok := volumeContext[key]
+	if !ok {
+		return -1, nil
+	}
+	id, err := strconv.ParseUint(val, 10, 31)
+	if err != nil {
+		return -1, fmt.Errorf("%s %q must be a numeric id", key, val)
+	}
+	return int(id), nil
+}
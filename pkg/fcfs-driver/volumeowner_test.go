@@ -0,0 +1,130 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+)
+
+func mountGroupCapability(group string) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{VolumeMountGroup: group}},
+	}
+}
+
+func TestNewVolumeOwner(t *testing.T) {
+	testCases := []struct {
+		name          string
+		volCap        *csi.VolumeCapability
+		volumeContext map[string]string
+		expected      *volumeOwner
+		expectErr     bool
+	}{
+		{
+			name:          "none",
+			volCap:        mountGroupCapability(""),
+			volumeContext: map[string]string{"static": "true"},
+		},
+		{
+			name:          "storage class defaults",
+			volumeContext: map[string]string{volumeUIDKey: "1000", volumeGIDKey: "2000", volumeModeKey: "0770"},
+			expected:      &volumeOwner{uid: 1000, gid: 2000, mode: 0770, setMode: true},
+		},
+		{
+			name:          "mount group",
+			volCap:        mountGroupCapability("3000"),
+			volumeContext: map[string]string{volumeGIDKey: "2000"},
+			expected:      &volumeOwner{uid: -1, gid: 3000},
+		},
+		{
+			name:      "mount group name",
+			volCap:    mountGroupCapability("users"),
+			expectErr: true,
+		},
+		{
+			name:          "negative uid",
+			volumeContext: map[string]string{volumeUIDKey: "-1"},
+			expectErr:     true,
+		},
+		{
+			name:          "symbolic mode",
+			volumeContext: map[string]string{volumeModeKey: "g+w"},
+			expectErr:     true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			owner, err := newVolumeOwner(tc.volCap, tc.volumeContext)
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, owner)
+		})
+	}
+}
+
+func TestVolumeOwnerApply(t *testing.T) {
+	ctx := context.Background()
+	gid := os.Getgid()
+	testCases := []struct {
+		name     string
+		owner    *volumeOwner
+		expected os.FileMode
+	}{
+		{
+			name:     "group",
+			owner:    &volumeOwner{uid: -1, gid: gid},
+			expected: os.ModeDir | os.ModeSetgid | 0770,
+		},
+		{
+			name:     "mode",
+			owner:    &volumeOwner{uid: -1, gid: gid, mode: os.ModeSticky | 0777, setMode: true},
+			expected: os.ModeDir | os.ModeSticky | 0777,
+		},
+		{
+			name:     "owner only",
+			owner:    &volumeOwner{uid: os.Getuid(), gid: -1},
+			expected: os.ModeDir | 0710,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			require.NoError(t, os.Chmod(dir, 0710))
+
+			require.NoError(t, tc.owner.apply(ctx, dir))
+			info, err := os.Stat(dir)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, info.Mode())
+			require.Equal(t, uint32(gid), info.Sys().(*syscall.Stat_t).Gid)
+
+			// applying it again changes nothing
+			require.NoError(t, tc.owner.apply(ctx, dir))
+			again, err := os.Stat(dir)
+			require.NoError(t, err)
+			require.Equal(t, info.Mode(), again.Mode())
+		})
+	}
+}
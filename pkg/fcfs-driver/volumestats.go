@@ -0,0 +1,387 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/klog/v2"
+	"k8s.io/kubernetes/pkg/volume/util/fs"
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+	"vazmin.github.io/fastcfs-csi/pkg/fcfs"
+)
+
+const (
+	defaultVolumeStatsTimeout  = 5 * time.Second
+	defaultVolumeStatsCacheTTL = 30 * time.Second
+
+	// stagedPoolFileName is stored next to the staging path, as kubelet keeps vol_data.json
+	stagedPoolFileName = "fcfs-pool.json"
+)
+
+var (
+	// errStatsTimeout is returned by volumeStats.get if the volume path does
+	// not answer in time, e.g. on a wedged fcfs_fused.
+	errStatsTimeout = errors.New("timed out reading the volume stats")
+	errNotMounted   = errors.New("volume path is not mounted")
+)
+
+// isStaleMount reports whether err of the stats of a volume path shows that
+// its fcfs_fused is wedged or gone, so the path has to be mounted again.
+func isStaleMount(err error) bool {
+	return errors.Is(err, errStatsTimeout) || errors.Is(err, syscall.ENOTCONN)
+}
+
+// statsCall is a stat of a volume path in flight, later requests of the path
+// wait for it instead of piling up workers on a wedged mount.
+type statsCall struct {
+	done  chan struct{}
+	usage []*csi.VolumeUsage
+	err   error
+}
+
+type statsEntry struct {
+	usage []*csi.VolumeUsage
+	at    time.Time
+}
+
+// volumeStats reads the usage of volume paths in workers bounded by timeout,
+// and caches the results for ttl. It also tracks the paths found stale, which
+// NodeStageVolume and NodePublishVolume unmount before mounting again.
+type volumeStats struct {
+	timeout time.Duration
+	ttl     time.Duration
+	// stat reads the usage of a volume path staged at stagingPath, if it is
+	// known. It may block forever.
+	stat func(path, stagingPath string) ([]*csi.VolumeUsage, error)
+
+	mux      sync.Mutex
+	cache    map[string]*statsEntry
+	inflight map[string]*statsCall
+	stale    map[string]struct{}
+}
+
+func newVolumeStats(timeout, ttl time.Duration, stat func(path, stagingPath string) ([]*csi.VolumeUsage, error)) *volumeStats {
+	return &volumeStats{
+		timeout:  timeout,
+		ttl:      ttl,
+		stat:     stat,
+		cache:    make(map[string]*statsEntry),
+		inflight: make(map[string]*statsCall),
+		stale:    make(map[string]struct{}),
+	}
+}
+
+// get returns the usage of path, from the cache if it is younger than ttl. It
+// returns errStatsTimeout if the stat does not finish within timeout, the
+// worker is left to finish in the background.
+func (s *volumeStats) get(ctx context.Context, path, stagingPath string) ([]*csi.VolumeUsage, error) {
+	s.mux.Lock()
+	if entry, ok := s.cache[path]; ok && time.Since(entry.at) < s.ttl {
+		s.mux.Unlock()
+		return entry.usage, nil
+	}
+	call, ok := s.inflight[path]
+	if !ok {
+		call = &statsCall{done: make(chan struct{})}
+		s.inflight[path] = call
+		go s.run(path, stagingPath, call)
+	}
+	s.mux.Unlock()
+
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	select {
+	case <-call.done:
+		return call.usage, call.err
+	case <-timer.C:
+		return nil, errStatsTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *volumeStats) run(path, stagingPath string, call *statsCall) {
+	call.usage, call.err = s.stat(path, stagingPath)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	// the call was dropped by forget if the path got mounted again meanwhile
+	if s.inflight[path] == call {
+		delete(s.inflight, path)
+		if call.err == nil {
+			s.cache[path] = &statsEntry{usage: call.usage, at: time.Now()}
+		}
+	}
+	close(call.done)
+}
+
+// lastUsage returns the cached usage of path regardless of its age.
+func (s *volumeStats) lastUsage(path string) []*csi.VolumeUsage {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if entry, ok := s.cache[path]; ok {
+		return entry.usage
+	}
+	return nil
+}
+
+// markStale records paths to be unmounted lazily before they are mounted again.
+func (s *volumeStats) markStale(paths ...string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, path := range paths {
+		if len(path) > 0 {
+			s.stale[path] = struct{}{}
+		}
+	}
+}
+
+func (s *volumeStats) isStale(path string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	_, ok := s.stale[path]
+	return ok
+}
+
+// invalidate expires the cached usage of path, e.g. when its capacity changes.
+// It is still reported by lastUsage.
+func (s *volumeStats) invalidate(path string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if entry, ok := s.cache[path]; ok {
+		entry.at = time.Time{}
+	}
+}
+
+// forget drops the cached usage, the worker in flight and the stale mark of
+// path, once it is mounted again or unmounted.
+func (s *volumeStats) forget(path string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.cache, path)
+	delete(s.inflight, path)
+	delete(s.stale, path)
+}
+
+// statVolume returns the usage of the file system mounted at path.
+func statVolume(mounter Mounter, path string) ([]*csi.VolumeUsage, error) {
+	// the mount point check stats path as well, which blocks on a wedged mount
+	notMnt, err := mounter.IsLikelyNotMountPoint(path)
+	if err != nil {
+		return nil, err
+	}
+	if notMnt {
+		return nil, errNotMounted
+	}
+	available, capacity, used, inodes, inodesFree, inodesUsed, err := fs.Info(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to statfs %s: %w", path, err)
+	}
+	return []*csi.VolumeUsage{
+		{
+			Unit:      csi.VolumeUsage_BYTES,
+			Available: available,
+			Total:     capacity,
+			Used:      used,
+		},
+		{
+			Unit:      csi.VolumeUsage_INODES,
+			Available: inodesFree,
+			Total:     inodes,
+			Used:      inodesUsed,
+		},
+	}, nil
+}
+
+// statBlockVolume returns the size of the image of the block volume staged at
+// stagingPath. statfs of the device file published at the volume path reports
+// devtmpfs, and the usage of the image is up to the file system in it.
+func statBlockVolume(stagingPath string) ([]*csi.VolumeUsage, error) {
+	if len(stagingPath) == 0 {
+		return nil, nil
+	}
+	info, err := os.Stat(blockImagePath(stagingPath))
+	if err != nil {
+		return nil, err
+	}
+	return []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Total: info.Size()}}, nil
+}
+
+// stagedPool records the pool staged at a staging path and the credentials it
+// is mounted with, for the stats of NodeGetVolumeStats, which has no secrets.
+type stagedPool struct {
+	BaseConfigURL  string            `json:"baseConfigURL"`
+	VolName        string            `json:"volName"`
+	PreProvisioned bool              `json:"preProvisioned"`
+	Secrets        map[string]string `json:"secrets"`
+}
+
+func stagedPoolFile(stagingPath string) string {
+	return filepath.Join(filepath.Dir(stagingPath), stagedPoolFileName)
+}
+
+func saveStagedPool(stagingPath string, pool *stagedPool) error {
+	content, err := json.Marshal(pool)
+	if err != nil {
+		return err
+	}
+	// the record holds the secret key of the volume
+	return ioutil.WriteFile(stagedPoolFile(stagingPath), content, 0600)
+}
+
+// loadStagedPool returns the pool staged at stagingPath, or nil if it is not recorded.
+func loadStagedPool(stagingPath string) (*stagedPool, error) {
+	content, err := ioutil.ReadFile(stagedPoolFile(stagingPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pool := &stagedPool{}
+	if err := json.Unmarshal(content, pool); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", stagedPoolFile(stagingPath), err)
+	}
+	return pool, nil
+}
+
+func removeStagedPool(stagingPath string) error {
+	if err := os.Remove(stagedPoolFile(stagingPath)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// statVolume returns the usage of the volume mounted at path. The bytes are
+// those of the pool if it is known, statfs of fcfs_fused reports the cluster.
+// Block volumes report the size of their image only.
+func (ns *nodeServer) statVolume(path, stagingPath string) ([]*csi.VolumeUsage, error) {
+	// block volumes are published on a device file
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		return statBlockVolume(stagingPath)
+	}
+	usage, err := statVolume(ns.mounter, path)
+	if err != nil || !ns.statsQuota {
+		return usage, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ns.stats.timeout)
+	defer cancel()
+	pool, err := ns.volumePool(ctx, path, stagingPath)
+	if err != nil {
+		klog.Warningf("failed to read the pool of volume path %s: %v", path, err)
+		return usage, nil
+	}
+	if pool == nil {
+		// e.g. volumes staged before the quota was enabled, until they are staged again
+		klog.V(2).Infof("the pool of volume path %s is not recorded, reporting the file system", path)
+		return usage, nil
+	}
+	poolUsage, err := ns.poolUsage(ctx, pool)
+	if err != nil {
+		klog.Warningf("failed to get the usage of pool %s, reporting the file system of %s: %v", pool.VolName, path, err)
+		return usage, nil
+	}
+	applyPoolUsage(usage, poolUsage)
+	return usage, nil
+}
+
+// volumePool returns the pool of an ephemeral volume published at path, queried
+// with the ephemeral secret, or of a volume staged at stagingPath, or nil if
+// neither is recorded.
+func (ns *nodeServer) volumePool(ctx context.Context, path, stagingPath string) (*stagedPool, error) {
+	vol, err := loadEphemeralVolume(path)
+	if err != nil {
+		return nil, err
+	}
+	if vol != nil {
+		if ns.ephemeralSecrets == nil {
+			return nil, errors.New("the node server has no --ephemeral-secret")
+		}
+		secrets, err := ns.ephemeralSecrets(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &stagedPool{BaseConfigURL: vol.BaseConfigURL, VolName: vol.VolName, Secrets: secrets}, nil
+	}
+	if len(stagingPath) == 0 {
+		return nil, nil
+	}
+	return loadStagedPool(stagingPath)
+}
+
+func (ns *nodeServer) poolUsage(ctx context.Context, pool *stagedPool) (*fcfs.VolumeUsage, error) {
+	if ns.cfs == nil {
+		return nil, errors.New("FastCFS is not available on the node")
+	}
+	cr, err := common.GetCredentialsForVolume(pool.PreProvisioned, pool.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	defer cr.DeleteCredentials()
+	return ns.cfs.GetVolumeUsage(ctx, &fcfs.VolumeOptions{
+		VolName:        pool.VolName,
+		BaseConfigURL:  pool.BaseConfigURL,
+		PreProvisioned: pool.PreProvisioned,
+	}, cr)
+}
+
+// applyPoolUsage replaces the bytes of the file system in usage by the quota
+// and usage of the pool. The available bytes are bounded by the cluster too.
+func applyPoolUsage(usage []*csi.VolumeUsage, pool *fcfs.VolumeUsage) {
+	for _, u := range usage {
+		if u.Unit != csi.VolumeUsage_BYTES {
+			continue
+		}
+		u.Used = pool.UsedBytes
+		if pool.QuotaBytes == fcfs.UnlimitedQuota {
+			// the pool may fill the cluster
+			continue
+		}
+		u.Total = pool.QuotaBytes
+		available := pool.QuotaBytes - pool.UsedBytes
+		if available < 0 {
+			available = 0
+		}
+		if available < u.Available {
+			u.Available = available
+		}
+	}
+}
+
+// remountStale lazily unmounts path if the stats found it stale, so that the
+// caller mounts it again. A lazy unmount detaches the mount point at once,
+// even while requests of the wedged fcfs_fused are pending.
+func (ns *nodeServer) remountStale(ctx context.Context, path string) error {
+	if !ns.stats.isStale(path) {
+		return nil
+	}
+	if err := ns.mounter.LazyUnmount(ctx, path); err != nil {
+		return err
+	}
+	ns.stats.forget(path)
+	return nil
+}
@@ -0,0 +1,275 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+	"vazmin.github.io/fastcfs-csi/pkg/fcfs"
+	"vazmin.github.io/fastcfs-csi/pkg/fcfs/fake"
+)
+
+func TestVolumeStats(t *testing.T) {
+	ctx := context.Background()
+	release := make(chan struct{})
+	var calls int32
+	usage := []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Total: 10, Used: 4, Available: 6}}
+	s := newVolumeStats(10*time.Millisecond, time.Hour, func(path, stagingPath string) ([]*csi.VolumeUsage, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return usage, nil
+	})
+
+	_, err := s.get(ctx, "/mnt/vol", "")
+	require.True(t, isStaleMount(err), err)
+	// a wedged stat is waited for, not run again
+	_, err = s.get(ctx, "/mnt/vol", "")
+	require.True(t, errors.Is(err, errStatsTimeout), err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	close(release)
+	require.Eventually(t, func() bool {
+		got, err := s.get(ctx, "/mnt/vol", "")
+		return err == nil && len(got) == 1
+	}, time.Second, time.Millisecond)
+	_, err = s.get(ctx, "/mnt/vol", "")
+	require.NoError(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls), "the result is cached")
+	require.Equal(t, usage, s.lastUsage("/mnt/vol"))
+
+	s.invalidate("/mnt/vol")
+	_, err = s.get(ctx, "/mnt/vol", "")
+	require.NoError(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	s.markStale("/mnt/vol", "")
+	require.True(t, s.isStale("/mnt/vol"))
+	require.False(t, s.isStale(""))
+	s.forget("/mnt/vol")
+	require.False(t, s.isStale("/mnt/vol"))
+	require.Nil(t, s.lastUsage("/mnt/vol"))
+}
+
+func TestIsStaleMount(t *testing.T) {
+	require.True(t, isStaleMount(errStatsTimeout))
+	require.True(t, isStaleMount(&os.PathError{Op: "statfs", Path: "/mnt/vol", Err: syscall.ENOTCONN}))
+	require.False(t, isStaleMount(&os.PathError{Op: "statfs", Path: "/mnt/vol", Err: syscall.ENOENT}))
+	require.False(t, isStaleMount(errNotMounted))
+}
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	ns, mounter := newFakeNodeServer(t)
+	ctx := context.Background()
+	stagingPath := t.TempDir()
+	targetPath := filepath.Join(t.TempDir(), "mount")
+	statsReq := &csi.NodeGetVolumeStatsRequest{
+		VolumeId:          "legacy-app",
+		VolumePath:        targetPath,
+		StagingTargetPath: stagingPath,
+	}
+
+	_, err := ns.NodeGetVolumeStats(ctx, statsReq)
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = ns.NodeStageVolume(ctx, newNodeStageVolumeRequest("legacy-app", stagingPath))
+	require.NoError(t, err)
+	publishReq := &csi.NodePublishVolumeRequest{
+		VolumeId:          "legacy-app",
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  mountGroupCapability(""),
+	}
+	_, err = ns.NodePublishVolume(ctx, publishReq)
+	require.NoError(t, err)
+	require.Len(t, mounter.MountPoints, 2)
+
+	resp, err := ns.NodeGetVolumeStats(ctx, statsReq)
+	require.NoError(t, err)
+	require.False(t, resp.GetVolumeCondition().GetAbnormal())
+	require.Len(t, resp.GetUsage(), 2)
+
+	// a disconnected fcfs_fused marks both the target and the staging path stale
+	ns.stats.invalidate(targetPath)
+	ns.stats.stat = func(path, stagingPath string) ([]*csi.VolumeUsage, error) {
+		return nil, &os.PathError{Op: "statfs", Path: path, Err: syscall.ENOTCONN}
+	}
+	resp, err = ns.NodeGetVolumeStats(ctx, statsReq)
+	require.NoError(t, err)
+	require.True(t, resp.GetVolumeCondition().GetAbnormal())
+	require.Len(t, resp.GetUsage(), 2, "the last usage is reported")
+	require.True(t, ns.stats.isStale(targetPath))
+	require.True(t, ns.stats.isStale(stagingPath))
+
+	// both are unmounted lazily and mounted again
+	mounter.SetError("LazyUnmount", errors.New("exit status 32"))
+	_, err = ns.NodeStageVolume(ctx, newNodeStageVolumeRequest("legacy-app", stagingPath))
+	require.Equal(t, codes.Internal, status.Code(err))
+	mounter.SetError("LazyUnmount", nil)
+
+	_, err = ns.NodeStageVolume(ctx, newNodeStageVolumeRequest("legacy-app", stagingPath))
+	require.NoError(t, err)
+	require.False(t, ns.stats.isStale(stagingPath))
+	_, err = ns.NodePublishVolume(ctx, publishReq)
+	require.NoError(t, err)
+	require.False(t, ns.stats.isStale(targetPath))
+	require.Len(t, mounter.MountPoints, 2)
+	require.Equal(t, stagingPath, mounter.MountPoints[0].Path)
+	require.Equal(t, targetPath, mounter.MountPoints[1].Path)
+}
+
+func TestNodeGetVolumeStatsTimeout(t *testing.T) {
+	ns, _ := newFakeNodeServer(t)
+	release := make(chan struct{})
+	defer close(release)
+	ns.stats.timeout = 10 * time.Millisecond
+	ns.stats.stat = func(path, stagingPath string) ([]*csi.VolumeUsage, error) {
+		<-release
+		return nil, nil
+	}
+	req := &csi.NodeGetVolumeStatsRequest{VolumeId: "legacy-app", VolumePath: t.TempDir()}
+
+	resp, err := ns.NodeGetVolumeStats(context.Background(), req)
+	require.NoError(t, err)
+	require.True(t, resp.GetVolumeCondition().GetAbnormal())
+	require.Empty(t, resp.GetUsage())
+	// the volume lock is released although the stat is still wedged
+	require.True(t, ns.volumeLocks.TryAcquire("legacy-app"))
+	ns.volumeLocks.Release("legacy-app")
+}
+
+func TestApplyPoolUsage(t *testing.T) {
+	tests := []struct {
+		name string
+		pool fcfs.VolumeUsage
+		want csi.VolumeUsage
+	}{
+		{
+			name: "quota",
+			pool: fcfs.VolumeUsage{QuotaBytes: 10 * common.GiB, UsedBytes: 4 * common.GiB},
+			want: csi.VolumeUsage{Total: 10 * common.GiB, Used: 4 * common.GiB, Available: 6 * common.GiB},
+		},
+		{
+			name: "over quota",
+			pool: fcfs.VolumeUsage{QuotaBytes: 10 * common.GiB, UsedBytes: 12 * common.GiB},
+			want: csi.VolumeUsage{Total: 10 * common.GiB, Used: 12 * common.GiB},
+		},
+		{
+			name: "cluster fuller than the quota",
+			pool: fcfs.VolumeUsage{QuotaBytes: 200 * common.GiB, UsedBytes: 4 * common.GiB},
+			want: csi.VolumeUsage{Total: 200 * common.GiB, Used: 4 * common.GiB, Available: 50 * common.GiB},
+		},
+		{
+			name: "unlimited",
+			pool: fcfs.VolumeUsage{QuotaBytes: fcfs.UnlimitedQuota, UsedBytes: 4 * common.GiB},
+			want: csi.VolumeUsage{Total: 100 * common.GiB, Used: 4 * common.GiB, Available: 50 * common.GiB},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usage := []*csi.VolumeUsage{
+				{Unit: csi.VolumeUsage_BYTES, Total: 100 * common.GiB, Used: 50 * common.GiB, Available: 50 * common.GiB},
+				{Unit: csi.VolumeUsage_INODES, Total: 1000, Used: 10, Available: 990},
+			}
+			applyPoolUsage(usage, &tt.pool)
+			tt.want.Unit = csi.VolumeUsage_BYTES
+			require.Equal(t, &tt.want, usage[0])
+			require.Equal(t, int64(1000), usage[1].Total, "the inodes are those of the file system")
+		})
+	}
+}
+
+func TestNodeGetVolumeStatsQuota(t *testing.T) {
+	ns, _ := newFakeNodeServer(t)
+	cfs := ns.cfs.(*fake.Cfs)
+	cfs.AddPool(testConfigBasePath, "user", fcfs.Pool{Name: "legacy-app", QuotaBytes: common.GiB, UsedBytes: common.GiB / 4})
+	ctx := context.Background()
+	stagingPath := t.TempDir()
+	targetPath := filepath.Join(t.TempDir(), "mount")
+
+	// the credentials are not recorded unless the quota is enabled
+	_, err := ns.NodeStageVolume(ctx, newNodeStageVolumeRequest("legacy-app", stagingPath))
+	require.NoError(t, err)
+	require.NoFileExists(t, stagedPoolFile(stagingPath))
+
+	// a volume staged without record gets one on its next stage
+	ns.statsQuota = true
+	_, err = ns.NodeStageVolume(ctx, newNodeStageVolumeRequest("legacy-app", stagingPath))
+	require.NoError(t, err)
+	pool, err := loadStagedPool(stagingPath)
+	require.NoError(t, err)
+	require.Equal(t, &stagedPool{
+		BaseConfigURL:  testConfigBasePath,
+		VolName:        "legacy-app",
+		PreProvisioned: true,
+		Secrets:        map[string]string{"userName": "user", "userSecretKey": "user-key"},
+	}, pool)
+	_, err = ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:          "legacy-app",
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  mountGroupCapability(""),
+	})
+	require.NoError(t, err)
+
+	resp, err := ns.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{
+		VolumeId:          "legacy-app",
+		VolumePath:        targetPath,
+		StagingTargetPath: stagingPath,
+	})
+	require.NoError(t, err)
+	bytes := resp.GetUsage()[0]
+	require.Equal(t, int64(common.GiB), bytes.GetTotal())
+	require.Equal(t, int64(common.GiB/4), bytes.GetUsed())
+	require.LessOrEqual(t, bytes.GetAvailable(), int64(3*common.GiB/4))
+
+	// the file system is reported if the pool cannot be queried
+	ns.stats.invalidate(targetPath)
+	cfs.SetError("GetVolumeUsage", errors.New("connection refused"))
+	resp, err = ns.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{
+		VolumeId:          "legacy-app",
+		VolumePath:        targetPath,
+		StagingTargetPath: stagingPath,
+	})
+	require.NoError(t, err)
+	require.NotEqual(t, int64(common.GiB), resp.GetUsage()[0].GetTotal())
+	cfs.SetError("GetVolumeUsage", nil)
+
+	// ephemeral volumes are not staged
+	ephemeralPath := filepath.Join(t.TempDir(), "mount")
+	_, err = ns.NodePublishVolume(ctx, newEphemeralPublishRequest("csi-0123", ephemeralPath))
+	require.NoError(t, err)
+	resp, err = ns.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: "csi-0123", VolumePath: ephemeralPath})
+	require.NoError(t, err)
+	require.Equal(t, int64(2*common.GiB), resp.GetUsage()[0].GetTotal())
+
+	require.NoError(t, ns.mounter.Unmount(targetPath))
+	_, err = ns.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: "legacy-app", StagingTargetPath: stagingPath})
+	require.NoError(t, err)
+	require.NoFileExists(t, stagedPoolFile(stagingPath))
+}
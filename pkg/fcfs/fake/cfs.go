@@ -0,0 +1,243 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fake provides an in-memory fcfs.Cfs for tests.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+	"vazmin.github.io/fastcfs-csi/pkg/fcfs"
+)
+
+// Cfs is an in-memory fcfs.Cfs keeping the pools and their quota, for tests
+// without a FastCFS cluster. The errors of fcfs_pool are mimicked: creating an
+// existing pool fails, deleting a missing one does not.
+type Cfs struct {
+	// Latency delays every call, calls fail if their context is done first.
+	Latency time.Duration
+
+	mux    sync.Mutex
+	pools  map[string]*fakePool // by base config URL and pool name
+	errors map[string]error     // by method name
+	calls  map[string]int       // by method name
+}
+
+type fakePool struct {
+	fcfs.Pool
+	owner string
+	volID string
+}
+
+var _ fcfs.Cfs = &Cfs{}
+
+// NewCfs returns a Cfs without pools.
+func NewCfs() *Cfs {
+	return &Cfs{
+		pools:  make(map[string]*fakePool),
+		errors: make(map[string]error),
+		calls:  make(map[string]int),
+	}
+}
+
+func fakePoolKey(baseConfigURL, poolName string) string {
+	return baseConfigURL + "\x00" + poolName
+}
+
+// SetError makes method, e.g. "CreateVolume", fail with err, a nil err resets it.
+func (f *Cfs) SetError(method string, err error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if err == nil {
+		delete(f.errors, method)
+		return
+	}
+	f.errors[method] = err
+}
+
+// Calls returns the number of calls of method, failed ones included.
+func (f *Cfs) Calls(method string) int {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.calls[method]
+}
+
+// AddPool adds a pool owned by userName, e.g. the pool of a static volume.
+func (f *Cfs) AddPool(baseConfigURL, userName string, pool fcfs.Pool) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.pools[fakePoolKey(baseConfigURL, pool.Name)] = &fakePool{Pool: pool, owner: userName}
+}
+
+// GetPool returns the pool named poolName.
+func (f *Cfs) GetPool(baseConfigURL, poolName string) (fcfs.Pool, bool) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	pool, ok := f.pools[fakePoolKey(baseConfigURL, poolName)]
+	if !ok {
+		return fcfs.Pool{}, false
+	}
+	return pool.Pool, true
+}
+
+// call counts a call of method and waits for the latency, it returns the
+// error to fail the call with.
+func (f *Cfs) call(ctx context.Context, method string) error {
+	f.mux.Lock()
+	f.calls[method]++
+	f.mux.Unlock()
+
+	if f.Latency > 0 {
+		timer := time.NewTimer(f.Latency)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.errors[method]
+}
+
+func (f *Cfs) CreateVolume(ctx context.Context, volOptions *fcfs.VolumeOptions, cr *common.Credentials) (*fcfs.Volume, error) {
+	if err := f.call(ctx, "CreateVolume"); err != nil {
+		return nil, err
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	key := fakePoolKey(volOptions.BaseConfigURL, volOptions.VolName)
+	if _, ok := f.pools[key]; ok {
+		return nil, fmt.Errorf("pool %s already exists", volOptions.VolName)
+	}
+	f.pools[key] = &fakePool{
+		Pool: fcfs.Pool{
+			Name:       volOptions.VolName,
+			QuotaBytes: common.RoundUpGiB(volOptions.CapacityBytes) * common.GiB,
+		},
+		owner: cr.UserName,
+		volID: volOptions.VolID,
+	}
+	return &fcfs.Volume{
+		VolumeId:      volOptions.VolID,
+		CapacityBytes: volOptions.CapacityBytes,
+		Labels:        volOptions.Topology,
+	}, nil
+}
+
+func (f *Cfs) DeleteVolume(ctx context.Context, volOptions *fcfs.VolumeOptions, cr *common.Credentials) error {
+	if err := f.call(ctx, "DeleteVolume"); err != nil {
+		return err
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	delete(f.pools, fakePoolKey(volOptions.BaseConfigURL, volOptions.VolName))
+	return nil
+}
+
+func (f *Cfs) ResizeVolume(ctx context.Context, volOptions *fcfs.VolumeOptions, cr *common.Credentials) (int64, error) {
+	if err := f.call(ctx, "ResizeVolume"); err != nil {
+		return 0, err
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	pool, ok := f.pools[fakePoolKey(volOptions.BaseConfigURL, volOptions.VolName)]
+	if !ok {
+		return 0, fmt.Errorf("pool %s not exist", volOptions.VolName)
+	}
+	pool.QuotaBytes = common.RoundUpGiB(volOptions.CapacityBytes) * common.GiB
+	return common.RoundOffBytes(volOptions.CapacityBytes), nil
+}
+
+func (f *Cfs) GetVolumeByID(ctx context.Context, volumeID string) (*fcfs.Volume, error) {
+	if err := f.call(ctx, "GetVolumeByID"); err != nil {
+		return nil, err
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	for _, pool := range f.pools {
+		if pool.volID == volumeID {
+			return &fcfs.Volume{VolumeId: volumeID, CapacityBytes: pool.QuotaBytes}, nil
+		}
+	}
+	return nil, fmt.Errorf("volume %s not found", volumeID)
+}
+
+func (f *Cfs) VolumeExists(ctx context.Context, configURL, volumeName string, cr *common.Credentials) (bool, error) {
+	if err := f.call(ctx, "VolumeExists"); err != nil {
+		return false, err
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	_, ok := f.pools[fakePoolKey(configURL, volumeName)]
+	return ok, nil
+}
+
+func (f *Cfs) MountVolume(ctx context.Context, volOptions *fcfs.VolumeOptions, mountOptions *fcfs.MountOptionsSecrets, cr *common.Credentials) error {
+	if err := f.call(ctx, "MountVolume"); err != nil {
+		return err
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if _, ok := f.pools[fakePoolKey(volOptions.BaseConfigURL, volOptions.VolName)]; !ok {
+		return fmt.Errorf("pool %s not exist", volOptions.VolName)
+	}
+	return nil
+}
+
+func (f *Cfs) GetVolumeUsage(ctx context.Context, volOptions *fcfs.VolumeOptions, cr *common.Credentials) (*fcfs.VolumeUsage, error) {
+	if err := f.call(ctx, "GetVolumeUsage"); err != nil {
+		return nil, err
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	pool, ok := f.pools[fakePoolKey(volOptions.BaseConfigURL, volOptions.VolName)]
+	if !ok {
+		return nil, fmt.Errorf("pool %s not found", volOptions.VolName)
+	}
+	return &fcfs.VolumeUsage{QuotaBytes: pool.QuotaBytes, UsedBytes: pool.UsedBytes}, nil
+}
+
+func (f *Cfs) ListPools(ctx context.Context, baseConfigURL, userName string, cr *common.Credentials) ([]fcfs.Pool, error) {
+	if err := f.call(ctx, "ListPools"); err != nil {
+		return nil, err
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	pools := []fcfs.Pool{}
+	for key, pool := range f.pools {
+		if pool.owner == userName && key == fakePoolKey(baseConfigURL, pool.Name) {
+			pools = append(pools, pool.Pool)
+		}
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].Name < pools[j].Name })
+	return pools, nil
+}
@@ -22,7 +22,10 @@ import (
 	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc"
-	"k8s.io/klog/v2"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"os"
 	"os/exec"
 	"strings"
 	"time"
@@ -59,10 +62,25 @@ type VolumeOptions struct {
 	BaseConfigURL       string
 	ClusterID           string
 	PreProvisioned      bool
+	FuseOptions         map[string]string
+	// ClientConfig are the server parameters of a client config generated for the volume
+	ClientConfig map[string]string
 }
 
-func (vo *VolumeOptions) getPoolConfigURL() string {
-	return vo.BaseConfigURL + common.PoolConfigFile
+// getPoolConfigURL returns the client.conf of the pool commands, http(s)
+// configs are taken from the local config cache.
+func (vo *VolumeOptions) getPoolConfigURL(ctx context.Context) (string, error) {
+	return common.LocalConfig(ctx, vo.BaseConfigURL+common.PoolConfigFile)
+}
+
+// BasePath returns the base path of the fcfs_fused mounting the volume. Static
+// volumes whose handle differs from their pool publish a subpath of a pool
+// other volumes may share, so that they get a base path of their own.
+func (vo *VolumeOptions) BasePath() string {
+	if vo.PreProvisioned && len(vo.VolID) > 0 && vo.VolID != vo.VolName {
+		return common.SharedPoolBasePath(vo.VolName, vo.VolID)
+	}
+	return common.BuildBasePath(vo.VolName)
 }
 
 func (vo *VolumeOptions) getFuseClientConfigURL() string {
@@ -76,20 +94,25 @@ func NewCFS() (Cfs, error) {
 }
 
 func (c *cfs) CreateVolume(ctx context.Context, volOptions *VolumeOptions, cr *common.Credentials) (*Volume, error) {
+	configURL, err := volOptions.getPoolConfigURL(ctx)
+	if err != nil {
+		return nil, err
+	}
 	args := []string{
 		"-u", cr.UserName,
 		"-k", cr.KeyFile,
-		"-c", volOptions.getPoolConfigURL(),
+		"-c", configURL,
 		"create", volOptions.VolName,
 		fmt.Sprintf("%dg", common.RoundUpGiB(volOptions.CapacityBytes)),
 	}
 
 	output, err := common.ExecPoolCommand(ctx, args...)
+	auditPool(ctx, common.AuditCreate, volOptions, cr, args, output, err)
 	if err != nil {
-		klog.Errorf("[FastCFS] create volume %s", string(output))
-		return nil, err
+		common.Log(ctx).Errorf("[FastCFS] create volume %s", string(output))
+		return nil, withOutput(err, output)
 	}
-	klog.V(4).Infof("[FastCFS] successfully create FcfsVolume: %s", volOptions.VolID)
+	common.Log(ctx).V(4).Infof("[FastCFS] successfully create FcfsVolume: %s", volOptions.VolID)
 
 	return &Volume{
 		VolumeId:      volOptions.VolID,
@@ -99,10 +122,14 @@ func (c *cfs) CreateVolume(ctx context.Context, volOptions *VolumeOptions, cr *c
 }
 
 func (c *cfs) VolumeExists(ctx context.Context, baseURL, volumeName string, cr *common.Credentials) (bool, error) {
+	configURL, err := common.LocalConfig(ctx, baseURL+common.PoolConfigFile)
+	if err != nil {
+		return false, err
+	}
 	args := []string{
 		"-u", cr.UserName,
 		"-k", cr.KeyFile,
-		"-c", baseURL + common.PoolConfigFile,
+		"-c", configURL,
 		"plist", cr.UserName, volumeName,
 	}
 	output, err := common.ExecPoolCommand(ctx, args...)
@@ -111,7 +138,7 @@ func (c *cfs) VolumeExists(ctx context.Context, baseURL, volumeName string, cr *
 		if exitError.ExitCode() == common.CmdExitCode {
 			return false, nil
 		} else {
-			klog.Warningf("[FastCFS] failed to plist FastCFS Volume %s", res)
+			common.Log(ctx).Warningf("[FastCFS] failed to plist FastCFS Volume %s", res)
 			return true, errors.New(res)
 		}
 	}
@@ -125,41 +152,52 @@ func (c *cfs) VolumeExists(ctx context.Context, baseURL, volumeName string, cr *
 }
 
 func (c *cfs) DeleteVolume(ctx context.Context, volOptions *VolumeOptions, cr *common.Credentials) error {
+	configURL, err := volOptions.getPoolConfigURL(ctx)
+	if err != nil {
+		return err
+	}
 	args := []string{
 		"-u", cr.UserName,
 		"-k", cr.KeyFile,
-		"-c", volOptions.getPoolConfigURL(),
+		"-c", configURL,
 		"delete", volOptions.VolName,
 	}
 	output, err := common.ExecPoolCommand(ctx, args...)
 	if err == nil || (len(output) > 0 && strings.Contains(string(output), "No such file or directory")) {
-		klog.V(4).Infof("[FastCFS] successfully deleted FcfsVolume: %s", volOptions.VolID)
+		auditPool(ctx, common.AuditDelete, volOptions, cr, args, output, nil)
+		common.Log(ctx).V(4).Infof("[FastCFS] successfully deleted FcfsVolume: %s", volOptions.VolID)
 		return nil
 	}
-	klog.Warningf("[FastCFS] failed to delete FcfsVolume %s", string(output))
-	return err
+	auditPool(ctx, common.AuditDelete, volOptions, cr, args, output, err)
+	common.Log(ctx).Warningf("[FastCFS] failed to delete FcfsVolume %s", string(output))
+	return withOutput(err, output)
 }
 
 func (c *cfs) ResizeVolume(ctx context.Context, volOptions *VolumeOptions, cr *common.Credentials) (int64, error) {
 
 	newSize := common.RoundOffBytes(volOptions.CapacityBytes)
 
+	configURL, err := volOptions.getPoolConfigURL(ctx)
+	if err != nil {
+		return 0, err
+	}
 	args := []string{
 		"-u", cr.UserName,
 		"-k", cr.KeyFile,
-		"-c", volOptions.getPoolConfigURL(),
+		"-c", configURL,
 		"quota", volOptions.VolName,
 		fmt.Sprintf("%dg", common.RoundUpGiB(volOptions.CapacityBytes)),
 	}
 
 	output, err := common.ExecPoolCommand(ctx, args...)
+	auditPool(ctx, common.AuditQuota, volOptions, cr, args, output, err)
 
 	if err != nil {
-		klog.Warningf("[FastCFS] failed to resize FcfsVolume %s", string(output))
-		return 0, err
+		common.Log(ctx).Warningf("[FastCFS] failed to resize FcfsVolume %s", string(output))
+		return 0, withOutput(err, output)
 	}
 
-	klog.V(4).Infof("[FastCFS] successfully resize FcfsVolume: %s", volOptions.VolID)
+	common.Log(ctx).V(4).Infof("[FastCFS] successfully resize FcfsVolume: %s", volOptions.VolID)
 	return newSize, nil
 }
 
@@ -177,13 +215,23 @@ func (c *cfs) GetVolumeByID(ctx context.Context, volumeID string) (disk *Volume,
 }
 
 func FuseMount(ctx context.Context, volumeOptions *VolumeOptions, cr *common.Credentials) error {
-	klog.V(5).Infof("fuse client mount volume %s", volumeOptions.VolID)
+	common.Log(ctx).V(5).Infof("fuse client mount volume %s", volumeOptions.VolID)
 	if err := common.CreateDirIfNotExists(volumeOptions.VolPath); err != nil {
 		return err
 	}
 
-	basePath := common.BuildBasePath(volumeOptions.VolName)
-	if err := common.CreateDirIfNotExists(basePath); err != nil {
+	basePath := volumeOptions.BasePath()
+	if err := os.MkdirAll(basePath, 0750); err != nil {
+		return err
+	}
+
+	fuseConfigURL, err := common.LocalConfig(ctx, volumeOptions.getFuseClientConfigURL())
+	if err != nil {
+		return err
+	}
+	configURL, err := common.VolumeFuseConfig(basePath, fuseConfigURL,
+		volumeOptions.ClientConfig, volumeOptions.FuseOptions)
+	if err != nil {
 		return err
 	}
 
@@ -193,53 +241,138 @@ func FuseMount(ctx context.Context, volumeOptions *VolumeOptions, cr *common.Cre
 		"-b", basePath,
 		"-n", volumeOptions.VolName,
 		"-m", volumeOptions.VolPath,
-		volumeOptions.BaseConfigURL + common.FuseClientConfigFile, "restart",
+		configURL, "restart",
 	}
 
 	output, err := common.ExecFuseCommand(ctx, args...)
 
 	if err == nil {
-		klog.V(5).Infof("[FastCFS] successfully fuse client mount")
+		common.Log(ctx).V(5).Infof("[FastCFS] successfully fuse client mount")
 		return nil
 	}
 
-	klog.Warningf("[FastCFS] failed to mount %s, output <= %s", volumeOptions.VolID, string(output))
+	common.Log(ctx).Warningf("[FastCFS] failed to mount %s, output <= %s", volumeOptions.VolID, string(output))
+
+	return withOutput(err, output)
+}
+
+// auditPool records a fcfs_pool command changing the pool of volOptions.
+func auditPool(ctx context.Context, operation string, volOptions *VolumeOptions, cr *common.Credentials, args []string, output []byte, err error) {
+	if err != nil {
+		err = withOutput(err, output)
+	}
+	common.Audit(ctx, &common.AuditEvent{
+		Operation: operation,
+		VolumeID:  volOptions.VolID,
+		Pool:      volOptions.VolName,
+		User:      cr.UserName,
+		Request:   common.AuditArgs(common.PoolCMD, args),
+	}, err)
+}
 
+// withOutput adds the output of a failed command to its error.
+func withOutput(err error, output []byte) error {
+	if out := strings.TrimSpace(string(output)); len(out) > 0 {
+		return fmt.Errorf("%w, output: %s", err, out)
+	}
 	return err
 }
 
 func MountFcfsFusedWithProxy(ctx context.Context, volumeOptions *VolumeOptions, mountOption *MountOptionsSecrets) (string, error) {
-	klog.V(5).Infof("fuse client proxy mount volume %s", volumeOptions.VolID)
+	common.Log(ctx).V(5).Infof("fuse client proxy mount volume %s", volumeOptions.VolID)
 	if err := common.CreateDirIfNotExists(volumeOptions.VolPath); err != nil {
 		return "", err
 	}
 
-	basePath := common.BuildBasePath(volumeOptions.VolName)
-	args := []string{
-		"-n", volumeOptions.VolName,
-		"-m", volumeOptions.VolPath,
-		volumeOptions.BaseConfigURL + common.FuseClientConfigFile, "restart",
+	basePath := volumeOptions.BasePath()
+	conn, err := dialFcfsFusedProxy(mountOption.MountOptions)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	mountClient := NewMountClient(conn)
+	mountReq := mount_fcfs_fused.MountFcfsFusedRequest{
+		Version:        mount_fcfs_fused.MountAPIVersion_MOUNT_API_V2,
+		BasePath:       basePath,
+		VolName:        volumeOptions.VolName,
+		MountPoint:     volumeOptions.VolPath,
+		ConfigURL:      volumeOptions.getFuseClientConfigURL(),
+		FuseOptions:    volumeOptions.FuseOptions,
+		ClientConfig:   volumeOptions.ClientConfig,
+		Secrets:        mountOption.Secrets,
+		PreProvisioned: volumeOptions.PreProvisioned,
+	}
+	common.Log(ctx).V(2).Infof("calling fcfsfused Proxy: MountFcfsFused function")
+	resp, err := mountClient.service.MountFcfsFused(ctx, &mountReq)
+	if err != nil {
+		common.Log(ctx).Errorf("GRPC call returned with an error: %v", err)
+		return "", err
+	}
+	return resp.GetOutput(), nil
+}
+
+// UnmountFcfsFusedWithProxy asks the fcfsfused-proxy to unmount the volume, so that it stops restoring the mount.
+func UnmountFcfsFusedWithProxy(ctx context.Context, volumeOptions *VolumeOptions, mountOption *MountOptions) error {
+	common.Log(ctx).V(5).Infof("fuse client proxy unmount volume %s", volumeOptions.VolID)
+	conn, err := dialFcfsFusedProxy(mountOption)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	mountClient := NewMountClient(conn)
+	req := mount_fcfs_fused.UnmountFcfsFusedRequest{
+		VolName:    volumeOptions.VolName,
+		MountPoint: volumeOptions.VolPath,
+	}
+	common.Log(ctx).V(2).Infof("calling fcfsfused Proxy: UnmountFcfsFused function")
+	_, err = mountClient.service.UnmountFcfsFused(ctx, &req)
+	if err != nil {
+		common.Log(ctx).Errorf("GRPC call returned with an error: %v", err)
+	}
+	return err
+}
+
+// CheckFcfsFusedProxy checks that the fcfsfused-proxy answers health checks,
+// proxies without the health service are considered healthy.
+func CheckFcfsFusedProxy(ctx context.Context, mountOption *MountOptions) error {
+	conn, err := dialFcfsFusedProxy(mountOption)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if status.Code(err) == codes.Unimplemented {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("fcfsfused-proxy is %s", resp.GetStatus())
+	}
+	return nil
+}
+
+// dialFcfsFusedProxy connects to the fcfsfused-proxy within the configured connection timeout.
+func dialFcfsFusedProxy(mountOption *MountOptions) (*grpc.ClientConn, error) {
+	transportOption, err := mountOption.transportOption()
+	if err != nil {
+		return nil, err
 	}
-	var resp *mount_fcfs_fused.MountFcfsFusedResponse
-	var output string
 	connectionTimout := time.Duration(mountOption.FcfsFusedProxyConnTimout)
 	ctx, cancel := context.WithTimeout(context.Background(), connectionTimout*time.Second)
 	defer cancel()
-	conn, err := grpc.DialContext(ctx, mountOption.FcfsFusedEndpoint, grpc.WithInsecure(), grpc.WithBlock())
-	if err == nil {
-		mountClient := NewMountClient(conn)
-		mountReq := mount_fcfs_fused.MountFcfsFusedRequest{
-			BasePath:       basePath,
-			MountArgs:      args,
-			Secrets:        mountOption.Secrets,
-			PreProvisioned: volumeOptions.PreProvisioned,
-		}
-		klog.V(2).Infof("calling fcfsfused Proxy: MountFcfsFused function")
-		resp, err = mountClient.service.MountFcfsFused(context.TODO(), &mountReq)
-		if err != nil {
-			klog.Error("GRPC call returned with an error:", err)
-		}
-		output = resp.GetOutput()
+	conn, err := grpc.DialContext(ctx, mountOption.FcfsFusedEndpoint, transportOption, grpc.WithBlock(),
+		grpc.WithChainUnaryInterceptor(common.RequestIDClientInterceptor, common.TracingClientInterceptor))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrProxyUnavailable, mountOption.FcfsFusedEndpoint, err)
 	}
-	return output, err
+	return conn, nil
+}
+
+// IsProxyUnavailable reports whether err means the fcfsfused-proxy could not be
+// reached. A status returned by the proxy, even Unavailable, does not: it may
+// have started the mount already.
+func IsProxyUnavailable(err error) bool {
+	return errors.Is(err, ErrProxyUnavailable)
 }
@@ -28,6 +28,8 @@ type Cfs interface {
     GetVolumeByID(ctx context.Context, volumeID string) (vol *Volume, err error)
     VolumeExists(ctx context.Context, configURL , volumeName string, cr *common.Credentials) (bool, error)
     MountVolume(ctx context.Context, volOptions *VolumeOptions, mountOptions *MountOptionsSecrets, cr *common.Credentials) error
+    GetVolumeUsage(ctx context.Context, volOptions *VolumeOptions, cr *common.Credentials) (*VolumeUsage, error)
+    ListPools(ctx context.Context, baseConfigURL, userName string, cr *common.Credentials) ([]Pool, error)
 }
 
 
@@ -2,8 +2,12 @@ package fcfs
 
 import (
 	"context"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/apimachinery/pkg/util/rand"
 	"os"
+	"reflect"
 	"testing"
 	"vazmin.github.io/fastcfs-csi/pkg/common"
 )
@@ -80,3 +84,95 @@ func Test_cfs_VolumeExists(t *testing.T) {
 		})
 	}
 }
+
+func Test_parsePoolUsage(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		poolName string
+		want     *VolumeUsage
+		wantErr  bool
+	}{
+		{
+			name: "units separated by space",
+			output: `  No.          pool_name        quota         used
+    1     csi-vol-foo      10 GB       1.5 GB
+    2     csi-vol-bar  unlimited        512 MB
+`,
+			poolName: "csi-vol-foo",
+			want:     &VolumeUsage{QuotaBytes: 10 * common.GiB, UsedBytes: common.GiB + 512*common.MiB},
+		}, {
+			name: "unlimited quota",
+			output: `No. pool_name quota used
+1 csi-vol-foo 10GB 0
+2 csi-vol-bar unlimited 512MB
+`,
+			poolName: "csi-vol-bar",
+			want:     &VolumeUsage{QuotaBytes: UnlimitedQuota, UsedBytes: 512 * common.MiB},
+		}, {
+			name:     "pool not found",
+			output:   "No. pool_name quota used\n1 csi-vol-foo 10GB 0\n",
+			poolName: "csi-vol-bar",
+			wantErr:  true,
+		}, {
+			name:     "no header",
+			output:   "csi-vol-foo not exist\n",
+			poolName: "csi-vol-foo",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePoolUsage([]byte(tt.output), tt.poolName)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parsePoolUsage() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePoolUsage() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parsePoolList(t *testing.T) {
+	output := `  No.          pool_name        quota         used
+    1     legacy-app      10 GB       1.5 GB
+    2     legacy-db   unlimited        512 MB
+`
+	got, err := parsePoolList([]byte(output))
+	if err != nil {
+		t.Fatalf("parsePoolList() error = %v", err)
+	}
+	want := []Pool{
+		{Name: "legacy-app", QuotaBytes: 10 * common.GiB, UsedBytes: common.GiB + 512*common.MiB},
+		{Name: "legacy-db", QuotaBytes: UnlimitedQuota, UsedBytes: 512 * common.MiB},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parsePoolList() got = %v, want %v", got, want)
+	}
+
+	got, err = parsePoolList([]byte("No. pool_name quota used\n"))
+	if err != nil || len(got) != 0 {
+		t.Errorf("parsePoolList() of empty list got = %v, %v", got, err)
+	}
+}
+
+func TestIsProxyUnavailable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "dial failed", err: fmt.Errorf("%w: unix://tmp/fcfsfused-proxy.sock: context deadline exceeded", ErrProxyUnavailable), want: true},
+		{name: "returned by the proxy", err: status.Error(codes.Unavailable, "failed to fetch the fuse config"), want: false},
+		{name: "mount failed", err: status.Error(codes.Internal, "exit status 1"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsProxyUnavailable(tt.err); got != tt.want {
+				t.Errorf("IsProxyUnavailable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
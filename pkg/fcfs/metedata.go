@@ -38,29 +38,32 @@ func (m *Metadata) GetLabels() map[string]string {
 }
 
 func NewMetadata(nodeName string) (MetadataService, error) {
+    clientset, err := NewKubernetesClient()
+    if err != nil {
+        klog.Fatalf("Failed to get cluster config with error: %v\n", err)
+    }
+    metadataService, err := NewMetadataService(nodeName, clientset)
+    if err != nil {
+        return nil, fmt.Errorf("error getting information from metadata service or node object: %w", err)
+    }
+    return metadataService, err
+}
+
+// NewKubernetesClient returns a clientset of the in-cluster config, or of the
+// kubeconfig at KUBERNETES_CONFIG_PATH if set.
+func NewKubernetesClient() (kubernetes.Interface, error) {
     configPath := os.Getenv("KUBERNETES_CONFIG_PATH")
     var err error
     var config *rest.Config
     if configPath != "" {
         config, err = clientcmd.BuildConfigFromFlags("", configPath)
-        if err != nil {
-            klog.Fatalf("Failed to get cluster config with error: %v\n", err)
-        }
     } else {
         config, err = rest.InClusterConfig()
-        if err != nil {
-            klog.Fatalf("Failed to get cluster config with error: %v\n", err)
-        }
     }
     if err != nil {
         return nil, err
     }
-    clientset, err := kubernetes.NewForConfig(config)
-    metadataService, err := NewMetadataService(nodeName, clientset)
-    if err != nil {
-        return nil, fmt.Errorf("error getting information from metadata service or node object: %w", err)
-    }
-    return metadataService, err
+    return kubernetes.NewForConfig(config)
 }
 
 // NewMetadataService returns a new MetadataServiceImplementation.
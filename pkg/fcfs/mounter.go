@@ -17,16 +17,30 @@ limitations under the License.
 package fcfs
 
 import (
+    "errors"
     "google.golang.org/grpc"
+    "google.golang.org/grpc/credentials"
+    "vazmin.github.io/fastcfs-csi/pkg/common"
     mount_fcfs_fused "vazmin.github.io/fastcfs-csi/pkg/fcfsfused-proxy/pb"
 )
 
+// Fallback policies applied when the fcfsfused-proxy is enabled but unavailable
+const (
+    // ProxyFallbackNever fails the mount
+    ProxyFallbackNever = "never"
+    // ProxyFallbackOnUnavailable mounts directly with fcfs_fused
+    ProxyFallbackOnUnavailable = "on-unavailable"
+)
+
+// ErrProxyUnavailable is returned when the fcfsfused-proxy endpoint cannot be reached.
+var ErrProxyUnavailable = errors.New("fcfsfused-proxy is unavailable")
 
 type MountOptions struct {
     EnableFcfsFusedProxy     bool
     FcfsFusedEndpoint        string
     FcfsFusedProxyConnTimout int
-
+    FcfsFusedProxyTLS        *common.TLSOptions
+    FcfsFusedProxyFallback   string
 }
 type MountOptionsSecrets struct {
     *MountOptions
@@ -35,6 +49,18 @@ type MountOptionsSecrets struct {
 
 
 
+// transportOption returns the credentials used to dial the fcfsfused-proxy.
+func (m *MountOptions) transportOption() (grpc.DialOption, error) {
+    if m.FcfsFusedProxyTLS == nil || !m.FcfsFusedProxyTLS.Enable {
+        return grpc.WithInsecure(), nil
+    }
+    tlsConfig, err := m.FcfsFusedProxyTLS.ClientConfig()
+    if err != nil {
+        return nil, err
+    }
+    return grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)), nil
+}
+
 type MountClient struct {
     service mount_fcfs_fused.MountServiceClient
 }
@@ -0,0 +1,202 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fcfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+)
+
+// UnlimitedQuota is the QuotaBytes of a pool without quota.
+const UnlimitedQuota int64 = -1
+
+// VolumeUsage is the quota and usage of a FastCFS pool.
+type VolumeUsage struct {
+	QuotaBytes int64
+	UsedBytes  int64
+}
+
+// Pool is a FastCFS pool listed by fcfs_pool plist.
+type Pool struct {
+	Name       string
+	QuotaBytes int64
+	UsedBytes  int64
+}
+
+var sizeUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"k":   common.KiB,
+	"kb":  common.KiB,
+	"kib": common.KiB,
+	"m":   common.MiB,
+	"mb":  common.MiB,
+	"mib": common.MiB,
+	"g":   common.GiB,
+	"gb":  common.GiB,
+	"gib": common.GiB,
+	"t":   common.TiB,
+	"tb":  common.TiB,
+	"tib": common.TiB,
+	"p":   common.TiB * 1024,
+	"pb":  common.TiB * 1024,
+	"pib": common.TiB * 1024,
+}
+
+func (c *cfs) GetVolumeUsage(ctx context.Context, volOptions *VolumeOptions, cr *common.Credentials) (*VolumeUsage, error) {
+	configURL, err := volOptions.getPoolConfigURL(ctx)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{
+		"-u", cr.UserName,
+		"-k", cr.KeyFile,
+		"-c", configURL,
+		"plist", cr.UserName, volOptions.VolName,
+	}
+	output, err := common.ExecPoolCommand(ctx, args...)
+	if err != nil {
+		common.Log(ctx).Warningf("[FastCFS] failed to plist FastCFS Volume %s", string(output))
+		return nil, withOutput(err, output)
+	}
+	return parsePoolUsage(output, volOptions.VolName)
+}
+
+func (c *cfs) ListPools(ctx context.Context, baseConfigURL, userName string, cr *common.Credentials) ([]Pool, error) {
+	configURL, err := common.LocalConfig(ctx, baseConfigURL+common.PoolConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{
+		"-u", cr.UserName,
+		"-k", cr.KeyFile,
+		"-c", configURL,
+		"plist", userName,
+	}
+	output, err := common.ExecPoolCommand(ctx, args...)
+	if err != nil {
+		common.Log(ctx).Warningf("[FastCFS] failed to plist pools of user %s: %s", userName, string(output))
+		return nil, withOutput(err, output)
+	}
+	return parsePoolList(output)
+}
+
+// parsePoolUsage finds poolName in the table printed by fcfs_pool plist.
+func parsePoolUsage(output []byte, poolName string) (*VolumeUsage, error) {
+	pools, err := parsePoolList(output)
+	if err != nil {
+		return nil, err
+	}
+	for _, pool := range pools {
+		if pool.Name == poolName {
+			return &VolumeUsage{QuotaBytes: pool.QuotaBytes, UsedBytes: pool.UsedBytes}, nil
+		}
+	}
+	return nil, fmt.Errorf("pool %s not found", poolName)
+}
+
+// parsePoolList parses the table printed by fcfs_pool plist, the columns are
+// looked up by the header, e.g.
+//
+//	pool_name  quota  used
+//	csi-vol-x  10 GB  1.5 GB
+func parsePoolList(output []byte) ([]Pool, error) {
+	var (
+		header []string
+		pools  []Pool
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := joinSizeFields(strings.Fields(scanner.Text()))
+		if header == nil {
+			for _, f := range fields {
+				if f == "pool_name" {
+					header = fields
+					break
+				}
+			}
+			continue
+		}
+		if len(fields) != len(header) {
+			continue
+		}
+		row := make(map[string]string, len(header))
+		for i, name := range header {
+			row[name] = fields[i]
+		}
+		poolName := row["pool_name"]
+		quota, err := parsePoolSize(row["quota"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid quota of pool %s: %w", poolName, err)
+		}
+		used, err := parsePoolSize(row["used"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid usage of pool %s: %w", poolName, err)
+		}
+		pools = append(pools, Pool{Name: poolName, QuotaBytes: quota, UsedBytes: used})
+	}
+	if header == nil {
+		return nil, fmt.Errorf("unexpected output of plist: %q", string(output))
+	}
+	return pools, nil
+}
+
+// joinSizeFields merges a number and the unit following it, "10 GB" is a single column.
+func joinSizeFields(fields []string) []string {
+	joined := make([]string, 0, len(fields))
+	for _, f := range fields {
+		if n := len(joined); n > 0 {
+			if _, isUnit := sizeUnits[strings.ToLower(f)]; isUnit {
+				if _, err := strconv.ParseFloat(joined[n-1], 64); err == nil {
+					joined[n-1] += f
+					continue
+				}
+			}
+		}
+		joined = append(joined, f)
+	}
+	return joined
+}
+
+// parsePoolSize parses sizes such as "unlimited", "1024", "10GB" or "1.5T", units are binary.
+func parsePoolSize(s string) (int64, error) {
+	lower := strings.ToLower(s)
+	if lower == "unlimited" || lower == "-" || lower == "none" {
+		return UnlimitedQuota, nil
+	}
+	i := strings.IndexFunc(lower, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(lower)
+	}
+	unit, ok := sizeUnits[lower[i:]]
+	if !ok {
+		return 0, fmt.Errorf("unknown size unit in %q", s)
+	}
+	value, err := strconv.ParseFloat(lower[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", s, err)
+	}
+	return int64(value * float64(unit)), nil
+}
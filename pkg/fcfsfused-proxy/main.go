@@ -22,12 +22,16 @@ Licensed under the Apache License, Version 2.0.
 package main
 
 import (
+	"context"
 	"flag"
 	"net"
 	"os"
+	"syscall"
+	"time"
 
 	"k8s.io/klog/v2"
 
+	"vazmin.github.io/fastcfs-csi/pkg/common"
 	csicommon "vazmin.github.io/fastcfs-csi/pkg/csi-common"
 	server "vazmin.github.io/fastcfs-csi/pkg/fcfsfused-proxy/server"
 )
@@ -38,16 +42,63 @@ func init() {
 
 var (
 	blobfuseProxyEndpoint = flag.String("fcfsfused-proxy-endpoint", "unix://tmp/fcfsfused-proxy.sock", "fcfsfused-proxy endpoint")
+	tlsOptions            common.TLSOptions
+	allowedUIDs           []string
+	allowedPIDs           []string
+	serverOptions         server.Options
+	tracingOptions        common.TracingOptions
+	configCacheOptions    common.ConfigCacheOptions
+	logFormat             string
 )
 
 func main() {
+	flag.BoolVar(&tlsOptions.Enable, "enable-tls", false, "serve the proxy endpoint over TLS")
+	flag.StringVar(&tlsOptions.CertFile, "tls-cert-file", "", "TLS certificate file of the proxy")
+	flag.StringVar(&tlsOptions.KeyFile, "tls-key-file", "", "TLS private key file of the proxy")
+	flag.StringVar(&tlsOptions.CAFile, "tls-client-ca-file", "", "CA file used to verify client certificates, enables mutual TLS when set")
+	flag.Var(common.NewStringSlice(&allowedUIDs), "allowed-uids", "comma separated uids allowed to connect to a unix socket endpoint, empty allows any")
+	flag.Var(common.NewStringSlice(&allowedPIDs), "allowed-pids", "comma separated pids allowed to connect to a unix socket endpoint, empty allows any")
+	serverOptions.AllowedMountPrefixes = []string{"/var/lib/kubelet"}
+	serverOptions.AllowedConfigPrefixes = []string{"/etc/fastcfs-client-config", "/etc/fastcfs"}
+	flag.Var(common.NewStringSlice(&serverOptions.AllowedMountPrefixes), "allowed-mount-prefixes", "comma separated directories mount points must be located in")
+	flag.Var(common.NewStringSlice(&serverOptions.AllowedConfigPrefixes), "allowed-config-prefixes", "comma separated directories or http(s) URLs fuse configs must be located in")
+	flag.StringVar(&serverOptions.StateDir, "state-dir", "/var/lib/fcfsfused-proxy", "directory journaling the active mounts, which are restored on start, empty disables journaling")
+	flag.IntVar(&serverOptions.MaxConcurrentMounts, "max-concurrent-mounts", 8, "maximum number of volumes mounted at the same time, 0 means unbounded")
+	flag.StringVar(&configCacheOptions.Dir, "config-cache-dir", "/var/lib/fcfsfused-proxy/config-cache", "directory http(s) FastCFS client configs are downloaded to, so that mounts are restored with the last good copy while the config server is unreachable, empty passes the URLs to fcfs_fused")
+	flag.DurationVar(&configCacheOptions.MaxAge, "config-cache-max-age", time.Minute, "how long a downloaded config is used before it is revalidated with the config server")
+	flag.Var(common.NewStringSlice(&configCacheOptions.Checksums), "config-checksum", "comma separated URL=sha256 pins of downloaded config files, which are refused if their checksum differs, may be repeated")
+	flag.StringVar(&configCacheOptions.TLS.CAFile, "config-tls-ca-file", "", "CA file used to verify the certificate of https config servers")
+	flag.StringVar(&configCacheOptions.TLS.CertFile, "config-tls-cert-file", "", "client certificate file presented to https config servers")
+	flag.StringVar(&configCacheOptions.TLS.KeyFile, "config-tls-key-file", "", "client private key file presented to https config servers")
+	flag.StringVar(&tracingOptions.OTLPEndpoint, "otlp-endpoint", "", "host:port of the OTLP gRPC collector traces are exported to, tracing is disabled if empty")
+	flag.BoolVar(&tracingOptions.OTLPInsecure, "otlp-insecure", false, "connect to the OTLP collector without TLS")
+	flag.StringVar(&logFormat, "log-format", common.LogFormatText, "log format: text or json, lines logged while handling a request carry its requestID")
 	klog.InitFlags(nil)
 	flag.Parse()
+	if err := common.SetLogFormat(logFormat); err != nil {
+		klog.Exitf("invalid --log-format: %v", err)
+	}
+	shutdownTracing, err := common.InitTracing(context.Background(), "fcfsfused-proxy", &tracingOptions)
+	if err != nil {
+		klog.Fatalf("failed to init tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+	if err := common.InitConfigCache(&configCacheOptions); err != nil {
+		klog.Fatalf("failed to init config cache: %v", err)
+	}
+
 	proto, addr, err := csicommon.ParseEndpoint(*blobfuseProxyEndpoint)
 	if err != nil {
 		klog.Fatalf("failed to  parse endpoint %v", err.Error())
 	}
 
+	mountServer, err := server.NewMountServiceServer(serverOptions)
+	if err != nil {
+		klog.Fatalf("failed to create mount server: %v", err)
+	}
+	// restore the journaled mounts before accepting requests
+	mountServer.Restore()
+
 	if proto == "unix" {
 		addr = "/" + addr
 		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
@@ -55,15 +106,30 @@ func main() {
 		}
 	}
 
-	listener, err := net.Listen(proto, addr)
+	listener, err := listen(proto, addr)
+	if err != nil {
+		klog.Fatal("cannot start server:", err)
+	}
+	listener, err = server.NewPeerCredListener(listener, allowedUIDs, allowedPIDs)
 	if err != nil {
 		klog.Fatal("cannot start server:", err)
 	}
-
-	mountServer := server.NewMountServiceServer()
 
 	klog.V(2).Info("Listening for connections on address: %v\n", listener.Addr())
-	if err = server.RunGRPCServer(mountServer, false, listener); err != nil {
+	if err = server.RunGRPCServer(mountServer, &tlsOptions, listener); err != nil {
 		klog.Fatalf("Error running grpc server. Error: %v", listener.Addr(), err)
 	}
 }
+
+// listen creates unix sockets with mode 0600 so that only the owner may connect,
+// further narrowed by the peer credentials allow-lists. The umask is narrowed
+// around the bind instead of chmodding afterwards, which would leave a window
+// in which the socket is open to everyone.
+func listen(proto, addr string) (net.Listener, error) {
+	if proto != "unix" {
+		return net.Listen(proto, addr)
+	}
+	oldMask := syscall.Umask(0177)
+	defer syscall.Umask(oldMask)
+	return net.Listen(proto, addr)
+}
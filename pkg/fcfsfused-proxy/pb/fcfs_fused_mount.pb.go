@@ -25,15 +25,71 @@ const (
 // of the legacy proto package is being used.
 const _ = proto.ProtoPackageIsVersion4
 
+type MountAPIVersion int32
+
+const (
+	// raw mountArgs passthrough, no longer accepted by the proxy
+	MountAPIVersion_MOUNT_API_V1 MountAPIVersion = 0
+	// typed mount fields validated by the proxy
+	MountAPIVersion_MOUNT_API_V2 MountAPIVersion = 2
+)
+
+// Enum value maps for MountAPIVersion.
+var (
+	MountAPIVersion_name = map[int32]string{
+		0: "MOUNT_API_V1",
+		2: "MOUNT_API_V2",
+	}
+	MountAPIVersion_value = map[string]int32{
+		"MOUNT_API_V1": 0,
+		"MOUNT_API_V2": 2,
+	}
+)
+
+func (x MountAPIVersion) Enum() *MountAPIVersion {
+	p := new(MountAPIVersion)
+	*p = x
+	return p
+}
+
+func (x MountAPIVersion) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (MountAPIVersion) Descriptor() protoreflect.EnumDescriptor {
+	return file_fcfs_fused_mount_proto_enumTypes[0].Descriptor()
+}
+
+func (MountAPIVersion) Type() protoreflect.EnumType {
+	return &file_fcfs_fused_mount_proto_enumTypes[0]
+}
+
+func (x MountAPIVersion) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use MountAPIVersion.Descriptor instead.
+func (MountAPIVersion) EnumDescriptor() ([]byte, []int) {
+	return file_fcfs_fused_mount_proto_rawDescGZIP(), []int{0}
+}
+
 type MountFcfsFusedRequest struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	BasePath       string            `protobuf:"bytes,1,opt,name=basePath,proto3" json:"basePath,omitempty"`
+	BasePath string `protobuf:"bytes,1,opt,name=basePath,proto3" json:"basePath,omitempty"`
+	// Deprecated: Do not use.
 	MountArgs      []string          `protobuf:"bytes,2,rep,name=mountArgs,proto3" json:"mountArgs,omitempty"`
 	Secrets        map[string]string `protobuf:"bytes,3,rep,name=secrets,proto3" json:"secrets,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
 	PreProvisioned bool              `protobuf:"varint,4,opt,name=PreProvisioned,proto3" json:"PreProvisioned,omitempty"`
+	Version        MountAPIVersion   `protobuf:"varint,5,opt,name=version,proto3,enum=MountAPIVersion" json:"version,omitempty"`
+	VolName        string            `protobuf:"bytes,6,opt,name=volName,proto3" json:"volName,omitempty"`
+	MountPoint     string            `protobuf:"bytes,7,opt,name=mountPoint,proto3" json:"mountPoint,omitempty"`
+	ConfigURL      string            `protobuf:"bytes,8,opt,name=configURL,proto3" json:"configURL,omitempty"`
+	FuseOptions    map[string]string `protobuf:"bytes,9,rep,name=fuseOptions,proto3" json:"fuseOptions,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	// server parameters of a client config generated below the base path
+	ClientConfig map[string]string `protobuf:"bytes,10,rep,name=clientConfig,proto3" json:"clientConfig,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
 }
 
 func (x *MountFcfsFusedRequest) Reset() {
@@ -75,6 +131,7 @@ func (x *MountFcfsFusedRequest) GetBasePath() string {
 	return ""
 }
 
+// Deprecated: Do not use.
 func (x *MountFcfsFusedRequest) GetMountArgs() []string {
 	if x != nil {
 		return x.MountArgs
@@ -96,6 +153,48 @@ func (x *MountFcfsFusedRequest) GetPreProvisioned() bool {
 	return false
 }
 
+func (x *MountFcfsFusedRequest) GetVersion() MountAPIVersion {
+	if x != nil {
+		return x.Version
+	}
+	return MountAPIVersion_MOUNT_API_V1
+}
+
+func (x *MountFcfsFusedRequest) GetVolName() string {
+	if x != nil {
+		return x.VolName
+	}
+	return ""
+}
+
+func (x *MountFcfsFusedRequest) GetMountPoint() string {
+	if x != nil {
+		return x.MountPoint
+	}
+	return ""
+}
+
+func (x *MountFcfsFusedRequest) GetConfigURL() string {
+	if x != nil {
+		return x.ConfigURL
+	}
+	return ""
+}
+
+func (x *MountFcfsFusedRequest) GetFuseOptions() map[string]string {
+	if x != nil {
+		return x.FuseOptions
+	}
+	return nil
+}
+
+func (x *MountFcfsFusedRequest) GetClientConfig() map[string]string {
+	if x != nil {
+		return x.ClientConfig
+	}
+	return nil
+}
+
 type MountFcfsFusedResponse struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -143,36 +242,170 @@ func (x *MountFcfsFusedResponse) GetOutput() string {
 	return ""
 }
 
+type UnmountFcfsFusedRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	VolName    string `protobuf:"bytes,1,opt,name=volName,proto3" json:"volName,omitempty"`
+	MountPoint string `protobuf:"bytes,2,opt,name=mountPoint,proto3" json:"mountPoint,omitempty"`
+}
+
+func (x *UnmountFcfsFusedRequest) Reset() {
+	*x = UnmountFcfsFusedRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_fcfs_fused_mount_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *UnmountFcfsFusedRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UnmountFcfsFusedRequest) ProtoMessage() {}
+
+func (x *UnmountFcfsFusedRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_fcfs_fused_mount_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UnmountFcfsFusedRequest.ProtoReflect.Descriptor instead.
+func (*UnmountFcfsFusedRequest) Descriptor() ([]byte, []int) {
+	return file_fcfs_fused_mount_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *UnmountFcfsFusedRequest) GetVolName() string {
+	if x != nil {
+		return x.VolName
+	}
+	return ""
+}
+
+func (x *UnmountFcfsFusedRequest) GetMountPoint() string {
+	if x != nil {
+		return x.MountPoint
+	}
+	return ""
+}
+
+type UnmountFcfsFusedResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+}
+
+func (x *UnmountFcfsFusedResponse) Reset() {
+	*x = UnmountFcfsFusedResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_fcfs_fused_mount_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *UnmountFcfsFusedResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UnmountFcfsFusedResponse) ProtoMessage() {}
+
+func (x *UnmountFcfsFusedResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_fcfs_fused_mount_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UnmountFcfsFusedResponse.ProtoReflect.Descriptor instead.
+func (*UnmountFcfsFusedResponse) Descriptor() ([]byte, []int) {
+	return file_fcfs_fused_mount_proto_rawDescGZIP(), []int{3}
+}
+
 var File_fcfs_fused_mount_proto protoreflect.FileDescriptor
 
 var file_fcfs_fused_mount_proto_rawDesc = []byte{
 	0x0a, 0x16, 0x66, 0x63, 0x66, 0x73, 0x5f, 0x66, 0x75, 0x73, 0x65, 0x64, 0x5f, 0x6d, 0x6f, 0x75,
-	0x6e, 0x74, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0xf4, 0x01, 0x0a, 0x15, 0x4d, 0x6f, 0x75,
+	0x6e, 0x74, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0x96, 0x05, 0x0a, 0x15, 0x4d, 0x6f, 0x75,
 	0x6e, 0x74, 0x46, 0x63, 0x66, 0x73, 0x46, 0x75, 0x73, 0x65, 0x64, 0x52, 0x65, 0x71, 0x75, 0x65,
 	0x73, 0x74, 0x12, 0x1a, 0x0a, 0x08, 0x62, 0x61, 0x73, 0x65, 0x50, 0x61, 0x74, 0x68, 0x18, 0x01,
-	0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x62, 0x61, 0x73, 0x65, 0x50, 0x61, 0x74, 0x68, 0x12, 0x1c,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x62, 0x61, 0x73, 0x65, 0x50, 0x61, 0x74, 0x68, 0x12, 0x20,
 	0x0a, 0x09, 0x6d, 0x6f, 0x75, 0x6e, 0x74, 0x41, 0x72, 0x67, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28,
-	0x09, 0x52, 0x09, 0x6d, 0x6f, 0x75, 0x6e, 0x74, 0x41, 0x72, 0x67, 0x73, 0x12, 0x3d, 0x0a, 0x07,
-	0x73, 0x65, 0x63, 0x72, 0x65, 0x74, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x23, 0x2e,
-	0x4d, 0x6f, 0x75, 0x6e, 0x74, 0x46, 0x63, 0x66, 0x73, 0x46, 0x75, 0x73, 0x65, 0x64, 0x52, 0x65,
-	0x71, 0x75, 0x65, 0x73, 0x74, 0x2e, 0x53, 0x65, 0x63, 0x72, 0x65, 0x74, 0x73, 0x45, 0x6e, 0x74,
-	0x72, 0x79, 0x52, 0x07, 0x73, 0x65, 0x63, 0x72, 0x65, 0x74, 0x73, 0x12, 0x26, 0x0a, 0x0e, 0x50,
-	0x72, 0x65, 0x50, 0x72, 0x6f, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x65, 0x64, 0x18, 0x04, 0x20,
-	0x01, 0x28, 0x08, 0x52, 0x0e, 0x50, 0x72, 0x65, 0x50, 0x72, 0x6f, 0x76, 0x69, 0x73, 0x69, 0x6f,
-	0x6e, 0x65, 0x64, 0x1a, 0x3a, 0x0a, 0x0c, 0x53, 0x65, 0x63, 0x72, 0x65, 0x74, 0x73, 0x45, 0x6e,
-	0x74, 0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
-	0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02,
-	0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01, 0x22,
-	0x30, 0x0a, 0x16, 0x4d, 0x6f, 0x75, 0x6e, 0x74, 0x46, 0x63, 0x66, 0x73, 0x46, 0x75, 0x73, 0x65,
-	0x64, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x6f, 0x75, 0x74,
-	0x70, 0x75, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x6f, 0x75, 0x74, 0x70, 0x75,
-	0x74, 0x32, 0x53, 0x0a, 0x0c, 0x4d, 0x6f, 0x75, 0x6e, 0x74, 0x53, 0x65, 0x72, 0x76, 0x69, 0x63,
-	0x65, 0x12, 0x43, 0x0a, 0x0e, 0x4d, 0x6f, 0x75, 0x6e, 0x74, 0x46, 0x63, 0x66, 0x73, 0x46, 0x75,
-	0x73, 0x65, 0x64, 0x12, 0x16, 0x2e, 0x4d, 0x6f, 0x75, 0x6e, 0x74, 0x46, 0x63, 0x66, 0x73, 0x46,
-	0x75, 0x73, 0x65, 0x64, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x17, 0x2e, 0x4d, 0x6f,
+	0x09, 0x42, 0x02, 0x18, 0x01, 0x52, 0x09, 0x6d, 0x6f, 0x75, 0x6e, 0x74, 0x41, 0x72, 0x67, 0x73,
+	0x12, 0x3d, 0x0a, 0x07, 0x73, 0x65, 0x63, 0x72, 0x65, 0x74, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28,
+	0x0b, 0x32, 0x23, 0x2e, 0x4d, 0x6f, 0x75, 0x6e, 0x74, 0x46, 0x63, 0x66, 0x73, 0x46, 0x75, 0x73,
+	0x65, 0x64, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x2e, 0x53, 0x65, 0x63, 0x72, 0x65, 0x74,
+	0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x07, 0x73, 0x65, 0x63, 0x72, 0x65, 0x74, 0x73, 0x12,
+	0x26, 0x0a, 0x0e, 0x50, 0x72, 0x65, 0x50, 0x72, 0x6f, 0x76, 0x69, 0x73, 0x69, 0x6f, 0x6e, 0x65,
+	0x64, 0x18, 0x04, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0e, 0x50, 0x72, 0x65, 0x50, 0x72, 0x6f, 0x76,
+	0x69, 0x73, 0x69, 0x6f, 0x6e, 0x65, 0x64, 0x12, 0x2a, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69,
+	0x6f, 0x6e, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x10, 0x2e, 0x4d, 0x6f, 0x75, 0x6e, 0x74,
+	0x41, 0x50, 0x49, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x52, 0x07, 0x76, 0x65, 0x72, 0x73,
+	0x69, 0x6f, 0x6e, 0x12, 0x18, 0x0a, 0x07, 0x76, 0x6f, 0x6c, 0x4e, 0x61, 0x6d, 0x65, 0x18, 0x06,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x76, 0x6f, 0x6c, 0x4e, 0x61, 0x6d, 0x65, 0x12, 0x1e, 0x0a,
+	0x0a, 0x6d, 0x6f, 0x75, 0x6e, 0x74, 0x50, 0x6f, 0x69, 0x6e, 0x74, 0x18, 0x07, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x0a, 0x6d, 0x6f, 0x75, 0x6e, 0x74, 0x50, 0x6f, 0x69, 0x6e, 0x74, 0x12, 0x1c, 0x0a,
+	0x09, 0x63, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x55, 0x52, 0x4c, 0x18, 0x08, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x09, 0x63, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x55, 0x52, 0x4c, 0x12, 0x49, 0x0a, 0x0b, 0x66,
+	0x75, 0x73, 0x65, 0x4f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x18, 0x09, 0x20, 0x03, 0x28, 0x0b,
+	0x32, 0x27, 0x2e, 0x4d, 0x6f, 0x75, 0x6e, 0x74, 0x46, 0x63, 0x66, 0x73, 0x46, 0x75, 0x73, 0x65,
+	0x64, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x2e, 0x46, 0x75, 0x73, 0x65, 0x4f, 0x70, 0x74,
+	0x69, 0x6f, 0x6e, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x0b, 0x66, 0x75, 0x73, 0x65, 0x4f,
+	0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x12, 0x4c, 0x0a, 0x0c, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74,
+	0x43, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x18, 0x0a, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x28, 0x2e, 0x4d,
+	0x6f, 0x75, 0x6e, 0x74, 0x46, 0x63, 0x66, 0x73, 0x46, 0x75, 0x73, 0x65, 0x64, 0x52, 0x65, 0x71,
+	0x75, 0x65, 0x73, 0x74, 0x2e, 0x43, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x43, 0x6f, 0x6e, 0x66, 0x69,
+	0x67, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x0c, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x43, 0x6f,
+	0x6e, 0x66, 0x69, 0x67, 0x1a, 0x3a, 0x0a, 0x0c, 0x53, 0x65, 0x63, 0x72, 0x65, 0x74, 0x73, 0x45,
+	0x6e, 0x74, 0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01,
+	0x1a, 0x3e, 0x0a, 0x10, 0x46, 0x75, 0x73, 0x65, 0x4f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x45,
+	0x6e, 0x74, 0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01,
+	0x1a, 0x3f, 0x0a, 0x11, 0x43, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x43, 0x6f, 0x6e, 0x66, 0x69, 0x67,
+	0x45, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38,
+	0x01, 0x22, 0x30, 0x0a, 0x16, 0x4d, 0x6f, 0x75, 0x6e, 0x74, 0x46, 0x63, 0x66, 0x73, 0x46, 0x75,
+	0x73, 0x65, 0x64, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x6f,
+	0x75, 0x74, 0x70, 0x75, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x6f, 0x75, 0x74,
+	0x70, 0x75, 0x74, 0x22, 0x53, 0x0a, 0x17, 0x55, 0x6e, 0x6d, 0x6f, 0x75, 0x6e, 0x74, 0x46, 0x63,
+	0x66, 0x73, 0x46, 0x75, 0x73, 0x65, 0x64, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x18,
+	0x0a, 0x07, 0x76, 0x6f, 0x6c, 0x4e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x07, 0x76, 0x6f, 0x6c, 0x4e, 0x61, 0x6d, 0x65, 0x12, 0x1e, 0x0a, 0x0a, 0x6d, 0x6f, 0x75, 0x6e,
+	0x74, 0x50, 0x6f, 0x69, 0x6e, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0a, 0x6d, 0x6f,
+	0x75, 0x6e, 0x74, 0x50, 0x6f, 0x69, 0x6e, 0x74, 0x22, 0x1a, 0x0a, 0x18, 0x55, 0x6e, 0x6d, 0x6f,
 	0x75, 0x6e, 0x74, 0x46, 0x63, 0x66, 0x73, 0x46, 0x75, 0x73, 0x65, 0x64, 0x52, 0x65, 0x73, 0x70,
-	0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x42, 0x06, 0x5a, 0x04, 0x2e, 0x3b, 0x70, 0x62, 0x62, 0x06,
-	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x6f, 0x6e, 0x73, 0x65, 0x2a, 0x35, 0x0a, 0x0f, 0x4d, 0x6f, 0x75, 0x6e, 0x74, 0x41, 0x50, 0x49,
+	0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x10, 0x0a, 0x0c, 0x4d, 0x4f, 0x55, 0x4e, 0x54,
+	0x5f, 0x41, 0x50, 0x49, 0x5f, 0x56, 0x31, 0x10, 0x00, 0x12, 0x10, 0x0a, 0x0c, 0x4d, 0x4f, 0x55,
+	0x4e, 0x54, 0x5f, 0x41, 0x50, 0x49, 0x5f, 0x56, 0x32, 0x10, 0x02, 0x32, 0x9e, 0x01, 0x0a, 0x0c,
+	0x4d, 0x6f, 0x75, 0x6e, 0x74, 0x53, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x12, 0x43, 0x0a, 0x0e,
+	0x4d, 0x6f, 0x75, 0x6e, 0x74, 0x46, 0x63, 0x66, 0x73, 0x46, 0x75, 0x73, 0x65, 0x64, 0x12, 0x16,
+	0x2e, 0x4d, 0x6f, 0x75, 0x6e, 0x74, 0x46, 0x63, 0x66, 0x73, 0x46, 0x75, 0x73, 0x65, 0x64, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x17, 0x2e, 0x4d, 0x6f, 0x75, 0x6e, 0x74, 0x46, 0x63,
+	0x66, 0x73, 0x46, 0x75, 0x73, 0x65, 0x64, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22,
+	0x00, 0x12, 0x49, 0x0a, 0x10, 0x55, 0x6e, 0x6d, 0x6f, 0x75, 0x6e, 0x74, 0x46, 0x63, 0x66, 0x73,
+	0x46, 0x75, 0x73, 0x65, 0x64, 0x12, 0x18, 0x2e, 0x55, 0x6e, 0x6d, 0x6f, 0x75, 0x6e, 0x74, 0x46,
+	0x63, 0x66, 0x73, 0x46, 0x75, 0x73, 0x65, 0x64, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a,
+	0x19, 0x2e, 0x55, 0x6e, 0x6d, 0x6f, 0x75, 0x6e, 0x74, 0x46, 0x63, 0x66, 0x73, 0x46, 0x75, 0x73,
+	0x65, 0x64, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x42, 0x06, 0x5a, 0x04,
+	0x2e, 0x3b, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -187,21 +420,32 @@ func file_fcfs_fused_mount_proto_rawDescGZIP() []byte {
 	return file_fcfs_fused_mount_proto_rawDescData
 }
 
-var file_fcfs_fused_mount_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_fcfs_fused_mount_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_fcfs_fused_mount_proto_msgTypes = make([]protoimpl.MessageInfo, 7)
 var file_fcfs_fused_mount_proto_goTypes = []interface{}{
-	(*MountFcfsFusedRequest)(nil),  // 0: MountFcfsFusedRequest
-	(*MountFcfsFusedResponse)(nil), // 1: MountFcfsFusedResponse
-	nil,                            // 2: MountFcfsFusedRequest.SecretsEntry
+	(MountAPIVersion)(0),             // 0: MountAPIVersion
+	(*MountFcfsFusedRequest)(nil),    // 1: MountFcfsFusedRequest
+	(*MountFcfsFusedResponse)(nil),   // 2: MountFcfsFusedResponse
+	(*UnmountFcfsFusedRequest)(nil),  // 3: UnmountFcfsFusedRequest
+	(*UnmountFcfsFusedResponse)(nil), // 4: UnmountFcfsFusedResponse
+	nil,                              // 5: MountFcfsFusedRequest.SecretsEntry
+	nil,                              // 6: MountFcfsFusedRequest.FuseOptionsEntry
+	nil,                              // 7: MountFcfsFusedRequest.ClientConfigEntry
 }
 var file_fcfs_fused_mount_proto_depIdxs = []int32{
-	2, // 0: MountFcfsFusedRequest.secrets:type_name -> MountFcfsFusedRequest.SecretsEntry
-	0, // 1: MountService.MountFcfsFused:input_type -> MountFcfsFusedRequest
-	1, // 2: MountService.MountFcfsFused:output_type -> MountFcfsFusedResponse
-	2, // [2:3] is the sub-list for method output_type
-	1, // [1:2] is the sub-list for method input_type
-	1, // [1:1] is the sub-list for extension type_name
-	1, // [1:1] is the sub-list for extension extendee
-	0, // [0:1] is the sub-list for field type_name
+	5, // 0: MountFcfsFusedRequest.secrets:type_name -> MountFcfsFusedRequest.SecretsEntry
+	0, // 1: MountFcfsFusedRequest.version:type_name -> MountAPIVersion
+	6, // 2: MountFcfsFusedRequest.fuseOptions:type_name -> MountFcfsFusedRequest.FuseOptionsEntry
+	7, // 3: MountFcfsFusedRequest.clientConfig:type_name -> MountFcfsFusedRequest.ClientConfigEntry
+	1, // 4: MountService.MountFcfsFused:input_type -> MountFcfsFusedRequest
+	3, // 5: MountService.UnmountFcfsFused:input_type -> UnmountFcfsFusedRequest
+	2, // 6: MountService.MountFcfsFused:output_type -> MountFcfsFusedResponse
+	4, // 7: MountService.UnmountFcfsFused:output_type -> UnmountFcfsFusedResponse
+	6, // [6:8] is the sub-list for method output_type
+	4, // [4:6] is the sub-list for method input_type
+	4, // [4:4] is the sub-list for extension type_name
+	4, // [4:4] is the sub-list for extension extendee
+	0, // [0:4] is the sub-list for field type_name
 }
 
 func init() { file_fcfs_fused_mount_proto_init() }
@@ -234,19 +478,44 @@ func file_fcfs_fused_mount_proto_init() {
 				return nil
 			}
 		}
+		file_fcfs_fused_mount_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*UnmountFcfsFusedRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_fcfs_fused_mount_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*UnmountFcfsFusedResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_fcfs_fused_mount_proto_rawDesc,
-			NumEnums:      0,
-			NumMessages:   3,
+			NumEnums:      1,
+			NumMessages:   7,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
 		GoTypes:           file_fcfs_fused_mount_proto_goTypes,
 		DependencyIndexes: file_fcfs_fused_mount_proto_depIdxs,
+		EnumInfos:         file_fcfs_fused_mount_proto_enumTypes,
 		MessageInfos:      file_fcfs_fused_mount_proto_msgTypes,
 	}.Build()
 	File_fcfs_fused_mount_proto = out.File
@@ -19,6 +19,7 @@ const _ = grpc.SupportPackageIsVersion7
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type MountServiceClient interface {
 	MountFcfsFused(ctx context.Context, in *MountFcfsFusedRequest, opts ...grpc.CallOption) (*MountFcfsFusedResponse, error)
+	UnmountFcfsFused(ctx context.Context, in *UnmountFcfsFusedRequest, opts ...grpc.CallOption) (*UnmountFcfsFusedResponse, error)
 }
 
 type mountServiceClient struct {
@@ -38,11 +39,21 @@ func (c *mountServiceClient) MountFcfsFused(ctx context.Context, in *MountFcfsFu
 	return out, nil
 }
 
+func (c *mountServiceClient) UnmountFcfsFused(ctx context.Context, in *UnmountFcfsFusedRequest, opts ...grpc.CallOption) (*UnmountFcfsFusedResponse, error) {
+	out := new(UnmountFcfsFusedResponse)
+	err := c.cc.Invoke(ctx, "/MountService/UnmountFcfsFused", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // MountServiceServer is the server API for MountService service.
 // All implementations must embed UnimplementedMountServiceServer
 // for forward compatibility
 type MountServiceServer interface {
 	MountFcfsFused(context.Context, *MountFcfsFusedRequest) (*MountFcfsFusedResponse, error)
+	UnmountFcfsFused(context.Context, *UnmountFcfsFusedRequest) (*UnmountFcfsFusedResponse, error)
 	mustEmbedUnimplementedMountServiceServer()
 }
 
@@ -53,6 +64,9 @@ type UnimplementedMountServiceServer struct {
 func (UnimplementedMountServiceServer) MountFcfsFused(context.Context, *MountFcfsFusedRequest) (*MountFcfsFusedResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method MountFcfsFused not implemented")
 }
+func (UnimplementedMountServiceServer) UnmountFcfsFused(context.Context, *UnmountFcfsFusedRequest) (*UnmountFcfsFusedResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UnmountFcfsFused not implemented")
+}
 func (UnimplementedMountServiceServer) mustEmbedUnimplementedMountServiceServer() {}
 
 // UnsafeMountServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -84,6 +98,24 @@ func _MountService_MountFcfsFused_Handler(srv interface{}, ctx context.Context,
 	return interceptor(ctx, in, info, handler)
 }
 
+func _MountService_UnmountFcfsFused_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UnmountFcfsFusedRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MountServiceServer).UnmountFcfsFused(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/MountService/UnmountFcfsFused",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MountServiceServer).UnmountFcfsFused(ctx, req.(*UnmountFcfsFusedRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // MountService_ServiceDesc is the grpc.ServiceDesc for MountService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -95,6 +127,10 @@ var MountService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "MountFcfsFused",
 			Handler:    _MountService_MountFcfsFused_Handler,
 		},
+		{
+			MethodName: "UnmountFcfsFused",
+			Handler:    _MountService_UnmountFcfsFused_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "fcfs_fused_mount.proto",
@@ -0,0 +1,117 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+// peerCredListener wraps a unix socket listener and drops every connection
+// whose SO_PEERCRED uid or pid is not allow-listed.
+type peerCredListener struct {
+	*net.UnixListener
+	allowedUIDs map[uint32]bool
+	allowedPIDs map[int32]bool
+}
+
+// NewPeerCredListener returns a listener that only accepts peers matching
+// allowedUIDs and allowedPIDs. An empty list allows any value.
+func NewPeerCredListener(listener net.Listener, allowedUIDs, allowedPIDs []string) (net.Listener, error) {
+	if len(allowedUIDs) == 0 && len(allowedPIDs) == 0 {
+		return listener, nil
+	}
+	ul, ok := listener.(*net.UnixListener)
+	if !ok {
+		return nil, fmt.Errorf("peer credentials are only supported on unix sockets, got %s", listener.Addr().Network())
+	}
+	l := &peerCredListener{
+		UnixListener: ul,
+		allowedUIDs:  make(map[uint32]bool),
+		allowedPIDs:  make(map[int32]bool),
+	}
+	for _, s := range allowedUIDs {
+		uid, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uid %q: %w", s, err)
+		}
+		l.allowedUIDs[uint32(uid)] = true
+	}
+	for _, s := range allowedPIDs {
+		pid, err := strconv.ParseInt(s, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pid %q: %w", s, err)
+		}
+		l.allowedPIDs[int32(pid)] = true
+	}
+	return l, nil
+}
+
+func (l *peerCredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.UnixListener.AcceptUnix()
+		if err != nil {
+			return nil, err
+		}
+		if err := l.authorize(conn); err != nil {
+			klog.Warningf("rejected connection on %s: %v", l.Addr(), err)
+			_ = conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+func (l *peerCredListener) authorize(conn *net.UnixConn) error {
+	cred, err := getPeerCred(conn)
+	if err != nil {
+		return err
+	}
+	if len(l.allowedUIDs) > 0 && !l.allowedUIDs[cred.Uid] {
+		return fmt.Errorf("uid %d is not allowed", cred.Uid)
+	}
+	if len(l.allowedPIDs) > 0 && !l.allowedPIDs[cred.Pid] {
+		return fmt.Errorf("pid %d is not allowed", cred.Pid)
+	}
+	klog.V(5).Infof("accepted connection from uid %d pid %d", cred.Uid, cred.Pid)
+	return nil
+}
+
+func getPeerCred(conn *net.UnixConn) (*unix.Ucred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		cred    *unix.Ucred
+		credErr error
+	)
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, fmt.Errorf("failed to get peer credentials: %w", credErr)
+	}
+	return cred, nil
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerCredListener(t *testing.T) {
+	testCases := []struct {
+		name        string
+		allowedUIDs []string
+		allowedPIDs []string
+		accepted    bool
+	}{
+		{
+			name:     "no_allow_list",
+			accepted: true,
+		},
+		{
+			name:        "uid_allowed",
+			allowedUIDs: []string{strconv.Itoa(os.Getuid())},
+			accepted:    true,
+		},
+		{
+			name:        "uid_denied",
+			allowedUIDs: []string{strconv.Itoa(os.Getuid() + 1)},
+			accepted:    false,
+		},
+		{
+			name:        "pid_allowed",
+			allowedPIDs: []string{strconv.Itoa(os.Getpid())},
+			accepted:    true,
+		},
+		{
+			name:        "pid_denied",
+			allowedPIDs: []string{"1"},
+			accepted:    os.Getpid() == 1,
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "peercred")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			addr := filepath.Join(dir, "proxy.sock")
+			raw, err := net.Listen("unix", addr)
+			require.NoError(t, err)
+			listener, err := NewPeerCredListener(raw, tc.allowedUIDs, tc.allowedPIDs)
+			require.NoError(t, err)
+			defer listener.Close()
+
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				conn, err := listener.Accept()
+				if err == nil {
+					accepted <- conn
+				}
+			}()
+
+			client, err := net.Dial("unix", addr)
+			require.NoError(t, err)
+			defer client.Close()
+
+			select {
+			case conn := <-accepted:
+				conn.Close()
+				require.True(t, tc.accepted, "connection should have been rejected")
+			case <-time.After(500 * time.Millisecond):
+				require.False(t, tc.accepted, "connection should have been accepted")
+			}
+		})
+	}
+}
+
+func TestPeerCredListenerInvalid(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer raw.Close()
+
+	_, err = NewPeerCredListener(raw, []string{"0"}, nil)
+	require.Error(t, err)
+
+	listener, err := NewPeerCredListener(raw, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, raw, listener)
+}
@@ -24,84 +24,261 @@ package server
 import (
 	"context"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/status"
 	"net"
-	"os/exec"
-	"sync"
+	"os"
+	"strings"
 	"vazmin.github.io/fastcfs-csi/pkg/common"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"k8s.io/klog/v2"
+	"k8s.io/mount-utils"
 	mount_fcfs_fused "vazmin.github.io/fastcfs-csi/pkg/fcfsfused-proxy/pb"
 )
 
-var (
-	mutex sync.Mutex
-)
+// Options restricts what the mount requests may ask for.
+type Options struct {
+	// AllowedMountPrefixes lists the directories mount points must be located in.
+	AllowedMountPrefixes []string
+	// AllowedConfigPrefixes lists the directories or URLs fuse configs must be located in.
+	AllowedConfigPrefixes []string
+	// MaxConcurrentMounts bounds the number of fcfs_fused processes started at once, 0 means unbounded.
+	MaxConcurrentMounts int
+	// StateDir keeps the journal of active mounts, journaling is disabled when empty.
+	StateDir string
+}
 
 type MountServer struct {
 	mount_fcfs_fused.UnimplementedMountServiceServer
+	options     Options
+	volumeLocks *common.VolumeLocks
+	// workers holds one token per running mount
+	workers chan struct{}
+	mounter mount.Interface
+	state   *mountState
 }
 
 // NewMountServiceServer returns a new Mountserver
-func NewMountServiceServer() *MountServer {
-	return &MountServer{}
+func NewMountServiceServer(options Options) (*MountServer, error) {
+	server := &MountServer{
+		options:     options,
+		volumeLocks: common.NewVolumeLocks(),
+		mounter:     mount.New(""),
+	}
+	if options.MaxConcurrentMounts > 0 {
+		server.workers = make(chan struct{}, options.MaxConcurrentMounts)
+	}
+	if len(options.StateDir) > 0 {
+		state, err := newMountState(options.StateDir)
+		if err != nil {
+			return nil, err
+		}
+		server.state = state
+	}
+	return server, nil
 }
 
-// MountFcfsFused mounts an azure blob container to given location
+// acquireWorker blocks until a mount worker is available or ctx is done.
+func (server *MountServer) acquireWorker(ctx context.Context) (release func(), err error) {
+	if server.workers == nil {
+		return func() {}, nil
+	}
+	select {
+	case server.workers <- struct{}{}:
+		return func() { <-server.workers }, nil
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+		}
+		return nil, status.Error(codes.Canceled, ctx.Err().Error())
+	}
+}
+
+// MountFcfsFused mounts a FastCFS pool to the requested mount point
 func (server *MountServer) MountFcfsFused(ctx context.Context,
 	req *mount_fcfs_fused.MountFcfsFusedRequest,
 ) (resp *mount_fcfs_fused.MountFcfsFusedResponse, err error) {
-	mutex.Lock()
-	defer mutex.Unlock()
+	if err := server.validateMountRequest(req); err != nil {
+		common.Log(ctx).Errorf("rejected mount request of volume %q: %v", req.GetVolName(), err)
+		return nil, err
+	}
+
+	volName := req.GetVolName()
+	// volumes sharing a pool are mounted by one fcfs_fused each
+	mountPoint := req.GetMountPoint()
+	if acquired := server.volumeLocks.TryAcquire(mountPoint); !acquired {
+		common.Log(ctx).Errorf(common.VolumeOperationAlreadyExistsFmt, mountPoint)
+		return nil, status.Errorf(codes.Aborted, common.VolumeOperationAlreadyExistsFmt, mountPoint)
+	}
+	defer server.volumeLocks.Release(mountPoint)
 
-	args := req.GetMountArgs()
+	releaseWorker, err := server.acquireWorker(ctx)
+	if err != nil {
+		common.Log(ctx).Errorf("no mount worker available for volume %s: %v", volName, err)
+		return nil, err
+	}
+	defer releaseWorker()
 
-	klog.V(2).Infof("received mount request: Mounting with args %v \n", args)
+	common.Log(ctx).V(2).Infof("received mount request: mounting volume %s on %s, config %s, fuse options %v, client config %v",
+		req.GetVolName(), req.GetMountPoint(), req.GetConfigURL(), req.GetFuseOptions(), req.GetClientConfig())
 
 	cr, err := common.GetCredentialsForVolume(req.PreProvisioned, req.GetSecrets())
 	if err != nil {
-		klog.Errorf("failed to retrieve credentials: %v", err)
+		common.Log(ctx).Errorf("failed to retrieve credentials: %v", err)
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 	defer cr.DeleteCredentials()
-	cfsArgs := []string{
-		"-u", cr.UserName,
-		"-k", cr.KeyFile,
+
+	rec := &mountRecord{
+		VolName:      volName,
+		MountPoint:   mountPoint,
+		BasePath:     req.GetBasePath(),
+		ConfigURL:    req.GetConfigURL(),
+		FuseOptions:  req.GetFuseOptions(),
+		ClientConfig: req.GetClientConfig(),
+		UserName:     cr.UserName,
 	}
-	if len(req.GetBasePath()) > 0 {
-		err := common.MakeDir(req.GetBasePath())
-		if err != nil {
-			return nil, status.Errorf(codes.InvalidArgument, "failed to make dir %s, %v", req.GetBasePath(), err)
+	output, err := server.fcfsFused(ctx, rec, cr.KeyFile)
+	result := &mount_fcfs_fused.MountFcfsFusedResponse{Output: string(output)}
+	common.Log(ctx).V(2).Infof("fcfs_fused output: %s\n", result.Output)
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return result, err
 		}
-		cfsArgs = append(cfsArgs, "-b", req.GetBasePath())
+		// the response is dropped on error, keep the output for the node plugin
+		return result, status.Errorf(codes.Internal, "fcfs_fused failed: %v, output: %s", err, strings.TrimSpace(result.Output))
 	}
-	cfsArgs = append(cfsArgs, args...)
+	if server.state != nil {
+		if err := server.state.put(rec, cr.KeyFile); err != nil {
+			common.Log(ctx).Errorf("failed to journal mount of volume %s: %v", volName, err)
+		}
+	}
+	return result, nil
+}
 
-	var result mount_fcfs_fused.MountFcfsFusedResponse
-	cmd := exec.Command(common.FuseClientCMD, cfsArgs...)
+// UnmountFcfsFused unmounts a FastCFS pool and drops it from the journal
+func (server *MountServer) UnmountFcfsFused(ctx context.Context,
+	req *mount_fcfs_fused.UnmountFcfsFusedRequest,
+) (*mount_fcfs_fused.UnmountFcfsFusedResponse, error) {
+	volName := req.GetVolName()
+	if len(volName) == 0 || !volNameRegexp.MatchString(volName) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid volume name %q", volName)
+	}
+	if err := validatePath("mount point", req.GetMountPoint(), server.options.AllowedMountPrefixes); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
-	output, err := cmd.CombinedOutput()
+	mountPoint := req.GetMountPoint()
+	if acquired := server.volumeLocks.TryAcquire(mountPoint); !acquired {
+		common.Log(ctx).Errorf(common.VolumeOperationAlreadyExistsFmt, mountPoint)
+		return nil, status.Errorf(codes.Aborted, common.VolumeOperationAlreadyExistsFmt, mountPoint)
+	}
+	defer server.volumeLocks.Release(mountPoint)
+
+	common.Log(ctx).V(2).Infof("received unmount request: unmounting volume %s from %s", volName, req.GetMountPoint())
+	if err := mount.CleanupMountPoint(req.GetMountPoint(), server.mounter, false); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unmount %s: %v", req.GetMountPoint(), err)
+	}
+	if server.state != nil {
+		if err := server.state.remove(mountPoint); err != nil {
+			common.Log(ctx).Errorf("failed to drop volume %s on %s from the journal: %v", volName, mountPoint, err)
+		}
+	}
+	return &mount_fcfs_fused.UnmountFcfsFusedResponse{}, nil
+}
+
+// Restore mounts the journaled volumes again, it should be called before
+// serving requests. Records of mount points which no longer exist are dropped.
+func (server *MountServer) Restore() {
+	if server.state == nil {
+		return
+	}
+	for _, rec := range server.state.list() {
+		notMnt, err := server.mounter.IsLikelyNotMountPoint(rec.MountPoint)
+		if os.IsNotExist(err) {
+			klog.Infof("mount point %s of volume %s no longer exists, dropping it", rec.MountPoint, rec.VolName)
+			if err := server.state.remove(rec.MountPoint); err != nil {
+				klog.Errorf("failed to drop volume %s from the journal: %v", rec.VolName, err)
+			}
+			continue
+		}
+		if err == nil && !notMnt {
+			klog.V(2).Infof("volume %s is still mounted on %s", rec.VolName, rec.MountPoint)
+			continue
+		}
+		if err != nil && mount.IsCorruptedMnt(err) {
+			klog.Warningf("detected corrupted mount %s of volume %s, unmounting it", rec.MountPoint, rec.VolName)
+			if err := server.mounter.Unmount(rec.MountPoint); err != nil {
+				klog.Errorf("failed to unmount %s: %v", rec.MountPoint, err)
+				continue
+			}
+		}
+		klog.Infof("restoring mount of volume %s on %s", rec.VolName, rec.MountPoint)
+		if output, err := server.fcfsFused(context.Background(), rec, rec.KeyFile); err != nil {
+			klog.Errorf("failed to restore mount of volume %s: %v, output: %s", rec.VolName, err, string(output))
+		}
+	}
+}
+
+// fcfsFused runs fcfs_fused for rec with the secret key in keyFile.
+func (server *MountServer) fcfsFused(ctx context.Context, rec *mountRecord, keyFile string) ([]byte, error) {
+	basePath := rec.basePath()
+	if err := common.MakeDir(basePath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to make dir %s, %v", basePath, err)
+	}
+	if err := common.MakeDir(rec.MountPoint); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to make dir %s, %v", rec.MountPoint, err)
+	}
+	fuseConfigURL, err := common.LocalConfig(ctx, rec.ConfigURL)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "failed to fetch the fuse config: %v", err)
+	}
+	configURL, err := common.VolumeFuseConfig(basePath, fuseConfigURL, rec.ClientConfig, rec.FuseOptions)
 	if err != nil {
-		klog.Error("fcfs_fused mount failed: with error:", err.Error())
+		return nil, status.Errorf(codes.Internal, "failed to prepare the fuse config: %v", err)
+	}
+	cfsArgs := []string{
+		"-u", rec.UserName,
+		"-k", keyFile,
+		"-b", basePath,
+		"-n", rec.VolName,
+		"-m", rec.MountPoint,
+		configURL, "restart",
+	}
+
+	output, err := common.ExecFuseCommand(ctx, cfsArgs...)
+	if err != nil {
+		common.Log(ctx).Errorf("fcfs_fused mount failed: with error: %v", err)
 	} else {
-		klog.V(2).Infof("successfully mounted")
+		common.Log(ctx).V(2).Infof("successfully mounted")
 	}
-	result.Output = string(output)
-	klog.V(2).Infof("fcfs_fused output: %s\n", result.Output)
-	return &result, err
+	return output, err
 }
 
 func RunGRPCServer(
 	mountServer mount_fcfs_fused.MountServiceServer,
-	enableTLS bool,
+	tlsOptions *common.TLSOptions,
 	listener net.Listener,
 ) error {
-	var serverOptions []grpc.ServerOption
+	serverOptions := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(common.RequestIDServerInterceptor, common.TracingServerInterceptor),
+	}
+	if tlsOptions.Enable {
+		tlsConfig, err := tlsOptions.ServerConfig()
+		if err != nil {
+			return err
+		}
+		serverOptions = append(serverOptions, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
 	grpcServer := grpc.NewServer(serverOptions...)
 
 	mount_fcfs_fused.RegisterMountServiceServer(grpcServer, mountServer)
+	healthpb.RegisterHealthServer(grpcServer, health.NewServer())
 
-	klog.V(2).Infof("Start GRPC server at %s, TLS = %t", listener.Addr().String(), enableTLS)
+	klog.V(2).Infof("Start GRPC server at %s, TLS = %t, mutual TLS = %t",
+		listener.Addr().String(), tlsOptions.Enable, tlsOptions.Enable && len(tlsOptions.CAFile) > 0)
 	return grpcServer.Serve(listener)
 }
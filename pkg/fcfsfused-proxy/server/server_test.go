@@ -19,27 +19,123 @@ package server
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"vazmin.github.io/fastcfs-csi/pkg/common"
 	mount_fcfs_fused "vazmin.github.io/fastcfs-csi/pkg/fcfsfused-proxy/pb"
 )
 
-func TestServerMountAzureBlob(t *testing.T) {
+func TestServerMountFcfsFused(t *testing.T) {
 	t.Parallel()
 
+	validRequest := func() *mount_fcfs_fused.MountFcfsFusedRequest {
+		return &mount_fcfs_fused.MountFcfsFusedRequest{
+			Version:    mount_fcfs_fused.MountAPIVersion_MOUNT_API_V2,
+			VolName:    "csi-vol-pvc-1",
+			MountPoint: "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount",
+			ConfigURL:  "/etc/fastcfs-client-config/fastcfs/fcfs/fuse.conf",
+			Secrets:    map[string]string{"hello": ""},
+		}
+	}
+
 	testCases := []struct {
-		name    string
-		args    string
-		secrets map[string]string
-		code    codes.Code
+		name   string
+		modify func(req *mount_fcfs_fused.MountFcfsFusedRequest)
+		code   codes.Code
 	}{
 		{
-			name:    "failed_mount",
-			args:    "--hello",
-			secrets: map[string]string{"hello": ""},
-			code:    codes.InvalidArgument,
+			name: "legacy_mount_args",
+			modify: func(req *mount_fcfs_fused.MountFcfsFusedRequest) {
+				req.Version = mount_fcfs_fused.MountAPIVersion_MOUNT_API_V1
+				req.MountArgs = []string{"--hello"}
+			},
+			code: codes.FailedPrecondition,
+		},
+		{
+			name: "mount_args_with_v2",
+			modify: func(req *mount_fcfs_fused.MountFcfsFusedRequest) {
+				req.MountArgs = []string{"-m", "/"}
+			},
+			code: codes.FailedPrecondition,
+		},
+		{
+			name: "invalid_vol_name",
+			modify: func(req *mount_fcfs_fused.MountFcfsFusedRequest) {
+				req.VolName = "../etc"
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "mismatched_base_path",
+			modify: func(req *mount_fcfs_fused.MountFcfsFusedRequest) {
+				req.BasePath = "/tmp"
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "base_path_of_another_pool",
+			modify: func(req *mount_fcfs_fused.MountFcfsFusedRequest) {
+				req.BasePath = common.SharedPoolBasePath("csi-vol-pvc-2", "csi-vol-pvc-2#app")
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "mount_point_outside_prefix",
+			modify: func(req *mount_fcfs_fused.MountFcfsFusedRequest) {
+				req.MountPoint = "/etc"
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "mount_point_escapes_prefix",
+			modify: func(req *mount_fcfs_fused.MountFcfsFusedRequest) {
+				req.MountPoint = "/var/lib/kubelet/../../../etc"
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "config_outside_prefix",
+			modify: func(req *mount_fcfs_fused.MountFcfsFusedRequest) {
+				req.ConfigURL = "/root/fuse.conf"
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "remote_config_not_allowed",
+			modify: func(req *mount_fcfs_fused.MountFcfsFusedRequest) {
+				req.ConfigURL = "http://evil.example.com/fuse.conf"
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "fuse_option_not_allowed",
+			modify: func(req *mount_fcfs_fused.MountFcfsFusedRequest) {
+				req.FuseOptions = map[string]string{"exec": "/bin/sh"}
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "invalid_fuse_option_value",
+			modify: func(req *mount_fcfs_fused.MountFcfsFusedRequest) {
+				req.FuseOptions = map[string]string{"entry_timeout": "5\n[FUSE]"}
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "invalid_server_address",
+			modify: func(req *mount_fcfs_fused.MountFcfsFusedRequest) {
+				req.ClientConfig = map[string]string{common.FdirServersKey: "10.0.0.1\n[server-2]"}
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name:   "missing_credentials",
+			modify: func(req *mount_fcfs_fused.MountFcfsFusedRequest) {},
+			code:   codes.InvalidArgument,
 		},
 	}
 
@@ -48,19 +144,64 @@ func TestServerMountAzureBlob(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			t.Parallel()
 
-			mountServer := NewMountServiceServer()
-			req := mount_fcfs_fused.MountFcfsFusedRequest{
-				MountArgs: tc.args,
-				Secrets:   tc.secrets,
-			}
-			res, err := mountServer.MountFcfsFused(context.Background(), &req)
+			mountServer, err := NewMountServiceServer(Options{
+				AllowedMountPrefixes:  []string{"/var/lib/kubelet"},
+				AllowedConfigPrefixes: []string{"/etc/fastcfs-client-config"},
+			})
+			require.NoError(t, err)
+			req := validRequest()
+			tc.modify(req)
+			res, err := mountServer.MountFcfsFused(context.Background(), req)
 			if tc.code == codes.OK {
 				require.NoError(t, err)
 				require.NotNil(t, res)
 			} else {
 				require.Error(t, err)
-				require.NotNil(t, res)
+				require.Equal(t, tc.code, status.Code(err), err.Error())
+				require.Nil(t, res)
 			}
 		})
 	}
 }
+
+func TestHasAllowedPrefix(t *testing.T) {
+	prefixes := []string{"/var/lib/kubelet/", "http://config.example.com/fastcfs"}
+	require.True(t, hasAllowedPrefix("/var/lib/kubelet", prefixes))
+	require.True(t, hasAllowedPrefix("/var/lib/kubelet/pods/1", prefixes))
+	require.False(t, hasAllowedPrefix("/var/lib/kubelet2/pods", prefixes))
+	require.True(t, hasAllowedPrefix("http://config.example.com/fastcfs/fcfs/fuse.conf", prefixes))
+	require.False(t, hasAllowedPrefix("http://config.example.com/fastcfs2/fuse.conf", prefixes))
+}
+
+func TestServerMountFcfsFusedConcurrency(t *testing.T) {
+	req := &mount_fcfs_fused.MountFcfsFusedRequest{
+		Version:    mount_fcfs_fused.MountAPIVersion_MOUNT_API_V2,
+		VolName:    "csi-vol-pvc-1",
+		MountPoint: "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount",
+		ConfigURL:  "/etc/fastcfs-client-config/fastcfs/fcfs/fuse.conf",
+	}
+	mountServer, err := NewMountServiceServer(Options{
+		AllowedMountPrefixes:  []string{"/var/lib/kubelet"},
+		AllowedConfigPrefixes: []string{"/etc/fastcfs-client-config"},
+		MaxConcurrentMounts:   1,
+	})
+	require.NoError(t, err)
+
+	// duplicate in-flight request for the same mount point
+	require.True(t, mountServer.volumeLocks.TryAcquire(req.MountPoint))
+	_, err = mountServer.MountFcfsFused(context.Background(), req)
+	require.Equal(t, codes.Aborted, status.Code(err))
+	mountServer.volumeLocks.Release(req.MountPoint)
+
+	// all workers busy with other volumes
+	release, err := mountServer.acquireWorker(context.Background())
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = mountServer.MountFcfsFused(ctx, req)
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	release()
+
+	// the volume lock is released after the request
+	require.True(t, mountServer.volumeLocks.TryAcquire(req.MountPoint))
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+)
+
+const (
+	stateFileName = "mounts.json"
+	keysDirName   = "keys"
+)
+
+// mountRecord is the journal entry of an active mount, it holds everything
+// needed to mount the volume again without the node plugin. Volumes sharing a
+// pool are mounted by one fcfs_fused each, the records are keyed by their
+// mount point.
+type mountRecord struct {
+	VolName    string `json:"volName"`
+	MountPoint string `json:"mountPoint"`
+	// BasePath is the base path of the fcfs_fused, the one of the pool if empty.
+	BasePath     string            `json:"basePath,omitempty"`
+	ConfigURL    string            `json:"configURL"`
+	FuseOptions  map[string]string `json:"fuseOptions,omitempty"`
+	ClientConfig map[string]string `json:"clientConfig,omitempty"`
+	UserName     string            `json:"userName"`
+	// KeyFile references the copy of the secret key owned by the proxy.
+	KeyFile string `json:"keyFile"`
+}
+
+func (rec *mountRecord) basePath() string {
+	if len(rec.BasePath) > 0 {
+		return rec.BasePath
+	}
+	return common.BuildBasePath(rec.VolName)
+}
+
+// mountState journals the active mounts to a file readable by root only.
+type mountState struct {
+	dir    string
+	mux    sync.Mutex
+	mounts map[string]*mountRecord
+}
+
+// newMountState loads the journal from dir, creating dir if needed.
+func newMountState(dir string) (*mountState, error) {
+	if err := os.MkdirAll(filepath.Join(dir, keysDirName), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create state dir %s: %w", dir, err)
+	}
+	s := &mountState{
+		dir:    dir,
+		mounts: make(map[string]*mountRecord),
+	}
+	content, err := ioutil.ReadFile(s.stateFile())
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+	var records []*mountRecord
+	if err := json.Unmarshal(content, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", s.stateFile(), err)
+	}
+	for _, rec := range records {
+		s.mounts[rec.MountPoint] = rec
+	}
+	return s, nil
+}
+
+func (s *mountState) stateFile() string {
+	return filepath.Join(s.dir, stateFileName)
+}
+
+func (s *mountState) keyFile(rec *mountRecord) string {
+	sum := sha256.Sum256([]byte(rec.MountPoint))
+	return filepath.Join(s.dir, keysDirName, rec.VolName+"-"+hex.EncodeToString(sum[:8])+".key")
+}
+
+// put copies keyFile into the state dir and journals rec.
+func (s *mountState) put(rec *mountRecord, keyFile string) error {
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read key file: %w", err)
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	rec.KeyFile = s.keyFile(rec)
+	if err := writeFileAtomic(rec.KeyFile, key); err != nil {
+		return err
+	}
+	s.mounts[rec.MountPoint] = rec
+	return s.save()
+}
+
+// remove drops the record of mountPoint and its key.
+func (s *mountState) remove(mountPoint string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	rec, ok := s.mounts[mountPoint]
+	if !ok {
+		return nil
+	}
+	delete(s.mounts, mountPoint)
+	if err := os.Remove(rec.KeyFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.save()
+}
+
+// list returns the records sorted by volume name and mount point.
+func (s *mountState) list() []*mountRecord {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	records := make([]*mountRecord, 0, len(s.mounts))
+	for _, rec := range s.mounts {
+		records = append(records, rec)
+	}
+	sortRecords(records)
+	return records
+}
+
+func sortRecords(records []*mountRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].VolName != records[j].VolName {
+			return records[i].VolName < records[j].VolName
+		}
+		return records[i].MountPoint < records[j].MountPoint
+	})
+}
+
+func (s *mountState) save() error {
+	records := make([]*mountRecord, 0, len(s.mounts))
+	for _, rec := range s.mounts {
+		records = append(records, rec)
+	}
+	sortRecords(records)
+	content, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.stateFile(), content)
+}
+
+// writeFileAtomic replaces path with content, the file is only readable by its owner.
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
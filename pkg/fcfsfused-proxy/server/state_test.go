@@ -0,0 +1,158 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/mount-utils"
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+	mount_fcfs_fused "vazmin.github.io/fastcfs-csi/pkg/fcfsfused-proxy/pb"
+)
+
+func TestMountState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxystate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "tmp.key")
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte("secret"), 0644))
+
+	state, err := newMountState(filepath.Join(dir, "state"))
+	require.NoError(t, err)
+	rec := &mountRecord{
+		VolName:    "csi-vol-pvc-1",
+		MountPoint: "/var/lib/kubelet/plugins/pvc-1/globalmount",
+		ConfigURL:  "/etc/fastcfs/fcfs/fuse.conf",
+		UserName:   "admin",
+	}
+	require.NoError(t, state.put(rec, keyFile))
+
+	info, err := os.Stat(state.stateFile())
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	info, err = os.Stat(rec.KeyFile)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	key, err := ioutil.ReadFile(rec.KeyFile)
+	require.NoError(t, err)
+	require.Equal(t, "secret", string(key))
+
+	// reload from disk
+	state, err = newMountState(filepath.Join(dir, "state"))
+	require.NoError(t, err)
+	require.Equal(t, []*mountRecord{rec}, state.list())
+
+	require.NoError(t, state.remove(rec.MountPoint))
+	require.Empty(t, state.list())
+	_, err = os.Stat(rec.KeyFile)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestRestoreAndUnmount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxyrestore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "tmp.key")
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte("secret"), 0600))
+	mounted := filepath.Join(dir, "kubelet", "mounted")
+	require.NoError(t, os.MkdirAll(mounted, 0755))
+
+	mountServer, err := NewMountServiceServer(Options{
+		AllowedMountPrefixes: []string{dir},
+		StateDir:             filepath.Join(dir, "state"),
+	})
+	require.NoError(t, err)
+	mountServer.mounter = mount.NewFakeMounter([]mount.MountPoint{{Device: "fcfs_fused", Path: mounted}})
+
+	require.NoError(t, mountServer.state.put(&mountRecord{VolName: "mounted", MountPoint: mounted}, keyFile))
+	require.NoError(t, mountServer.state.put(&mountRecord{VolName: "gone", MountPoint: filepath.Join(dir, "gone")}, keyFile))
+
+	// the record of a removed mount point is dropped, the mounted one is kept
+	mountServer.Restore()
+	records := mountServer.state.list()
+	require.Len(t, records, 1)
+	require.Equal(t, "mounted", records[0].VolName)
+
+	_, err = mountServer.UnmountFcfsFused(context.Background(), &mount_fcfs_fused.UnmountFcfsFusedRequest{
+		VolName:    "mounted",
+		MountPoint: mounted,
+	})
+	require.NoError(t, err)
+	require.Empty(t, mountServer.state.list())
+
+	_, err = mountServer.UnmountFcfsFused(context.Background(), &mount_fcfs_fused.UnmountFcfsFusedRequest{
+		VolName:    "mounted",
+		MountPoint: "/etc",
+	})
+	require.Error(t, err)
+}
+
+func TestUnmountSharedPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxyshared")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "tmp.key")
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte("secret"), 0600))
+	mountServer, err := NewMountServiceServer(Options{
+		AllowedMountPrefixes: []string{dir},
+		StateDir:             filepath.Join(dir, "state"),
+	})
+	require.NoError(t, err)
+
+	// two volumes publishing subpaths of the same pool are staged on the node
+	var mountPoints []string
+	for _, handle := range []string{"legacy-app#app-1", "legacy-app#app-2"} {
+		mountPoint := filepath.Join(dir, "kubelet", handle, "globalmount")
+		require.NoError(t, os.MkdirAll(mountPoint, 0755))
+		mountPoints = append(mountPoints, mountPoint)
+		require.NoError(t, mountServer.state.put(&mountRecord{
+			VolName:    "legacy-app",
+			MountPoint: mountPoint,
+			BasePath:   common.SharedPoolBasePath("legacy-app", handle),
+		}, keyFile))
+	}
+	mountServer.mounter = mount.NewFakeMounter([]mount.MountPoint{
+		{Device: "fcfs_fused", Path: mountPoints[0]},
+		{Device: "fcfs_fused", Path: mountPoints[1]},
+	})
+	records := mountServer.state.list()
+	require.Len(t, records, 2)
+	require.NotEqual(t, records[0].KeyFile, records[1].KeyFile)
+	require.NotEqual(t, records[0].basePath(), records[1].basePath())
+
+	// unstaging one of them keeps the other journaled
+	_, err = mountServer.UnmountFcfsFused(context.Background(), &mount_fcfs_fused.UnmountFcfsFusedRequest{
+		VolName:    "legacy-app",
+		MountPoint: mountPoints[0],
+	})
+	require.NoError(t, err)
+	records = mountServer.state.list()
+	require.Len(t, records, 1)
+	require.Equal(t, mountPoints[1], records[0].MountPoint)
+	require.FileExists(t, records[0].KeyFile)
+
+	mountServer.Restore()
+	require.Len(t, mountServer.state.list(), 1, "the mount of the other volume is restored")
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"vazmin.github.io/fastcfs-csi/pkg/common"
+	mount_fcfs_fused "vazmin.github.io/fastcfs-csi/pkg/fcfsfused-proxy/pb"
+)
+
+const maxVolNameLen = 128
+
+var volNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// validateMountRequest rejects legacy requests and every field which does not
+// pass the allow-lists of the server.
+func (server *MountServer) validateMountRequest(req *mount_fcfs_fused.MountFcfsFusedRequest) error {
+	if req.GetVersion() != mount_fcfs_fused.MountAPIVersion_MOUNT_API_V2 || len(req.GetMountArgs()) > 0 {
+		return status.Errorf(codes.FailedPrecondition,
+			"unsupported mount API version %s: raw mount arguments are no longer accepted, upgrade the FastCFS CSI node plugin",
+			req.GetVersion())
+	}
+
+	volName := req.GetVolName()
+	if len(volName) == 0 || len(volName) > maxVolNameLen || !volNameRegexp.MatchString(volName) {
+		return status.Errorf(codes.InvalidArgument, "invalid volume name %q", volName)
+	}
+	if basePath := req.GetBasePath(); len(basePath) > 0 && !common.IsBasePathOf(basePath, volName) {
+		return status.Errorf(codes.InvalidArgument, "base path %s does not match volume %s", basePath, volName)
+	}
+	if err := validatePath("mount point", req.GetMountPoint(), server.options.AllowedMountPrefixes); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := validateConfigURL(req.GetConfigURL(), server.options.AllowedConfigPrefixes); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := common.ValidateFuseOptions(req.GetFuseOptions()); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := common.ValidateClientConfig(req.GetClientConfig()); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return nil
+}
+
+// validatePath checks p is a clean absolute path below one of the prefixes.
+func validatePath(name, p string, prefixes []string) error {
+	if len(p) == 0 {
+		return fmt.Errorf("%s is empty", name)
+	}
+	if !filepath.IsAbs(p) || filepath.Clean(p) != p {
+		return fmt.Errorf("%s %s must be a clean absolute path", name, p)
+	}
+	if !hasAllowedPrefix(p, prefixes) {
+		return fmt.Errorf("%s %s is not under the allowed prefixes %q", name, p, prefixes)
+	}
+	return nil
+}
+
+func validateConfigURL(configURL string, prefixes []string) error {
+	if strings.HasPrefix(configURL, "http://") || strings.HasPrefix(configURL, "https://") {
+		if strings.Contains(configURL, "/../") || !hasAllowedPrefix(configURL, prefixes) {
+			return fmt.Errorf("config URL %s is not under the allowed prefixes %q", configURL, prefixes)
+		}
+		return nil
+	}
+	return validatePath("config URL", configURL, prefixes)
+}
+
+func hasAllowedPrefix(p string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if len(prefix) > 0 && (p == prefix || strings.HasPrefix(p, prefix+"/")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,454 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2021 vazmin.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// fake-fastcfs mimics the command lines and the output of fcfs_pool and
+// fcfs_fused without a FastCFS cluster, it runs as the command it is installed
+// as. Each pool is a tmpfs of the size of its quota, fcfs_fused bind-mounts it
+// onto the mount point. The pools are kept under $FAKE_FASTCFS_ROOT.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	defaultRoot = "/var/lib/fake-fastcfs"
+	gib         = 1 << 30
+
+	// exit codes of fcfs_pool are the errno of the failure
+	errnoNotExist = 2
+	errnoExist    = 17
+)
+
+// pool is the state of a pool, stored in <root>/pools/<name>.json.
+type pool struct {
+	Owner      string `json:"owner"`
+	QuotaBytes int64  `json:"quotaBytes"` // -1 is unlimited
+}
+
+// exitError ends the command with the errno of fcfs_pool.
+type exitError struct {
+	code int
+	msg  string
+}
+
+func (e *exitError) Error() string {
+	return e.msg
+}
+
+var root = defaultRoot
+
+func main() {
+	if r := os.Getenv("FAKE_FASTCFS_ROOT"); len(r) > 0 {
+		root = r
+	}
+	var err error
+	switch name := filepath.Base(os.Args[0]); name {
+	case "fcfs_pool":
+		err = withLock(func() error { return fcfsPool(os.Args[1:]) })
+	case "fcfs_fused":
+		err = withLock(func() error { return fcfsFused(os.Args[1:]) })
+	default:
+		err = fmt.Errorf("unknown command %s, install fake-fastcfs as fcfs_pool or fcfs_fused", name)
+	}
+	if err != nil {
+		fmt.Println(err)
+		var exitErr *exitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.code)
+		}
+		os.Exit(1)
+	}
+}
+
+// withLock runs fn holding the lock of the state, commands run concurrently.
+func withLock(fn func() error) error {
+	if err := os.MkdirAll(filepath.Join(root, "pools"), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(root, "lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	return fn()
+}
+
+// parseArgs splits args into the values of the options taking one, and the
+// other arguments.
+func parseArgs(args []string, options string) (map[string]string, []string, error) {
+	values := make(map[string]string)
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if len(arg) != 2 || arg[0] != '-' || !strings.Contains(options, arg[1:]) {
+			positional = append(positional, arg)
+			continue
+		}
+		if i+1 == len(args) {
+			return nil, nil, fmt.Errorf("option %s requires an argument", arg)
+		}
+		values[arg[1:]] = args[i+1]
+		i++
+	}
+	return values, positional, nil
+}
+
+// checkKeyFile mimics the authentication with the secret key file.
+func checkKeyFile(keyFile string) error {
+	if len(keyFile) == 0 {
+		return nil
+	}
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil || len(key) == 0 {
+		return fmt.Errorf("load secret key from file %s fail", keyFile)
+	}
+	return nil
+}
+
+func poolFile(name string) string {
+	return filepath.Join(root, "pools", name+".json")
+}
+
+func poolData(name string) string {
+	return filepath.Join(root, "data", name)
+}
+
+func loadPool(name string) (*pool, error) {
+	content, err := ioutil.ReadFile(poolFile(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p := &pool{}
+	return p, json.Unmarshal(content, p)
+}
+
+func savePool(name string, p *pool) error {
+	content, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(poolFile(name), content, 0600)
+}
+
+// parseQuota parses a quota of fcfs_pool, the default unit is GB.
+func parseQuota(s string) (int64, error) {
+	lower := strings.TrimSuffix(strings.ToLower(s), "b")
+	if lower == "unlimited" {
+		return -1, nil
+	}
+	unit := int64(gib)
+	if i := strings.IndexAny(lower, "kmgt"); i > 0 && i == len(lower)-1 {
+		unit = map[byte]int64{'k': 1 << 10, 'm': 1 << 20, 'g': gib, 't': gib << 10}[lower[i]]
+		lower = lower[:i]
+	}
+	value, err := strconv.ParseFloat(lower, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid quota: %s", s)
+	}
+	return int64(value * float64(unit)), nil
+}
+
+// formatSize formats bytes like fcfs_pool plist.
+func formatSize(bytes int64) string {
+	if bytes < 0 {
+		return "unlimited"
+	}
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value, i := float64(bytes), 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	formatted := strings.TrimRight(strings.TrimRight(strconv.FormatFloat(value, 'f', 2, 64), "0"), ".")
+	return formatted + " " + units[i]
+}
+
+func run(name string, args ...string) error {
+	if output, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s: %v, output: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// mountTmpfs mounts or remounts the tmpfs of a pool with its quota as size.
+func mountTmpfs(name string, quotaBytes int64, remount bool) error {
+	options := "mode=0777"
+	if quotaBytes >= 0 {
+		options += fmt.Sprintf(",size=%d", quotaBytes)
+	}
+	if remount {
+		return run("mount", "-o", "remount,"+options, poolData(name))
+	}
+	if err := os.MkdirAll(poolData(name), 0755); err != nil {
+		return err
+	}
+	return run("mount", "-t", "tmpfs", "-o", options, "fake-fastcfs-"+name, poolData(name))
+}
+
+// isMountPoint reports whether path is in the mount table.
+func isMountPoint(path string) (bool, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 4 && fields[4] == path {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// usedBytes returns the used bytes of the tmpfs of a pool.
+func usedBytes(name string) int64 {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(poolData(name), &st); err != nil {
+		return 0
+	}
+	return int64(st.Blocks-st.Bfree) * int64(st.Bsize)
+}
+
+// fcfsPool mimics
+//
+//	fcfs_pool [-c config] [-u admin] [-k key] <operation> [username] [pool_name] [quota]
+func fcfsPool(args []string) error {
+	options, positional, err := parseArgs(args, "cukds")
+	if err != nil {
+		return err
+	}
+	if err := checkKeyFile(options["k"]); err != nil {
+		return err
+	}
+	user := options["u"]
+	if len(user) == 0 {
+		user = "admin"
+	}
+	if len(positional) == 0 {
+		return errors.New("expect operation")
+	}
+	operation, params := positional[0], positional[1:]
+
+	switch operation {
+	case "create":
+		if len(params) != 2 {
+			return errors.New("usage: create <pool_name> <quota>")
+		}
+		return createPool(user, params[0], params[1])
+	case "quota":
+		if len(params) != 2 {
+			return errors.New("usage: quota <pool_name> <quota>")
+		}
+		return setQuota(params[0], params[1])
+	case "delete", "remove":
+		if len(params) != 1 {
+			return errors.New("usage: delete <pool_name>")
+		}
+		return deletePool(params[0])
+	case "plist", "pool-list":
+		if len(params) > 0 {
+			user = params[0]
+		}
+		var name string
+		if len(params) > 1 {
+			name = params[1]
+		}
+		return listPools(user, name)
+	default:
+		return fmt.Errorf("unknown operation: %s", operation)
+	}
+}
+
+func createPool(user, name, quota string) error {
+	quotaBytes, err := parseQuota(quota)
+	if err != nil {
+		return err
+	}
+	if p, err := loadPool(name); err != nil || p != nil {
+		if err != nil {
+			return err
+		}
+		return &exitError{code: errnoExist, msg: fmt.Sprintf("create pool %s fail, errno: %d, error info: File exists", name, errnoExist)}
+	}
+	if err := mountTmpfs(name, quotaBytes, false); err != nil {
+		return err
+	}
+	if err := savePool(name, &pool{Owner: user, QuotaBytes: quotaBytes}); err != nil {
+		return err
+	}
+	fmt.Printf("create pool %s success\n", name)
+	return nil
+}
+
+func setQuota(name, quota string) error {
+	quotaBytes, err := parseQuota(quota)
+	if err != nil {
+		return err
+	}
+	p, err := loadPool(name)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return &exitError{code: errnoNotExist, msg: fmt.Sprintf("set quota of pool %s fail, errno: %d, error info: No such file or directory", name, errnoNotExist)}
+	}
+	if err := mountTmpfs(name, quotaBytes, true); err != nil {
+		return err
+	}
+	p.QuotaBytes = quotaBytes
+	if err := savePool(name, p); err != nil {
+		return err
+	}
+	fmt.Printf("set quota of pool %s success\n", name)
+	return nil
+}
+
+func deletePool(name string) error {
+	p, err := loadPool(name)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return &exitError{code: errnoNotExist, msg: fmt.Sprintf("delete pool %s fail, errno: %d, error info: No such file or directory", name, errnoNotExist)}
+	}
+	if err := run("umount", poolData(name)); err != nil {
+		return err
+	}
+	if err := os.Remove(poolData(name)); err != nil {
+		return err
+	}
+	if err := os.Remove(poolFile(name)); err != nil {
+		return err
+	}
+	fmt.Printf("delete pool %s success\n", name)
+	return nil
+}
+
+func listPools(user, name string) error {
+	var names []string
+	if len(name) > 0 {
+		names = []string{name}
+	} else {
+		files, err := filepath.Glob(poolFile("*"))
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			names = append(names, strings.TrimSuffix(filepath.Base(f), ".json"))
+		}
+		sort.Strings(names)
+	}
+
+	fmt.Printf("%5s %20s %12s %12s\n", "No.", "pool_name", "quota", "used")
+	no := 0
+	for _, n := range names {
+		p, err := loadPool(n)
+		if err != nil {
+			return err
+		}
+		if p == nil || p.Owner != user {
+			if len(name) > 0 {
+				return &exitError{code: errnoNotExist, msg: fmt.Sprintf("pool %s not exist", name)}
+			}
+			continue
+		}
+		no++
+		fmt.Printf("%5d %20s %12s %12s\n", no, n, formatSize(p.QuotaBytes), formatSize(usedBytes(n)))
+	}
+	return nil
+}
+
+// fcfsFused mimics
+//
+//	fcfs_fused [-u user] [-k key] [-b base_path] [-n pool_name] [-m mountpoint] <config> start|restart|stop
+func fcfsFused(args []string) error {
+	options, positional, err := parseArgs(args, "ukbnm")
+	if err != nil {
+		return err
+	}
+	if err := checkKeyFile(options["k"]); err != nil {
+		return err
+	}
+	if len(positional) != 2 {
+		return errors.New("usage: fcfs_fused [options] <config_filename> start|restart|stop")
+	}
+	name, mountPoint := options["n"], options["m"]
+	if len(name) == 0 || len(mountPoint) == 0 {
+		return errors.New("the pool name (-n) and the mount point (-m) are required")
+	}
+
+	mounted, err := isMountPoint(mountPoint)
+	if err != nil {
+		return err
+	}
+	switch command := positional[1]; command {
+	case "start", "restart":
+		p, err := loadPool(name)
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			return fmt.Errorf("pool %s not exist", name)
+		}
+		if basePath := options["b"]; len(basePath) > 0 {
+			if err := os.MkdirAll(basePath, 0755); err != nil {
+				return err
+			}
+		}
+		if mounted {
+			if command == "start" {
+				return fmt.Errorf("%s is already mounted", mountPoint)
+			}
+			if err := run("umount", mountPoint); err != nil {
+				return err
+			}
+		}
+		if err := os.MkdirAll(mountPoint, 0755); err != nil {
+			return err
+		}
+		return run("mount", "--bind", poolData(name), mountPoint)
+	case "stop":
+		if !mounted {
+			return nil
+		}
+		return run("umount", mountPoint)
+	default:
+		return fmt.Errorf("unknown command: %s", command)
+	}
+}